@@ -0,0 +1,282 @@
+// Command mapreduce-local runs the whole MapReduce in a single process, without GCP or any emulators. The functions are
+// wired together with an in-memory pubsub broker, the files are read from and written to an in-memory storage backend,
+// and the Redis instances are replaced with in-memory Redis servers. The input files are loaded from a local directory
+// and the output files are written to a local directory once the job has finished.
+//
+// Usage:
+//
+//	go run ./cmd/mapreduce-local -input ./books -output ./results [-job anagrams] [-reducers 5] [-format jsonl]
+//		[-gzip] [-merge] [-include '*.zip,*.txt'] [-exclude 'draft-*']
+//
+// The delivery of messages can be configured, and faults injected into it, with the environment variables read by
+// pubsub.BrokerConfigFromEnv.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"gitlab.com/cameron_w20/serverless-mapreduce/controller"
+	"gitlab.com/cameron_w20/serverless-mapreduce/job"
+	"gitlab.com/cameron_w20/serverless-mapreduce/mapphase"
+	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
+	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
+	"gitlab.com/cameron_w20/serverless-mapreduce/reducephase"
+	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memoryScheme is the scheme that the in-memory storage backend is registered under.
+const memoryScheme = "mem"
+
+// inputBucketName is the name of the in-memory bucket that the input files are loaded into.
+const inputBucketName = "input"
+
+// outputBucketName is the name of the in-memory bucket that the output files are written to.
+const outputBucketName = "output"
+
+func main() {
+	inputDir := flag.String("input", "", "the directory containing the input files")
+	outputDir := flag.String("output", "", "the directory to write the output files to")
+	jobName := flag.String("job", job.DefaultJobName, "the name of the job to run, one of: "+
+		strings.Join(job.Names(), ", "))
+	reducers := flag.Int("reducers", r.NoOfReducerJobs, "the number of reducers to run")
+	splitSize := flag.Int64("split-size", mapphase.DefaultSplitSize, "the maximum number of bytes of a file read by "+
+		"a single splitter")
+	outputFormat := flag.String("format", storage.DefaultFormat, "the format to write the output files in, one of: "+
+		strings.Join(storage.Formats(), ", "))
+	gzipOutput := flag.Bool("gzip", false, "compress the output files with gzip")
+	maxPartSize := flag.Int64("max-part-size", 0, "the number of bytes after which a reducer starts a new part file, "+
+		"or 0 for no limit")
+	maxPartRecords := flag.Int("max-part-records", 0, "the number of records after which a reducer starts a new part "+
+		"file, or 0 for no limit")
+	merge := flag.Bool("merge", false, "merge the output files into a single file sorted by key")
+	include := flag.String("include", "", "comma separated glob patterns of the input files to use, including "+
+		"archives, *.txt by default")
+	exclude := flag.String("exclude", "", "comma separated glob patterns of the input files not to use")
+	flag.Parse()
+	if *inputDir == "" || *outputDir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	options := jobOptions{
+		job:       *jobName,
+		reducers:  *reducers,
+		splitSize: *splitSize,
+		include:   *include,
+		exclude:   *exclude,
+		output: storage.OutputOptions{
+			Format:         *outputFormat,
+			MaxPartBytes:   *maxPartSize,
+			MaxPartRecords: *maxPartRecords,
+			Merge:          *merge,
+		},
+	}
+	if *gzipOutput {
+		options.output.Compression = storage.CompressionGzip
+	}
+	if err := run(*inputDir, *outputDir, options); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// jobOptions are the options that a job is run with.
+type jobOptions struct {
+	// job is the name of the job to run.
+	job string
+	// reducers is the number of reducers to run.
+	reducers int
+	// splitSize is the maximum number of bytes of a file read by a single splitter. Larger files are split into byte
+	// ranges of that size.
+	splitSize int64
+	// include are the comma separated patterns of the input files to use, or empty to use storage.DefaultInclude.
+	include string
+	// exclude are the comma separated patterns of the input files not to use.
+	exclude string
+	// output are the options the output files are written with.
+	output storage.OutputOptions
+}
+
+// run runs a job with the given options on the files in the input directory and writes the output files to the output
+// directory.
+func run(inputDir, outputDir string, options jobOptions) error {
+	if options.reducers < 1 {
+		return fmt.Errorf("the number of reducers must be at least 1")
+	}
+	r.NoOfReducerJobs = options.reducers
+	stopRedis, err := startRedis(options.reducers)
+	if err != nil {
+		return err
+	}
+	defer stopRedis()
+
+	// Load the input files into memory
+	memory := storage.NewMemory()
+	if err := loadInputFiles(memory, inputDir); err != nil {
+		return err
+	}
+	memory.CreateBucket(outputBucketName)
+	storage.RegisterBackend(memoryScheme, memory)
+
+	// Wire the functions together with an in-memory broker, configured by the PUBSUB_MEMORY_* and PUBSUB_FAULT_*
+	// environment variables
+	config, err := pubsub.BrokerConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	broker := pubsub.NewBroker(config)
+	broker.Subscribe(pubsub.SplitterTopic, mapphase.Splitter)
+	broker.Subscribe(pubsub.MapperTopic, mapphase.Mapper)
+	broker.Subscribe(pubsub.CombineTopic, mapphase.Combine)
+	broker.Subscribe(pubsub.ShufflerTopic, reducephase.Shuffler)
+	broker.Subscribe(pubsub.ControllerTopic, controller.Controller)
+	broker.Subscribe(pubsub.ReducerTopic, reducephase.Reducer)
+	pubsub.UseBroker(broker)
+	defer pubsub.UseBroker(nil)
+
+	start := time.Now()
+	jobID, err := startJob(options)
+	if err != nil {
+		return err
+	}
+	log.Printf("Started job %s", jobID)
+	// Wait for every message to be handled, at which point the job has either finished or failed
+	broker.Wait()
+	log.Printf("Job %s stopped after %v", jobID, time.Since(start))
+	if failed := broker.Failed(); failed > 0 {
+		log.Printf("%d messages were given up on after repeated errors", failed)
+	}
+	return writeOutputFiles(memory, jobID, outputDir)
+}
+
+// startRedis starts an in-memory Redis server for the controller and for each reducer, and points the Redis clients
+// used by the functions at them. It returns a function that stops the servers.
+func startRedis(reducers int) (func(), error) {
+	servers := make([]*miniredis.Miniredis, 0, reducers+1)
+	stop := func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+	newClient := func() (*redis.Client, error) {
+		server, err := miniredis.Run()
+		if err != nil {
+			return nil, fmt.Errorf("error starting in-memory redis: %v", err)
+		}
+		servers = append(servers, server)
+		return redis.NewClient(&redis.Options{Addr: server.Addr()}), nil
+	}
+	client, err := newClient()
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	r.SingleRedisClient = client
+	r.MultiRedisClient = make(map[string]*redis.Client)
+	for i := 0; i < reducers; i++ {
+		client, err := newClient()
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		r.MultiRedisClient[strconv.Itoa(i)] = client
+	}
+	return stop, nil
+}
+
+// loadInputFiles adds every file in the given directory, and its subdirectories, to the input bucket. Each object is
+// named after the file's path relative to the directory.
+func loadInputFiles(memory *storage.Memory, inputDir string) error {
+	memory.CreateBucket(inputBucketName)
+	return filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error reading input directory: %v", err)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading input file %s: %v", path, err)
+		}
+		objectName, err := filepath.Rel(inputDir, path)
+		if err != nil {
+			return err
+		}
+		memory.PutObject(inputBucketName, filepath.ToSlash(objectName), data)
+		return nil
+	})
+}
+
+// startJob starts a job with the given options by calling the starter in the same way as an HTTP request would, and
+// returns the ID of the job.
+func startJob(options jobOptions) (string, error) {
+	query := url.Values{}
+	query.Set("input-bucket", memoryScheme+"://"+inputBucketName)
+	query.Set("output-bucket", memoryScheme+"://"+outputBucketName)
+	query.Set("job", options.job)
+	query.Set("split-size", strconv.FormatInt(options.splitSize, 10))
+	query.Set("output-format", options.output.Format)
+	query.Set("output-compression", options.output.Compression)
+	query.Set("max-part-size", strconv.FormatInt(options.output.MaxPartBytes, 10))
+	query.Set("max-part-records", strconv.Itoa(options.output.MaxPartRecords))
+	query.Set("merge-output", strconv.FormatBool(options.output.Merge))
+	if options.include != "" {
+		query.Set("include", options.include)
+	}
+	if options.exclude != "" {
+		query.Set("exclude", options.exclude)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+	rec := httptest.NewRecorder()
+	mapphase.StartMapReduce(rec, req)
+	var response mapphase.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		return "", fmt.Errorf("error reading starter response: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		return "", fmt.Errorf("error starting job: %s", response.Message)
+	}
+	return response.JobID, nil
+}
+
+// writeOutputFiles writes the output files of the given job to the output directory. It returns an error if the job
+// didn't finish, after writing any output files that were written.
+func writeOutputFiles(memory *storage.Memory, jobID, outputDir string) error {
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("error creating output directory: %v", err)
+	}
+	prefix := jobID + "/"
+	for objectName, data := range memory.Objects(outputBucketName) {
+		if !strings.HasPrefix(objectName, prefix) {
+			continue
+		}
+		path := filepath.Join(outputDir, filepath.FromSlash(strings.TrimPrefix(objectName, prefix)))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("error creating output directory: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return fmt.Errorf("error writing output file %s: %v", path, err)
+		}
+	}
+	manifestBytes, ok := memory.Objects(outputBucketName)[prefix+controller.SuccessObjectName]
+	if !ok {
+		return fmt.Errorf("job %s didn't finish, see the log for the errors that stopped it", jobID)
+	}
+	var manifest controller.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("error reading manifest: %v", err)
+	}
+	log.Printf("Job %s wrote %d records to %d files in %s", jobID, manifest.Records, len(manifest.Outputs), outputDir)
+	return nil
+}
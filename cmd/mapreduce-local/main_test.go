@@ -0,0 +1,394 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/cameron_w20/serverless-mapreduce/job"
+	"gitlab.com/cameron_w20/serverless-mapreduce/mapphase"
+	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt"), []byte("Listen to the silent race"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "book-2.txt"), []byte("Take care to enlist"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+
+	// When
+	err := run(inputDir, outputDir, jobOptions{job: job.DefaultJobName, reducers: 2, splitSize: mapphase.DefaultSplitSize})
+
+	// Then
+	assert.Nil(t, err)
+	var output []string
+	for _, part := range []string{"anagrams-part-0.txt", "anagrams-part-1.txt"} {
+		data, err := os.ReadFile(filepath.Join(outputDir, part))
+		if err != nil {
+			t.Fatalf("Error reading output file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				output = append(output, line)
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{"acer: care race", "eilnst: enlist listen silent"}, output)
+	assert.FileExists(t, filepath.Join(outputDir, "_SUCCESS"))
+	// The temporary output files should have been deleted once the job was committed
+	assert.NoDirExists(t, filepath.Join(outputDir, "_temporary"))
+}
+
+func TestRun_Faults(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt"), []byte("Listen to the silent race"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "book-2.txt"), []byte("Take care to enlist"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	// Deliver messages twice, out of order and late, which the functions should all handle
+	setEnv(t, "PUBSUB_FAULT_DUPLICATE_RATE", "0.5")
+	setEnv(t, "PUBSUB_FAULT_REORDER_RATE", "0.5")
+	setEnv(t, "PUBSUB_FAULT_MAX_DELAY", "5ms")
+	setEnv(t, "PUBSUB_FAULT_SEED", "1")
+	setEnv(t, "PUBSUB_MEMORY_MAX_DELIVERY_ATTEMPTS", "10")
+
+	// When
+	err := run(inputDir, outputDir, jobOptions{job: job.DefaultJobName, reducers: 2, splitSize: mapphase.DefaultSplitSize})
+
+	// Then
+	assert.Nil(t, err)
+	var output []string
+	for _, part := range []string{"anagrams-part-0.txt", "anagrams-part-1.txt"} {
+		data, err := os.ReadFile(filepath.Join(outputDir, part))
+		if err != nil {
+			t.Fatalf("Error reading output file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				output = append(output, line)
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{"acer: care race", "eilnst: enlist listen silent"}, output)
+	assert.FileExists(t, filepath.Join(outputDir, "_SUCCESS"))
+}
+
+func TestRun_ClaimCheck(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	book := strings.Repeat("Listen to the silent race, take care to enlist. ", 200)
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt"), []byte(book), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	// Offload the mapped words to storage, but not the small status messages sent to the controller
+	setEnv(t, "PUBSUB_CLAIM_CHECK_THRESHOLD", "1000")
+
+	// When
+	err := run(inputDir, outputDir, jobOptions{job: job.DefaultJobName, reducers: 1, splitSize: mapphase.DefaultSplitSize,
+		output: storage.OutputOptions{Merge: true}})
+
+	// Then
+	assert.Nil(t, err)
+	data, err := os.ReadFile(filepath.Join(outputDir, "anagrams.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "acer: care race\neilnst: enlist listen silent\n", string(data))
+	// The offloaded data should have been deleted along with the temporary output files
+	assert.NoDirExists(t, filepath.Join(outputDir, "_temporary"))
+}
+
+func TestRun_BinaryCodec(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	book := strings.Repeat("Listen to the silent race, take care to enlist. ", 200)
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt"), []byte(book), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	setEnv(t, "PUBSUB_CODEC", "binary")
+	setEnv(t, "PUBSUB_COMPRESSION", "gzip")
+
+	// When
+	err := run(inputDir, outputDir, jobOptions{job: job.DefaultJobName, reducers: 2, splitSize: mapphase.DefaultSplitSize,
+		output: storage.OutputOptions{Merge: true}})
+
+	// Then
+	assert.Nil(t, err)
+	data, err := os.ReadFile(filepath.Join(outputDir, "anagrams.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "acer: care race\neilnst: enlist listen silent\n", string(data))
+}
+
+func TestRun_SplitSize(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	book := "Header *** START OF THE PROJECT GUTENBERG EBOOK BOOK *** Listen to the silent race\n" +
+		"*** END OF THE PROJECT GUTENBERG EBOOK BOOK *** Footer acre"
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt"), []byte(book), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "book-2.txt"), []byte("Take care to enlist"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+
+	// When
+	// Split the files into byte ranges that start and end in the middle of words, and of the header and footer
+	err := run(inputDir, outputDir, jobOptions{job: job.DefaultJobName, reducers: 2, splitSize: 4})
+
+	// Then
+	assert.Nil(t, err)
+	var output []string
+	for _, part := range []string{"anagrams-part-0.txt", "anagrams-part-1.txt"} {
+		data, err := os.ReadFile(filepath.Join(outputDir, part))
+		if err != nil {
+			t.Fatalf("Error reading output file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				output = append(output, line)
+			}
+		}
+	}
+	// The words in the header and footer, including "acre", shouldn't be used
+	assert.ElementsMatch(t, []string{"acer: care race", "eilnst: enlist listen silent"}, output)
+	manifest, err := os.ReadFile(filepath.Join(outputDir, "_SUCCESS"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(manifest), `"inputs":["book-1.txt","book-2.txt"]`)
+}
+
+func TestRun_CompressedInput(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	var book bytes.Buffer
+	writer := gzip.NewWriter(&book)
+	writer.Write([]byte("Header *** START OF THE PROJECT GUTENBERG EBOOK BOOK *** Listen to the silent race\n" +
+		"*** END OF THE PROJECT GUTENBERG EBOOK BOOK *** Footer acre"))
+	writer.Close()
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt.gz"), book.Bytes(), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "book-2.txt"), []byte("Take care to enlist"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+
+	// When
+	err := run(inputDir, outputDir, jobOptions{job: job.DefaultJobName, reducers: 2, splitSize: mapphase.DefaultSplitSize})
+
+	// Then
+	assert.Nil(t, err)
+	var output []string
+	for _, part := range []string{"anagrams-part-0.txt", "anagrams-part-1.txt"} {
+		data, err := os.ReadFile(filepath.Join(outputDir, part))
+		if err != nil {
+			t.Fatalf("Error reading output file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				output = append(output, line)
+			}
+		}
+	}
+	// The words in the header and footer, including "acre", shouldn't be used
+	assert.ElementsMatch(t, []string{"acer: care race", "eilnst: enlist listen silent"}, output)
+}
+
+func TestRun_ArchiveInput(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	var zipData bytes.Buffer
+	zipWriter := zip.NewWriter(&zipData)
+	member, _ := zipWriter.Create("books/book-1.txt")
+	member.Write([]byte("Listen to the silent race"))
+	// Files in the archive that don't match the include patterns shouldn't be used
+	member, _ = zipWriter.Create("README.md")
+	member.Write([]byte("acre"))
+	zipWriter.Close()
+	if err := os.WriteFile(filepath.Join(inputDir, "books-1.zip"), zipData.Bytes(), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	var tarData bytes.Buffer
+	gzipWriter := gzip.NewWriter(&tarData)
+	tarWriter := tar.NewWriter(gzipWriter)
+	tarWriter.WriteHeader(&tar.Header{Name: "book-2.txt", Typeflag: tar.TypeReg, Mode: 0o644, Size: 19})
+	tarWriter.Write([]byte("Take care to enlist"))
+	tarWriter.Close()
+	gzipWriter.Close()
+	if err := os.WriteFile(filepath.Join(inputDir, "books-2.tar.gz"), tarData.Bytes(), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+
+	// When
+	// The archives are only used because they match the include patterns, and the .txt files in them are then used
+	err := run(inputDir, outputDir, jobOptions{job: job.DefaultJobName, reducers: 2,
+		splitSize: mapphase.DefaultSplitSize, include: "*.zip,*.tar,*.txt"})
+
+	// Then
+	assert.Nil(t, err)
+	var output []string
+	for _, part := range []string{"anagrams-part-0.txt", "anagrams-part-1.txt"} {
+		data, err := os.ReadFile(filepath.Join(outputDir, part))
+		if err != nil {
+			t.Fatalf("Error reading output file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				output = append(output, line)
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{"acer: care race", "eilnst: enlist listen silent"}, output)
+}
+
+func TestRun_OutputFormat(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt"), []byte("Listen to the silent race"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "book-2.txt"), []byte("Take care to enlist"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	options := jobOptions{job: job.DefaultJobName, reducers: 2, splitSize: mapphase.DefaultSplitSize,
+		output: storage.OutputOptions{Format: "jsonl"}}
+
+	// When
+	err := run(inputDir, outputDir, options)
+
+	// Then
+	assert.Nil(t, err)
+	var output []string
+	for _, part := range []string{"anagrams-part-0.jsonl", "anagrams-part-1.jsonl"} {
+		data, err := os.ReadFile(filepath.Join(outputDir, part))
+		if err != nil {
+			t.Fatalf("Error reading output file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				output = append(output, line)
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{`{"key":"acer","values":["care","race"]}`,
+		`{"key":"eilnst","values":["enlist","listen","silent"]}`}, output)
+	manifest, err := os.ReadFile(filepath.Join(outputDir, "_SUCCESS"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(manifest), `"outputFormat":"jsonl"`)
+}
+
+func TestRun_CompressedParts(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt"), []byte("Listen to the silent race care"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	options := jobOptions{job: job.DefaultJobName, reducers: 1, splitSize: mapphase.DefaultSplitSize,
+		output: storage.OutputOptions{Compression: storage.CompressionGzip, MaxPartRecords: 1}}
+
+	// When
+	err := run(inputDir, outputDir, options)
+
+	// Then
+	assert.Nil(t, err)
+	var output []string
+	for _, part := range []string{"anagrams-part-0-00001.txt.gz", "anagrams-part-0-00002.txt.gz"} {
+		file, err := os.Open(filepath.Join(outputDir, part))
+		if err != nil {
+			t.Fatalf("Error opening output file: %v", err)
+		}
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Error decompressing output file: %v", err)
+		}
+		data, err := io.ReadAll(reader)
+		_ = file.Close()
+		if err != nil {
+			t.Fatalf("Error reading output file: %v", err)
+		}
+		output = append(output, strings.TrimSpace(string(data)))
+	}
+	assert.ElementsMatch(t, []string{"acer: care race", "eilnst: listen silent"}, output)
+	_, err = os.Stat(filepath.Join(outputDir, "anagrams-part-0-00003.txt.gz"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRun_MergedOutput(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt"), []byte("Listen to the silent race"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "book-2.txt"), []byte("Take care to enlist, eat tea"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+	options := jobOptions{job: job.DefaultJobName, reducers: 3, splitSize: mapphase.DefaultSplitSize,
+		output: storage.OutputOptions{Merge: true}}
+
+	// When
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		outputDir := t.TempDir()
+		if err := run(inputDir, outputDir, options); err != nil {
+			t.Fatalf("Error running job: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(outputDir, "anagrams.txt"))
+		if err != nil {
+			t.Fatalf("Error reading merged output file: %v", err)
+		}
+		outputs = append(outputs, string(data))
+	}
+
+	// Then
+	// The merged output file should be sorted by key and the same for every run
+	assert.Equal(t, "acer: care race\naet: eat tea\neilnst: enlist listen silent\n", outputs[0])
+	assert.Equal(t, outputs[0], outputs[1])
+}
+
+func TestRun_UnknownJobError(t *testing.T) {
+	// Given
+	inputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inputDir, "book-1.txt"), []byte("Listen to the silent race"), 0o644); err != nil {
+		t.Fatalf("Error writing input file: %v", err)
+	}
+
+	// When
+	err := run(inputDir, t.TempDir(), jobOptions{job: "unknown", reducers: 2, splitSize: mapphase.DefaultSplitSize})
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Unknown job unknown")
+}
+
+// setEnv sets the given environment variable for the rest of the test.
+func setEnv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("Error setting environment variable: %v", err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
@@ -0,0 +1,342 @@
+// Command worker runs the stages of the MapReduce in a long-running process, so that the pipeline can be run on plain
+// VMs or Kubernetes without Cloud Functions. Rather than being triggered by pubsub, the worker pulls the messages
+// published to each stage's topic from a subscription, and delivers them to the same functions that are deployed to
+// Cloud Functions. Any number of workers can be run, each running some or all of the stages.
+//
+// Usage:
+//
+//	go run ./cmd/worker [-transport pubsub] [-stages splitter,mapper,combiner,shuffler,controller,reducer]
+//		[-concurrency mapper=8,reducer=1] [-default-concurrency 10] [-subscription-suffix -worker] [-http :8080]
+//		[-shutdown-timeout 30s]
+//
+// With the pubsub transport, the subscription of each stage is named after its topic followed by the subscription
+// suffix, e.g. "mapreduce-mapper-worker", and is created if it doesn't exist. With the memory transport, the messages
+// are delivered by an in-memory broker configured by pubsub.BrokerConfigFromEnv, so every stage runs in the worker.
+//
+// If an HTTP address is given, the worker also serves the starter at /start and the status function at /status, with
+// the same query parameters as the deployed functions. The worker reads the same environment variables as the
+// functions, e.g. GCP_PROJECT, REDIS_HOST, REDIS_HOSTS and NO_OF_REDUCERS.
+//
+// When the worker receives SIGINT or SIGTERM, it stops serving HTTP requests and pulling messages, and waits up to the
+// shutdown timeout for the messages it is handling to be handled. Messages that aren't handled in time are redelivered
+// by pubsub.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"gitlab.com/cameron_w20/serverless-mapreduce/controller"
+	"gitlab.com/cameron_w20/serverless-mapreduce/mapphase"
+	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
+	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
+	"gitlab.com/cameron_w20/serverless-mapreduce/reducephase"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// transportPubSub is the transport that pulls messages from pubsub subscriptions.
+const transportPubSub = "pubsub"
+
+// stage is a stage of the MapReduce, which handles the messages published to its topic.
+type stage struct {
+	name    string
+	topic   string
+	handler pubsub.Handler
+}
+
+// stages are the stages of the MapReduce, named after the functions that they run.
+var stages = []stage{
+	{name: "splitter", topic: pubsub.SplitterTopic, handler: mapphase.Splitter},
+	{name: "mapper", topic: pubsub.MapperTopic, handler: mapphase.Mapper},
+	{name: "combiner", topic: pubsub.CombineTopic, handler: mapphase.Combine},
+	{name: "shuffler", topic: pubsub.ShufflerTopic, handler: reducephase.Shuffler},
+	{name: "controller", topic: pubsub.ControllerTopic, handler: controller.Controller},
+	{name: "reducer", topic: pubsub.ReducerTopic, handler: reducephase.Reducer},
+}
+
+// stageNames returns the names of the stages.
+func stageNames() []string {
+	names := make([]string, 0, len(stages))
+	for _, s := range stages {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+func main() {
+	transport := flag.String("transport", transportPubSub, "the transport to receive messages from, one of: "+
+		transportPubSub+", "+pubsub.TransportMemory)
+	stageList := flag.String("stages", strings.Join(stageNames(), ","), "the comma separated stages to run")
+	concurrency := flag.String("concurrency", "", "the comma separated maximum number of messages handled at the "+
+		"same time by each stage, e.g. mapper=8,reducer=1")
+	defaultConcurrency := flag.Int("default-concurrency", 10, "the maximum number of messages handled at the same "+
+		"time by the stages not given a concurrency")
+	subscriptionSuffix := flag.String("subscription-suffix", "-worker", "the suffix added to the name of each "+
+		"stage's topic to name the subscription it pulls messages from")
+	httpAddr := flag.String("http", "", "the address to serve the starter and status function on, e.g. :8080, or "+
+		"empty to not serve them")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "the time to wait for the messages being "+
+		"handled to be handled when shutting down")
+	flag.Parse()
+	if os.Getenv("NO_OF_REDUCERS") != "" {
+		r.NoOfReducerJobs, _ = strconv.Atoi(os.Getenv("NO_OF_REDUCERS"))
+	}
+	stageConcurrency, err := parseConcurrency(*concurrency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg := config{
+		transport:          *transport,
+		stages:             strings.Split(*stageList, ","),
+		concurrency:        stageConcurrency,
+		defaultConcurrency: *defaultConcurrency,
+		subscriptionSuffix: *subscriptionSuffix,
+		httpAddr:           *httpAddr,
+		shutdownTimeout:    *shutdownTimeout,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// config configures a worker.
+type config struct {
+	// transport is the transport that messages are received from, either pubsub or memory.
+	transport string
+	// stages are the names of the stages to run.
+	stages []string
+	// concurrency is the maximum number of messages handled at the same time by each stage, by stage name.
+	concurrency map[string]int
+	// defaultConcurrency is the maximum number of messages handled at the same time by the stages that aren't in
+	// concurrency.
+	defaultConcurrency int
+	// subscriptionSuffix is added to the name of each stage's topic to name the subscription it pulls messages from.
+	subscriptionSuffix string
+	// httpAddr is the address to serve the starter and status function on, or empty to not serve them.
+	httpAddr string
+	// shutdownTimeout is the time to wait for the messages being handled to be handled when shutting down.
+	shutdownTimeout time.Duration
+}
+
+// parseConcurrency parses a comma separated list of stage names and the maximum number of messages they handle at the
+// same time, e.g. "mapper=8,reducer=1".
+func parseConcurrency(value string) (map[string]int, error) {
+	concurrency := make(map[string]int)
+	if value == "" {
+		return concurrency, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid concurrency %q: must be a stage name and a number, e.g. mapper=8", entry)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid concurrency %q: must be a positive number", entry)
+		}
+		concurrency[strings.TrimSpace(parts[0])] = n
+	}
+	return concurrency, nil
+}
+
+// selectStages returns the stages with the given names, in pipeline order, and the maximum number of messages each
+// handles at the same time.
+func selectStages(cfg config) ([]stage, map[string]int, error) {
+	known := make(map[string]bool, len(stages))
+	for _, s := range stages {
+		known[s.name] = true
+	}
+	wanted := make(map[string]bool)
+	for _, name := range cfg.stages {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, nil, fmt.Errorf("unknown stage %s, must be one of: %s", name, strings.Join(stageNames(), ", "))
+		}
+		wanted[name] = true
+	}
+	if len(wanted) == 0 {
+		return nil, nil, fmt.Errorf("no stages to run")
+	}
+	for name := range cfg.concurrency {
+		if !wanted[name] {
+			return nil, nil, fmt.Errorf("concurrency given for stage %s, which isn't being run", name)
+		}
+	}
+	selected := make([]stage, 0, len(wanted))
+	concurrency := make(map[string]int, len(wanted))
+	for _, s := range stages {
+		if !wanted[s.name] {
+			continue
+		}
+		selected = append(selected, s)
+		concurrency[s.name] = cfg.defaultConcurrency
+		if n, ok := cfg.concurrency[s.name]; ok {
+			concurrency[s.name] = n
+		}
+	}
+	return selected, concurrency, nil
+}
+
+// run runs a worker with the given config until the given context is done or the worker fails, and then shuts it down.
+func run(ctx context.Context, cfg config) error {
+	w, err := newWorker(cfg)
+	if err != nil {
+		return err
+	}
+	w.start()
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down worker")
+	case runErr = <-w.errs:
+		log.Printf("Shutting down worker after error: %v", runErr)
+	}
+	if err := w.shutdown(); err != nil && runErr == nil {
+		runErr = err
+	}
+	return runErr
+}
+
+// worker receives the messages published to the topics of its stages and delivers them to the stages' handlers.
+type worker struct {
+	cfg         config
+	stages      []stage
+	concurrency map[string]int
+	// broker delivers the messages when the transport is memory.
+	broker *pubsub.Broker
+	// server serves the starter and status function, or is nil if they aren't served.
+	server *http.Server
+	// cancelReceive stops pulling messages from the pubsub subscriptions.
+	cancelReceive context.CancelFunc
+	// receiving is done once every stage has stopped pulling messages and handling the messages it pulled.
+	receiving sync.WaitGroup
+	// errs receives the errors that stop the worker.
+	errs chan error
+}
+
+// newWorker returns a worker for the given config, or an error if the config isn't valid.
+func newWorker(cfg config) (*worker, error) {
+	if cfg.transport != transportPubSub && cfg.transport != pubsub.TransportMemory {
+		return nil, fmt.Errorf("unknown transport %s, must be one of: %s, %s", cfg.transport, transportPubSub,
+			pubsub.TransportMemory)
+	}
+	selected, concurrency, err := selectStages(cfg)
+	if err != nil {
+		return nil, err
+	}
+	w := &worker{
+		cfg:         cfg,
+		stages:      selected,
+		concurrency: concurrency,
+		errs:        make(chan error, len(selected)+1),
+	}
+	if cfg.transport == pubsub.TransportMemory {
+		if len(selected) != len(stages) {
+			return nil, fmt.Errorf("every stage must be run with the %s transport", pubsub.TransportMemory)
+		}
+		brokerConfig, err := pubsub.BrokerConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		w.broker = pubsub.NewBroker(brokerConfig)
+	}
+	if cfg.httpAddr != "" {
+		w.server = &http.Server{Addr: cfg.httpAddr, Handler: newHandler()}
+	}
+	return w, nil
+}
+
+// newHandler returns an HTTP handler that serves the starter at /start and the status function at /status.
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", mapphase.StartMapReduce)
+	mux.HandleFunc("/status", controller.Status)
+	return mux
+}
+
+// start starts receiving messages for each of the worker's stages, and serving HTTP requests if it has a server.
+func (w *worker) start() {
+	if w.broker != nil {
+		for _, s := range w.stages {
+			w.broker.SubscribeWithConcurrency(s.topic, s.handler, w.concurrency[s.name])
+		}
+		pubsub.UseBroker(w.broker)
+		log.Printf("Running every stage with the %s transport", w.cfg.transport)
+	} else {
+		var receiveCtx context.Context
+		receiveCtx, w.cancelReceive = context.WithCancel(context.Background())
+		for _, s := range w.stages {
+			s := s
+			subscriptionName := s.topic + w.cfg.subscriptionSuffix
+			w.receiving.Add(1)
+			go func() {
+				defer w.receiving.Done()
+				log.Printf("Receiving messages for stage %s from subscription %s", s.name, subscriptionName)
+				err := pubsub.Receive(receiveCtx, s.topic, subscriptionName, w.concurrency[s.name], s.handler)
+				if err != nil {
+					w.errs <- fmt.Errorf("error running stage %s: %v", s.name, err)
+				}
+			}()
+		}
+	}
+	if w.server != nil {
+		go func() {
+			log.Printf("Serving the starter and status function on %s", w.server.Addr)
+			if err := w.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				w.errs <- fmt.Errorf("error serving HTTP requests: %v", err)
+			}
+		}()
+	}
+}
+
+// shutdown stops the worker serving HTTP requests and receiving messages, and waits up to the shutdown timeout for the
+// messages being handled to be handled. With the memory transport, every message published to the broker is handled,
+// since they would be lost otherwise.
+func (w *worker) shutdown() error {
+	deadline := time.Now().Add(w.cfg.shutdownTimeout)
+	if w.server != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := w.server.Shutdown(ctx); err != nil {
+			return fmt.Errorf("error shutting down HTTP server: %v", err)
+		}
+	}
+	if w.broker != nil {
+		defer pubsub.UseBroker(nil)
+		return waitUntil(w.broker.Wait, deadline)
+	}
+	w.cancelReceive()
+	return waitUntil(w.receiving.Wait, deadline)
+}
+
+// waitUntil calls the given wait function and returns once it has returned, or returns an error if it hasn't returned
+// by the given deadline.
+func waitUntil(wait func(), deadline time.Time) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("timed out waiting for the messages being handled to be handled")
+	}
+}
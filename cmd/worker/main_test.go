@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/cameron_w20/serverless-mapreduce/controller"
+	"gitlab.com/cameron_w20/serverless-mapreduce/mapphase"
+	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
+	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
+	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConcurrency(t *testing.T) {
+	// When
+	concurrency, err := parseConcurrency("mapper=8, reducer=1")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"mapper": 8, "reducer": 1}, concurrency)
+}
+
+func TestParseConcurrency_InvalidConcurrencyError(t *testing.T) {
+	for _, value := range []string{"mapper", "mapper=eight", "mapper=0"} {
+		t.Run(value, func(t *testing.T) {
+			// When
+			_, err := parseConcurrency(value)
+
+			// Then
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), "invalid concurrency")
+		})
+	}
+}
+
+func TestSelectStages(t *testing.T) {
+	// Given
+	cfg := config{
+		stages:             []string{"reducer", "mapper", "combiner"},
+		concurrency:        map[string]int{"mapper": 8},
+		defaultConcurrency: 2,
+	}
+
+	// When
+	selected, concurrency, err := selectStages(cfg)
+
+	// Then
+	assert.Nil(t, err)
+	var names []string
+	for _, s := range selected {
+		names = append(names, s.name)
+	}
+	// The stages should be in pipeline order
+	assert.Equal(t, []string{"mapper", "combiner", "reducer"}, names)
+	assert.Equal(t, map[string]int{"mapper": 8, "combiner": 2, "reducer": 2}, concurrency)
+}
+
+func TestSelectStages_InvalidStagesError(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         config
+		expectedErr string
+	}{
+		{name: "UnknownStage", cfg: config{stages: []string{"mapper", "sorter"}},
+			expectedErr: "unknown stage sorter, must be one of: splitter, mapper, combiner, shuffler, controller, reducer"},
+		{name: "NoStages", cfg: config{stages: []string{""}}, expectedErr: "no stages to run"},
+		{name: "ConcurrencyForStageNotRun", cfg: config{stages: []string{"mapper"},
+			concurrency: map[string]int{"reducer": 1}},
+			expectedErr: "concurrency given for stage reducer, which isn't being run"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			_, _, err := selectStages(tt.cfg)
+
+			// Then
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), tt.expectedErr)
+		})
+	}
+}
+
+func TestNewWorker_UnknownTransportError(t *testing.T) {
+	// When
+	_, err := newWorker(config{transport: "redis-streams", stages: stageNames()})
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unknown transport redis-streams, must be one of: pubsub, memory")
+}
+
+func TestNewWorker_MemoryTransportMissingStageError(t *testing.T) {
+	// When
+	_, err := newWorker(config{transport: pubsub.TransportMemory, stages: []string{"mapper"}})
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "every stage must be run with the memory transport")
+}
+
+func TestWorker_Memory(t *testing.T) {
+	// Given
+	setupRedis(t, 2)
+	memory := storage.NewMemory()
+	memory.CreateBucket("input")
+	memory.CreateBucket("output")
+	memory.PutObject("input", "book-1.txt", []byte("Listen to the silent race"))
+	memory.PutObject("input", "book-2.txt", []byte("Take care to enlist"))
+	storage.RegisterBackend("worker-mem", memory)
+	w, err := newWorker(config{
+		transport:          pubsub.TransportMemory,
+		stages:             stageNames(),
+		concurrency:        map[string]int{"mapper": 4, "reducer": 1},
+		defaultConcurrency: 2,
+		shutdownTimeout:    10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Error creating worker: %v", err)
+	}
+	w.start()
+	handler := newHandler()
+
+	// When
+	query := url.Values{}
+	query.Set("input-bucket", "worker-mem://input")
+	query.Set("output-bucket", "worker-mem://output")
+	startRec := httptest.NewRecorder()
+	handler.ServeHTTP(startRec, httptest.NewRequest(http.MethodGet, "/start?"+query.Encode(), nil))
+	var startResponse mapphase.Response
+	if err := json.Unmarshal(startRec.Body.Bytes(), &startResponse); err != nil {
+		t.Fatalf("Error reading starter response: %v", err)
+	}
+	// Shutting down waits for every message published to the broker to be handled
+	err = w.shutdown()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, startRec.Code)
+	statusRec := httptest.NewRecorder()
+	handler.ServeHTTP(statusRec, httptest.NewRequest(http.MethodGet, "/status?job-id="+startResponse.JobID, nil))
+	assert.Equal(t, http.StatusOK, statusRec.Code)
+	assert.Contains(t, statusRec.Body.String(), `"phase":"`+controller.PhaseDone+`"`)
+	objects := memory.Objects("output")
+	assert.Contains(t, objects, startResponse.JobID+"/"+controller.SuccessObjectName)
+	var output []string
+	for _, part := range []string{"anagrams-part-0.txt", "anagrams-part-1.txt"} {
+		for _, line := range strings.Split(string(objects[startResponse.JobID+"/"+part]), "\n") {
+			if line != "" {
+				output = append(output, line)
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{"acer: care race", "eilnst: enlist listen silent"}, output)
+}
+
+func TestWaitUntil_TimeoutError(t *testing.T) {
+	// Given
+	release := make(chan struct{})
+	defer close(release)
+
+	// When
+	err := waitUntil(func() { <-release }, time.Now().Add(10*time.Millisecond))
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "timed out waiting for the messages being handled to be handled")
+}
+
+// setupRedis points the Redis clients used by the functions at in-memory Redis servers, one for the controller and one
+// for each of the given number of reducers, which are stopped once the test has finished.
+func setupRedis(t *testing.T, reducers int) {
+	previousReducers := r.NoOfReducerJobs
+	r.NoOfReducerJobs = reducers
+	r.SingleRedisClient = redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	r.MultiRedisClient = make(map[string]*redis.Client)
+	for i := 0; i < reducers; i++ {
+		r.MultiRedisClient[strconv.Itoa(i)] = redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	}
+	t.Cleanup(func() {
+		r.NoOfReducerJobs = previousReducers
+		r.SingleRedisClient = nil
+		r.MultiRedisClient = nil
+	})
+}
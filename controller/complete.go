@@ -0,0 +1,326 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"gitlab.com/cameron_w20/serverless-mapreduce/job"
+	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
+	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// SuccessObjectName is the name of the manifest object written to the job's directory in the output bucket once every
+// reducer has written its output file.
+const SuccessObjectName = "_SUCCESS"
+
+// callbackClient is the HTTP client used to POST the manifest to a job's callback URL.
+var callbackClient = &http.Client{Timeout: 10 * time.Second}
+
+// Manifest is the summary of a finished job. It is written to the output bucket as the _SUCCESS object and POSTed to
+// the job's callback URL.
+type Manifest struct {
+	JobID           string           `json:"jobId"`
+	Job             string           `json:"job"`
+	InputBucket     string           `json:"inputBucket"`
+	Inputs          []string         `json:"inputs"`
+	OutputBucket    string           `json:"outputBucket"`
+	OutputFormat    string           `json:"outputFormat"`
+	Outputs         []ManifestOutput `json:"outputs"`
+	Merged          *ManifestOutput  `json:"merged,omitempty"`
+	Records         int              `json:"records"`
+	StartedAt       string           `json:"startedAt"`
+	FinishedAt      string           `json:"finishedAt"`
+	DurationSeconds float64          `json:"durationSeconds"`
+}
+
+// ManifestOutput is an output file written by a reducer and the number of records in it.
+type ManifestOutput struct {
+	ObjectName string `json:"objectName"`
+	Records    int    `json:"records"`
+}
+
+// finishJobScript checks whether every reducer started for a job has written its output files. If they have and the job
+// isn't already being committed, it records the time the job started being committed and returns 1. Running this as a
+// script means that only one controller instance commits the output files and writes the manifest for a job. It
+// returns 2 if the job has been committed but its callback URL hasn't been notified yet, -1 if the job has been
+// aborted, and 0 otherwise.
+var finishJobScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], 'finishedAt') == 1 then
+	local callbackURL = redis.call('HGET', KEYS[1], 'callbackUrl')
+	if callbackURL and callbackURL ~= '' and redis.call('HEXISTS', KEYS[1], 'notifiedAt') == 0 then
+		return 2
+	end
+	return 0
+end
+if redis.call('HEXISTS', KEYS[1], 'abortedAt') == 1 then
+	return -1
+end
+if redis.call('HEXISTS', KEYS[1], 'committingAt') == 1 then
+	return 0
+end
+local reducers = tonumber(redis.call('HGET', KEYS[1], 'reducers'))
+if not reducers or redis.call('HLEN', KEYS[2]) < reducers then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'committingAt', ARGV[1])
+return 1
+`)
+
+// checkReducersFinished checks whether every reducer of the given job has written its output files. If they have, then
+// it commits the job and POSTs the job's manifest to the job's callback URL, if one was provided. If committing the job
+// fails, the job is marked as uncommitted again so that the commit is retried when the message is redelivered. If
+// only the callback fails, the job stays committed and just the callback is retried when the message is redelivered.
+// If the job has been aborted, the output files of reducers that finished after it was aborted are deleted instead.
+func checkReducersFinished(ctx context.Context, jobID string) error {
+	keys := []string{r.JobStatusKey(jobID), r.ReducersFinishedKey(jobID)}
+	finished, err := finishJobScript.Run(ctx, r.SingleRedisClient, keys, now()).Int()
+	if err != nil {
+		return fmt.Errorf("error checking if reducers have finished: %v", err)
+	}
+	switch finished {
+	case -1:
+		return deleteTemporaryOutputs(ctx, jobID)
+	case 1:
+		manifestBytes, err := commitJob(ctx, jobID)
+		if err != nil {
+			if delErr := r.SingleRedisClient.HDel(ctx, r.JobStatusKey(jobID), "committingAt").Err(); delErr != nil {
+				return fmt.Errorf("%v, and error marking job as uncommitted: %v", err, delErr)
+			}
+			return err
+		}
+		return notifyJob(ctx, jobID, manifestBytes)
+	case 2:
+		return notifyJob(ctx, jobID, nil)
+	}
+	return nil
+}
+
+// commitJob commits the output files of the given job, which promotes them from the job's temporary directory to the
+// job's output directory, and merges them if the job was started with merged output. It then writes the job's manifest
+// to the output bucket, records that the job has finished along with its committed output files, and deletes the
+// temporary directory. The manifest is only written once every output file has been committed, so the _SUCCESS object
+// marks the output as complete. The manifest is returned so that it can be POSTed to the job's callback URL.
+func commitJob(ctx context.Context, jobID string) ([]byte, error) {
+	fields, err := r.SingleRedisClient.HGetAll(ctx, r.JobStatusKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading job status from redis: %v", err)
+	}
+	inputs, err := r.SingleRedisClient.SMembers(ctx, r.InputsKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading inputs from redis: %v", err)
+	}
+	outputRecords, err := r.SingleRedisClient.HGetAll(ctx, r.OutputRecordsKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading output records from redis: %v", err)
+	}
+	outputs, err := r.SingleRedisClient.HGetAll(ctx, r.OutputsKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading outputs from redis: %v", err)
+	}
+	// Promote the output files to the job's output directory, in order of their names
+	temporaryNames := make([]string, 0, len(outputRecords))
+	for objectName := range outputRecords {
+		temporaryNames = append(temporaryNames, objectName)
+	}
+	sort.Strings(temporaryNames)
+	committedNames, err := storage.CommitOutputs(ctx, fields["outputBucket"], storage.OutputPrefix(jobID),
+		temporaryNames)
+	if err != nil {
+		return nil, err
+	}
+	committedRecords := make(map[string]string, len(committedNames))
+	for i, objectName := range committedNames {
+		committedRecords[objectName] = outputRecords[temporaryNames[i]]
+	}
+	// The job finished when every reducer had finished and it started being committed
+	fields["finishedAt"] = fields["committingAt"]
+	manifest := newManifest(jobID, fields, inputs, committedRecords)
+	outputOptions, err := storage.OutputOptionsFromAttributes(fields)
+	if err != nil {
+		return nil, err
+	}
+	if outputOptions.Merge {
+		objectNames := make([]string, 0, len(manifest.Outputs))
+		for _, output := range manifest.Outputs {
+			objectNames = append(objectNames, output.ObjectName)
+		}
+		merged, err := storage.MergeOutputs(ctx, manifest.OutputBucket, objectNames,
+			mergedBaseName(jobID, job.NameFromAttributes(fields)), outputOptions)
+		if err != nil {
+			return nil, fmt.Errorf("error merging output files: %v", err)
+		}
+		manifest.Merged = &ManifestOutput{ObjectName: merged.ObjectName, Records: merged.Records}
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling manifest: %v", err)
+	}
+	// Write the manifest alongside the job's output files
+	storageClient, err := storage.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer storageClient.Close()
+	err = storageClient.WriteObject(ctx, manifest.OutputBucket, successObjectName(jobID), manifestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error writing manifest: %v", err)
+	}
+	// Record that the job has finished, and replace its outputs with the committed output files, so that its status
+	// lists the files in the job's directory rather than the temporary files that are about to be deleted
+	err = updateJobStatus(ctx, jobID, func(pipe redis.Pipeliner) {
+		pipe.Del(ctx, r.OutputsKey(jobID))
+		for i, objectName := range committedNames {
+			pipe.HSet(ctx, r.OutputsKey(jobID), objectName, outputs[temporaryNames[i]])
+		}
+		pipe.HSet(ctx, r.JobStatusKey(jobID), "finishedAt", manifest.FinishedAt)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error recording job finish in redis: %v", err)
+	}
+	// The job has been committed, so a failure to delete the temporary output files is only logged
+	if err := storage.DeleteTemporaryOutputs(ctx, manifest.OutputBucket, storage.OutputPrefix(jobID)); err != nil {
+		log.Printf("Error deleting temporary output files of job %s: %v", jobID, err)
+	}
+	return manifestBytes, nil
+}
+
+// notifyJob POSTs the manifest of the given committed job to the job's callback URL, if one was provided, and records
+// that the callback URL has been notified. If the manifest isn't given, it is read from the job's output bucket, which
+// is how the callback is retried without committing the job again.
+func notifyJob(ctx context.Context, jobID string, manifestBytes []byte) error {
+	fields, err := r.SingleRedisClient.HGetAll(ctx, r.JobStatusKey(jobID)).Result()
+	if err != nil {
+		return fmt.Errorf("error reading job status from redis: %v", err)
+	}
+	callbackURL := fields["callbackUrl"]
+	if callbackURL == "" {
+		return nil
+	}
+	if manifestBytes == nil {
+		storageClient, err := storage.New(ctx)
+		if err != nil {
+			return err
+		}
+		defer storageClient.Close()
+		manifestBytes, err = storageClient.ReadObject(ctx, fields["outputBucket"], successObjectName(jobID))
+		if err != nil {
+			return fmt.Errorf("error reading manifest: %v", err)
+		}
+	}
+	if err := postManifest(ctx, callbackURL, manifestBytes); err != nil {
+		return err
+	}
+	if err := r.SingleRedisClient.HSet(ctx, r.JobStatusKey(jobID), "notifiedAt", now()).Err(); err != nil {
+		return fmt.Errorf("error recording job notification in redis: %v", err)
+	}
+	return nil
+}
+
+// newManifest creates the manifest of a job from the job's status, the files it was started with and the number of
+// records written to each output file.
+func newManifest(jobID string, fields map[string]string, inputs []string, outputRecords map[string]string) Manifest {
+	manifest := Manifest{
+		JobID:        jobID,
+		Job:          fields["job"],
+		InputBucket:  fields["inputBucket"],
+		Inputs:       append(make([]string, 0, len(inputs)), inputs...),
+		OutputBucket: fields["outputBucket"],
+		OutputFormat: fields["outputFormat"],
+		Outputs:      make([]ManifestOutput, 0, len(outputRecords)),
+		StartedAt:    fields["startedAt"],
+		FinishedAt:   fields["finishedAt"],
+	}
+	sort.Strings(manifest.Inputs)
+	for objectName, records := range outputRecords {
+		manifest.Outputs = append(manifest.Outputs, ManifestOutput{ObjectName: objectName, Records: atoi(records)})
+		manifest.Records += atoi(records)
+	}
+	sort.Slice(manifest.Outputs, func(i, j int) bool {
+		return manifest.Outputs[i].ObjectName < manifest.Outputs[j].ObjectName
+	})
+	startedAt, startErr := time.Parse(time.RFC3339, manifest.StartedAt)
+	finishedAt, finishErr := time.Parse(time.RFC3339, manifest.FinishedAt)
+	if startErr == nil && finishErr == nil {
+		manifest.DurationSeconds = finishedAt.Sub(startedAt).Seconds()
+	}
+	return manifest
+}
+
+// successObjectName returns the name of the manifest object for the given job.
+func successObjectName(jobID string) string {
+	if jobID == "" {
+		return SuccessObjectName
+	}
+	return jobID + "/" + SuccessObjectName
+}
+
+// abortJobScript records that a job has been aborted and returns 1, unless the job is being committed or has already
+// finished, in which case it returns 0. The time the job was first aborted is kept if the job is aborted more than once.
+var abortJobScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], 'committingAt') == 1 or redis.call('HEXISTS', KEYS[1], 'finishedAt') == 1 then
+	return 0
+end
+redis.call('HSETNX', KEYS[1], 'abortedAt', ARGV[1])
+return 1
+`)
+
+// abortJob aborts the given job after one of its functions has failed, unless the job is being committed or has already
+// finished. The output files that the reducers have written to the job's temporary directory are deleted, and the job
+// is never committed, so none of its output files are promoted to its output directory.
+func abortJob(ctx context.Context, jobID string) error {
+	aborted, err := abortJobScript.Run(ctx, r.SingleRedisClient, []string{r.JobStatusKey(jobID)}, now()).Int()
+	if err != nil {
+		return fmt.Errorf("error recording job abort in redis: %v", err)
+	}
+	if aborted != 1 {
+		return nil
+	}
+	return deleteTemporaryOutputs(ctx, jobID)
+}
+
+// deleteTemporaryOutputs deletes the output files in the temporary directory of the given job. Nothing is deleted if
+// the job's output bucket isn't known yet, since no reducers have been started for the job.
+func deleteTemporaryOutputs(ctx context.Context, jobID string) error {
+	outputBucket, err := r.SingleRedisClient.HGet(ctx, r.JobStatusKey(jobID), "outputBucket").Result()
+	if err == redis.Nil || (err == nil && outputBucket == "") {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading output bucket from redis: %v", err)
+	}
+	return storage.DeleteTemporaryOutputs(ctx, outputBucket, storage.OutputPrefix(jobID))
+}
+
+// mergedBaseName returns the name of the merged output file of the given job, without the extension added by
+// storage.MergeOutputs.
+func mergedBaseName(jobID, jobName string) string {
+	if jobID == "" {
+		return jobName
+	}
+	return jobID + "/" + jobName
+}
+
+// postManifest POSTs the given manifest to the given callback URL, returning an error if the callback doesn't respond
+// with a 2xx status code.
+func postManifest(ctx context.Context, callbackURL string, manifest []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(manifest))
+	if err != nil {
+		return fmt.Errorf("error creating callback request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling callback URL: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error calling callback URL: unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
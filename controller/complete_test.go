@@ -0,0 +1,313 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/cameron_w20/serverless-mapreduce/redis"
+	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+	"gitlab.com/cameron_w20/serverless-mapreduce/test"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckReducersFinished(t *testing.T) {
+	// Given
+	teardownStorage := test.SetupStorageTest(t)
+	defer teardownStorage(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	var callbackBody []byte
+	callbackCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		callbackCalls++
+		callbackBody, _ = io.ReadAll(req.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	redis.SingleRedisClient.HSet(ctx, redis.JobStatusKey("job-1"), "job", "anagrams", "inputBucket",
+		test.InputBucketName, "outputBucket", test.OutputBucketName, "callbackUrl", server.URL, "reducers", 2,
+		"startedAt", "2022-11-01T12:00:00Z")
+	redis.SingleRedisClient.HSet(ctx, redis.FilePartitionsKey("job-1"), "test.txt", 1)
+	redis.SingleRedisClient.SAdd(ctx, redis.InputsKey("job-1"), "test.txt")
+	redis.SingleRedisClient.HSet(ctx, redis.ReducersFinishedKey("job-1"), "0", "2022-11-01T12:00:08Z", "1",
+		"2022-11-01T12:00:09Z")
+	redis.SingleRedisClient.HSet(ctx, redis.OutputsKey("job-1"), "job-1/_temporary/anagrams-part-0.txt",
+		"2022-11-01T12:00:08Z", "job-1/_temporary/anagrams-part-1.txt", "2022-11-01T12:00:09Z")
+	redis.SingleRedisClient.HSet(ctx, redis.OutputRecordsKey("job-1"), "job-1/_temporary/anagrams-part-0.txt", 2,
+		"job-1/_temporary/anagrams-part-1.txt", 3)
+	storageClient, err := storage.New(ctx)
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	defer storageClient.Close()
+	for _, objectName := range []string{"anagrams-part-0.txt", "anagrams-part-1.txt"} {
+		err := storageClient.WriteObject(ctx, test.OutputBucketName, "job-1/_temporary/"+objectName, []byte("a: b c\n"))
+		if err != nil {
+			t.Fatalf("Error writing output file: %v", err)
+		}
+	}
+
+	// When
+	err = checkReducersFinished(ctx, "job-1")
+	// A redelivered message shouldn't write the manifest again
+	errRedelivered := checkReducersFinished(ctx, "job-1")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Nil(t, errRedelivered)
+	assert.Equal(t, 1, callbackCalls)
+	// The output files should have been promoted from the temporary directory
+	objects, err := storageClient.ListObjects(ctx, test.OutputBucketName, "job-1/")
+	if err != nil {
+		t.Fatalf("Error listing output files: %v", err)
+	}
+	objectNames := make([]string, 0, len(objects))
+	for _, object := range objects {
+		objectNames = append(objectNames, object.Name)
+	}
+	assert.Equal(t, []string{"job-1/_SUCCESS", "job-1/anagrams-part-0.txt", "job-1/anagrams-part-1.txt"}, objectNames)
+	data, err := storageClient.ReadObject(ctx, test.OutputBucketName, "job-1/_SUCCESS")
+	if err != nil {
+		t.Fatalf("Error reading manifest: %v", err)
+	}
+	assert.Equal(t, data, callbackBody)
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("Error unmarshalling manifest: %v", err)
+	}
+	assert.Equal(t, "job-1", manifest.JobID)
+	assert.Equal(t, []string{"test.txt"}, manifest.Inputs)
+	assert.Equal(t, 5, manifest.Records)
+	assert.Equal(t, []ManifestOutput{{ObjectName: "job-1/anagrams-part-0.txt", Records: 2},
+		{ObjectName: "job-1/anagrams-part-1.txt", Records: 3}}, manifest.Outputs)
+	// The job's outputs should be the committed output files
+	outputs, _ := redis.SingleRedisClient.HGetAll(ctx, redis.OutputsKey("job-1")).Result()
+	assert.Equal(t, map[string]string{"job-1/anagrams-part-0.txt": "2022-11-01T12:00:08Z",
+		"job-1/anagrams-part-1.txt": "2022-11-01T12:00:09Z"}, outputs)
+}
+
+func TestCheckReducersFinished_CallbackError(t *testing.T) {
+	// Given
+	teardownStorage := test.SetupStorageTest(t)
+	defer teardownStorage(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	redis.SingleRedisClient.HSet(ctx, redis.JobStatusKey("job-1"), "outputBucket", test.OutputBucketName,
+		"callbackUrl", server.URL, "reducers", 1)
+	redis.SingleRedisClient.HSet(ctx, redis.ReducersFinishedKey("job-1"), "0", "2022-11-01T12:00:08Z")
+	redis.SingleRedisClient.HSet(ctx, redis.OutputsKey("job-1"), "job-1/anagrams-part-0.txt", "2022-11-01T12:00:08Z")
+
+	// When
+	err := checkReducersFinished(ctx, "job-1")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unexpected status code 500")
+	// The job should stay committed, and only be marked as not notified so that just the callback is retried
+	finished, _ := redis.SingleRedisClient.HExists(ctx, redis.JobStatusKey("job-1"), "finishedAt").Result()
+	assert.True(t, finished)
+	notified, _ := redis.SingleRedisClient.HExists(ctx, redis.JobStatusKey("job-1"), "notifiedAt").Result()
+	assert.False(t, notified)
+}
+
+func TestCheckReducersFinished_CallbackRetried(t *testing.T) {
+	// Given
+	teardownStorage := test.SetupStorageTest(t)
+	defer teardownStorage(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	var callbackBody []byte
+	callbackCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		callbackCalls++
+		// The callback fails the first time it is called
+		if callbackCalls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		callbackBody, _ = io.ReadAll(req.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	redis.SingleRedisClient.HSet(ctx, redis.JobStatusKey("job-1"), "job", "anagrams", "outputBucket",
+		test.OutputBucketName, "callbackUrl", server.URL, "reducers", 1)
+	redis.SingleRedisClient.HSet(ctx, redis.ReducersFinishedKey("job-1"), "0", "2022-11-01T12:00:08Z")
+	redis.SingleRedisClient.HSet(ctx, redis.OutputsKey("job-1"), "job-1/_temporary/anagrams-part-0.txt",
+		"2022-11-01T12:00:08Z")
+	redis.SingleRedisClient.HSet(ctx, redis.OutputRecordsKey("job-1"), "job-1/_temporary/anagrams-part-0.txt", 1)
+	storageClient, err := storage.New(ctx)
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	defer storageClient.Close()
+	err = storageClient.WriteObject(ctx, test.OutputBucketName, "job-1/_temporary/anagrams-part-0.txt", []byte("a: b\n"))
+	if err != nil {
+		t.Fatalf("Error writing output file: %v", err)
+	}
+
+	// When
+	errFirst := checkReducersFinished(ctx, "job-1")
+	// The redelivered message should only retry the callback, since the temporary output files have been deleted
+	errRedelivered := checkReducersFinished(ctx, "job-1")
+	// Once the callback has succeeded, it shouldn't be called again
+	errNotified := checkReducersFinished(ctx, "job-1")
+
+	// Then
+	assert.NotNil(t, errFirst)
+	assert.Contains(t, errFirst.Error(), "unexpected status code 503")
+	assert.Nil(t, errRedelivered)
+	assert.Nil(t, errNotified)
+	assert.Equal(t, 2, callbackCalls)
+	data, err := storageClient.ReadObject(ctx, test.OutputBucketName, "job-1/_SUCCESS")
+	if err != nil {
+		t.Fatalf("Error reading manifest: %v", err)
+	}
+	assert.Equal(t, data, callbackBody)
+	notified, _ := redis.SingleRedisClient.HExists(ctx, redis.JobStatusKey("job-1"), "notifiedAt").Result()
+	assert.True(t, notified)
+}
+
+func TestCheckReducersFinished_NotAllReducersFinished(t *testing.T) {
+	// Given
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	ctx := context.Background()
+	redis.SingleRedisClient.HSet(ctx, redis.JobStatusKey("job-1"), "reducers", 2)
+	redis.SingleRedisClient.HSet(ctx, redis.ReducersFinishedKey("job-1"), "0", "2022-11-01T12:00:08Z")
+	redis.SingleRedisClient.HSet(ctx, redis.OutputsKey("job-1"), "job-1/anagrams-part-0.txt", "2022-11-01T12:00:08Z")
+
+	// When
+	err := checkReducersFinished(ctx, "job-1")
+
+	// Then
+	assert.Nil(t, err)
+	finished, _ := redis.SingleRedisClient.HExists(ctx, redis.JobStatusKey("job-1"), "finishedAt").Result()
+	assert.False(t, finished)
+}
+
+func TestAbortJob(t *testing.T) {
+	// Given
+	teardownStorage := test.SetupStorageTest(t)
+	defer teardownStorage(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	ctx := context.Background()
+	redis.SingleRedisClient.HSet(ctx, redis.JobStatusKey("job-1"), "outputBucket", test.OutputBucketName, "reducers", 1)
+	storageClient, err := storage.New(ctx)
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	defer storageClient.Close()
+	err = storageClient.WriteObject(ctx, test.OutputBucketName, "job-1/_temporary/anagrams-part-0.txt", []byte("a: b\n"))
+	if err != nil {
+		t.Fatalf("Error writing output file: %v", err)
+	}
+	redis.SingleRedisClient.HSet(ctx, redis.ReducersFinishedKey("job-1"), "0", "2022-11-01T12:00:08Z")
+	redis.SingleRedisClient.HSet(ctx, redis.OutputRecordsKey("job-1"), "job-1/_temporary/anagrams-part-0.txt", 1)
+
+	// When
+	err = abortJob(ctx, "job-1")
+	// A reducer that finishes after the job was aborted shouldn't commit the job
+	errFinished := checkReducersFinished(ctx, "job-1")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Nil(t, errFinished)
+	objects, err := storageClient.ListObjects(ctx, test.OutputBucketName, "job-1/")
+	assert.Nil(t, err)
+	assert.Empty(t, objects)
+	finished, _ := redis.SingleRedisClient.HExists(ctx, redis.JobStatusKey("job-1"), "finishedAt").Result()
+	assert.False(t, finished)
+}
+
+func TestNewManifest(t *testing.T) {
+	// Given
+	fields := map[string]string{
+		"job":          "anagrams",
+		"inputBucket":  test.InputBucketName,
+		"outputBucket": test.OutputBucketName,
+		"outputFormat": "jsonl",
+		"startedAt":    "2022-11-01T12:00:00Z",
+		"finishedAt":   "2022-11-01T12:01:30Z",
+	}
+	inputs := []string{"book-2.txt", "book-1.txt"}
+	outputRecords := map[string]string{"job-1/anagrams-part-1.txt": "3", "job-1/anagrams-part-0.txt": "2"}
+
+	expectedManifest := Manifest{
+		JobID:        "job-1",
+		Job:          "anagrams",
+		InputBucket:  test.InputBucketName,
+		Inputs:       []string{"book-1.txt", "book-2.txt"},
+		OutputBucket: test.OutputBucketName,
+		OutputFormat: "jsonl",
+		Outputs: []ManifestOutput{
+			{ObjectName: "job-1/anagrams-part-0.txt", Records: 2},
+			{ObjectName: "job-1/anagrams-part-1.txt", Records: 3},
+		},
+		Records:         5,
+		StartedAt:       "2022-11-01T12:00:00Z",
+		FinishedAt:      "2022-11-01T12:01:30Z",
+		DurationSeconds: 90,
+	}
+
+	// When
+	manifest := newManifest("job-1", fields, inputs, outputRecords)
+
+	// Then
+	assert.Equal(t, expectedManifest, manifest)
+}
+
+func TestSuccessObjectName(t *testing.T) {
+	assert.Equal(t, "job-1/_SUCCESS", successObjectName("job-1"))
+	assert.Equal(t, "_SUCCESS", successObjectName(""))
+}
+
+func TestMergedBaseName(t *testing.T) {
+	assert.Equal(t, "job-1/anagrams", mergedBaseName("job-1", "anagrams"))
+	assert.Equal(t, "anagrams", mergedBaseName("", "anagrams"))
+}
+
+func TestPostManifest(t *testing.T) {
+	// Given
+	var contentType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contentType = req.Header.Get("Content-Type")
+		body, _ = io.ReadAll(req.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// When
+	err := postManifest(context.Background(), server.URL, []byte(`{"jobId":"job-1"}`))
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, `{"jobId":"job-1"}`, string(body))
+}
+
+func TestPostManifest_UnexpectedStatusCodeError(t *testing.T) {
+	// Given
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	// When
+	err := postManifest(context.Background(), server.URL, []byte(`{}`))
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unexpected status code 502")
+}
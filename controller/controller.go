@@ -4,18 +4,34 @@ import (
 	"context"
 	"fmt"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/go-redis/redis/v8"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
 	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
+	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
 	"strconv"
-	"sync"
+	"time"
 )
 
-// Controller is a function that is triggered by a message being published to the controller topic. It is triggered by the
-// splitter for each file partition sent to the Mapper and adds the partition's uuid to a set in Redis.
+// Controller is a function that is triggered by a message being published to the controller topic. It tracks the
+// progress of each job in Redis, namespaced by the job ID in the message attributes so that concurrent jobs don't affect
+// each other, and starts the reduce phase once every partition of the job has been shuffled.
 //
-// It is also triggered by the shuffler once a partition's key-value pairs have been added to the Redis instances and
-// the uuid for that partition is removed from the set in the controller's Redis instance. A message is then sent to the
-// reducer to start reducing the data in each Redis instance once the controller's Redis set cardinality is 0.
+// It is triggered by the starter with the number of files in the job, by the splitter with the number of partitions
+// each file has been split into and for each partition sent to the Mapper, and by the shuffler once a partition's
+// key-value pairs have been added to the Redis instances. Since pubsub doesn't guarantee the order messages are
+// delivered in, the reduce phase is only started once every file has reported how many partitions it has and all of
+// those partitions have finished, however the messages arrive. A message is then sent to the reducer to start reducing
+// the data in each Redis instance.
+//
+// Every message is recorded in sets and hashes keyed by the partition, file or output it is about, and the reduce phase
+// and the job's manifest are started by scripts that only run once per job, so redelivered messages are safe to
+// process again.
+//
+// It is also triggered by each reducer once it has written its output files to the job's temporary directory, and by
+// any function that fails, which aborts the job and deletes its temporary directory. Once every reducer has written its
+// output files, they are committed by promoting them to the job's output directory, merged into a single file sorted by
+// key if the job was started with merged output, and a _SUCCESS manifest is written to the output bucket and POSTed to
+// the callback URL provided when the job was started. The progress recorded is read by the Status function.
 func Controller(ctx context.Context, e event.Event) error {
 	r.InitSingleRedisClient()
 	// Create a new pubsub client
@@ -31,59 +47,227 @@ func Controller(ctx context.Context, e event.Event) error {
 	if err != nil {
 		return fmt.Errorf("error reading pubsub message: %v", err)
 	}
+	jobID := attributes["jobId"]
 	// We need to perform different actions depending on the status of the message
 	switch statusMessage.Status {
+	// If the status is "job-started", then we record the details of the job including the number of files
+	case pubsub.StatusJobStarted:
+		var outputOptions storage.OutputOptions
+		outputOptions, err = storage.OutputOptionsFromAttributes(attributes)
+		if err != nil {
+			return err
+		}
+		err = updateJobStatus(ctx, jobID, func(pipe redis.Pipeliner) {
+			pipe.HSet(ctx, r.JobStatusKey(jobID), "files", statusMessage.Count, "job", attributes["job"],
+				"inputBucket", attributes["inputBucket"], "outputBucket", attributes["outputBucket"],
+				"callbackUrl", attributes["callbackUrl"])
+			// Record the output options so that the output files can be merged once the job has finished
+			for name, value := range outputOptions.Attributes() {
+				pipe.HSet(ctx, r.JobStatusKey(jobID), name, value)
+			}
+			// Only set the start time and the number of reducers the job is reduced by once in case the message is
+			// redelivered
+			pipe.HSetNX(ctx, r.JobStatusKey(jobID), "startedAt", now())
+			pipe.HSetNX(ctx, r.JobStatusKey(jobID), "noOfReducers", r.NoOfReducerJobs)
+		})
+		if err != nil {
+			return fmt.Errorf("error recording job start in redis: %v", err)
+		}
+		// The rest of the job's messages may have arrived first, so check if the job is ready to be reduced
+		err = checkJobComplete(ctx, pubsubClient, attributes)
+		if err != nil {
+			return fmt.Errorf("error checking if job is complete: %v", err)
+		}
+	// If the status is "file-split", then we record the number of partitions the split of the file was split into, and
+	// the name of the file for the job's manifest
+	case pubsub.StatusFileSplit:
+		err = updateJobStatus(ctx, jobID, func(pipe redis.Pipeliner) {
+			pipe.HSet(ctx, r.FilePartitionsKey(jobID), statusMessage.ID, statusMessage.Count)
+			pipe.SAdd(ctx, r.InputsKey(jobID), statusMessage.FileName)
+		})
+		if err != nil {
+			return fmt.Errorf("error recording file split in redis: %v", err)
+		}
+		// All the file's partitions may have finished before this message arrived, so check if the job is ready to be
+		// reduced
+		err = checkJobComplete(ctx, pubsubClient, attributes)
+		if err != nil {
+			return fmt.Errorf("error checking if job is complete: %v", err)
+		}
 	// If the status is "started", then we add the partition uuid to the set in redis
 	case pubsub.StatusStarted:
-		// Use SADD to add the partition uuid to the 'started-processing' set in redis
-		res := r.SingleRedisClient.SAdd(ctx, "started-processing", statusMessage.ID)
-		if res.Err() != nil {
-			return fmt.Errorf("error pushing value to set in redis: %v", res.Err())
+		err = updateJobStatus(ctx, jobID, func(pipe redis.Pipeliner) {
+			// Use SADD to add the partition uuid to the job's 'started-processing' set in redis
+			pipe.SAdd(ctx, r.StartedProcessingKey(jobID), statusMessage.ID)
+		})
+		if err != nil {
+			return fmt.Errorf("error pushing value to set in redis: %v", err)
 		}
-	// If the status is "finished", then we remove the partition uuid from the set in redis, and check if the set is empty.
+	// If the status is "finished", then we add the partition uuid to the set of finished partitions in redis, and check
+	// if all the job's partitions have finished.
 	case pubsub.StatusFinished:
-		res := r.SingleRedisClient.SRem(ctx, "started-processing", statusMessage.ID)
-		if res.Err() != nil {
-			return fmt.Errorf("error removing value from set in redis: %v", res.Err())
+		err = finishPartition(ctx, jobID, statusMessage.FileName, statusMessage.ID)
+		if err != nil {
+			return fmt.Errorf("error recording partition finish in redis: %v", err)
+		}
+		// Check if all the partitions have finished, and start reducing if they have
+		err = checkJobComplete(ctx, pubsubClient, attributes)
+		if err != nil {
+			return fmt.Errorf("error checking if job is complete: %v", err)
+		}
+	// If the status is "reducer-finished", then we record that the reducer has finished, the output files written by
+	// the reducer and the number of records in each, and check if all the reducers have finished
+	case pubsub.StatusReducerFinished:
+		err = updateJobStatus(ctx, jobID, func(pipe redis.Pipeliner) {
+			finishedAt := now()
+			pipe.HSet(ctx, r.ReducersFinishedKey(jobID), statusMessage.ID, finishedAt)
+			for _, output := range statusMessage.Outputs {
+				pipe.HSet(ctx, r.OutputsKey(jobID), output.ObjectName, finishedAt)
+				pipe.HSet(ctx, r.OutputRecordsKey(jobID), output.ObjectName, output.Records)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("error recording reducer finish in redis: %v", err)
+		}
+		// Write the job's manifest and notify the callback URL if every reducer has finished
+		err = checkReducersFinished(ctx, jobID)
+		if err != nil {
+			return fmt.Errorf("error checking if reducers have finished: %v", err)
 		}
-		// Check if the set is empty, and start reducing if it is
-		err = checkSetCardinality(ctx, pubsubClient, attributes)
+	// If the status is "failed", then we record the error so that it can be reported, and abort the job so that none
+	// of its output files are committed
+	case pubsub.StatusFailed:
+		err = updateJobStatus(ctx, jobID, func(pipe redis.Pipeliner) {
+			pipe.HSet(ctx, r.JobStatusKey(jobID), "error", statusMessage.Error)
+		})
 		if err != nil {
-			return fmt.Errorf("error removing uuid from redis set: %v", err)
+			return fmt.Errorf("error recording failure in redis: %v", err)
+		}
+		err = abortJob(ctx, jobID)
+		if err != nil {
+			return fmt.Errorf("error aborting job: %v", err)
 		}
 	}
 	return nil
 }
 
-// checkSetCardinality checks the cardinality of the set in redis. If the set is empty, then it sends a message to the
-// reducer topic for each redis instance to start a reducing job on each
-func checkSetCardinality(ctx context.Context, client pubsub.Client, attributes map[string]string) error {
-	// Use SCARD to get the cardinality of the 'started-processing' set in redis
-	cardinality, err := r.SingleRedisClient.SCard(ctx, "started-processing").Result()
+// finishPartitionScript adds a partition to the set of finished partitions and, only if it wasn't already in the set,
+// increments the number of finished partitions for its file, so that the counts stay correct if the same partition is
+// reported more than once.
+var finishPartitionScript = redis.NewScript(`
+if redis.call('SADD', KEYS[1], ARGV[1]) == 1 then
+	redis.call('HINCRBY', KEYS[2], ARGV[2], 1)
+end
+return 0
+`)
+
+// finishPartition records that the given partition of the given file has finished being processed for the given job.
+func finishPartition(ctx context.Context, jobID, fileName, partitionID string) error {
+	keys := []string{r.FinishedPartitionsKey(jobID), r.FileFinishedPartitionsKey(jobID)}
+	if err := finishPartitionScript.Run(ctx, r.SingleRedisClient, keys, partitionID, fileName).Err(); err != nil {
+		return err
+	}
+	// Update the time the job was last updated and the TTL of its keys
+	return updateJobStatus(ctx, jobID, func(pipe redis.Pipeliner) {})
+}
+
+// updateJobStatus runs the given function to queue commands that update the progress of the given job in a
+// transaction. The time the job was last updated is set, and the job's keys are given a TTL, in the same transaction.
+func updateJobStatus(ctx context.Context, jobID string, update func(pipe redis.Pipeliner)) error {
+	_, err := r.SingleRedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		update(pipe)
+		pipe.HSet(ctx, r.JobStatusKey(jobID), "updatedAt", now())
+		for _, key := range jobKeys(jobID) {
+			pipe.Expire(ctx, key, r.IntermediateKeyTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// jobKeys returns all the keys that the controller uses to track the progress of the given job.
+func jobKeys(jobID string) []string {
+	return []string{
+		r.JobStatusKey(jobID),
+		r.StartedProcessingKey(jobID),
+		r.FinishedPartitionsKey(jobID),
+		r.FilePartitionsKey(jobID),
+		r.FileFinishedPartitionsKey(jobID),
+		r.InputsKey(jobID),
+		r.OutputsKey(jobID),
+		r.OutputRecordsKey(jobID),
+		r.ReducersFinishedKey(jobID),
+	}
+}
+
+// now returns the current time in UTC formatted as an RFC3339 string.
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// startReducePhaseScript checks whether a job is ready to be reduced, which is when the number of files in the job is
+// known, every file has reported the number of partitions it was split into, and that many partitions have finished. If
+// the job is ready and the reduce phase hasn't already been started, it records that the reduce phase has started and
+// returns 1, otherwise it returns 0. Running this as a script means that only one controller instance can start the
+// reduce phase for a job.
+var startReducePhaseScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], 'reducers') == 1 then
+	return 0
+end
+local files = tonumber(redis.call('HGET', KEYS[1], 'files'))
+if not files or redis.call('HLEN', KEYS[2]) < files then
+	return 0
+end
+local partitions = 0
+for _, count in ipairs(redis.call('HVALS', KEYS[2])) do
+	partitions = partitions + tonumber(count)
+end
+if redis.call('SCARD', KEYS[3]) < partitions then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'reducers', ARGV[1], 'reduceStartedAt', ARGV[2])
+return 1
+`)
+
+// checkJobComplete checks whether every partition of the job in the given attributes has finished. If they have, then
+// it sends a message to the reducer topic for each redis instance to start a reducing job on each, passing on the output
+// options in the attributes.
+func checkJobComplete(ctx context.Context, client pubsub.Client, attributes map[string]string) error {
+	jobID := attributes["jobId"]
+	outputOptions, err := storage.OutputOptionsFromAttributes(attributes)
 	if err != nil {
-		return fmt.Errorf("error checking if set is empty: %v", err)
+		return err
 	}
-	// If the set is empty, then we need to send messages to start generating the output files
-	if cardinality == int64(0) {
-		// Send a message to start a reducer job on each redis instance
-		var wg sync.WaitGroup
+	keys := []string{r.JobStatusKey(jobID), r.FilePartitionsKey(jobID), r.FinishedPartitionsKey(jobID)}
+	started, err := startReducePhaseScript.Run(ctx, r.SingleRedisClient, keys, r.NoOfReducerJobs, now()).Int()
+	if err != nil {
+		return fmt.Errorf("error checking if partitions have finished: %v", err)
+	}
+	// If all the partitions have finished, then we need to send messages to start generating the output files
+	if started == 1 {
+		// Publish a message to start a reducer job on each redis instance, without waiting for each one so that they
+		// are sent in batches
 		for i := 0; i < r.NoOfReducerJobs; i++ {
-			wg.Add(1)
-			// Send the messages to the reducer topic concurrently to improve performance
-			go func(i int) {
-				defer wg.Done()
-				// Create a copy of the attributes map so that we can add the redis instance number to the message
-				reducerAttributes := make(map[string]string)
-				for k, v := range attributes {
-					reducerAttributes[k] = v
-				}
-				reducerAttributes["redisNum"] = strconv.Itoa(i)
-				// Create a message to send to the reducer
-				client.SendPubSubMessage(pubsub.ReducerTopic, nil, reducerAttributes)
-			}(i)
+			// Create the attributes for the reducer, adding the redis instance number to the message
+			reducerAttributes := outputOptions.Attributes()
+			reducerAttributes["outputBucket"] = attributes["outputBucket"]
+			reducerAttributes["job"] = attributes["job"]
+			reducerAttributes["jobId"] = jobID
+			reducerAttributes["redisNum"] = strconv.Itoa(i)
+			client.PublishPubSubMessage(pubsub.ReducerTopic, nil, reducerAttributes)
 		}
 		// Wait for all the messages to be sent before returning
-		wg.Wait()
+		sendErr := client.Flush()
+		// If any of the messages couldn't be sent, then mark the reduce phase as not started so that it is started
+		// again when the message is redelivered. Any reducers that were started will skip their instance if they have
+		// already reduced it.
+		if sendErr != nil {
+			if err := r.SingleRedisClient.HDel(ctx, keys[0], "reducers", "reduceStartedAt").Err(); err != nil {
+				return fmt.Errorf("error sending message to reducer: %v, and error marking reduce phase as not "+
+					"started: %v", sendErr, err)
+			}
+			return fmt.Errorf("error sending message to reducer: %v", sendErr)
+		}
 	}
 	return nil
 }
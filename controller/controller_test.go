@@ -9,6 +9,8 @@ import (
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
 	"gitlab.com/cameron_w20/serverless-mapreduce/redis"
 	"gitlab.com/cameron_w20/serverless-mapreduce/test"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -30,7 +32,8 @@ func TestMapReduceController_StatusStarted(t *testing.T) {
 	}
 	message := pubsub.MessagePublishedData{
 		Message: pubsub.Message{
-			Data: statusMessageBytes,
+			Data:       statusMessageBytes,
+			Attributes: map[string]string{"jobId": "job-1"},
 		},
 	}
 
@@ -50,7 +53,7 @@ func TestMapReduceController_StatusStarted(t *testing.T) {
 	// Then
 	assert.Nil(t, err)
 
-	result := redis.SingleRedisClient.SMembers(context.Background(), "started-processing")
+	result := redis.SingleRedisClient.SMembers(context.Background(), redis.StartedProcessingKey("job-1"))
 	if result.Err() != nil {
 		t.Fatalf("Error getting data from redis: %v", result.Err())
 	}
@@ -63,34 +66,57 @@ func TestMapReduceController_StatusFinished(t *testing.T) {
 	defer teardown(t)
 	teardownRedis := test.SetupRedisTest(t)
 	defer teardownRedis(t)
-	statusMessage := pubsub.ControllerMessage{
-		ID:     "12345",
-		Status: pubsub.StatusFinished,
-	}
-	// Create a message
-	statusMessageBytes, err := json.Marshal(statusMessage)
-	if err != nil {
-		t.Fatalf("Error marshalling status message: %v", err)
-	}
-	message := pubsub.MessagePublishedData{
-		Message: pubsub.Message{
-			Data:       statusMessageBytes,
-			Attributes: map[string]string{"reducerNum": "0"},
-		},
-	}
+	e := createStatusFinishedEvent(t, "12345")
 
-	// Create a CloudEvent to be sent to the shuffler
-	e := event.New()
-	e.SetDataContentType("application/json")
-	err = e.SetData(e.DataContentType(), message)
+	redis.SingleRedisClient.HSet(context.Background(), redis.JobStatusKey("job-1"), "files", 1)
+	redis.SingleRedisClient.HSet(context.Background(), redis.FilePartitionsKey("job-1"), "test.txt", 2)
+	redis.SingleRedisClient.SAdd(context.Background(), redis.FinishedPartitionsKey("job-1"), "67890")
+	// Add a partition for another job which shouldn't stop the reducers from starting
+	redis.SingleRedisClient.HSet(context.Background(), redis.FilePartitionsKey("job-2"), "test.txt", 1)
+
+	// When
+	err := Controller(context.Background(), e)
+
+	// Then
+	assert.Nil(t, err)
+	// The subscription will listen forever unless given a context with a timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	reducerNums := make([]string, 0)
+	err = subscriptions[0].Receive(ctx, func(ctx context.Context, msg *ps.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "job-1", msg.Attributes["jobId"])
+		reducerNums = append(reducerNums, msg.Attributes["redisNum"])
+		msg.Ack()
+	})
+	// Ensure there are no errors returned by the receiver
+	assert.Nil(t, err)
+	// Ensure a reducer was started for each redis instance
+	assert.Len(t, reducerNums, redis.NoOfReducerJobs)
+
+	reducers, err := redis.SingleRedisClient.HGet(context.Background(), redis.JobStatusKey("job-1"), "reducers").Result()
 	if err != nil {
-		t.Fatalf("Error setting event data: %v", err)
+		t.Fatalf("Error getting data from redis: %v", err)
 	}
+	assert.Equal(t, strconv.Itoa(redis.NoOfReducerJobs), reducers)
+}
 
-	redis.SingleRedisClient.SAdd(context.Background(), "started-processing", "12345")
+func TestMapReduceController_StatusFinishedBeforeAllFilesSplit(t *testing.T) {
+	// Given
+	teardown, subscriptions := test.SetupPubSubTest(t, []string{pubsub.ReducerTopic})
+	defer teardown(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	e := createStatusFinishedEvent(t, "12345")
+
+	// The job has two files, but only one of them has been split so far
+	redis.SingleRedisClient.HSet(context.Background(), redis.JobStatusKey("job-1"), "files", 2)
+	redis.SingleRedisClient.HSet(context.Background(), redis.FilePartitionsKey("job-1"), "test.txt", 1)
 
 	// When
-	err = Controller(context.Background(), e)
+	err := Controller(context.Background(), e)
 
 	// Then
 	assert.Nil(t, err)
@@ -98,17 +124,47 @@ func TestMapReduceController_StatusFinished(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	err = subscriptions[0].Receive(ctx, func(ctx context.Context, msg *ps.Message) {
-		assert.NotNil(t, msg)
+		t.Errorf("Reducer started before all files were split")
 		msg.Ack()
 	})
 	// Ensure there are no errors returned by the receiver
 	assert.Nil(t, err)
 
-	cardinality, err := redis.SingleRedisClient.SCard(context.Background(), "started-processing").Result()
+	finished, err := redis.SingleRedisClient.SMembers(context.Background(), redis.FinishedPartitionsKey("job-1")).Result()
 	if err != nil {
 		t.Fatalf("Error getting data from redis: %v", err)
 	}
-	assert.Equal(t, int64(0), cardinality)
+	assert.Equal(t, []string{"12345"}, finished)
+}
+
+// createStatusFinishedEvent creates a CloudEvent containing a message from the shuffler saying that the partition with
+// the given ID of test.txt in job-1 has finished.
+func createStatusFinishedEvent(t *testing.T, partitionID string) event.Event {
+	statusMessage := pubsub.ControllerMessage{
+		ID:       partitionID,
+		Status:   pubsub.StatusFinished,
+		FileName: "test.txt",
+	}
+	// Create a message
+	statusMessageBytes, err := json.Marshal(statusMessage)
+	if err != nil {
+		t.Fatalf("Error marshalling status message: %v", err)
+	}
+	message := pubsub.MessagePublishedData{
+		Message: pubsub.Message{
+			Data:       statusMessageBytes,
+			Attributes: map[string]string{"jobId": "job-1", "outputBucket": test.OutputBucketName},
+		},
+	}
+
+	// Create a CloudEvent to be sent to the controller
+	e := event.New()
+	e.SetDataContentType("application/json")
+	err = e.SetData(e.DataContentType(), message)
+	if err != nil {
+		t.Fatalf("Error setting event data: %v", err)
+	}
+	return e
 }
 
 func TestMapReduceController_ReadPubSubMessageError(t *testing.T) {
@@ -175,3 +231,104 @@ func TestMapReduceController_CreatePubSubClientError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "error creating pubsub client")
 }
+
+func TestMapReduceController_StatusJobStarted(t *testing.T) {
+	// Given
+	teardown, _ := test.SetupPubSubTest(t, []string{pubsub.ReducerTopic})
+	defer teardown(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	statusMessage := pubsub.ControllerMessage{
+		ID:     "job-1",
+		Status: pubsub.StatusJobStarted,
+		Count:  3,
+	}
+	// Create a message
+	statusMessageBytes, err := json.Marshal(statusMessage)
+	if err != nil {
+		t.Fatalf("Error marshalling status message: %v", err)
+	}
+	message := pubsub.MessagePublishedData{
+		Message: pubsub.Message{
+			Data:       statusMessageBytes,
+			Attributes: map[string]string{"jobId": "job-1", "outputBucket": test.OutputBucketName},
+		},
+	}
+
+	// Create a CloudEvent to be sent to the controller
+	e := event.New()
+	e.SetDataContentType("application/json")
+	err = e.SetData(e.DataContentType(), message)
+	if err != nil {
+		t.Fatalf("Error setting event data: %v", err)
+	}
+
+	// When
+	err = Controller(context.Background(), e)
+
+	// Then
+	assert.Nil(t, err)
+	result, err := redis.SingleRedisClient.HGetAll(context.Background(), redis.JobStatusKey("job-1")).Result()
+	if err != nil {
+		t.Fatalf("Error getting data from redis: %v", err)
+	}
+	assert.Equal(t, "3", result["files"])
+	assert.Equal(t, test.OutputBucketName, result["outputBucket"])
+	assert.Equal(t, strconv.Itoa(redis.NoOfReducerJobs), result["noOfReducers"])
+	assert.NotEmpty(t, result["startedAt"])
+}
+
+func TestMapReduceController_StatusReducerFinished(t *testing.T) {
+	// Given
+	teardown, _ := test.SetupPubSubTest(t, []string{pubsub.ReducerTopic})
+	defer teardown(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	statusMessage := pubsub.ControllerMessage{
+		ID:      "1",
+		Status:  pubsub.StatusReducerFinished,
+		Count:   4,
+		Outputs: []pubsub.ReducerOutput{{ObjectName: "job-1/_temporary/anagrams-part-1.txt", Records: 4}},
+	}
+	// Create a message
+	statusMessageBytes, err := json.Marshal(statusMessage)
+	if err != nil {
+		t.Fatalf("Error marshalling status message: %v", err)
+	}
+	message := pubsub.MessagePublishedData{
+		Message: pubsub.Message{
+			Data:       statusMessageBytes,
+			Attributes: map[string]string{"jobId": "job-1"},
+		},
+	}
+
+	// Create a CloudEvent to be sent to the controller
+	e := event.New()
+	e.SetDataContentType("application/json")
+	err = e.SetData(e.DataContentType(), message)
+	if err != nil {
+		t.Fatalf("Error setting event data: %v", err)
+	}
+
+	// When
+	err = Controller(context.Background(), e)
+
+	// Then
+	assert.Nil(t, err)
+	result, err := redis.SingleRedisClient.HKeys(context.Background(), redis.OutputsKey("job-1")).Result()
+	if err != nil {
+		t.Fatalf("Error getting data from redis: %v", err)
+	}
+	assert.Equal(t, []string{"job-1/_temporary/anagrams-part-1.txt"}, result)
+	records, err := redis.SingleRedisClient.HGet(context.Background(), redis.OutputRecordsKey("job-1"),
+		"job-1/_temporary/anagrams-part-1.txt").Result()
+	if err != nil {
+		t.Fatalf("Error getting data from redis: %v", err)
+	}
+	assert.Equal(t, "4", records)
+	reducers, err := redis.SingleRedisClient.HKeys(context.Background(), redis.ReducersFinishedKey("job-1")).Result()
+	if err != nil {
+		t.Fatalf("Error getting data from redis: %v", err)
+	}
+	assert.Equal(t, []string{"1"}, reducers)
+}
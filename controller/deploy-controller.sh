@@ -26,7 +26,7 @@ REDIS_HOST=$(gcloud redis instances describe mapreduce-controller \
 echo "Deploying controller"
 if (gcloud functions deploy controller \
     --gen2 \
-    --runtime=go116 \
+    --runtime=go119 \
     --trigger-topic mapreduce-controller \
     --source=. \
     --entry-point Controller \
@@ -34,7 +34,7 @@ if (gcloud functions deploy controller \
     --memory=512MB \
     --project="$GCP_PROJECT" \
     --vpc-connector=projects/"$GCP_PROJECT"/locations/"$GCP_REGION"/connectors/mapreduce-connector \
-    --set-env-vars=REDIS_HOST="$REDIS_HOST",GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS"
+    --set-env-vars=REDIS_HOST="$REDIS_HOST",GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS",PUBSUB_CODEC="$PUBSUB_CODEC",PUBSUB_COMPRESSION="$PUBSUB_COMPRESSION"
     ) ; then
   echo "Successfully deployed controller"
 else
@@ -0,0 +1,33 @@
+#!/usr/bin/env bash
+
+# Read env file
+source .env
+
+# Check if gcloud is installed
+if ! [ -x "$(command -v gcloud)" ]; then
+  echo 'Error: gcloud is not installed.' >&2
+  exit 1
+fi
+
+REDIS_HOST=$(gcloud redis instances describe mapreduce-controller \
+              --region="$GCP_REGION" \
+              --format="value(host)")
+
+echo "Deploying status"
+if (gcloud functions deploy status \
+    --gen2 \
+    --runtime=go119 \
+    --trigger-http \
+    --source=. \
+    --entry-point Status \
+    --region="$GCP_REGION" \
+    --memory=256MB \
+    --project="$GCP_PROJECT" \
+    --vpc-connector=projects/"$GCP_PROJECT"/locations/"$GCP_REGION"/connectors/mapreduce-connector \
+    --set-env-vars=REDIS_HOST="$REDIS_HOST",GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS"
+    ) ; then
+  echo "Successfully deployed status"
+else
+  echo "Failed to deploy status"
+  exit 1
+fi
@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/cameron_w20/serverless-mapreduce/mapphase"
+	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// PhaseSplitting is the phase of a job when its files are being split.
+const PhaseSplitting = "splitting"
+
+// PhaseMapping is the phase of a job when its partitions are being mapped and combined.
+const PhaseMapping = "mapping"
+
+// PhaseShuffling is the phase of a job when its partitions are being shuffled into the Redis instances.
+const PhaseShuffling = "shuffling"
+
+// PhaseReducing is the phase of a job when the reducers have been started.
+const PhaseReducing = "reducing"
+
+// PhaseCommitting is the phase of a job when every reducer has written its output file, and the output files are being
+// committed.
+const PhaseCommitting = "committing"
+
+// PhaseDone is the phase of a job when its output files have been committed and its manifest has been written.
+const PhaseDone = "done"
+
+// PhaseFailed is the phase of a job when one of its functions has reported a failure, and the job has been aborted.
+const PhaseFailed = "failed"
+
+// StatusResponse is the response object sent to the client by the Status function. It has the same fields as
+// mapphase.Response, with the status of the job added.
+type StatusResponse struct {
+	mapphase.Response
+	Status *JobStatus `json:"status,omitempty"`
+}
+
+// JobStatus is the progress of a job. A large file that is read in byte ranges counts as one file per range.
+type JobStatus struct {
+	Phase        string   `json:"phase"`
+	Error        string   `json:"error,omitempty"`
+	OutputBucket string   `json:"outputBucket"`
+	Files        Progress `json:"files"`
+	Partitions   Progress `json:"partitions"`
+	Reducers     Progress `json:"reducers"`
+	Outputs      []Output `json:"outputs"`
+	StartedAt    string   `json:"startedAt,omitempty"`
+	FinishedAt   string   `json:"finishedAt,omitempty"`
+	UpdatedAt    string   `json:"updatedAt,omitempty"`
+}
+
+// Progress is the number of items of a job that there are in total, that have been started and that have finished.
+type Progress struct {
+	Total    int `json:"total"`
+	Started  int `json:"started"`
+	Finished int `json:"finished"`
+}
+
+// Output is an output file written by a reducer and the time it was written.
+type Output struct {
+	ObjectName string `json:"objectName"`
+	WrittenAt  string `json:"writtenAt"`
+}
+
+// Status is a function triggered by an HTTP request which reports the progress of a job from the state recorded in
+// Redis by the controller. The function requires one query parameter:
+// job-id: the ID of the job returned by the starter
+func Status(w http.ResponseWriter, req *http.Request) {
+	r.InitSingleRedisClient()
+	ctx := req.Context()
+	jobID := req.URL.Query().Get("job-id")
+	if jobID == "" {
+		writeStatusResponse(w, http.StatusBadRequest, "No job ID provided, please provide one using the query parameter 'job-id'", "", nil)
+		return
+	}
+	status, err := readJobStatus(ctx, jobID)
+	if err != nil {
+		writeStatusResponse(w, http.StatusInternalServerError, err.Error(), jobID, nil)
+		return
+	}
+	if status == nil {
+		writeStatusResponse(w, http.StatusNotFound, "No job found with ID: "+jobID, jobID, nil)
+		return
+	}
+	writeStatusResponse(w, http.StatusOK, "Job is "+status.Phase, jobID, status)
+}
+
+// readJobStatus reads the progress of the given job from Redis. It returns nil if no progress has been recorded for the
+// job.
+func readJobStatus(ctx context.Context, jobID string) (*JobStatus, error) {
+	fields, err := r.SingleRedisClient.HGetAll(ctx, r.JobStatusKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading job status from redis: %v", err)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	filePartitions, err := r.SingleRedisClient.HGetAll(ctx, r.FilePartitionsKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading file partitions from redis: %v", err)
+	}
+	fileFinishedPartitions, err := r.SingleRedisClient.HGetAll(ctx, r.FileFinishedPartitionsKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading file finished partitions from redis: %v", err)
+	}
+	partitionsStarted, err := r.SingleRedisClient.SCard(ctx, r.StartedProcessingKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading started partitions from redis: %v", err)
+	}
+	partitionsFinished, err := r.SingleRedisClient.SCard(ctx, r.FinishedPartitionsKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading finished partitions from redis: %v", err)
+	}
+	reducersFinished, err := r.SingleRedisClient.HLen(ctx, r.ReducersFinishedKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading finished reducers from redis: %v", err)
+	}
+	outputs, err := r.SingleRedisClient.HGetAll(ctx, r.OutputsKey(jobID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading outputs from redis: %v", err)
+	}
+	// Jobs started before the number of reducers was recorded report the number this function is configured with
+	reducersTotal := r.NoOfReducerJobs
+	if noOfReducers, ok := fields["noOfReducers"]; ok {
+		reducersTotal = atoi(noOfReducers)
+	}
+	status := &JobStatus{
+		Error:        fields["error"],
+		OutputBucket: fields["outputBucket"],
+		Files: Progress{
+			Total:   atoi(fields["files"]),
+			Started: len(filePartitions),
+		},
+		Partitions: Progress{
+			Started:  int(partitionsStarted),
+			Finished: int(partitionsFinished),
+		},
+		Reducers: Progress{
+			Total:    reducersTotal,
+			Started:  atoi(fields["reducers"]),
+			Finished: int(reducersFinished),
+		},
+		Outputs:    make([]Output, 0, len(outputs)),
+		StartedAt:  fields["startedAt"],
+		FinishedAt: fields["finishedAt"],
+		UpdatedAt:  fields["updatedAt"],
+	}
+	// The total number of partitions is known once each file has been split, and a file has finished once all of its
+	// partitions have finished
+	for fileName, partitions := range filePartitions {
+		status.Partitions.Total += atoi(partitions)
+		if atoi(fileFinishedPartitions[fileName]) >= atoi(partitions) {
+			status.Files.Finished++
+		}
+	}
+	for objectName, writtenAt := range outputs {
+		status.Outputs = append(status.Outputs, Output{ObjectName: objectName, WrittenAt: writtenAt})
+	}
+	sort.Slice(status.Outputs, func(i, j int) bool {
+		return status.Outputs[i].ObjectName < status.Outputs[j].ObjectName
+	})
+	status.Phase = phase(status)
+	return status, nil
+}
+
+// phase works out the phase of a job from its progress. A job that has failed is reported as failed whatever its
+// progress, and a job is only done once it has been committed.
+func phase(status *JobStatus) string {
+	switch {
+	case status.Error != "":
+		return PhaseFailed
+	case status.FinishedAt != "":
+		return PhaseDone
+	case status.Reducers.Started > 0 && status.Reducers.Finished >= status.Reducers.Started:
+		return PhaseCommitting
+	case status.Reducers.Started > 0:
+		return PhaseReducing
+	case status.Partitions.Finished > 0:
+		return PhaseShuffling
+	case status.Partitions.Started > 0:
+		return PhaseMapping
+	default:
+		return PhaseSplitting
+	}
+}
+
+// atoi converts a field read from Redis to an int, treating a missing or invalid field as 0.
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
+
+// writeStatusResponse writes the response to the client
+func writeStatusResponse(w http.ResponseWriter, code int, message, jobID string, status *JobStatus) {
+	// Create a response object
+	responseMsg := StatusResponse{
+		Response: mapphase.Response{
+			ResponseCode: code,
+			Message:      message,
+			JobID:        jobID,
+		},
+		Status: status,
+	}
+	// Convert the response object to JSON
+	responseMsgBytes, err := json.Marshal(responseMsg)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// Write the response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(responseMsgBytes)
+}
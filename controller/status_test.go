@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/cameron_w20/serverless-mapreduce/redis"
+	"gitlab.com/cameron_w20/serverless-mapreduce/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	// Given
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	ctx := context.Background()
+	// The job is reduced by a different number of reducers than the status function is configured with
+	redis.SingleRedisClient.HSet(ctx, redis.JobStatusKey("job-1"), "files", 3, "outputBucket",
+		test.OutputBucketName, "noOfReducers", 3, "reducers", 3, "startedAt", "2022-11-01T12:00:00Z", "updatedAt",
+		"2022-11-01T12:00:10Z")
+	redis.SingleRedisClient.HSet(ctx, redis.FilePartitionsKey("job-1"), "book-1.txt", 1, "book-2.txt", 2)
+	redis.SingleRedisClient.HSet(ctx, redis.FileFinishedPartitionsKey("job-1"), "book-1.txt", 1, "book-2.txt", 1)
+	redis.SingleRedisClient.SAdd(ctx, redis.StartedProcessingKey("job-1"), "p1", "p2", "p3")
+	redis.SingleRedisClient.SAdd(ctx, redis.FinishedPartitionsKey("job-1"), "p1", "p2")
+	redis.SingleRedisClient.HSet(ctx, redis.ReducersFinishedKey("job-1"), "0", "2022-11-01T12:00:08Z", "1",
+		"2022-11-01T12:00:09Z")
+	redis.SingleRedisClient.HSet(ctx, redis.OutputsKey("job-1"), "job-1/anagrams-part-1.txt", "2022-11-01T12:00:09Z",
+		"job-1/anagrams-part-0.txt", "2022-11-01T12:00:08Z")
+	req := httptest.NewRequest(http.MethodGet, "https://someurl.com?job-id=job-1", nil)
+	rec := httptest.NewRecorder()
+
+	expectedStatus := JobStatus{
+		Phase:        PhaseReducing,
+		OutputBucket: test.OutputBucketName,
+		Files:        Progress{Total: 3, Started: 2, Finished: 1},
+		Partitions:   Progress{Total: 3, Started: 3, Finished: 2},
+		Reducers:     Progress{Total: 3, Started: 3, Finished: 2},
+		Outputs: []Output{
+			{ObjectName: "job-1/anagrams-part-0.txt", WrittenAt: "2022-11-01T12:00:08Z"},
+			{ObjectName: "job-1/anagrams-part-1.txt", WrittenAt: "2022-11-01T12:00:09Z"},
+		},
+		StartedAt: "2022-11-01T12:00:00Z",
+		UpdatedAt: "2022-11-01T12:00:10Z",
+	}
+
+	// When
+	Status(rec, req)
+
+	// Then
+	require.Equal(t, http.StatusOK, rec.Code)
+	var actualResponse StatusResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &actualResponse))
+	require.NotNil(t, actualResponse.Status)
+	assert.Equal(t, http.StatusOK, actualResponse.ResponseCode)
+	assert.Equal(t, "job-1", actualResponse.JobID)
+	assert.Equal(t, expectedStatus, *actualResponse.Status)
+}
+
+func TestStatus_JobNotFoundError(t *testing.T) {
+	// Given
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	req := httptest.NewRequest(http.MethodGet, "https://someurl.com?job-id=job-1", nil)
+	rec := httptest.NewRecorder()
+
+	expectedResponse := `{"responseCode":404,"message":"No job found with ID: job-1","jobId":"job-1"}`
+
+	// When
+	Status(rec, req)
+
+	// Then
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, expectedResponse, rec.Body.String())
+}
+
+func TestStatus_NoJobIDProvidedError(t *testing.T) {
+	// Given
+	req := httptest.NewRequest(http.MethodGet, "https://someurl.com", nil)
+	rec := httptest.NewRecorder()
+
+	expectedResponse := `{"responseCode":400,"message":"No job ID provided, please provide one using the query parameter 'job-id'"}`
+
+	// When
+	Status(rec, req)
+
+	// Then
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, expectedResponse, rec.Body.String())
+}
+
+func TestPhase(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   JobStatus
+		expected string
+	}{
+		{"splitting", JobStatus{}, PhaseSplitting},
+		{"mapping", JobStatus{Partitions: Progress{Started: 2}}, PhaseMapping},
+		{"shuffling", JobStatus{Partitions: Progress{Started: 2, Finished: 1}}, PhaseShuffling},
+		{"reducing", JobStatus{Reducers: Progress{Started: 5, Finished: 4}}, PhaseReducing},
+		{"committing", JobStatus{Reducers: Progress{Started: 5, Finished: 5}}, PhaseCommitting},
+		{"done", JobStatus{Reducers: Progress{Started: 5, Finished: 5}, FinishedAt: "2022-11-01T12:00:19Z"}, PhaseDone},
+		{"failed", JobStatus{Error: "error splitting file", Partitions: Progress{Started: 2}}, PhaseFailed},
+		// A job that fails after every reducer has finished is aborted before it is committed
+		{"failedAfterReducing", JobStatus{Error: "error reducing partition", Reducers: Progress{Started: 5, Finished: 5}},
+			PhaseFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			actual := phase(&tt.status)
+
+			// Then
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 func init() {
 	// Register all the functions
 	functions.HTTP("Starter", mapphase.StartMapReduce)
+	functions.HTTP("Status", controller.Status)
 	functions.CloudEvent("Controller", controller.Controller)
 	functions.CloudEvent("Splitter", mapphase.Splitter)
 	functions.CloudEvent("Mapper", mapphase.Mapper)
@@ -0,0 +1,165 @@
+package job
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// AnagramJobName is the name that the anagram job is registered under.
+const AnagramJobName = "anagrams"
+
+func init() {
+	Register(AnagramJobName, Anagram{})
+}
+
+// Anagram is a Job that finds the sets of words in the input text that are anagrams of each other. Each word is mapped
+// to its letters in alphabetical order, so all the anagrams of a word share the same key.
+type Anagram struct{}
+
+var _ Job = Anagram{}
+
+var _ Combiner = Anagram{}
+
+// Map splits the line into words, and returns a key-value pair of the sorted word and the pre-processed word for each
+// word in the line. The words are lowercased so that the same word is always mapped to the same value. If a word is
+// empty after pre-processing, it is discounted.
+func (Anagram) Map(record string) []KeyValue {
+	var keyValues []KeyValue
+	for _, word := range strings.Fields(strings.ToLower(record)) {
+		// Do some preprocessing on the word
+		preProcessedWord := preProcessWord(word)
+		// If the word is empty after preprocessing, skip it
+		if preProcessedWord == "" {
+			continue
+		}
+		// sort string into alphabetical order
+		splitWord := strings.Split(preProcessedWord, "")
+		sort.Strings(splitWord)
+		sortedWord := strings.Join(splitWord, "")
+		keyValues = append(keyValues, KeyValue{Key: sortedWord, Value: preProcessedWord})
+	}
+	return keyValues
+}
+
+// Combine removes any duplicate anagrams of the key in a partition, so that each anagram is only sent to the reducer
+// once per partition however many times it appears in the text.
+func (Anagram) Combine(key string, values []string) []string {
+	combinedAnagrams := reduceAnagrams(values)
+	sort.Strings(combinedAnagrams)
+	return combinedAnagrams
+}
+
+// Reduce removes any duplicate anagrams and sorts the remaining anagrams alphabetically. The key is only written to
+// the output if there is more than one anagram in the set.
+func (Anagram) Reduce(key string, values []string) ([]string, bool) {
+	// Remove any duplicate anagrams in the slice
+	reducedAnagrams := reduceAnagrams(values)
+	// Only write to the file if the key has more than one anagram
+	if len(reducedAnagrams) <= 1 {
+		return nil, false
+	}
+	// Sort the anagrams alphabetically
+	sort.Strings(reducedAnagrams)
+	return reducedAnagrams, true
+}
+
+// KeyCodec returns a StringCodec since the sorted words are sent as they are.
+func (Anagram) KeyCodec() Codec {
+	return StringCodec{}
+}
+
+// ValueCodec returns a StringCodec since the anagrams are sent as they are.
+func (Anagram) ValueCodec() Codec {
+	return StringCodec{}
+}
+
+// reduceAnagrams removes any duplicate anagrams from the slice by converting it to a map and then back to a slice
+func reduceAnagrams(values []string) []string {
+	var reducedAnagrams []string
+	// Create a map to ignore duplicate anagrams
+	var anagramMap = make(map[string]struct{})
+	// Loop through each anagram and add it to the map
+	for _, value := range values {
+		anagramMap[value] = struct{}{}
+	}
+	// Convert the map back to a slice
+	for key := range anagramMap {
+		reducedAnagrams = append(reducedAnagrams, key)
+	}
+	return reducedAnagrams
+}
+
+// preProcessWord receives a lowercase word and strips any non-alphabetic characters from the start and end of the word.
+// If the word is a stop word, or still contains any non-alphabetic characters, it returns an empty string. Otherwise,
+// it returns the pre-processed word.
+func preProcessWord(word string) string {
+	// Use a map to replicate the functionality of a set since Go doesn't have a set data structure
+	stopwords := map[string]struct{}{"'tis": {}, "'twas": {}, "a": {}, "able": {}, "about": {}, "across": {},
+		"after": {}, "ain't": {}, "all": {}, "almost": {}, "also": {}, "am": {}, "among": {}, "an": {}, "and": {},
+		"any": {}, "are": {}, "aren't": {}, "as": {}, "at": {}, "be": {}, "because": {}, "been": {}, "but": {},
+		"by": {}, "can": {}, "can't": {}, "cannot": {}, "could": {}, "could've": {}, "couldn't": {}, "dear": {},
+		"did": {}, "didn't": {}, "do": {}, "does": {}, "doesn't": {}, "don't": {}, "either": {}, "else": {}, "ever": {},
+		"every": {}, "for": {}, "from": {}, "get": {}, "got": {}, "had": {}, "has": {}, "hasn't": {}, "have": {},
+		"he": {}, "he'd": {}, "he'll": {}, "he's": {}, "her": {}, "hers": {}, "him": {}, "his": {}, "how": {},
+		"how'd": {}, "how'll": {}, "how's": {}, "however": {}, "i": {}, "i'd": {}, "i'll": {}, "i'm": {}, "i've": {},
+		"if": {}, "in": {}, "into": {}, "is": {}, "isn't": {}, "it": {}, "it's": {}, "its": {}, "just": {}, "least": {},
+		"let": {}, "like": {}, "likely": {}, "may": {}, "me": {}, "might": {}, "might've": {}, "mightn't": {},
+		"most": {}, "must": {}, "must've": {}, "mustn't": {}, "my": {}, "neither": {}, "no": {}, "nor": {}, "not": {},
+		"of": {}, "off": {}, "often": {}, "on": {}, "only": {}, "or": {}, "other": {}, "our": {}, "own": {},
+		"rather": {}, "said": {}, "say": {}, "says": {}, "shan't": {}, "she": {}, "she'd": {}, "she'll": {},
+		"she's": {}, "should": {}, "should've": {}, "shouldn't": {}, "since": {}, "so": {}, "some": {}, "than": {},
+		"that": {}, "that'll": {}, "that's": {}, "the": {}, "their": {}, "them": {}, "then": {}, "there": {},
+		"there's": {}, "these": {}, "they": {}, "they'd": {}, "they'll": {}, "they're": {}, "they've": {}, "this": {},
+		"tis": {}, "to": {}, "too": {}, "twas": {}, "us": {}, "wants": {}, "was": {}, "wasn't": {}, "we": {},
+		"we'd": {}, "we'll": {}, "we're": {}, "were": {}, "weren't": {}, "what": {}, "what'd": {}, "what's": {},
+		"when": {}, "when'd": {}, "when'll": {}, "when's": {}, "where": {}, "where'd": {}, "where'll": {},
+		"where's": {}, "which": {}, "while": {}, "who": {}, "who'd": {}, "who'll": {}, "who's": {}, "whom": {},
+		"why": {}, "why'd": {}, "why'll": {}, "why's": {}, "will": {}, "with": {}, "won't": {}, "would": {},
+		"would've": {}, "wouldn't": {}, "yet": {}, "you": {}, "you'd": {}, "you'll": {}, "you're": {}, "you've": {},
+		"your": {},
+	}
+	// Remove any non-Unicode letters from the start and end of the word
+	word = trimNonAlphabeticCharacters(word)
+	// Remove the word if it is a stop-word, or contains non-Unicode letters
+	if _, ok := stopwords[word]; ok || !containsOnlyLetters(word) {
+		return ""
+	}
+	return word
+}
+
+// trimNonAlphabeticCharacters receives a string and removes any non-Unicode letters from the start and end of the string.
+func trimNonAlphabeticCharacters(word string) string {
+	// Convert the string to a rune slice
+	chars := []rune(word)
+	// Trim non-alphabetic characters from the start of the word
+	for i := 0; i < len(chars)-1; i++ {
+		// If the character is a letter, slice the word from the start of the word to the current index then break
+		if unicode.IsLetter(chars[i]) {
+			chars = chars[i:]
+			break
+		}
+	}
+	// Trim non-alphabetic characters from the end of the word
+	for i := len(chars) - 1; i >= 0; i-- {
+		// If the character is a letter, slice the word from the current index to the end of the word then break
+		if unicode.IsLetter(chars[i]) {
+			chars = chars[:i+1]
+			break
+		}
+	}
+	// Convert the rune slice back to a string and return it
+	return string(chars)
+}
+
+// containsOnlyLetters returns true if the string contains only alphabetic characters, and false otherwise.
+func containsOnlyLetters(word string) bool {
+	// Loop through each character in the word
+	for _, char := range word {
+		// If the character is not an alphabetic character, return false
+		if !unicode.IsLetter(char) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package job
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAnagramMap(t *testing.T) {
+	// Given
+	inputText := "Race, the CARE\trace"
+	expectedResult := []KeyValue{{Key: "acer", Value: "race"}, {Key: "acer", Value: "care"},
+		{Key: "acer", Value: "race"}}
+
+	// When
+	actualResult := Anagram{}.Map(inputText)
+
+	// Then
+	assert.Equal(t, expectedResult, actualResult)
+}
+
+func TestAnagramMap_StopWord(t *testing.T) {
+	// Given
+	inputText := "the"
+
+	// When
+	actualResult := Anagram{}.Map(inputText)
+
+	// Then
+	assert.Empty(t, actualResult)
+}
+
+func TestAnagramCombine(t *testing.T) {
+	// Given
+	inputData := []string{"care", "race", "race"}
+
+	// When
+	actualResult := Anagram{}.Combine("acer", inputData)
+
+	// Then
+	assert.Equal(t, []string{"care", "race"}, actualResult)
+}
+
+func TestAnagramReduce(t *testing.T) {
+	// Given
+	inputData := []string{"race", "race", "care", "race"}
+	expectedResult := []string{"care", "race"}
+
+	// When
+	actualResult, ok := Anagram{}.Reduce("acer", inputData)
+
+	// Then
+	assert.True(t, ok)
+	assert.Equal(t, expectedResult, actualResult)
+}
+
+func TestAnagramReduce_SingleAnagram(t *testing.T) {
+	// Given
+	inputData := []string{"part", "part"}
+
+	// When
+	actualResult, ok := Anagram{}.Reduce("aprt", inputData)
+
+	// Then
+	assert.False(t, ok)
+	assert.Nil(t, actualResult)
+}
+
+func TestProcessText(t *testing.T) {
+	// Given
+	inputText := "teststring."
+	expectedResult := "teststring"
+
+	// When
+	actualResult := preProcessWord(inputText)
+
+	// Then
+	assert.Equal(t, expectedResult, actualResult)
+}
+
+func TestProcessTextNumber(t *testing.T) {
+	// Given
+	inputText := "test1string"
+	expectedResult := ""
+
+	// When
+	actualResult := preProcessWord(inputText)
+
+	// Then
+	assert.Equal(t, expectedResult, actualResult)
+}
+
+func TestProcessTextStopWord(t *testing.T) {
+	// Given
+	inputText := "would've"
+	expectedResult := ""
+
+	// When
+	actualResult := preProcessWord(inputText)
+
+	// Then
+	assert.Equal(t, expectedResult, actualResult)
+}
+
+func TestTrimNonAlphabetic(t *testing.T) {
+	// Given
+	inputText := ";'.[]/,'][çteststringç];/];];/'"
+	expectedResult := "çteststringç"
+
+	// When
+	actualResult := trimNonAlphabeticCharacters(inputText)
+
+	// Then
+	assert.Equal(t, expectedResult, actualResult)
+}
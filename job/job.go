@@ -0,0 +1,125 @@
+package job
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultJobName is the name of the job that is run when no job name is provided when starting the MapReduce.
+const DefaultJobName = AnagramJobName
+
+// KeyValue is a single key-value pair emitted by the map function of a Job.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Job is an interface for a MapReduce workload that can be run by the deployed functions. The functions handle the
+// splitting, shuffling and storage of the data, and call into the Job to map each record, reduce the values for each
+// key and encode the keys and values sent between the functions.
+//
+// The values for a key are kept as a list, so a Job receives every value emitted for a key, including duplicates,
+// unless its Combiner removes them.
+type Job interface {
+	// Map receives a single record of the input, which is a line of the text without its line ending, and returns the
+	// key-value pairs for it. Returning no key-value pairs discounts the record.
+	Map(record string) []KeyValue
+	// Reduce receives a key and all the values that were emitted for it, and returns the values that should be written
+	// to the output for that key. If the boolean returned is false, the key is not written to the output.
+	Reduce(key string, values []string) ([]string, bool)
+	// KeyCodec returns the codec used to encode keys in messages and Redis.
+	KeyCodec() Codec
+	// ValueCodec returns the codec used to encode values in messages and Redis.
+	ValueCodec() Codec
+}
+
+// Combiner is an optional interface that can be implemented by a Job to do a mini-reduce of the values for a key at
+// the end of the map phase. If a Job doesn't implement it, the combiner only groups the values by key.
+type Combiner interface {
+	// Combine receives a key and the values for the key in a single partition, and returns the values that should be
+	// sent on to the shuffler.
+	Combine(key string, values []string) []string
+}
+
+// Codec is an interface for encoding keys and values into the strings that are sent between the functions and stored
+// in Redis, and decoding them again.
+type Codec interface {
+	Encode(value string) string
+	Decode(data string) (string, error)
+}
+
+// StringCodec is a Codec that leaves strings unchanged.
+type StringCodec struct{}
+
+var _ Codec = StringCodec{}
+
+// Encode returns the given string unchanged.
+func (StringCodec) Encode(value string) string {
+	return value
+}
+
+// Decode returns the given string unchanged.
+func (StringCodec) Decode(data string) (string, error) {
+	return data, nil
+}
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]Job)
+)
+
+// Register makes a Job available to the functions under the given name. It panics if the name is empty, the Job is
+// nil or a Job has already been registered with the name.
+func Register(name string, j Job) {
+	mu.Lock()
+	defer mu.Unlock()
+	if name == "" {
+		panic("job: Register job with empty name")
+	}
+	if j == nil {
+		panic("job: Register job is nil")
+	}
+	if _, ok := registry[name]; ok {
+		panic("job: Register called twice for job " + name)
+	}
+	registry[name] = j
+}
+
+// Get returns the Job registered with the given name or an error if no Job has been registered with the name.
+func Get(name string) (Job, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	j, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("no job registered with name: %s", name)
+	}
+	return j, nil
+}
+
+// Names returns the sorted names of all the registered jobs.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NameFromAttributes returns the name of the job in the given message attributes, or the DefaultJobName if the
+// attributes don't contain one.
+func NameFromAttributes(attributes map[string]string) string {
+	if name := attributes["job"]; name != "" {
+		return name
+	}
+	return DefaultJobName
+}
+
+// FromAttributes returns the Job named in the given message attributes, or the default Job if the attributes don't
+// contain a job name.
+func FromAttributes(attributes map[string]string) (Job, error) {
+	return Get(NameFromAttributes(attributes))
+}
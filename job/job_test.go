@@ -0,0 +1,54 @@
+package job
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	// When
+	j, err := Get(AnagramJobName)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, Anagram{}, j)
+}
+
+func TestGet_UnknownJobError(t *testing.T) {
+	// When
+	j, err := Get("unknown")
+
+	// Then
+	assert.Nil(t, j)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no job registered with name: unknown")
+}
+
+func TestRegister_DuplicateNamePanics(t *testing.T) {
+	// When
+	register := func() { Register(AnagramJobName, Anagram{}) }
+
+	// Then
+	assert.Panics(t, register)
+}
+
+func TestFromAttributes_DefaultJob(t *testing.T) {
+	// When
+	j, err := FromAttributes(map[string]string{})
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, Anagram{}, j)
+}
+
+func TestStringCodec(t *testing.T) {
+	// Given
+	codec := StringCodec{}
+
+	// When
+	decoded, err := codec.Decode(codec.Encode("word"))
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, "word", decoded)
+}
@@ -2,15 +2,23 @@ package mapphase
 
 import (
 	"context"
+	"fmt"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"gitlab.com/cameron_w20/serverless-mapreduce/job"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
+	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
+	"log"
+	"sort"
 )
 
 // Combine is a function that is triggered by a message being published to the Combine topic. It receives the list of
-// key-value pairs from the mapper, and does a mini-reduce to group the key-value pairs by key by adding each key-value
-// pair in the partition to a map. It requires the message data to be of type []MappedWord. It then converts the map to a
-// slice of MappedWord and sends the slice to the Shuffler topic.
+// key-value pairs from the mapper, and does a mini-reduce to group the key-value pairs by key by appending the values
+// of each key-value pair in the partition to the list of values for its key. It requires the message data to be of type
+// []KeyValues. If the job named in the message attributes implements job.Combiner, the grouped values for each key are
+// then combined by the job. It then sends the grouped key-value pairs to the Shuffler topic. A dedupe record is written
+// to Redis once the partition has been combined, so that a redelivered message isn't combined again.
 func Combine(ctx context.Context, e event.Event) error {
+	r.InitSingleRedisClient()
 	// Create a new pubsub client
 	pubsubClient, err := pubsub.New(ctx, e)
 	if err != nil {
@@ -19,29 +27,86 @@ func Combine(ctx context.Context, e event.Event) error {
 	defer pubsubClient.Close()
 
 	// Read the data from the event i.e. message pushed from mapper
-	var wordData []pubsub.MappedWord
-	attributes, err := pubsubClient.ReadPubSubMessage(&wordData)
+	var keyValues []pubsub.KeyValues
+	attributes, err := pubsubClient.ReadPubSubMessage(&keyValues)
 	if err != nil {
 		return err
 	}
-	// Use map[string]struct{} as the value to act as a set to not consider duplicate words
-	combinedWordDataMap := make(map[string]map[string]struct{})
+	// Don't combine the partition again if a previous delivery of the message has already combined it
+	processedKey := r.ProcessedKey(attributes["jobId"], "combiner", attributes["partitionId"])
+	_, processed, err := r.Processed(ctx, r.SingleRedisClient, processedKey)
+	if err != nil {
+		return err
+	}
+	if processed {
+		log.Printf("Partition %s has already been combined, skipping", attributes["partitionId"])
+		return nil
+	}
+	// Get the job that the key-value pairs were mapped by
+	j, err := job.FromAttributes(attributes)
+	if err != nil {
+		return err
+	}
+	combinedKeyValues, err := combineKeyValues(j, keyValues)
+	if err != nil {
+		return err
+	}
+	// Send the combined key-value pairs to the Shuffler topic
+	err = pubsubClient.SendPubSubMessage(pubsub.ShufflerTopic, combinedKeyValues, attributes)
+	if err != nil {
+		return fmt.Errorf("error sending combined key-value pairs to shuffler: %v", err)
+	}
+	return r.MarkProcessed(ctx, r.SingleRedisClient, processedKey, 1)
+}
+
+// combineKeyValues groups the given key-value pairs by key, keeping every value of each key including duplicates, and
+// combines the values for each key if the given job implements job.Combiner. The keys are returned in sorted order.
+func combineKeyValues(j job.Job, keyValues []pubsub.KeyValues) ([]pubsub.KeyValues, error) {
 	// Add each key-value pair to the map and group the values by key
-	for _, pair := range wordData {
-		if combinedWordDataMap[pair.SortedWord] == nil {
-			combinedWordDataMap[pair.SortedWord] = pair.Anagrams
-		} else {
-			for k, v := range pair.Anagrams {
-				combinedWordDataMap[pair.SortedWord][k] = v
-			}
+	groupedValues := make(map[string][]string)
+	for _, pair := range keyValues {
+		groupedValues[pair.Key] = append(groupedValues[pair.Key], pair.Values...)
+	}
+	// Let the job combine the values for each key if it can
+	if combiner, ok := j.(job.Combiner); ok {
+		if err := combineValues(j, combiner, groupedValues); err != nil {
+			return nil, err
 		}
 	}
-	// Convert the map to a slice of WordData
-	combinedKeyValues := make([]pubsub.MappedWord, 0)
-	for k, v := range combinedWordDataMap {
-		combinedKeyValues = append(combinedKeyValues, pubsub.MappedWord{SortedWord: k, Anagrams: v})
+	// Convert the map to a slice of KeyValues in order of their keys
+	combinedKeyValues := make([]pubsub.KeyValues, 0, len(groupedValues))
+	for k, v := range groupedValues {
+		combinedKeyValues = append(combinedKeyValues, pubsub.KeyValues{Key: k, Values: v})
+	}
+	sort.Slice(combinedKeyValues, func(i, j int) bool {
+		return combinedKeyValues[i].Key < combinedKeyValues[j].Key
+	})
+	return combinedKeyValues, nil
+}
+
+// combineValues decodes the values for each key in the given map, combines them using the given combiner and replaces
+// the values in the map with the encoded result. It returns an error if a key or value can't be decoded.
+func combineValues(j job.Job, combiner job.Combiner, groupedValues map[string][]string) error {
+	for encodedKey, encodedValues := range groupedValues {
+		key, err := j.KeyCodec().Decode(encodedKey)
+		if err != nil {
+			return fmt.Errorf("error decoding key %s: %v", encodedKey, err)
+		}
+		values := make([]string, 0, len(encodedValues))
+		for _, encodedValue := range encodedValues {
+			value, err := j.ValueCodec().Decode(encodedValue)
+			if err != nil {
+				return fmt.Errorf("error decoding value %s: %v", encodedValue, err)
+			}
+			values = append(values, value)
+		}
+		// Sort the values so the combiner always receives them in the same order
+		sort.Strings(values)
+		combinedValues := make([]string, 0, len(values))
+		for _, value := range combiner.Combine(key, values) {
+			combinedValues = append(combinedValues, j.ValueCodec().Encode(value))
+		}
+		groupedValues[encodedKey] = combinedValues
 	}
-	// Send the combined key-value pairs to the Shuffler topic
-	pubsubClient.SendPubSubMessage(pubsub.ShufflerTopic, combinedKeyValues, attributes)
 	return nil
 }
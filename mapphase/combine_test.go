@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"github.com/cloudevents/sdk-go/v2/event"
 	"github.com/stretchr/testify/assert"
+	"gitlab.com/cameron_w20/serverless-mapreduce/job"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
 	"gitlab.com/cameron_w20/serverless-mapreduce/test"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -16,14 +19,16 @@ func TestCombine(t *testing.T) {
 	// Setup test
 	teardown, subscriptions := test.SetupPubSubTest(t, []string{pubsub.ShufflerTopic})
 	defer teardown(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
 	// Given
 	// Create a message
-	inputData := []pubsub.MappedWord{
-		{Anagrams: map[string]struct{}{"care": {}}, SortedWord: "acer"},
-		{Anagrams: map[string]struct{}{"part": {}}, SortedWord: "artp"},
-		{Anagrams: map[string]struct{}{"race": {}}, SortedWord: "acer"},
-		{Anagrams: map[string]struct{}{"care": {}}, SortedWord: "acer"},
-		{Anagrams: map[string]struct{}{"trap": {}}, SortedWord: "artp"},
+	inputData := []pubsub.KeyValues{
+		{Values: []string{"care"}, Key: "acer"},
+		{Values: []string{"part"}, Key: "artp"},
+		{Values: []string{"race"}, Key: "acer"},
+		{Values: []string{"care"}, Key: "acer"},
+		{Values: []string{"trap"}, Key: "artp"},
 	}
 	inputDataBytes, err := json.Marshal(inputData)
 	if err != nil {
@@ -43,9 +48,9 @@ func TestCombine(t *testing.T) {
 		t.Fatalf("Error setting event data: %v", err)
 	}
 
-	expectedResult := []pubsub.MappedWord{
-		{SortedWord: "acer", Anagrams: map[string]struct{}{"care": {}, "race": {}}},
-		{SortedWord: "artp", Anagrams: map[string]struct{}{"part": {}, "trap": {}}},
+	expectedResult := []pubsub.KeyValues{
+		{Key: "acer", Values: []string{"care", "race"}},
+		{Key: "artp", Values: []string{"part", "trap"}},
 	}
 
 	// When
@@ -57,9 +62,9 @@ func TestCombine(t *testing.T) {
 	// The subscription will listen forever unless given a context with a timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
-	var actualResult []pubsub.MappedWord
+	var actualResult []pubsub.KeyValues
 	err = subscriptions[0].Receive(ctx, func(ctx context.Context, msg *ps.Message) {
-		// Unmarshal the message data into the MappedWord struct
+		// Unmarshal the message data into the KeyValues struct
 		err := json.Unmarshal(msg.Data, &actualResult)
 		if err != nil {
 			t.Fatalf("Error unmarshalling message: %v", err)
@@ -134,3 +139,72 @@ func TestCombine_CreatePubSubClientError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "error creating pubsub client")
 }
+
+func TestCombineKeyValues(t *testing.T) {
+	// Given
+	inputData := []pubsub.KeyValues{
+		{Key: "acer", Values: []string{"race"}},
+		{Key: "artp", Values: []string{"part"}},
+		{Key: "acer", Values: []string{"care", "race"}},
+	}
+
+	// When
+	actualResult, err := combineKeyValues(job.Anagram{}, inputData)
+
+	// Then
+	assert.Nil(t, err)
+	// The anagram job's combiner removes the duplicate anagrams
+	assert.Equal(t, []pubsub.KeyValues{{Key: "acer", Values: []string{"care", "race"}},
+		{Key: "artp", Values: []string{"part"}}}, actualResult)
+}
+
+func TestCombineKeyValues_WordCount(t *testing.T) {
+	// Given
+	j := wordCount{}
+	var inputData []pubsub.KeyValues
+	for _, record := range []string{"the cat", "the dog the end"} {
+		for _, kv := range j.Map(record) {
+			inputData = append(inputData, pubsub.KeyValues{Key: kv.Key, Values: []string{kv.Value}})
+		}
+	}
+
+	// When
+	actualResult, err := combineKeyValues(j, inputData)
+
+	// Then
+	assert.Nil(t, err)
+	// A job without a combiner receives every value emitted for a key, including duplicates
+	assert.Equal(t, []pubsub.KeyValues{
+		{Key: "cat", Values: []string{"1"}},
+		{Key: "dog", Values: []string{"1"}},
+		{Key: "end", Values: []string{"1"}},
+		{Key: "the", Values: []string{"1", "1", "1"}},
+	}, actualResult)
+	values, ok := j.Reduce("the", actualResult[3].Values)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"3"}, values)
+}
+
+// wordCount is a Job that counts how many times each word appears in the text, which relies on every value emitted
+// for a word being kept.
+type wordCount struct{}
+
+func (wordCount) Map(record string) []job.KeyValue {
+	var keyValues []job.KeyValue
+	for _, word := range strings.Fields(record) {
+		keyValues = append(keyValues, job.KeyValue{Key: word, Value: "1"})
+	}
+	return keyValues
+}
+
+func (wordCount) Reduce(key string, values []string) ([]string, bool) {
+	return []string{strconv.Itoa(len(values))}, true
+}
+
+func (wordCount) KeyCodec() job.Codec {
+	return job.StringCodec{}
+}
+
+func (wordCount) ValueCodec() job.Codec {
+	return job.StringCodec{}
+}
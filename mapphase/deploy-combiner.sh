@@ -19,17 +19,22 @@ else
   exit 1
 fi
 
+REDIS_HOST=$(gcloud redis instances describe mapreduce-controller \
+              --region="$GCP_REGION" \
+              --format="value(host)")
+
 echo "Deploying combiner"
 if (gcloud functions deploy combiner \
     --gen2 \
-    --runtime=go116 \
+    --runtime=go119 \
     --trigger-topic mapreduce-combiner \
     --source=. \
     --entry-point Combiner \
     --region="$GCP_REGION" \
     --memory=512MB \
     --project="$GCP_PROJECT" \
-    --set-env-vars=GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS") ; then
+    --vpc-connector=projects/"$GCP_PROJECT"/locations/"$GCP_REGION"/connectors/mapreduce-connector \
+    --set-env-vars=REDIS_HOST="$REDIS_HOST",GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS",PUBSUB_CODEC="$PUBSUB_CODEC",PUBSUB_COMPRESSION="$PUBSUB_COMPRESSION") ; then
   echo "Successfully deployed combiner"
 else
   echo "Failed to deploy combiner"
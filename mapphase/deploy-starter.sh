@@ -12,14 +12,14 @@ fi
 echo "Deploying starter"
 if (gcloud functions deploy starter \
     --gen2 \
-    --runtime=go116 \
+    --runtime=go119 \
     --trigger-http \
     --source=. \
     --entry-point Starter \
     --region="$GCP_REGION" \
     --memory=512MB \
     --project="$GCP_PROJECT" \
-    --set-env-vars=GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS") ; then
+    --set-env-vars=GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS",PUBSUB_CODEC="$PUBSUB_CODEC",PUBSUB_COMPRESSION="$PUBSUB_COMPRESSION") ; then
   echo "Successfully deployed starter"
 else
   echo "Failed to deploy starter"
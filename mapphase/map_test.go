@@ -16,9 +16,11 @@ func TestMapper(t *testing.T) {
 	// Setup test
 	teardown, subscriptions := test.SetupPubSubTest(t, []string{pubsub.CombineTopic})
 	defer teardown(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
 	// Given
 	// Create a message
-	inputData := []string{"the", "quick", "brown", "fox", "quick"}
+	inputData := []string{"The quick brown", "fox, quick"}
 	inputDataBytes, err := json.Marshal(inputData)
 	if err != nil {
 		t.Fatalf("Error marshalling Mapper data: %v", err)
@@ -37,10 +39,10 @@ func TestMapper(t *testing.T) {
 		t.Fatalf("Error setting event data: %v", err)
 	}
 
-	expectedResult := []pubsub.MappedWord{
-		{Anagrams: map[string]struct{}{"quick": {}}, SortedWord: "cikqu"},
-		{Anagrams: map[string]struct{}{"brown": {}}, SortedWord: "bnorw"},
-		{Anagrams: map[string]struct{}{"fox": {}}, SortedWord: "fox"},
+	expectedResult := []pubsub.KeyValues{
+		{Values: []string{"quick"}, Key: "cikqu"},
+		{Values: []string{"brown"}, Key: "bnorw"},
+		{Values: []string{"fox"}, Key: "fox"},
 	}
 
 	// When
@@ -52,9 +54,9 @@ func TestMapper(t *testing.T) {
 	// The subscription will listen forever unless given a context with a timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
-	var actualResult []pubsub.MappedWord
+	var actualResult []pubsub.KeyValues
 	err = subscriptions[0].Receive(ctx, func(ctx context.Context, msg *ps.Message) {
-		// Unmarshal the message data into the MappedWord struct
+		// Unmarshal the message data into the KeyValues struct
 		err := json.Unmarshal(msg.Data, &actualResult)
 		if err != nil {
 			t.Fatalf("Error unmarshalling message: %v", err)
@@ -131,51 +133,3 @@ func TestMapper_CreatePubSubClientError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "error creating pubsub client")
 }
-
-func TestProcessText(t *testing.T) {
-	// Given
-	inputText := "teststring."
-	expectedResult := "teststring"
-
-	// When
-	actualResult := preProcessWord(inputText)
-
-	// Then
-	assert.Equal(t, expectedResult, actualResult)
-}
-
-func TestProcessTextNumber(t *testing.T) {
-	// Given
-	inputText := "test1string"
-	expectedResult := ""
-
-	// When
-	actualResult := preProcessWord(inputText)
-
-	// Then
-	assert.Equal(t, expectedResult, actualResult)
-}
-
-func TestProcessTextStopWord(t *testing.T) {
-	// Given
-	inputText := "would've"
-	expectedResult := ""
-
-	// When
-	actualResult := preProcessWord(inputText)
-
-	// Then
-	assert.Equal(t, expectedResult, actualResult)
-}
-
-func TestTrimNonAlphabetic(t *testing.T) {
-	// Given
-	inputText := ";'.[]/,'][çteststringç];/];];/'"
-	expectedResult := "çteststringç"
-
-	// When
-	actualResult := trimNonAlphabeticCharacters(inputText)
-
-	// Then
-	assert.Equal(t, expectedResult, actualResult)
-}
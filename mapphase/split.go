@@ -1,25 +1,39 @@
 package mapphase
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/cloudevents/sdk-go/v2/event"
 	"github.com/google/uuid"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
+	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
 	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+	"io"
 	"log"
 	"math"
 	"regexp"
 	"strings"
-	"sync"
 )
 
 // Splitter is a function that is triggered by a message being published to the splitter topic. It reads the file from
-// the bucket, removes the header and footer from the book, removes any duplicate words to improve performance later in
-// the MapReduce process, splits it into partitions and sends each partition to the Mapper in separate messages so they
-// can be mapped in parallel by different instances. It requires the message data to be of type SplitterData.
+// the bucket, removes the header and footer from the book, splits the text into records, which are its lines, splits
+// the records into partitions and sends each partition to the Mapper in separate messages so they can be mapped in
+// parallel by different instances. The number of partitions is sent to the controller so it knows how many partitions
+// to wait for before starting the reduce phase. It requires the message data to be of type SplitterData.
+//
+// When the message holds a byte range of a large file, only that range is read, and the file is tracked by the
+// controller as one split per range. A range is aligned to lines in the same way as a Hadoop InputSplit: a line
+// belongs to the range that its first byte is in, so each line of the file is read by exactly one range. The book's
+// header and footer aren't looked for in the range, since they are only in the first and last ranges and could be
+// cut in two by a range boundary. Instead, the starter finds them in the whole file and sends their offsets with each
+// range.
+//
+// The file is always split into the same partitions with the same IDs, and a dedupe record is written to Redis once the
+// partitions have been sent, so that a redelivered message doesn't cause the file's partitions to be counted twice.
 func Splitter(ctx context.Context, e event.Event) error {
+	r.InitSingleRedisClient()
 	// Create a new pubsub client
 	pubsubClient, err := pubsub.New(ctx, e)
 	if err != nil {
@@ -34,102 +48,195 @@ func Splitter(ctx context.Context, e event.Event) error {
 		return err
 	}
 
+	// Add the split name to the attributes so that the controller can track the progress of each split of the file
+	splitName := splitterData.SplitName()
+	attributes["fileName"] = splitName
+
+	// Don't split the file again if a previous delivery of the message has already split it
+	processedKey := r.ProcessedKey(attributes["jobId"], "splitter", splitName)
+	_, processed, err := r.Processed(ctx, r.SingleRedisClient, processedKey)
+	if err != nil {
+		return err
+	}
+	if processed {
+		log.Printf("File %s has already been split, skipping", splitName)
+		return nil
+	}
+
 	// Split the text in the file into partitions for efficiency and to avoid pubsub message size limits
 	// Also split each partition into a slice of words
-	partitionedText, err := splitFile(ctx, splitterData.BucketName, splitterData.FileName)
+	partitionedText, err := splitFile(ctx, splitterData)
+	if err != nil {
+		err = fmt.Errorf("error splitting file: %v", err)
+		pubsub.ReportFailure(pubsubClient, attributes, err)
+		return err
+	}
+	// Let the controller know how many partitions the file has been split into, so it knows how many to wait for
+	err = sendPartitionCountToController(pubsubClient, attributes, splitterData.FileName, len(partitionedText))
 	if err != nil {
-		return fmt.Errorf("error splitting file: %v", err)
+		return fmt.Errorf("error sending partition count to controller: %v", err)
 	}
 	// Send the partitions to the Mapper
 	err = sendTextToMapper(pubsubClient, attributes, partitionedText)
 	if err != nil {
 		return fmt.Errorf("error sending text to Mapper: %v", err)
 	}
-	return nil
+	return r.MarkProcessed(ctx, r.SingleRedisClient, processedKey, 1)
 }
 
-// splitFile reads a given file from a bucket, removes the text's header and footer, removes duplicate words,
-// splits it into partitions and returns the partitions as a slice of slices of strings or an error
-func splitFile(ctx context.Context, bucketName, fileName string) ([][]string, error) {
+// splitFile reads the given split of a file from a bucket, removes the text's header and footer, splits it into records
+// and then into partitions, and returns the partitions as a slice of slices of strings or an error
+func splitFile(ctx context.Context, data pubsub.SplitterData) ([][]string, error) {
 	// Create a storage client
 	storageClient, err := storage.New(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer storageClient.Close()
-	// Read the contents of the file from the bucket
-	data, err := storageClient.ReadObject(ctx, bucketName, fileName)
+	reader, err := openSplit(ctx, storageClient, data)
 	if err != nil {
 		return nil, fmt.Errorf("error reading file from bucket: %v", err)
 	}
-	// Remove the book header and footer from the data
-	text := removeBookHeaderAndFooter(bytesToUtf8String(data))
-	// Split the file into a list of words
-	splitText := strings.Fields(text)
-	// Remove non-unique words:
-	uniqueSplitText := removeDuplicateWords(splitText)
+	defer reader.Close()
+	text, err := readSplit(reader, data.Start, data.End, data.BodyStart, data.BodyEnd)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file from bucket: %v", err)
+	}
+	// Remove the book header and footer from a whole file. A range of a file has already had them removed by
+	// readSplit, since the starter finds them in the whole file rather than in each range
+	if data.End == 0 {
+		text = removeBookHeaderAndFooter(text)
+	}
+	// Split the file into a list of records
+	records := splitRecords(text)
 	// Partition the file since this will speed up the map phase
-	partitionedText := partitionFile(uniqueSplitText, pubsub.MaxMessageSizeBytes)
+	partitionedText := partitionFile(records, pubsub.MaxMessageSizeBytes)
 	return partitionedText, nil
 }
 
-// bytesToUtf8String converts a slice of bytes to a string. It also converts characters encoded in non-UTF8 format
-// to UTF8.
-func bytesToUtf8String(data []byte) string {
-	// Create a slice to store the converted bytes
-	buf := make([]rune, len(data))
-	// Loop through the bytes and convert them to UTF8
-	for i, char := range data {
-		buf[i] = rune(char)
-	}
-	// Convert the slice of runes to a string
-	return string(buf)
+// openSplit returns a reader of the given split of a file for readSplit to read. A member of an archive is read on its
+// own, and a compressed file is decompressed as it is read.
+func openSplit(ctx context.Context, storageClient storage.Client, data pubsub.SplitterData) (io.ReadCloser, error) {
+	if data.Member != "" {
+		archive := storage.ObjectAttrs{Name: data.FileName, Size: data.Size, Compression: data.Compression,
+			Archive: data.Archive}
+		return storage.OpenArchiveMember(ctx, storageClient, data.BucketName, archive, data.Member)
+	}
+	// Stream the split from the bucket, starting a byte early so we can tell whether the split starts mid-word
+	offset := data.Start
+	if offset > 0 {
+		offset--
+	}
+	rangeReader, err := storageClient.ReadObjectRange(ctx, data.BucketName, data.FileName, offset, -1)
+	if err != nil {
+		return nil, err
+	}
+	// Decompress the file before its header and footer are removed, so they are found in the plain text
+	reader, err := storage.NewDecompressor(rangeReader, data.Compression)
+	if err != nil {
+		rangeReader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// readSplit reads the lines in the byte range [start, end) of a file from the given reader and returns them as a
+// string, or reads the whole file if end is 0. The reader must start at the byte before start, or at the start of the
+// file if start is 0. A line that starts before start is skipped, since it belongs to the previous split, and a line
+// that starts before end is read to its end, even if that is past end. Each byte is converted to the character with
+// the same code point, so text encoded in a single byte format is converted to UTF8. When bodyEnd isn't 0, only the
+// bytes of the lines that are in the byte range [bodyStart, bodyEnd) of the file are returned, so that the book's
+// header and footer are left out.
+func readSplit(reader io.Reader, start, end, bodyStart, bodyEnd int64) (string, error) {
+	bufReader := bufio.NewReader(reader)
+	pos := start
+	if start > 0 {
+		// Skip the rest of the line that the byte before the split is part of
+		b, err := bufReader.ReadByte()
+		for err == nil && b != '\n' {
+			b, err = bufReader.ReadByte()
+			pos++
+		}
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	var text strings.Builder
+	if end > start {
+		text.Grow(int(end - start))
+	}
+	prevNewline := true
+	for {
+		b, err := bufReader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		// Stop at the first line that starts at or after the end of the split
+		if end > 0 && pos >= end && prevNewline {
+			break
+		}
+		if bodyEnd == 0 || (pos >= bodyStart && pos < bodyEnd) {
+			text.WriteRune(rune(b))
+		}
+		prevNewline = b == '\n'
+		pos++
+	}
+	return text.String(), nil
+}
+
+// splitRecords splits the given text into its records, which are its lines without their line endings. The text after
+// the last line ending is only a record if it isn't empty.
+func splitRecords(text string) []string {
+	records := strings.Split(text, "\n")
+	if records[len(records)-1] == "" {
+		records = records[:len(records)-1]
+	}
+	for i, record := range records {
+		records[i] = strings.TrimSuffix(record, "\r")
+	}
+	return records
+}
+
+// bookHeaderRegexp matches the header of a book.
+var bookHeaderRegexp = regexp.MustCompile(`\*\*\*.*START OF TH(E|IS) PROJECT GUTENBERG EBOOK.*\*\*\*`)
+
+// bookFooterRegexps match the two different types of footer of a book, in the order they are looked for.
+var bookFooterRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`End of[ th(e|is)]* Project Gutenberg`),
+	regexp.MustCompile(`\*\*\*.*END OF TH(E|IS) PROJECT GUTENBERG EBOOK.*\*\*\*`),
 }
 
 // removeBookHeaderAndFooter removes the header and footer from the given string and returns the text as a string
 func removeBookHeaderAndFooter(text string) string {
-	// Create a regex to match the header
-	re := regexp.MustCompile(`\*\*\*.*START OF TH(E|IS) PROJECT GUTENBERG EBOOK.*\*\*\*`)
-	// Find the index of the occurrence of the header
-	index := re.FindStringIndex(text)
-	// Remove the header
-	if index != nil {
-		text = text[index[1]+1:]
-	}
-	// Create a regex to match the footer
-	// There are two different types of footer so we need to match both
-	re = regexp.MustCompile(`End of[ th(e|is)]* Project Gutenberg`)
-	index = re.FindStringIndex(text)
-	if index != nil {
-		text = text[:index[0]]
-		return text
-	}
-	// Match the second type of footer
-	re = regexp.MustCompile(`\*\*\*.*END OF TH(E|IS) PROJECT GUTENBERG EBOOK.*\*\*\*`)
-	// Find the index of the occurrence of the footer
-	index = re.FindStringIndex(text)
-	// Remove the footer
-	if index != nil {
-		text = text[:index[0]]
-	}
-	return text
+	text = text[bookHeaderEnd(text):]
+	return text[:bookFooterStart(text)]
 }
 
-// removeDuplicateWords removes any duplicate words from the given slice of strings and returns the slice of strings
-func removeDuplicateWords(text []string) []string {
-	// Create a map to store the unique words
-	uniqueWords := make(map[string]struct{})
-	// Create a slice to store the unique words
-	uniqueWordsSlice := make([]string, 0)
-	// Loop through the words and add the lowercase version to the map
-	for _, word := range text {
-		uniqueWords[strings.ToLower(word)] = struct{}{}
-	}
-	// Loop through the map and add the words to the slice
-	for word := range uniqueWords {
-		uniqueWordsSlice = append(uniqueWordsSlice, word)
-	}
-	return uniqueWordsSlice
+// bookHeaderEnd returns the index in the given text that the book starts at, which is after its header and the
+// character after the header, or 0 if the text has no header.
+func bookHeaderEnd(text string) int {
+	index := bookHeaderRegexp.FindStringIndex(text)
+	if index == nil {
+		return 0
+	}
+	return minInt(index[1]+1, len(text))
+}
+
+// bookFooterStart returns the index in the given text that the book's footer starts at, or the length of the text if
+// it has no footer.
+func bookFooterStart(text string) int {
+	for _, re := range bookFooterRegexps {
+		if index := re.FindStringIndex(text); index != nil {
+			return index[0]
+		}
+	}
+	return len(text)
 }
 
 // partitionFile splits the given text into partitions of a given size and returns the partitions as a slice of
@@ -160,40 +267,62 @@ func partitionFile(splitText []string, messageSize int) [][]string {
 	return partitions
 }
 
-// sendTextToMapper sends the given partitions to the Mapper, one partition per message and can return an error
+// sendTextToMapper sends the given partitions to the Mapper, one partition per message. The messages are published
+// without waiting for each one so that they are sent in batches, and it returns an error if any of them couldn't be
+// sent.
 func sendTextToMapper(pubsubClient pubsub.Client, attributes map[string]string,
 	partitionedText [][]string) error {
-	// We need to use a wait group to wait for all the messages to be published before returning
-	var wg sync.WaitGroup
-	for _, partition := range partitionedText {
-		// To prevent the same uuid being used for multiple messages, we need to create a new map in each goroutine
+	for i, partition := range partitionedText {
+		// Each message needs its own attributes, since each partition has a different ID
 		partitionAttributes := make(map[string]string)
 		for k, v := range attributes {
 			partitionAttributes[k] = v
 		}
-		// Send the message concurrently to speed up the process
-		wg.Add(1)
-		go func(partition []string) {
-			defer wg.Done()
-			// Send a message to the controller topic to let it know that a partition has been published
-			sendIDToController(pubsubClient, partitionAttributes)
-			// Publish the partition to the Mapper topic
-			pubsubClient.SendPubSubMessage(pubsub.MapperTopic, partition, partitionAttributes)
-		}(partition)
-	}
-	wg.Wait()
-	return nil
+		partitionAttributes["partitionId"] = partitionID(attributes["jobId"], attributes["fileName"], i)
+		// Let the controller know that the partition has been published, then publish the partition to the Mapper
+		// topic
+		publishIDToController(pubsubClient, partitionAttributes)
+		pubsubClient.PublishPubSubMessage(pubsub.MapperTopic, partition, partitionAttributes)
+	}
+	// Wait for all the messages to be sent before returning
+	return pubsubClient.Flush()
 }
 
-// sendIDToController sends a message to the controller topic to let it know that a partition has been published
-func sendIDToController(pubsubClient pubsub.Client, attributes map[string]string) {
-	// Create a unique id for the partition so that we can track it
-	attributes["partitionId"] = uuid.New().String()
+// sendPartitionCountToController sends a message to the controller topic to let it know how many partitions the split
+// of the given file has been split into
+func sendPartitionCountToController(pubsubClient pubsub.Client, attributes map[string]string, fileName string,
+	noOfPartitions int) error {
+	statusMessage := pubsub.ControllerMessage{
+		ID:       attributes["fileName"],
+		Status:   pubsub.StatusFileSplit,
+		FileName: fileName,
+		Count:    noOfPartitions,
+	}
+	return pubsubClient.SendPubSubMessage(pubsub.ControllerTopic, statusMessage, attributes)
+}
+
+// partitionID returns the ID of the partition with the given index in the given file for the given job. The ID is derived
+// from the job, file and index rather than being random, so that a partition has the same ID if the file is split again.
+func partitionID(jobID, fileName string, index int) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(fmt.Sprintf("%s/%s/%d", jobID, fileName, index))).String()
+}
+
+// publishIDToController publishes a message to the controller topic to let it know that a partition has been published
+func publishIDToController(pubsubClient pubsub.Client, attributes map[string]string) {
 	// Create the data to be sent to the controller
 	statusMessage := pubsub.ControllerMessage{
-		ID:     attributes["partitionId"],
-		Status: pubsub.StatusStarted,
+		ID:       attributes["partitionId"],
+		Status:   pubsub.StatusStarted,
+		FileName: attributes["fileName"],
+	}
+	// Send the message to the controller with the job ID so it knows which job the partition belongs to
+	pubsubClient.PublishPubSubMessage(pubsub.ControllerTopic, statusMessage, map[string]string{"jobId": attributes["jobId"]})
+}
+
+// minInt returns the smaller of the two given ints.
+func minInt(a, b int) int {
+	if a < b {
+		return a
 	}
-	// Send the message to the controller
-	pubsubClient.SendPubSubMessage(pubsub.ControllerTopic, statusMessage, nil)
+	return b
 }
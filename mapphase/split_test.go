@@ -8,6 +8,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
 	"gitlab.com/cameron_w20/serverless-mapreduce/test"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -18,6 +20,8 @@ func TestSplitter(t *testing.T) {
 	defer teardown(t)
 	teardownTestStorage := test.SetupStorageTest(t)
 	defer teardownTestStorage(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
 
 	// Given
 	// Create a message
@@ -43,8 +47,14 @@ func TestSplitter(t *testing.T) {
 		t.Fatalf("Error setting event data: %v", err)
 	}
 
-	expectedResult := []string{"the", "quick", "brown", "fox", "jumps", "over", "lazy", "dog."}
+	expectedResult := []string{"The quick brown fox jumps over the lazy dog."}
 	expectedControllerResult := pubsub.ControllerMessage{Status: pubsub.StatusStarted}
+	expectedFileSplitResult := pubsub.ControllerMessage{
+		ID:       "test.txt",
+		Status:   pubsub.StatusFileSplit,
+		FileName: "test.txt",
+		Count:    1,
+	}
 
 	// When
 	err = Splitter(context.Background(), e)
@@ -58,7 +68,7 @@ func TestSplitter(t *testing.T) {
 	defer cancel()
 	var actualResult []string
 	err = subscriptions[0].Receive(ctx, func(ctx context.Context, msg *ps.Message) {
-		// Unmarshal the message data into the MappedWord struct
+		// Unmarshal the message data into the KeyValues struct
 		err := json.Unmarshal(msg.Data, &actualResult)
 		if err != nil {
 			t.Fatalf("Error unmarshalling message: %v", err)
@@ -66,9 +76,7 @@ func TestSplitter(t *testing.T) {
 		msg.Ack()
 	})
 	// Ensure the message data matches the expected result
-	for _, word := range expectedResult {
-		assert.Contains(t, actualResult, word)
-	}
+	assert.Equal(t, expectedResult, actualResult)
 	// Ensure there are no errors returned by the receiver
 	assert.Nil(t, err)
 
@@ -76,17 +84,23 @@ func TestSplitter(t *testing.T) {
 	// The subscription will listen forever unless given a context with a timeout
 	controllerCtx, controllerCancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer controllerCancel()
-	var received pubsub.ControllerMessage
+	var mu sync.Mutex
+	received := make(map[string]pubsub.ControllerMessage)
 	err = subscriptions[1].Receive(controllerCtx, func(ctx context.Context, msg *ps.Message) {
-		// Unmarshal the message data into the MappedWord struct
-		err := json.Unmarshal(msg.Data, &received)
+		// Unmarshal the message data into the ControllerMessage struct
+		var statusMessage pubsub.ControllerMessage
+		err := json.Unmarshal(msg.Data, &statusMessage)
 		if err != nil {
 			t.Fatalf("Error unmarshalling message: %v", err)
 		}
+		mu.Lock()
+		received[statusMessage.Status] = statusMessage
+		mu.Unlock()
 		msg.Ack()
 	})
 	// Ensure the message data matches the expected result
-	assert.Equal(t, expectedControllerResult.Status, received.Status)
+	assert.Equal(t, expectedControllerResult.Status, received[pubsub.StatusStarted].Status)
+	assert.Equal(t, expectedFileSplitResult, received[pubsub.StatusFileSplit])
 	// Ensure there are no errors returned by the receiver
 	assert.Nil(t, err)
 }
@@ -260,3 +274,116 @@ End of Project Gutenberg's Some Title, by Some Author
 	// Then
 	assert.Equal(t, expectedResult, actualResult)
 }
+
+func TestRemoveBookHeaderAndFooter_HeaderAtEnd(t *testing.T) {
+	// When
+	actualResult := removeBookHeaderAndFooter("#SOME BOOK HEADER# *** START OF THIS PROJECT GUTENBERG EBOOK SOME TITLE ***")
+
+	// Then
+	assert.Equal(t, "", actualResult)
+}
+
+func TestReadSplit(t *testing.T) {
+	text := "the quick\nbrown fox\n\njumps over"
+	tests := []struct {
+		name     string
+		start    int64
+		end      int64
+		expected string
+	}{
+		{name: "WholeFile", start: 0, end: 0, expected: text},
+		{name: "EndsMidLine", start: 0, end: 6, expected: "the quick\n"},
+		{name: "EndsBeforeLine", start: 0, end: 10, expected: "the quick\n"},
+		{name: "StartsMidLine", start: 6, end: 14, expected: "brown fox\n"},
+		{name: "StartsAtLine", start: 10, end: 12, expected: "brown fox\n"},
+		{name: "LineSpansSplit", start: 12, end: 14, expected: ""},
+		{name: "EmptyLine", start: 20, end: 21, expected: "\n"},
+		{name: "LastSplit", start: 21, end: 31, expected: "jumps over"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given
+			offset := tt.start
+			if offset > 0 {
+				offset--
+			}
+
+			// When
+			result, err := readSplit(strings.NewReader(text[offset:]), tt.start, tt.end, 0, 0)
+
+			// Then
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestReadSplit_BookBody(t *testing.T) {
+	// Given
+	text := "header *** START ***\nthe quick\nbrown fox\n*** END ***\nfooter"
+
+	// When
+	first, err1 := readSplit(strings.NewReader(text), 0, 25, 14, 41)
+	second, err2 := readSplit(strings.NewReader(text[24:]), 25, int64(len(text)), 14, 41)
+
+	// Then
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, "RT ***\nthe quick\n", first)
+	assert.Equal(t, "brown fox\n", second)
+}
+
+func TestReadSplit_EveryLineReadOnce(t *testing.T) {
+	// Given
+	text := "It was the best of times,\r\nit was the worst of times,\n\n\tit was the age of wisdom \xe9t\xe9\xa0fin"
+	expectedRecords := splitRecords(bytesToString([]byte(text)))
+
+	for splitSize := int64(1); splitSize <= int64(len(text)); splitSize++ {
+		// When
+		records := make([]string, 0)
+		for start := int64(0); start < int64(len(text)); start += splitSize {
+			end := start + splitSize
+			if end > int64(len(text)) {
+				end = int64(len(text))
+			}
+			offset := start
+			if offset > 0 {
+				offset--
+			}
+			result, err := readSplit(strings.NewReader(text[offset:]), start, end, 0, 0)
+			assert.Nil(t, err)
+			records = append(records, splitRecords(result)...)
+		}
+
+		// Then
+		assert.Equal(t, expectedRecords, records, "split size %d", splitSize)
+	}
+}
+
+// bytesToString converts each of the given bytes to the character with the same code point.
+func bytesToString(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func TestPartitionID(t *testing.T) {
+	// When
+	id := partitionID("12345", "test.txt", 0)
+
+	// Then
+	assert.Equal(t, id, partitionID("12345", "test.txt", 0))
+	assert.NotEqual(t, id, partitionID("12345", "test.txt", 1))
+	assert.NotEqual(t, id, partitionID("12345", "other.txt", 0))
+	assert.NotEqual(t, id, partitionID("67890", "test.txt", 0))
+}
+
+func TestSplitRecords(t *testing.T) {
+	// When
+	records := splitRecords("the quick\r\nbrown fox\n\njumps over\n")
+
+	// Then
+	assert.Equal(t, []string{"the quick", "brown fox", "", "jumps over"}, records)
+}
@@ -1,26 +1,61 @@
 package mapphase
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/google/uuid"
+	"gitlab.com/cameron_w20/serverless-mapreduce/job"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
 	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync"
 )
 
+// DefaultSplitSize is the maximum number of bytes of a file read by a single splitter when the split-size query
+// parameter isn't given.
+const DefaultSplitSize int64 = 32 << 20
+
 // Response is the response object sent to the client
 type Response struct {
 	ResponseCode int    `json:"responseCode"`
 	Message      string `json:"message"`
+	JobID        string `json:"jobId,omitempty"`
 }
 
-// StartMapReduce is a function triggered by an HTTP request which starts the MapReduce process. It reads all the file
-// names in the input bucket and pushes them to the splitter topic, one filename per message. The function requires two
-// query parameters:
+// StartMapReduce is a function triggered by an HTTP request which starts the MapReduce process. It creates a unique ID
+// for the job, reads all the file names in the input bucket and pushes them to the splitter topic, one file, or byte
+// range of a large file, per message. The job ID is sent in the attributes of every message so that the state of
+// concurrent jobs is kept separate, and the output files are stored under the job ID in the output bucket. The function
+// requires two query parameters:
 // input-bucket: the name of the bucket containing the input files
 // output-bucket: the name of the bucket where the output files will be stored
+// Either bucket name can start with a scheme, e.g. "s3://" or "file://", to use a bucket in another type of storage.
+// It also accepts the optional query parameters:
+// job: the name of the registered job to run, by default this is the anagram job
+// output-format: the format the output files are written in, one of the registered output formats, by default this is
+// the text format
+// output-compression: the compression of the output files, either "gzip" or "none", by default they aren't compressed
+// max-part-size and max-part-records: the number of bytes or records after which a reducer starts writing to a new
+// numbered part file, by default each reducer writes a single file
+// merge-output: "true" to merge the output files of every reducer into a single file sorted by key once the job has
+// finished, which is named after the job, e.g. "anagrams.txt"
+// callback-url: an HTTP(S) URL that the job's manifest is POSTed to once the job has finished
+// input-prefix: only use the objects in the input bucket whose names start with the prefix
+// include: only use the objects whose names match one of the glob patterns, by default this is "*.txt", so an archive
+// is only used if a pattern such as "*.zip" matches it, and then only the files in it that match one of the patterns
+// exclude: don't use the objects whose names match any of the glob patterns
+// min-size and max-size: only use the objects with a size in bytes in the range
+// input-manifest: the name of an object in the input bucket listing the names of the objects to use, one per line,
+// which can't be used with any of the other parameters that select the objects
+// split-size: the maximum number of bytes of a file read by a single splitter, by default this is DefaultSplitSize.
+// Larger files are split into byte ranges of this size that are read by different splitters, and a compressed file or a
+// file in an archive that is larger than it is rejected, since it can't be split.
 func StartMapReduce(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	// Get the query parameters
@@ -34,6 +69,46 @@ func StartMapReduce(w http.ResponseWriter, r *http.Request) {
 		writeResponse(w, http.StatusBadRequest, "No output bucket name provided, please provide one using the query parameter 'output-bucket'")
 		return
 	}
+	for _, bucketName := range []string{inputBucketName, outputBucketName} {
+		if !storage.IsSupported(bucketName) {
+			scheme, _ := storage.SplitBucketName(bucketName)
+			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Unsupported storage scheme %s, the supported schemes "+
+				"are: %s", scheme, strings.Join(storage.Schemes(), ", ")))
+			return
+		}
+	}
+	jobName := r.URL.Query().Get("job")
+	if jobName == "" {
+		jobName = job.DefaultJobName
+	}
+	if _, err := job.Get(jobName); err != nil {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Unknown job %s, the available jobs are: %s", jobName,
+			strings.Join(job.Names(), ", ")))
+		return
+	}
+	outputOptions, err := outputOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, "Error configuring output files: "+err.Error())
+		return
+	}
+	callbackURL := r.URL.Query().Get("callback-url")
+	if callbackURL != "" && !isValidCallbackURL(callbackURL) {
+		writeResponse(w, http.StatusBadRequest, "Invalid callback URL provided, it must be an absolute http or https URL")
+		return
+	}
+	splitSize, err := parseSize(r.URL.Query().Get("split-size"))
+	if err != nil || (splitSize == 0 && r.URL.Query().Get("split-size") != "") {
+		writeResponse(w, http.StatusBadRequest, "Invalid split size provided, it must be a positive number of bytes")
+		return
+	}
+	if splitSize == 0 {
+		splitSize = DefaultSplitSize
+	}
+	selection, err := selectionFromQuery(r.URL.Query())
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, "Error selecting input files: "+err.Error())
+		return
+	}
 	// Create a storage client
 	storageClient, err := storage.New(ctx)
 	if err != nil {
@@ -41,18 +116,32 @@ func StartMapReduce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer storageClient.Close()
-	// Read the file names in the input bucket
-	files, err := storageClient.ReadObjectNames(ctx, inputBucketName)
+	// Select the input files from the objects in the input bucket
+	files, err := storage.SelectObjects(ctx, storageClient, inputBucketName, selection)
 	if err != nil {
 		if strings.Contains(err.Error(), "bucket doesn't exist") {
 			writeResponse(w, http.StatusBadRequest, "Storage bucket doesn't exist or isn't accessible")
 			return
 		}
+		if errors.Is(err, storage.ErrInvalidSelection) {
+			writeResponse(w, http.StatusBadRequest, "Error selecting input files: "+err.Error())
+			return
+		}
+		writeResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Split the files, and the files in any archives, into the splits that are sent to the splitter
+	splits, err := splitFiles(ctx, storageClient, inputBucketName, files, selection, splitSize)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidArchive) || errors.Is(err, errSplitTooLarge) {
+			writeResponse(w, http.StatusBadRequest, "Error selecting input files: "+err.Error())
+			return
+		}
 		writeResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	// If there are no files in the bucket, write bad request response and return
-	if len(files) == 0 {
+	if len(splits) == 0 {
 		writeResponse(w, http.StatusBadRequest, "No files found in input bucket: "+inputBucketName)
 		return
 	}
@@ -63,32 +152,227 @@ func StartMapReduce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer pubsubClient.Close()
-	// Push each file name to the splitter topic
-	var wg sync.WaitGroup
+	// Create a unique id for the job so that its state can be kept separate from other jobs
+	jobID := uuid.New().String()
+	// Publish each split to the splitter topic without waiting for each one, so they are sent in batches
+	for _, splitterData := range splits {
+		attributes := outputOptions.Attributes()
+		attributes["outputBucket"] = outputBucketName
+		attributes["job"] = jobName
+		attributes["jobId"] = jobID
+		pubsubClient.PublishPubSubMessage(pubsub.SplitterTopic, splitterData, attributes)
+	}
+	// Let the controller know that the job has started and how many splits it has
+	statusMessage := pubsub.ControllerMessage{
+		ID:     jobID,
+		Status: pubsub.StatusJobStarted,
+		Count:  len(splits),
+	}
+	attributes := outputOptions.Attributes()
+	attributes["inputBucket"] = inputBucketName
+	attributes["outputBucket"] = outputBucketName
+	attributes["job"] = jobName
+	attributes["jobId"] = jobID
+	attributes["callbackUrl"] = callbackURL
+	pubsubClient.PublishPubSubMessage(pubsub.ControllerTopic, statusMessage, attributes)
+	// Wait for all the messages to be sent before sending a response
+	if sendErr := pubsubClient.Flush(); sendErr != nil {
+		writeJobResponse(w, http.StatusInternalServerError, "Error starting MapReduce: "+sendErr.Error(), jobID)
+		return
+	}
+	writeJobResponse(w, http.StatusOK, fmt.Sprintf("MapReduce started successfully - results will be stored in: %s/%s/",
+		outputBucketName, jobID), jobID)
+}
+
+// errSplitTooLarge is returned when a file that can't be split into byte ranges is larger than the split size.
+var errSplitTooLarge = errors.New("file is too large to be read by a single splitter")
+
+// bookMarkerWindow is the number of bytes at the start and end of a large file that its book's header and footer are
+// looked for in.
+const bookMarkerWindow int64 = 64 << 10
+
+// splitFiles returns the splits of the given files that are sent to the splitter. A file that is no larger than the
+// split size is sent whole, and a larger file is split into byte ranges of the split size, the last of which holds the
+// rest of the file, along with the offsets of the book's text in the whole file. Each file in an archive that is
+// selected by the given selection is sent separately. A compressed file and a file in an archive can only be read
+// whole by a single splitter, so an error wrapping errSplitTooLarge is returned if either is larger than the split
+// size.
+func splitFiles(ctx context.Context, client storage.Client, bucketName string, files []storage.ObjectAttrs,
+	selection storage.Selection, splitSize int64) ([]pubsub.SplitterData, error) {
+	splits := make([]pubsub.SplitterData, 0, len(files))
 	for _, file := range files {
-		// Create the data that will be sent to the splitter
-		splitterData := pubsub.SplitterData{
-			BucketName: inputBucketName,
-			FileName:   file,
+		if file.Archive != "" {
+			members, err := storage.ListArchiveMembers(ctx, client, bucketName, file)
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range members {
+				if !selection.MatchesMember(member.Name) {
+					continue
+				}
+				if member.Size > splitSize {
+					return nil, fmt.Errorf("%w: %s in archive %s is %d bytes, which is larger than the split size of "+
+						"%d bytes", errSplitTooLarge, member.Name, file.Name, member.Size, splitSize)
+				}
+				splits = append(splits, pubsub.SplitterData{BucketName: bucketName, FileName: file.Name,
+					Compression: file.Compression, Archive: file.Archive, Member: member.Name, Size: file.Size})
+			}
+			continue
+		}
+		if file.Compression != "" && file.Size > splitSize {
+			return nil, fmt.Errorf("%w: compressed file %s is %d bytes, which is larger than the split size of %d "+
+				"bytes", errSplitTooLarge, file.Name, file.Size, splitSize)
+		}
+		if file.Size <= splitSize {
+			splits = append(splits, pubsub.SplitterData{BucketName: bucketName, FileName: file.Name,
+				Compression: file.Compression})
+			continue
+		}
+		bodyStart, bodyEnd, err := findBookBody(ctx, client, bucketName, file)
+		if err != nil {
+			return nil, err
+		}
+		for start := int64(0); start < file.Size; start += splitSize {
+			end := start + splitSize
+			if end > file.Size {
+				end = file.Size
+			}
+			splits = append(splits, pubsub.SplitterData{BucketName: bucketName, FileName: file.Name, Start: start,
+				End: end, BodyStart: bodyStart, BodyEnd: bodyEnd})
+		}
+	}
+	return splits, nil
+}
+
+// findBookBody returns the byte range [start, end) of the given file that the book's text is in, without its header
+// and footer. Only the start and end of the file are read, since that is where the header and footer are, and the
+// range is the whole file if it has neither.
+func findBookBody(ctx context.Context, client storage.Client, bucketName string, file storage.ObjectAttrs) (int64,
+	int64, error) {
+	head, err := readObjectRange(ctx, client, bucketName, file.Name, 0, bookMarkerWindow)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := int64(bookHeaderEnd(string(head)))
+	// Only look for the footer after the header, since the start and end of a small file overlap
+	offset := file.Size - bookMarkerWindow
+	if offset < start {
+		offset = start
+	}
+	tail, err := readObjectRange(ctx, client, bucketName, file.Name, offset, -1)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, offset + int64(bookFooterStart(string(tail))), nil
+}
+
+// readObjectRange returns length bytes of the given object in the given bucket from the given offset, or the rest of
+// the object if length is negative.
+func readObjectRange(ctx context.Context, client storage.Client, bucketName, objectName string, offset,
+	length int64) ([]byte, error) {
+	reader, err := client.ReadObjectRange(ctx, bucketName, objectName, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file %s from bucket: %v", objectName, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file %s from bucket: %v", objectName, err)
+	}
+	return data, nil
+}
+
+// selectionFromQuery returns the selection of input files given by the query parameters. The include and exclude
+// parameters can be given more than once, and each can hold a comma separated list of patterns.
+func selectionFromQuery(query url.Values) (storage.Selection, error) {
+	selection := storage.Selection{
+		Prefix:   query.Get("input-prefix"),
+		Include:  splitPatterns(query["include"]),
+		Exclude:  splitPatterns(query["exclude"]),
+		Manifest: query.Get("input-manifest"),
+	}
+	var err error
+	if selection.MinSize, err = parseSize(query.Get("min-size")); err != nil {
+		return selection, fmt.Errorf("%w: min-size must be a number of bytes", storage.ErrInvalidSelection)
+	}
+	if selection.MaxSize, err = parseSize(query.Get("max-size")); err != nil {
+		return selection, fmt.Errorf("%w: max-size must be a number of bytes", storage.ErrInvalidSelection)
+	}
+	return selection, selection.Validate()
+}
+
+// outputOptionsFromQuery returns the options that the output files are written with given by the query parameters.
+func outputOptionsFromQuery(query url.Values) (storage.OutputOptions, error) {
+	options := storage.OutputOptions{
+		Format:      query.Get("output-format"),
+		Compression: query.Get("output-compression"),
+	}
+	if options.Compression == "none" {
+		options.Compression = ""
+	}
+	var err error
+	if options.MaxPartBytes, err = parseSize(query.Get("max-part-size")); err != nil {
+		return options, fmt.Errorf("%w: max-part-size must be a number of bytes", storage.ErrInvalidOutputOptions)
+	}
+	maxPartRecords, err := parseSize(query.Get("max-part-records"))
+	if err != nil {
+		return options, fmt.Errorf("%w: max-part-records must be a number of records", storage.ErrInvalidOutputOptions)
+	}
+	options.MaxPartRecords = int(maxPartRecords)
+	if merge := query.Get("merge-output"); merge != "" {
+		if options.Merge, err = strconv.ParseBool(merge); err != nil {
+			return options, fmt.Errorf("%w: merge-output must be true or false", storage.ErrInvalidOutputOptions)
 		}
-		wg.Add(1)
-		// Use a goroutine to send the messages concurrently -> this is faster than sending them sequentially
-		go func() {
-			defer wg.Done()
-			pubsubClient.SendPubSubMessage(pubsub.SplitterTopic, splitterData, map[string]string{"outputBucket": outputBucketName})
-		}()
-	}
-	// Use a wait group so we can wait for all the messages to be sent before sending a response
-	wg.Wait()
-	writeResponse(w, http.StatusOK, "MapReduce started successfully - results will be stored in: "+outputBucketName)
+	}
+	return options, options.Validate()
+}
+
+// splitPatterns returns the patterns in the given query parameter values, splitting each value on commas.
+func splitPatterns(values []string) []string {
+	var patterns []string
+	for _, value := range values {
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	return patterns
+}
+
+// parseSize returns the given size in bytes, or 0 if it is empty.
+func parseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return n, nil
+}
+
+// isValidCallbackURL returns true if the given URL is an absolute http or https URL, and false otherwise
+func isValidCallbackURL(callbackURL string) bool {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
 
 // writeResponse writes the response to the client
 func writeResponse(w http.ResponseWriter, code int, message string) {
+	writeJobResponse(w, code, message, "")
+}
+
+// writeJobResponse writes the response to the client including the ID of the job the response is about
+func writeJobResponse(w http.ResponseWriter, code int, message, jobID string) {
 	// Create a response object
 	responseMsg := Response{
 		ResponseCode: code,
 		Message:      message,
+		JobID:        jobID,
 	}
 	// Convert the response object to JSON
 	responseMsgBytes, err := json.Marshal(responseMsg)
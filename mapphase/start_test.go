@@ -1,23 +1,28 @@
 package mapphase
 
 import (
+	"archive/zip"
+	"bytes"
 	ps "cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
+	s "gitlab.com/cameron_w20/serverless-mapreduce/storage"
 	"gitlab.com/cameron_w20/serverless-mapreduce/test"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 )
 
 func TestStartMapReduce(t *testing.T) {
-	teardown, subscriptions := test.SetupPubSubTest(t, []string{"mapreduce-splitter"})
+	teardown, subscriptions := test.SetupPubSubTest(t, []string{"mapreduce-splitter", pubsub.ControllerTopic})
 	defer teardown(t)
 	teardownTestStorage := test.SetupStorageTest(t)
 	defer teardownTestStorage(t)
@@ -27,7 +32,6 @@ func TestStartMapReduce(t *testing.T) {
 		test.InputBucketName, test.OutputBucketName), nil)
 	rec := httptest.NewRecorder()
 
-	expectedResponse := `{"responseCode":200,"message":"MapReduce started successfully - results will be stored in: test-bucket-output"}`
 	expectedResult := pubsub.SplitterData{
 		BucketName: test.InputBucketName,
 		FileName:   "test.txt",
@@ -38,22 +42,45 @@ func TestStartMapReduce(t *testing.T) {
 
 	// Then
 	assert.Equal(t, http.StatusOK, rec.Code)
-	assert.Equal(t, expectedResponse, rec.Body.String())
+	var actualResponse Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &actualResponse); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+	assert.NotEmpty(t, actualResponse.JobID)
+	assert.Equal(t, "MapReduce started successfully - results will be stored in: test-bucket-output/"+
+		actualResponse.JobID+"/", actualResponse.Message)
 	// The subscription will listen forever unless given a context with a timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	var actualResult pubsub.SplitterData
+	var actualAttributes map[string]string
 	err := subscriptions[0].Receive(ctx, func(ctx context.Context, msg *ps.Message) {
 		// Ensure the message data matches the expected result
 		err := json.Unmarshal(msg.Data, &actualResult)
 		if err != nil {
 			t.Fatalf("Error unmarshalling message: %v", err)
 		}
+		actualAttributes = msg.Attributes
 		msg.Ack()
 	})
 	assert.Equal(t, expectedResult, actualResult)
+	assert.Equal(t, actualResponse.JobID, actualAttributes["jobId"])
 	// Ensure there are no errors returned by the receiver
 	assert.Nil(t, err)
+
+	// Ensure the controller was told that the job has started
+	controllerCtx, controllerCancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer controllerCancel()
+	var received pubsub.ControllerMessage
+	err = subscriptions[1].Receive(controllerCtx, func(ctx context.Context, msg *ps.Message) {
+		err := json.Unmarshal(msg.Data, &received)
+		if err != nil {
+			t.Fatalf("Error unmarshalling message: %v", err)
+		}
+		msg.Ack()
+	})
+	assert.Equal(t, pubsub.ControllerMessage{ID: actualResponse.JobID, Status: pubsub.StatusJobStarted, Count: 1}, received)
+	assert.Nil(t, err)
 }
 
 func TestStartMapReduce_CreatePubSubClientError(t *testing.T) {
@@ -196,3 +223,342 @@ func TestStartMapReduce_NoInputBucketProvidedError(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, rec.Code)
 	assert.Equal(t, expectedResponse, rec.Body.String())
 }
+
+func TestStartMapReduce_UnknownJobError(t *testing.T) {
+	// Given
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://someurl.com?input-bucket=%s&output-bucket=%s&job=unknown",
+		test.InputBucketName, test.OutputBucketName), nil)
+	rec := httptest.NewRecorder()
+
+	expectedResponse := `{"responseCode":400,"message":"Unknown job unknown, the available jobs are: anagrams"}`
+
+	// When
+	StartMapReduce(rec, req)
+
+	// Then
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, expectedResponse, rec.Body.String())
+}
+
+func TestStartMapReduce_UnknownOutputFormatError(t *testing.T) {
+	// Given
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://someurl.com?input-bucket=%s&output-bucket=%s&output-format=xml",
+		test.InputBucketName, test.OutputBucketName), nil)
+	rec := httptest.NewRecorder()
+
+	expectedResponse := `{"responseCode":400,"message":"Error configuring output files: invalid output options: unknown output format xml, the available formats are: csv, jsonl, text, tsv"}`
+
+	// When
+	StartMapReduce(rec, req)
+
+	// Then
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, expectedResponse, rec.Body.String())
+}
+
+func TestStartMapReduce_InvalidCallbackURLError(t *testing.T) {
+	// Given
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://someurl.com?input-bucket=%s&output-bucket=%s&callback-url=ftp://example.com",
+		test.InputBucketName, test.OutputBucketName), nil)
+	rec := httptest.NewRecorder()
+
+	expectedResponse := `{"responseCode":400,"message":"Invalid callback URL provided, it must be an absolute http or https URL"}`
+
+	// When
+	StartMapReduce(rec, req)
+
+	// Then
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, expectedResponse, rec.Body.String())
+}
+
+func TestStartMapReduce_UnsupportedStorageSchemeError(t *testing.T) {
+	// Given
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://someurl.com?input-bucket=%s&output-bucket=%s",
+		"ftp://some-bucket", test.OutputBucketName), nil)
+	rec := httptest.NewRecorder()
+
+	expectedResponse := `{"responseCode":400,"message":"Unsupported storage scheme ftp, the supported schemes are: file, gs, s3"}`
+
+	// When
+	StartMapReduce(rec, req)
+
+	// Then
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, expectedResponse, rec.Body.String())
+}
+
+func TestStartMapReduce_InvalidInputSelectionError(t *testing.T) {
+	// Given
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://someurl.com?input-bucket=%s&output-bucket=%s&min-size=abc",
+		test.InputBucketName, test.OutputBucketName), nil)
+	rec := httptest.NewRecorder()
+
+	expectedResponse := `{"responseCode":400,"message":"Error selecting input files: invalid input selection: min-size must be a number of bytes"}`
+
+	// When
+	StartMapReduce(rec, req)
+
+	// Then
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, expectedResponse, rec.Body.String())
+}
+
+func TestStartMapReduce_InvalidSplitSizeError(t *testing.T) {
+	// Given
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://someurl.com?input-bucket=%s&output-bucket=%s&split-size=0",
+		test.InputBucketName, test.OutputBucketName), nil)
+	rec := httptest.NewRecorder()
+
+	expectedResponse := `{"responseCode":400,"message":"Invalid split size provided, it must be a positive number of bytes"}`
+
+	// When
+	StartMapReduce(rec, req)
+
+	// Then
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, expectedResponse, rec.Body.String())
+}
+
+func TestSplitFiles(t *testing.T) {
+	// Given
+	memory := s.NewMemory()
+	memory.PutObject("input", "large.txt", []byte("the quick brown fox jumps"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+	files := []s.ObjectAttrs{
+		{Name: "small.txt", Size: 10},
+		{Name: "compressed.txt.gz", Size: 10, Compression: s.CompressionGzip},
+		{Name: "large.txt", Size: 25},
+	}
+
+	expectedSplits := []pubsub.SplitterData{
+		{BucketName: "input", FileName: "small.txt"},
+		{BucketName: "input", FileName: "compressed.txt.gz", Compression: s.CompressionGzip},
+		{BucketName: "input", FileName: "large.txt", Start: 0, End: 10, BodyEnd: 25},
+		{BucketName: "input", FileName: "large.txt", Start: 10, End: 20, BodyEnd: 25},
+		{BucketName: "input", FileName: "large.txt", Start: 20, End: 25, BodyEnd: 25},
+	}
+
+	// When
+	splits, err := splitFiles(context.Background(), client, "input", files, s.Selection{}, 10)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, expectedSplits, splits)
+	assert.Equal(t, "small.txt", splits[0].SplitName())
+	assert.Equal(t, "large.txt@10-20", splits[3].SplitName())
+}
+
+func TestSplitFiles_BookBody(t *testing.T) {
+	// Given
+	text := "#SOME BOOK HEADER# *** START OF THIS PROJECT GUTENBERG EBOOK SOME TITLE *** The quick brown fox\n" +
+		"jumps over\nthe lazy dog.\nEnd of Project Gutenberg's Some Title\n*** END OF THE PROJECT GUTENBERG EBOOK " +
+		"SOME TITLE *** #SOME BOOK FOOTER#"
+	memory := s.NewMemory()
+	memory.PutObject("input", "book.txt", []byte(text))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+	files := []s.ObjectAttrs{{Name: "book.txt", Size: int64(len(text))}}
+	expectedRecords := splitRecords(removeBookHeaderAndFooter(text))
+
+	for splitSize := int64(1); splitSize < int64(len(text)); splitSize++ {
+		// When
+		splits, err := splitFiles(context.Background(), client, "input", files, s.Selection{}, splitSize)
+		assert.Nil(t, err)
+		records := make([]string, 0)
+		for _, split := range splits {
+			offset := split.Start
+			if offset > 0 {
+				offset--
+			}
+			result, err := readSplit(strings.NewReader(text[offset:]), split.Start, split.End, split.BodyStart,
+				split.BodyEnd)
+			assert.Nil(t, err)
+			records = append(records, splitRecords(result)...)
+		}
+
+		// Then
+		assert.Equal(t, expectedRecords, records, "split size %d", splitSize)
+	}
+}
+
+func TestSplitFiles_TooLargeError(t *testing.T) {
+	// Given
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	member, _ := writer.Create("book.txt")
+	member.Write([]byte("some text that is too long"))
+	writer.Close()
+	memory := s.NewMemory()
+	memory.PutObject("input", "books.zip", archive.Bytes())
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+	tests := []struct {
+		name     string
+		file     s.ObjectAttrs
+		expected string
+	}{
+		{name: "Compressed", file: s.ObjectAttrs{Name: "book.txt.gz", Size: 25, Compression: s.CompressionGzip},
+			expected: "compressed file book.txt.gz is 25 bytes, which is larger than the split size of 10 bytes"},
+		{name: "ArchiveMember", file: s.ObjectAttrs{Name: "books.zip", Size: int64(archive.Len()),
+			Archive: s.ArchiveZip},
+			expected: "book.txt in archive books.zip is 26 bytes, which is larger than the split size of 10 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			_, err := splitFiles(context.Background(), client, "input", []s.ObjectAttrs{tt.file}, s.Selection{}, 10)
+
+			// Then
+			assert.True(t, errors.Is(err, errSplitTooLarge))
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+func TestSplitFiles_Archive(t *testing.T) {
+	// Given
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for _, name := range []string{"book-1.txt", "README.md", "books/book-2.txt"} {
+		member, _ := writer.Create(name)
+		member.Write([]byte("some text"))
+	}
+	writer.Close()
+	memory := s.NewMemory()
+	memory.PutObject("input", "books.zip", archive.Bytes())
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+	files := []s.ObjectAttrs{{Name: "books.zip", Size: int64(archive.Len()), Archive: s.ArchiveZip}}
+
+	expectedSplits := []pubsub.SplitterData{
+		{BucketName: "input", FileName: "books.zip", Archive: s.ArchiveZip, Member: "book-1.txt",
+			Size: int64(archive.Len())},
+		{BucketName: "input", FileName: "books.zip", Archive: s.ArchiveZip, Member: "books/book-2.txt",
+			Size: int64(archive.Len())},
+	}
+
+	// When
+	splits, err := splitFiles(context.Background(), client, "input", files, s.Selection{}, 10)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, expectedSplits, splits)
+	assert.Equal(t, "books.zip!book-1.txt", splits[0].SplitName())
+}
+
+func TestSplitFiles_InvalidArchiveError(t *testing.T) {
+	// Given
+	memory := s.NewMemory()
+	memory.PutObject("input", "books.zip", []byte("not a zip archive"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+	files := []s.ObjectAttrs{{Name: "books.zip", Size: 17, Archive: s.ArchiveZip}}
+
+	// When
+	_, err := splitFiles(context.Background(), client, "input", files, s.Selection{}, 10)
+
+	// Then
+	assert.True(t, errors.Is(err, s.ErrInvalidArchive))
+}
+
+func TestSelectionFromQuery(t *testing.T) {
+	// Given
+	query := url.Values{
+		"input-prefix": {"books/"},
+		"include":      {"*.txt,*.md", "*.csv"},
+		"exclude":      {"draft-*"},
+		"min-size":     {"10"},
+		"max-size":     {"1000"},
+	}
+
+	expectedSelection := s.Selection{
+		Prefix:  "books/",
+		Include: []string{"*.txt", "*.md", "*.csv"},
+		Exclude: []string{"draft-*"},
+		MinSize: 10,
+		MaxSize: 1000,
+	}
+
+	// When
+	selection, err := selectionFromQuery(query)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, expectedSelection, selection)
+}
+
+func TestSelectionFromQuery_ManifestWithPatternsError(t *testing.T) {
+	// Given
+	query := url.Values{"input-manifest": {"inputs.txt"}, "include": {"*.txt"}}
+
+	// When
+	_, err := selectionFromQuery(query)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "a manifest can't be used with a prefix, patterns or a size range")
+}
+
+func TestOutputOptionsFromQuery(t *testing.T) {
+	// Given
+	query := url.Values{
+		"output-format":      {"jsonl"},
+		"output-compression": {"gzip"},
+		"max-part-size":      {"1048576"},
+		"max-part-records":   {"1000"},
+		"merge-output":       {"true"},
+	}
+
+	expectedOptions := s.OutputOptions{
+		Format:         "jsonl",
+		Compression:    s.CompressionGzip,
+		MaxPartBytes:   1048576,
+		MaxPartRecords: 1000,
+		Merge:          true,
+	}
+
+	// When
+	options, err := outputOptionsFromQuery(query)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, expectedOptions, options)
+}
+
+func TestOutputOptionsFromQuery_UnsupportedCompressionError(t *testing.T) {
+	// Given
+	query := url.Values{"output-compression": {"bzip2"}}
+
+	// When
+	_, err := outputOptionsFromQuery(query)
+
+	// Then
+	assert.True(t, errors.Is(err, s.ErrInvalidOutputOptions))
+	assert.Contains(t, err.Error(), "unsupported output compression bzip2, the supported compressions are: gzip")
+}
+
+func TestOutputOptionsFromQuery_InvalidMaxPartRecordsError(t *testing.T) {
+	// Given
+	query := url.Values{"output-compression": {"none"}, "max-part-records": {"-1"}}
+
+	// When
+	_, err := outputOptionsFromQuery(query)
+
+	// Then
+	assert.True(t, errors.Is(err, s.ErrInvalidOutputOptions))
+	assert.Contains(t, err.Error(), "max-part-records must be a number of records")
+}
+
+func TestOutputOptionsFromQuery_InvalidMergeOutputError(t *testing.T) {
+	// Given
+	query := url.Values{"merge-output": {"sometimes"}}
+
+	// When
+	_, err := outputOptionsFromQuery(query)
+
+	// Then
+	assert.True(t, errors.Is(err, s.ErrInvalidOutputOptions))
+	assert.Contains(t, err.Error(), "merge-output must be true or false")
+}
@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+)
+
+// DefaultClaimCheckThresholdBytes is the size in bytes above which the data of a message is offloaded to storage if the
+// PUBSUB_CLAIM_CHECK_THRESHOLD environment variable isn't set. It leaves room for the attributes below pubsub's limit of
+// 10MB per message.
+const DefaultClaimCheckThresholdBytes = 9 * 1000 * 1000
+
+// ClaimCheckAttribute is the attribute of a message whose data has been offloaded to storage. Its value is the name of
+// the object holding the data, in the bucket of the message's "outputBucket" attribute.
+const ClaimCheckAttribute = "claimCheck"
+
+// claimCheckThreshold returns the size in bytes above which the data of a message is offloaded to storage, which is set
+// by the PUBSUB_CLAIM_CHECK_THRESHOLD environment variable.
+func claimCheckThreshold() (int, error) {
+	threshold, err := intFromEnv("PUBSUB_CLAIM_CHECK_THRESHOLD")
+	if err != nil {
+		return 0, err
+	}
+	if threshold <= 0 {
+		return DefaultClaimCheckThresholdBytes, nil
+	}
+	return threshold, nil
+}
+
+// offloadData writes the given message data to storage if it is larger than the claim-check threshold, so that a
+// message of any size can be sent. It returns the data and attributes to send, which for offloaded data are no data and
+// a copy of the attributes with the ClaimCheckAttribute added. The data is written to the temporary directory of the
+// job in the attributes, so it is deleted along with the job's temporary output files once the job has finished.
+func offloadData(ctx context.Context, data []byte, attributes map[string]string) ([]byte, map[string]string, error) {
+	threshold, err := claimCheckThreshold()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) <= threshold {
+		return data, attributes, nil
+	}
+	bucketName := attributes["outputBucket"]
+	if bucketName == "" {
+		return nil, nil, fmt.Errorf("message data of %d bytes is larger than %d bytes, and the message has no output "+
+			"bucket to offload it to", len(data), threshold)
+	}
+	objectName := storage.TemporaryPrefix(storage.OutputPrefix(attributes["jobId"])) + "claim-check/" +
+		uuid.New().String()
+	storageClient, err := storage.New(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer storageClient.Close()
+	if err := storageClient.WriteObject(ctx, bucketName, objectName, data); err != nil {
+		return nil, nil, fmt.Errorf("error offloading message data: %v", err)
+	}
+	claimAttributes := make(map[string]string, len(attributes)+1)
+	for k, v := range attributes {
+		claimAttributes[k] = v
+	}
+	claimAttributes[ClaimCheckAttribute] = objectName
+	return nil, claimAttributes, nil
+}
+
+// resolveData returns the data of a message with the given data and attributes, reading it from storage if it was
+// offloaded by offloadData. The ClaimCheckAttribute is removed from the attributes, so that it isn't passed on to the
+// messages that functions send with them. The data isn't deleted, since the message may be redelivered.
+func resolveData(ctx context.Context, data []byte, attributes map[string]string) ([]byte, error) {
+	objectName, ok := attributes[ClaimCheckAttribute]
+	if !ok {
+		return data, nil
+	}
+	delete(attributes, ClaimCheckAttribute)
+	storageClient, err := storage.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer storageClient.Close()
+	data, err = storageClient.ReadObject(ctx, attributes["outputBucket"], objectName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading offloaded message data: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+	"strings"
+	"testing"
+)
+
+func TestMemoryClient_ClaimCheck(t *testing.T) {
+	// Given
+	memory := storage.NewMemory()
+	memory.CreateBucket("output")
+	storage.RegisterBackend("test-mem", memory)
+	setEnv(t, "PUBSUB_CLAIM_CHECK_THRESHOLD", "20")
+	broker := NewBroker(BrokerConfig{})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	var received []string
+	var receivedAttributes map[string]string
+	var publishedData []byte
+	broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+		var msg MessagePublishedData
+		_ = e.DataAs(&msg)
+		publishedData = msg.Message.Data
+		client, err := New(ctx, e)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		receivedAttributes, err = client.ReadPubSubMessage(&received)
+		return err
+	})
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+	attributes := map[string]string{"outputBucket": "test-mem://output", "jobId": "job-1"}
+
+	// When
+	err = client.SendPubSubMessage("some-topic", []string{"some", "data", "that", "is", "too", "large"}, attributes)
+	broker.Wait()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"some", "data", "that", "is", "too", "large"}, received)
+	// The data should have been offloaded to the job's temporary directory, and the reference to it removed from the
+	// attributes that are passed on
+	assert.Empty(t, publishedData)
+	assert.Equal(t, map[string]string{"outputBucket": "test-mem://output", "jobId": "job-1"}, receivedAttributes)
+	assert.Equal(t, map[string]string{"outputBucket": "test-mem://output", "jobId": "job-1"}, attributes)
+	objects := memory.Objects("output")
+	assert.Len(t, objects, 1)
+	for objectName, data := range objects {
+		assert.True(t, strings.HasPrefix(objectName, "job-1/_temporary/claim-check/"))
+		assert.Equal(t, `["some","data","that","is","too","large"]`, string(data))
+	}
+}
+
+func TestOffloadData_BelowThreshold(t *testing.T) {
+	// Given
+	setEnv(t, "PUBSUB_CLAIM_CHECK_THRESHOLD", "20")
+	attributes := map[string]string{"jobId": "job-1"}
+
+	// When
+	data, sentAttributes, err := offloadData(context.Background(), []byte(`["some","data"]`), attributes)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, `["some","data"]`, string(data))
+	assert.Equal(t, attributes, sentAttributes)
+}
+
+func TestOffloadData_NoOutputBucketError(t *testing.T) {
+	// Given
+	setEnv(t, "PUBSUB_CLAIM_CHECK_THRESHOLD", "10")
+
+	// When
+	_, _, err := offloadData(context.Background(), []byte(`["some","data"]`), map[string]string{"jobId": "job-1"})
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "message data of 15 bytes is larger than 10 bytes, and the message has no output "+
+		"bucket to offload it to")
+}
+
+func TestResolveData_MissingObjectError(t *testing.T) {
+	// Given
+	memory := storage.NewMemory()
+	memory.CreateBucket("output")
+	storage.RegisterBackend("test-mem", memory)
+	attributes := map[string]string{"outputBucket": "test-mem://output", ClaimCheckAttribute: "job-1/_temporary/x"}
+
+	// When
+	_, err := resolveData(context.Background(), nil, attributes)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error reading offloaded message data")
+}
+
+func TestClaimCheckThreshold(t *testing.T) {
+	threshold, err := claimCheckThreshold()
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultClaimCheckThresholdBytes, threshold)
+	setEnv(t, "PUBSUB_CLAIM_CHECK_THRESHOLD", "1000")
+	threshold, err = claimCheckThreshold()
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, threshold)
+}
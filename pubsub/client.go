@@ -3,30 +3,46 @@ package pubsub
 import (
 	"cloud.google.com/go/pubsub"
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/cloudevents/sdk-go/v2/event"
 	"log"
 	"os"
+	"sync"
 )
 
-// Client is an interface for interacting with pubsub.
+// Client is an interface for interacting with pubsub. PublishPubSubMessage publishes a message without waiting for it
+// to be sent, so that many messages can be sent in batches, and Flush waits for every message published that way.
+// LastDeliveryAttempt reports whether the message that triggered the function won't be redelivered if it fails.
 type Client interface {
 	Close()
 	ReadPubSubMessage(data interface{}) (map[string]string, error)
-	SendPubSubMessage(topicName string, data interface{}, attributes map[string]string)
+	SendPubSubMessage(topicName string, data interface{}, attributes map[string]string) error
+	PublishPubSubMessage(topicName string, data interface{}, attributes map[string]string) PublishResult
+	Flush() error
+	LastDeliveryAttempt() bool
 }
 
 type clientImpl struct {
-	ctx    context.Context
-	event  event.Event
-	client *pubsub.Client
+	ctx     context.Context
+	event   event.Event
+	client  *pubsub.Client
+	mu      sync.Mutex
+	topics  map[string]*pubsub.Topic
+	pending pendingResults
 }
 
 var _ Client = &clientImpl{}
 
-// New returns a new pubsub client.
+// New returns a new pubsub client. If a Broker has been set with UseBroker, or the PUBSUB_TRANSPORT environment
+// variable is set to "memory", the client sends messages to an in-memory Broker rather than to pubsub.
 func New(ctx context.Context, e event.Event) (Client, error) {
+	b, err := currentBroker()
+	if err != nil {
+		return nil, fmt.Errorf("error creating pubsub client: %v", err)
+	}
+	if b != nil {
+		return &memoryClient{ctx: ctx, event: e, broker: b}, nil
+	}
 	// Create a pubsub client
 	client, err := pubsub.NewClient(ctx, os.Getenv("GCP_PROJECT"))
 	if err != nil {
@@ -36,11 +52,18 @@ func New(ctx context.Context, e event.Event) (Client, error) {
 		ctx:    ctx,
 		event:  e,
 		client: client,
+		topics: make(map[string]*pubsub.Topic),
 	}, nil
 }
 
-// Close closes the pubsub client.
-func (c clientImpl) Close() {
+// Close sends any messages still waiting to be sent in a batch and closes the pubsub client.
+func (c *clientImpl) Close() {
+	c.mu.Lock()
+	for _, topic := range c.topics {
+		topic.Stop()
+	}
+	c.topics = make(map[string]*pubsub.Topic)
+	c.mu.Unlock()
 	err := c.client.Close()
 	if err != nil {
 		log.Printf("Error closing pubsub client: %v", err)
@@ -49,43 +72,211 @@ func (c clientImpl) Close() {
 
 // ReadPubSubMessage reads a pubsub message from the given subscription and returns a pubsub client and the attributes
 // of the received message.
-func (c clientImpl) ReadPubSubMessage(data interface{}) (map[string]string, error) {
+func (c *clientImpl) ReadPubSubMessage(data interface{}) (map[string]string, error) {
+	return readMessage(c.ctx, c.event, data)
+}
+
+// readMessage decodes the data of the pubsub message in the given event into the given data interface and returns the
+// attributes of the message. Data that was offloaded to storage because it was too large for a message is read from
+// storage first. The message is checked against the schema of the topic it was published to, and an error wrapping
+// ErrInvalidMessage is returned if it doesn't match.
+func readMessage(ctx context.Context, e event.Event, data interface{}) (map[string]string, error) {
 	// Get the message from the event data
 	var msg MessagePublishedData
-	if err := c.event.DataAs(&msg); err != nil {
+	if err := e.DataAs(&msg); err != nil {
 		return nil, fmt.Errorf("error getting data from event: %v", err)
 	}
-	// Attempt to unmarshal the message data into the given data interface
-	if err := json.Unmarshal(msg.Message.Data, &data); err != nil && data != nil {
-		return nil, fmt.Errorf("error unmarshalling message: %v", err)
+	// Always return a map of attributes so that functions can add to them before passing them on
+	attributes := msg.Message.Attributes
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	messageData, err := resolveData(ctx, msg.Message.Data, attributes)
+	if err != nil {
+		return nil, err
+	}
+	// Check the message against the schema of the topic it was published to
+	schema, version, hasSchema, err := messageSchema(topicFromSource(e.Source()), attributes)
+	if err != nil {
+		return nil, err
+	}
+	target := data
+	if hasSchema {
+		if err := validateAttributes(schema, attributes); err != nil {
+			return nil, err
+		}
+		if target, err = dataTarget(schema, data); err != nil {
+			return nil, err
+		}
+	}
+	// Decode the message data into the given data interface with the codec it was sent with, upgrading the data of an
+	// earlier version of the schema
+	decoded := target
+	if hasSchema {
+		decoded = decodeTarget(schema, version, target)
+	}
+	if err := decodeData(messageData, attributes, decoded); err != nil {
+		return nil, err
+	}
+	if hasSchema {
+		upgradeData(schema, version, decoded, target)
+	}
+	if hasSchema && schema.Validate != nil {
+		if err := schema.Validate(target); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+	}
+	return attributes, nil
+}
+
+// SendPubSubMessage sends a message to the given topic and waits for it to be sent. The message is encoded with the
+// configured codec and compression and sent as the data of the pubsub message, unless it is larger than the
+// claim-check threshold, in which case it is offloaded to storage and the message only carries a reference to it. The
+// attributes are also sent with the message. Transient publish errors are retried with exponential backoff, and an
+// error is returned if the message couldn't be sent so that the calling function can fail and have its own message
+// redelivered.
+func (c *clientImpl) SendPubSubMessage(topicName string, data interface{}, attributes map[string]string) error {
+	return c.publish(topicName, data, attributes).Get(c.ctx)
+}
+
+// PublishPubSubMessage publishes a message to the given topic in the same way as SendPubSubMessage, but returns without
+// waiting for the message to be sent, so that it can be sent in a batch with other messages published to the topic.
+// The returned result can be used to wait for the message, or Flush can be used to wait for every published message.
+func (c *clientImpl) PublishPubSubMessage(topicName string, data interface{},
+	attributes map[string]string) PublishResult {
+	result := c.publish(topicName, data, attributes)
+	c.pending.add(result)
+	return result
+}
+
+// Flush waits for every message published with PublishPubSubMessage to be sent, and returns an error if any of them
+// couldn't be sent.
+func (c *clientImpl) Flush() error {
+	return c.pending.flush(c.ctx)
+}
+
+// LastDeliveryAttempt returns true if the message in the client's event is being delivered for the last time, which is
+// when it has been delivered as many times as the PUBSUB_MAX_DELIVERY_ATTEMPTS environment variable, by default 5.
+// This should match the maximum delivery attempts of the dead-letter policy of the function's subscription. Pubsub only
+// counts the delivery attempts of subscriptions with a dead-letter policy, so it always returns true without one, since
+// the function can't tell whether the message will be redelivered.
+func (c *clientImpl) LastDeliveryAttempt() bool {
+	maxDeliveryAttempts, err := intFromEnv("PUBSUB_MAX_DELIVERY_ATTEMPTS")
+	if err != nil || maxDeliveryAttempts <= 0 {
+		maxDeliveryAttempts = defaultMaxDeliveryAttempts
+	}
+	return lastDeliveryAttempt(c.event, maxDeliveryAttempts)
+}
+
+// lastDeliveryAttempt returns true if the message in the given event has been delivered the given maximum number of
+// times. It also returns true if the event doesn't say how many times the message has been delivered, so that a
+// failure is still reported when the subscription has no dead-letter policy.
+func lastDeliveryAttempt(e event.Event, maxDeliveryAttempts int) bool {
+	var msg MessagePublishedData
+	if err := e.DataAs(&msg); err != nil {
+		return true
 	}
-	return msg.Message.Attributes, nil
+	return msg.DeliveryAttempt == 0 || msg.DeliveryAttempt >= maxDeliveryAttempts
 }
 
-// SendPubSubMessage sends a message to the given topic. The message is marshalled into JSON and sent as the data of the
-// pubsub message. The attributes are also sent with the message.
-func (c clientImpl) SendPubSubMessage(topicName string, data interface{}, attributes map[string]string) {
-	// Get the JSON encoding of the data
-	dataBytes, err := json.Marshal(data)
+// setDeliveryAttempt sets the number of times the message in the given event has been delivered.
+func setDeliveryAttempt(e *event.Event, deliveryAttempt int) error {
+	var msg MessagePublishedData
+	if err := e.DataAs(&msg); err != nil {
+		return fmt.Errorf("error getting data from event: %v", err)
+	}
+	msg.DeliveryAttempt = deliveryAttempt
+	if err := e.SetData(event.ApplicationJSON, msg); err != nil {
+		return fmt.Errorf("error setting event data: %v", err)
+	}
+	return nil
+}
+
+// publish publishes a message to the given topic and returns its result. The message is handed to the topic straight
+// away so that it is batched with the other messages published to the topic, and the result is waited for, and the
+// message published again if there was a transient error, in the background.
+func (c *clientImpl) publish(topicName string, data interface{}, attributes map[string]string) *publishResult {
+	result := newPublishResult()
+	dataBytes, attributes, err := prepareMessage(c.ctx, topicName, data, attributes)
 	if err != nil {
-		log.Printf("Error marshalling word data: %v", err)
-		return
+		result.set(fmt.Errorf("error publishing message to topic %s: %v", topicName, err))
+		return result
+	}
+	topic := c.topic(topicName)
+	first := topic.Publish(c.ctx, &pubsub.Message{
+		Data:       dataBytes,
+		Attributes: attributes,
+	})
+	go func() {
+		attempt := 0
+		err := retryPublish(c.ctx, func() error {
+			attempt++
+			publishResult := first
+			if attempt > 1 {
+				// A message can't be published twice, so a new one is published for each retry
+				publishResult = topic.Publish(c.ctx, &pubsub.Message{
+					Data:       dataBytes,
+					Attributes: attributes,
+				})
+			}
+			// Wait for the message to be sent
+			_, err := publishResult.Get(c.ctx)
+			return err
+		})
+		if err != nil {
+			err = fmt.Errorf("error publishing message to topic %s: %v", topicName, err)
+		}
+		result.set(err)
+	}()
+	return result
+}
+
+// topic returns the client's handle for the topic with the given name, creating it the first time it is needed. The
+// handle is kept until the client is closed, so that the messages published to the topic are sent in batches.
+func (c *clientImpl) topic(topicName string) *pubsub.Topic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if topic, ok := c.topics[topicName]; ok {
+		return topic
 	}
-	// Create a topic to send messages to
 	topic := c.client.Topic(topicName)
-	defer topic.Stop()
 	// Set the topic publish settings
 	topic.PublishSettings.ByteThreshold = MaxMessageSizeBytes
 	topic.PublishSettings.CountThreshold = MaxMessageCount
 	topic.PublishSettings.DelayThreshold = MaxMessageDelay
-	// Push the message to the topic
-	result := topic.Publish(c.ctx, &pubsub.Message{
-		Data:       dataBytes,
-		Attributes: attributes,
-	})
-	// Wait for the message to be sent and log any errors
-	_, err = result.Get(c.ctx)
+	c.topics[topicName] = topic
+	return topic
+}
+
+// prepareMessage returns the data and attributes of a message sending the given data with the given attributes to the
+// given topic. The attributes are tagged with the topic's schema, and the data is encoded, and then offloaded to
+// storage if it is still larger than the claim-check threshold.
+func prepareMessage(ctx context.Context, topicName string, data interface{}, attributes map[string]string) ([]byte,
+	map[string]string, error) {
+	dataBytes, attributes, err := encodeData(data, tagAttributes(topicName, attributes))
 	if err != nil {
-		log.Printf("Error publishing message: %v", err)
+		return nil, nil, err
+	}
+	return offloadData(ctx, dataBytes, attributes)
+}
+
+// ReportFailure sends a message to the controller topic to let it know that a function has failed with the given error
+// for the job in the given attributes, which aborts the job. The failure is only reported on the message's last
+// delivery attempt, so that an error that goes away when the message is redelivered doesn't abort the job. Since it is
+// only called once a function has already failed, an error sending the message is logged rather than returned.
+func ReportFailure(client Client, attributes map[string]string, err error) {
+	if !client.LastDeliveryAttempt() {
+		log.Printf("Not reporting failure of job %s to controller, since the message will be redelivered: %v",
+			attributes["jobId"], err)
+		return
+	}
+	statusMessage := ControllerMessage{
+		ID:     attributes["jobId"],
+		Status: StatusFailed,
+		Error:  err.Error(),
+	}
+	sendErr := client.SendPubSubMessage(ControllerTopic, statusMessage, map[string]string{"jobId": attributes["jobId"]})
+	if sendErr != nil {
+		log.Printf("Error reporting failure to controller: %v", sendErr)
 	}
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/cloudevents/sdk-go/v2/event"
 	"github.com/stretchr/testify/assert"
 	"gitlab.com/cameron_w20/serverless-mapreduce/test"
+	"sync"
 	"testing"
 	"time"
 )
@@ -107,9 +108,10 @@ func TestSendPubSubMessage(t *testing.T) {
 	defer client.Close()
 
 	// When
-	client.SendPubSubMessage("some-topic", data, attributes)
+	err = client.SendPubSubMessage("some-topic", data, attributes)
 
 	// Then
+	assert.Nil(t, err)
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	var actualResult []string
@@ -127,3 +129,118 @@ func TestSendPubSubMessage(t *testing.T) {
 	assert.Equal(t, []string{"some", "data"}, actualResult)
 	assert.Equal(t, "some-value", actualAttr["some-key"])
 }
+
+func TestSendPubSubMessage_MarshalError(t *testing.T) {
+	// Setup test
+	teardown, _ := test.SetupPubSubTest(t, []string{"some-topic"})
+	defer teardown(t)
+
+	// Given
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+	defer client.Close()
+
+	// When
+	err = client.SendPubSubMessage("some-topic", make(chan int), nil)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error marshalling message data")
+}
+
+func TestPublishPubSubMessage(t *testing.T) {
+	// Setup test
+	teardown, subscriptions := test.SetupPubSubTest(t, []string{"some-topic"})
+	defer teardown(t)
+
+	// Given
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+	defer client.Close()
+
+	// When
+	var results []PublishResult
+	for _, word := range []string{"some", "data"} {
+		results = append(results, client.PublishPubSubMessage("some-topic", []string{word}, nil))
+	}
+	err = client.Flush()
+
+	// Then
+	assert.Nil(t, err)
+	for _, result := range results {
+		assert.Nil(t, result.Get(context.Background()))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	var actualResult []string
+	var mu sync.Mutex
+	err = subscriptions[0].Receive(ctx, func(ctx context.Context, msg *ps.Message) {
+		var words []string
+		if err := json.Unmarshal(msg.Data, &words); err != nil {
+			t.Errorf("Error unmarshalling message: %v", err)
+		}
+		mu.Lock()
+		actualResult = append(actualResult, words...)
+		mu.Unlock()
+		msg.Ack()
+	})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"some", "data"}, actualResult)
+}
+
+func TestPublishPubSubMessage_MarshalError(t *testing.T) {
+	// Setup test
+	teardown, _ := test.SetupPubSubTest(t, []string{"some-topic"})
+	defer teardown(t)
+
+	// Given
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+	defer client.Close()
+
+	// When
+	result := client.PublishPubSubMessage("some-topic", make(chan int), nil)
+	err = client.Flush()
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error marshalling message data")
+	assert.Equal(t, err, result.Get(context.Background()))
+}
+
+func TestLastDeliveryAttempt(t *testing.T) {
+	tests := []struct {
+		name            string
+		deliveryAttempt int
+		expected        bool
+	}{
+		{"Unknown", 0, true},
+		{"FirstAttempt", 1, false},
+		{"LastAttempt", 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given
+			e, err := NewMessageEvent("some-topic", []byte("null"), nil)
+			if err != nil {
+				t.Fatalf("Error creating event: %v", err)
+			}
+			if err := setDeliveryAttempt(&e, tt.deliveryAttempt); err != nil {
+				t.Fatalf("Error setting delivery attempt: %v", err)
+			}
+			client := &clientImpl{event: e}
+
+			// When
+			actual := client.LastDeliveryAttempt()
+
+			// Then
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
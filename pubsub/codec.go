@@ -0,0 +1,203 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
+	"io"
+	"os"
+)
+
+// CodecJSON is the name of the codec that encodes message data as JSON. It is the default codec, and messages without
+// a CodecAttribute are decoded with it, so that messages sent before codecs were added can still be read.
+const CodecJSON = "json"
+
+// CodecBinary is the name of the codec that encodes message data in a compact binary encoding.
+const CodecBinary = "binary"
+
+// CodecAttribute is the attribute of a message holding the name of the codec its data was encoded with.
+const CodecAttribute = "codec"
+
+// CompressionAttribute is the attribute of a message whose data has been compressed after it was encoded. Its value
+// is the compression of the data, e.g. "gzip".
+const CompressionAttribute = "compression"
+
+// Codec encodes the data of messages into bytes and decodes them again.
+type Codec interface {
+	// Name returns the name of the codec, which is sent in the CodecAttribute of the messages it encodes.
+	Name() string
+	// Marshal returns the encoding of the given data.
+	Marshal(data interface{}) ([]byte, error)
+	// Unmarshal decodes the given encoded data into the given pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// codecs holds the codecs that messages can be encoded with, by name.
+var codecs = map[string]Codec{
+	CodecJSON:   jsonCodec{},
+	CodecBinary: binaryCodec{},
+}
+
+// CodecByName returns the codec with the given name, or the JSON codec if the name is empty.
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		return jsonCodec{}, nil
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported message codec: %s", name)
+	}
+	return codec, nil
+}
+
+// jsonCodec is a Codec that encodes message data as JSON.
+type jsonCodec struct{}
+
+// Name returns the name of the JSON codec.
+func (jsonCodec) Name() string {
+	return CodecJSON
+}
+
+// Marshal returns the JSON encoding of the given data.
+func (jsonCodec) Marshal(data interface{}) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+// Unmarshal decodes the given JSON into the given pointer. Fields that the pointer's type doesn't have are an error, so
+// that data sent with a different schema isn't silently dropped.
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// binaryCodec is a Codec that encodes message data with gob, which is much smaller than JSON for the sets of words
+// sent by the mapper, since the words aren't sent as the keys of JSON objects. Nil data is encoded as no bytes, which
+// leave the pointer they are decoded into unchanged.
+type binaryCodec struct{}
+
+// Name returns the name of the binary codec.
+func (binaryCodec) Name() string {
+	return CodecBinary
+}
+
+// Marshal returns the gob encoding of the given data.
+func (binaryCodec) Marshal(data interface{}) ([]byte, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(data); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Unmarshal decodes the given gob encoding into the given pointer.
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// messageEncoding returns the codec and compression that messages are sent with, which are set by the PUBSUB_CODEC
+// and PUBSUB_COMPRESSION environment variables. By default messages are encoded as JSON and aren't compressed.
+func messageEncoding() (Codec, string, error) {
+	codec, err := CodecByName(os.Getenv("PUBSUB_CODEC"))
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading PUBSUB_CODEC: %v", err)
+	}
+	compression := os.Getenv("PUBSUB_COMPRESSION")
+	if compression != "" && compression != storage.CompressionGzip && compression != storage.CompressionZlib {
+		return nil, "", fmt.Errorf("error reading PUBSUB_COMPRESSION: unsupported compression: %s", compression)
+	}
+	return codec, compression, nil
+}
+
+// encodeData encodes the given message data with the codec and compression that messages are sent with, and returns
+// the encoded data and a copy of the given attributes recording how it was encoded. The data is only compressed if
+// that makes it smaller, which it often doesn't for small messages. The codec and compression of the message that
+// the attributes were received with are replaced, since functions pass on the attributes of the messages they read.
+func encodeData(data interface{}, attributes map[string]string) ([]byte, map[string]string, error) {
+	codec, compression, err := messageEncoding()
+	if err != nil {
+		return nil, nil, err
+	}
+	dataBytes, err := codec.Marshal(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshalling message data: %v", err)
+	}
+	encodedAttributes := make(map[string]string, len(attributes)+2)
+	for k, v := range attributes {
+		encodedAttributes[k] = v
+	}
+	delete(encodedAttributes, CodecAttribute)
+	delete(encodedAttributes, CompressionAttribute)
+	// JSON messages don't have a codec attribute so that they can be read by functions deployed before codecs were added
+	if codec.Name() != CodecJSON {
+		encodedAttributes[CodecAttribute] = codec.Name()
+	}
+	if compression != "" && len(dataBytes) > 0 {
+		var compressed bytes.Buffer
+		compressor, err := storage.NewCompressor(&compressed, compression)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = compressor.Write(dataBytes)
+		if closeErr := compressor.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error compressing message data: %v", err)
+		}
+		if compressed.Len() < len(dataBytes) {
+			dataBytes = compressed.Bytes()
+			encodedAttributes[CompressionAttribute] = compression
+		}
+	}
+	return dataBytes, encodedAttributes, nil
+}
+
+// decodeData decompresses and decodes the given message data, which was encoded by encodeData, into the given pointer,
+// using the codec and compression in the given attributes. If the pointer is nil, the message must have no data. The
+// CodecAttribute and CompressionAttribute are removed from the attributes, so that they aren't passed on to the
+// messages that functions send with them.
+func decodeData(data []byte, attributes map[string]string, v interface{}) error {
+	codec, err := CodecByName(attributes[CodecAttribute])
+	if err != nil {
+		return err
+	}
+	compression := attributes[CompressionAttribute]
+	delete(attributes, CodecAttribute)
+	delete(attributes, CompressionAttribute)
+	if compression != "" {
+		reader, err := storage.NewDecompressor(io.NopCloser(bytes.NewReader(data)), compression)
+		if err != nil {
+			return fmt.Errorf("error decompressing message data: %v", err)
+		}
+		defer reader.Close()
+		if data, err = io.ReadAll(reader); err != nil {
+			return fmt.Errorf("error decompressing message data: %v", err)
+		}
+	}
+	if v == nil {
+		// Nil data is encoded as JSON null by the JSON codec, and as no bytes by the binary codec
+		if len(data) != 0 && string(data) != "null" {
+			return fmt.Errorf("%w: message has data, but none was expected", ErrInvalidMessage)
+		}
+		return nil
+	}
+	if err := codec.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error unmarshalling message: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCodec_RoundTrip(t *testing.T) {
+	mappedWords := []KeyValues{
+		{Key: "eilnst", Values: []string{"listen", "silent"}},
+		{Key: "acer", Values: []string{"care"}},
+	}
+	for _, codecName := range []string{CodecJSON, CodecBinary} {
+		t.Run(codecName, func(t *testing.T) {
+			// Given
+			codec, err := CodecByName(codecName)
+			if err != nil {
+				t.Fatalf("Error getting codec: %v", err)
+			}
+
+			// When
+			data, err := codec.Marshal(mappedWords)
+			var decoded []KeyValues
+			unmarshalErr := codec.Unmarshal(data, &decoded)
+
+			// Then
+			assert.Nil(t, err)
+			assert.Nil(t, unmarshalErr)
+			assert.Equal(t, codecName, codec.Name())
+			assert.Equal(t, mappedWords, decoded)
+		})
+	}
+}
+
+func TestBinaryCodec_SmallerThanJSON(t *testing.T) {
+	// Given
+	mappedWords := make([]KeyValues, 0, 100)
+	for i := 0; i < 100; i++ {
+		word := fmt.Sprintf("word%d", i)
+		mappedWords = append(mappedWords, KeyValues{Key: word, Values: []string{word}})
+	}
+
+	// When
+	jsonData, jsonErr := jsonCodec{}.Marshal(mappedWords)
+	binaryData, binaryErr := binaryCodec{}.Marshal(mappedWords)
+
+	// Then
+	assert.Nil(t, jsonErr)
+	assert.Nil(t, binaryErr)
+	assert.Less(t, len(binaryData), len(jsonData))
+}
+
+func TestCodecByName_UnsupportedCodecError(t *testing.T) {
+	// When
+	_, err := CodecByName("protobuf")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unsupported message codec: protobuf")
+}
+
+func TestMemoryClient_Codec(t *testing.T) {
+	tests := []struct {
+		name               string
+		codec              string
+		compression        string
+		expectedAttributes map[string]string
+	}{
+		{name: "JSON", codec: CodecJSON, expectedAttributes: map[string]string{"jobId": "job-1"}},
+		{name: "Binary", codec: CodecBinary,
+			expectedAttributes: map[string]string{"jobId": "job-1", CodecAttribute: CodecBinary}},
+		{name: "BinaryGzip", codec: CodecBinary, compression: "gzip",
+			expectedAttributes: map[string]string{"jobId": "job-1", CodecAttribute: CodecBinary,
+				CompressionAttribute: "gzip"}},
+		{name: "JSONZlib", codec: CodecJSON, compression: "zlib",
+			expectedAttributes: map[string]string{"jobId": "job-1", CompressionAttribute: "zlib"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given
+			setEnv(t, "PUBSUB_CODEC", tt.codec)
+			setEnv(t, "PUBSUB_COMPRESSION", tt.compression)
+			broker := NewBroker(BrokerConfig{})
+			UseBroker(broker)
+			defer UseBroker(nil)
+			var received []KeyValues
+			var publishedAttributes, receivedAttributes map[string]string
+			broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+				var msg MessagePublishedData
+				_ = e.DataAs(&msg)
+				publishedAttributes = msg.Message.Attributes
+				client, err := New(ctx, e)
+				if err != nil {
+					return err
+				}
+				defer client.Close()
+				receivedAttributes, err = client.ReadPubSubMessage(&received)
+				return err
+			})
+			client, err := New(context.Background(), event.New())
+			if err != nil {
+				t.Fatalf("Error creating pubsub client: %v", err)
+			}
+			// Repeat the words so that compressing them makes them smaller
+			var mappedWords []KeyValues
+			for i := 0; i < 20; i++ {
+				mappedWords = append(mappedWords, KeyValues{Key: "eilnst",
+					Values: []string{"listen", "silent"}})
+			}
+
+			// When
+			err = client.SendPubSubMessage("some-topic", mappedWords, map[string]string{"jobId": "job-1"})
+			broker.Wait()
+
+			// Then
+			assert.Nil(t, err)
+			assert.Equal(t, mappedWords, received)
+			assert.Equal(t, tt.expectedAttributes, publishedAttributes)
+			// The codec and compression shouldn't be passed on with the attributes
+			assert.Equal(t, map[string]string{"jobId": "job-1"}, receivedAttributes)
+		})
+	}
+}
+
+func TestEncodeData_ReplacesReceivedEncoding(t *testing.T) {
+	// Given
+	setEnv(t, "PUBSUB_CODEC", "")
+	setEnv(t, "PUBSUB_COMPRESSION", "gzip")
+	attributes := map[string]string{"jobId": "job-1", CodecAttribute: CodecBinary, CompressionAttribute: "zlib"}
+
+	// When
+	data, encodedAttributes, err := encodeData("text", attributes)
+
+	// Then
+	assert.Nil(t, err)
+	// Compressing such a small message would make it larger, so it should be sent as JSON without compression
+	assert.Equal(t, `"text"`, string(data))
+	assert.Equal(t, map[string]string{"jobId": "job-1"}, encodedAttributes)
+	assert.Equal(t, CodecBinary, attributes[CodecAttribute])
+}
+
+func TestEncodeData_BinaryNil(t *testing.T) {
+	// Given
+	setEnv(t, "PUBSUB_CODEC", CodecBinary)
+	setEnv(t, "PUBSUB_COMPRESSION", "gzip")
+
+	// When
+	data, encodedAttributes, err := encodeData(nil, map[string]string{"jobId": "job-1"})
+
+	// Then
+	assert.Nil(t, err)
+	assert.Empty(t, data)
+	assert.Equal(t, map[string]string{"jobId": "job-1", CodecAttribute: CodecBinary}, encodedAttributes)
+}
+
+func TestEncodeData_UnsupportedCompressionError(t *testing.T) {
+	// Given
+	setEnv(t, "PUBSUB_COMPRESSION", "bzip2")
+
+	// When
+	_, _, err := encodeData("text", map[string]string{})
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error reading PUBSUB_COMPRESSION: unsupported compression: bzip2")
+}
+
+func TestDecodeData_UnsupportedCodecError(t *testing.T) {
+	// Given
+	var text string
+
+	// When
+	err := decodeData([]byte("text"), map[string]string{CodecAttribute: "protobuf"}, &text)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unsupported message codec: protobuf")
+}
+
+func TestDecodeData_InvalidCompressedDataError(t *testing.T) {
+	// Given
+	var text string
+
+	// When
+	err := decodeData([]byte(`"text"`), map[string]string{CompressionAttribute: "gzip"}, &text)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error decompressing message data")
+}
@@ -0,0 +1,465 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/google/uuid"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TransportMemory is the value of the PUBSUB_TRANSPORT environment variable that makes New return clients for the
+// default in-memory Broker rather than pubsub clients.
+const TransportMemory = "memory"
+
+// Handler is a function that handles a message delivered as a CloudEvent, in the same way as the functions triggered by
+// pubsub.
+type Handler func(ctx context.Context, e event.Event) error
+
+// BrokerConfig configures how a Broker delivers messages.
+type BrokerConfig struct {
+	// Concurrency is the maximum number of messages delivered to each handler at the same time, or 0 for no limit.
+	Concurrency int
+	// MaxDeliveryAttempts is the number of times a message is delivered to a handler that returns an error before the
+	// message is given up on, by default this is 5.
+	MaxDeliveryAttempts int
+	// RetryDelay is the time waited before a message is first redelivered to a handler that returned an error. It
+	// doubles for each redelivery after, by default it is 10ms.
+	RetryDelay time.Duration
+	// Faults are the faults that are injected into the delivery of messages.
+	Faults Faults
+}
+
+// Faults are faults that a Broker injects into the delivery of messages to test that the functions handle them, in the
+// same way that they would happen with pubsub. Each rate is the probability between 0 and 1 that the fault happens to a
+// message.
+type Faults struct {
+	// DropRate is the probability that a message isn't delivered to a handler at all.
+	DropRate float64
+	// DuplicateRate is the probability that a message is delivered to a handler twice.
+	DuplicateRate float64
+	// ReorderRate is the probability that a message is delivered to a handler before messages that were published
+	// before it.
+	ReorderRate float64
+	// MaxDelay is the maximum random delay before a message is delivered to a handler.
+	MaxDelay time.Duration
+	// Seed is the seed of the random number generator that decides which faults happen, so that a run can be repeated.
+	Seed int64
+}
+
+// defaultMaxDeliveryAttempts is the number of times a message is delivered to a handler that returns an error if the
+// BrokerConfig doesn't set one.
+const defaultMaxDeliveryAttempts = 5
+
+// defaultRetryDelay is the time waited before a message is first redelivered if the BrokerConfig doesn't set one.
+const defaultRetryDelay = 10 * time.Millisecond
+
+// Broker is an in-memory pubsub broker which delivers messages published to a topic to the handlers subscribed to the
+// topic. It is used to run the MapReduce in a single process without pubsub. Each message is delivered to each handler
+// wrapped in a CloudEvent in the same format as pubsub's, so the functions can be used as the handlers without any
+// changes. Like pubsub, a message is redelivered if the handler returns an error, and faults can be injected into the
+// delivery of messages.
+type Broker struct {
+	config        BrokerConfig
+	mu            sync.RWMutex
+	subscriptions map[string][]*subscription
+	wg            sync.WaitGroup
+	randMu        sync.Mutex
+	rand          *rand.Rand
+	failedMu      sync.Mutex
+	failed        int
+}
+
+// NewBroker returns a new Broker with no subscriptions that delivers messages as configured by the given config.
+func NewBroker(config BrokerConfig) *Broker {
+	if config.MaxDeliveryAttempts <= 0 {
+		config.MaxDeliveryAttempts = defaultMaxDeliveryAttempts
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = defaultRetryDelay
+	}
+	return &Broker{
+		config:        config,
+		subscriptions: make(map[string][]*subscription),
+		rand:          rand.New(rand.NewSource(config.Faults.Seed)),
+	}
+}
+
+// Subscribe adds the given handler to the handlers that messages published to the given topic are delivered to.
+func (b *Broker) Subscribe(topicName string, handler Handler) {
+	b.SubscribeWithConcurrency(topicName, handler, 0)
+}
+
+// SubscribeWithConcurrency adds the given handler to the handlers that messages published to the given topic are
+// delivered to, delivering at most the given number of messages to it at the same time. If the concurrency is 0, the
+// Broker's concurrency is used.
+func (b *Broker) SubscribeWithConcurrency(topicName string, handler Handler, concurrency int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscriptions[topicName] = append(b.subscriptions[topicName], &subscription{
+		broker:      b,
+		topic:       topicName,
+		handler:     handler,
+		concurrency: concurrency,
+	})
+}
+
+// Publish queues a message with the given data and attributes for delivery to each of the handlers subscribed to the
+// given topic. It returns once the message has been queued.
+func (b *Broker) Publish(topicName string, data []byte, attributes map[string]string) error {
+	b.mu.RLock()
+	subscriptions := b.subscriptions[topicName]
+	b.mu.RUnlock()
+	for _, s := range subscriptions {
+		if b.chance(b.config.Faults.DropRate) {
+			log.Printf("Dropping message published to topic %s", topicName)
+			continue
+		}
+		copies := 1
+		if b.chance(b.config.Faults.DuplicateRate) {
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			// Each delivery gets its own event, since the functions add to the attributes of the message they receive
+			e, err := NewMessageEvent(topicName, data, attributes)
+			if err != nil {
+				return err
+			}
+			b.wg.Add(1)
+			s.schedule(&delivery{event: e}, b.delay())
+		}
+	}
+	return nil
+}
+
+// Wait waits until every message published to the Broker, including those published by the handlers, has been
+// handled or given up on.
+func (b *Broker) Wait() {
+	b.wg.Wait()
+}
+
+// Failed returns the number of messages that have been given up on because the handler kept returning an error.
+func (b *Broker) Failed() int {
+	b.failedMu.Lock()
+	defer b.failedMu.Unlock()
+	return b.failed
+}
+
+// chance returns true with the given probability.
+func (b *Broker) chance(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+	b.randMu.Lock()
+	defer b.randMu.Unlock()
+	return b.rand.Float64() < probability
+}
+
+// delay returns a random delay up to the maximum delay of the Broker's faults.
+func (b *Broker) delay() time.Duration {
+	if b.config.Faults.MaxDelay <= 0 {
+		return 0
+	}
+	b.randMu.Lock()
+	defer b.randMu.Unlock()
+	return time.Duration(b.rand.Int63n(int64(b.config.Faults.MaxDelay)))
+}
+
+// intn returns a random number in [0, n).
+func (b *Broker) intn(n int) int {
+	b.randMu.Lock()
+	defer b.randMu.Unlock()
+	return b.rand.Intn(n)
+}
+
+// delivery is a message waiting to be delivered to a handler, and the number of times it has been delivered.
+type delivery struct {
+	event    event.Event
+	attempts int
+}
+
+// subscription is a handler subscribed to a topic, with the queue of messages waiting to be delivered to it.
+type subscription struct {
+	broker      *Broker
+	topic       string
+	handler     Handler
+	concurrency int
+	mu          sync.Mutex
+	queue       []*delivery
+	active      int
+}
+
+// schedule queues the given delivery after the given delay.
+func (s *subscription) schedule(d *delivery, delay time.Duration) {
+	if delay <= 0 {
+		s.enqueue(d)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		s.enqueue(d)
+	})
+}
+
+// enqueue adds the given delivery to the queue, usually at the back, but in front of other deliveries if the Broker
+// decides to reorder it, and then starts delivering messages.
+func (s *subscription) enqueue(d *delivery) {
+	s.mu.Lock()
+	if len(s.queue) > 0 && s.broker.chance(s.broker.config.Faults.ReorderRate) {
+		i := s.broker.intn(len(s.queue))
+		s.queue = append(s.queue[:i], append([]*delivery{d}, s.queue[i:]...)...)
+	} else {
+		s.queue = append(s.queue, d)
+	}
+	s.mu.Unlock()
+	s.dispatch()
+}
+
+// dispatch delivers messages from the front of the queue, each in its own goroutine, until the queue is empty or the
+// subscription's concurrency limit has been reached.
+func (s *subscription) dispatch() {
+	concurrency := s.concurrency
+	if concurrency <= 0 {
+		concurrency = s.broker.config.Concurrency
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) > 0 && (concurrency <= 0 || s.active < concurrency) {
+		d := s.queue[0]
+		s.queue = s.queue[1:]
+		s.active++
+		go s.deliver(d)
+	}
+}
+
+// deliver calls the handler with the given delivery. If the handler returns an error, the message is redelivered after
+// a backoff until the Broker's maximum number of delivery attempts has been reached. The event delivered says how many
+// times the message has been delivered, in the same way as pubsub's for a subscription with a dead-letter policy.
+func (s *subscription) deliver(d *delivery) {
+	d.attempts++
+	e := d.event.Clone()
+	if err := setDeliveryAttempt(&e, d.attempts); err != nil {
+		log.Printf("Error setting delivery attempt of message %s from topic %s: %v", d.event.ID(), s.topic, err)
+	}
+	err := s.handler(context.Background(), e)
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	switch {
+	case err == nil:
+		s.broker.wg.Done()
+	case d.attempts < s.broker.config.MaxDeliveryAttempts:
+		backoff := s.broker.config.RetryDelay << (d.attempts - 1)
+		log.Printf("Error handling message %s from topic %s on attempt %d, redelivering in %v: %v", d.event.ID(),
+			s.topic, d.attempts, backoff, err)
+		s.schedule(d, backoff)
+	default:
+		log.Printf("Error handling message %s from topic %s, giving up after %d attempts: %v", d.event.ID(), s.topic,
+			d.attempts, err)
+		s.broker.failedMu.Lock()
+		s.broker.failed++
+		s.broker.failedMu.Unlock()
+		s.broker.wg.Done()
+	}
+	// Deliver the next message now that there is room
+	s.dispatch()
+}
+
+// NewMessageEvent returns a CloudEvent holding a pubsub message with the given data and attributes published to the
+// given topic, in the same format as the events that trigger the functions.
+func NewMessageEvent(topicName string, data []byte, attributes map[string]string) (event.Event, error) {
+	messageAttributes := make(map[string]string, len(attributes))
+	for k, v := range attributes {
+		messageAttributes[k] = v
+	}
+	e := event.New()
+	e.SetID(uuid.New().String())
+	e.SetSource(topicName)
+	e.SetType("google.cloud.pubsub.topic.v1.messagePublished")
+	err := e.SetData(event.ApplicationJSON, MessagePublishedData{
+		Message: Message{
+			Data:       data,
+			Attributes: messageAttributes,
+		},
+	})
+	if err != nil {
+		return e, fmt.Errorf("error setting event data: %v", err)
+	}
+	return e, nil
+}
+
+// BrokerConfigFromEnv returns the BrokerConfig set by the following environment variables, any of which can be left
+// unset:
+// PUBSUB_MEMORY_CONCURRENCY: the maximum number of messages delivered to each handler at the same time
+// PUBSUB_MEMORY_MAX_DELIVERY_ATTEMPTS: the number of times a message is delivered before it is given up on
+// PUBSUB_MEMORY_RETRY_DELAY: the time waited before a message is first redelivered, e.g. "10ms"
+// PUBSUB_FAULT_DROP_RATE: the probability that a message is dropped
+// PUBSUB_FAULT_DUPLICATE_RATE: the probability that a message is delivered twice
+// PUBSUB_FAULT_REORDER_RATE: the probability that a message is delivered before messages published before it
+// PUBSUB_FAULT_MAX_DELAY: the maximum random delay before a message is delivered, e.g. "50ms"
+// PUBSUB_FAULT_SEED: the seed of the random number generator that decides which faults happen
+func BrokerConfigFromEnv() (BrokerConfig, error) {
+	var config BrokerConfig
+	var err error
+	if config.Concurrency, err = intFromEnv("PUBSUB_MEMORY_CONCURRENCY"); err != nil {
+		return config, err
+	}
+	if config.MaxDeliveryAttempts, err = intFromEnv("PUBSUB_MEMORY_MAX_DELIVERY_ATTEMPTS"); err != nil {
+		return config, err
+	}
+	if config.RetryDelay, err = durationFromEnv("PUBSUB_MEMORY_RETRY_DELAY"); err != nil {
+		return config, err
+	}
+	if config.Faults.DropRate, err = rateFromEnv("PUBSUB_FAULT_DROP_RATE"); err != nil {
+		return config, err
+	}
+	if config.Faults.DuplicateRate, err = rateFromEnv("PUBSUB_FAULT_DUPLICATE_RATE"); err != nil {
+		return config, err
+	}
+	if config.Faults.ReorderRate, err = rateFromEnv("PUBSUB_FAULT_REORDER_RATE"); err != nil {
+		return config, err
+	}
+	if config.Faults.MaxDelay, err = durationFromEnv("PUBSUB_FAULT_MAX_DELAY"); err != nil {
+		return config, err
+	}
+	seed, err := intFromEnv("PUBSUB_FAULT_SEED")
+	if err != nil {
+		return config, err
+	}
+	config.Faults.Seed = int64(seed)
+	return config, nil
+}
+
+// intFromEnv returns the value of the given environment variable as an int, or 0 if it isn't set.
+func intFromEnv(name string) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %v", name, err)
+	}
+	return i, nil
+}
+
+// durationFromEnv returns the value of the given environment variable as a duration, or 0 if it isn't set.
+func durationFromEnv(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %v", name, err)
+	}
+	return d, nil
+}
+
+// rateFromEnv returns the value of the given environment variable as a probability between 0 and 1, or 0 if it isn't
+// set.
+func rateFromEnv(name string) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("error reading %s: must be a number between 0 and 1", name)
+	}
+	return rate, nil
+}
+
+var (
+	brokerMu sync.Mutex
+	broker   *Broker
+)
+
+// UseBroker makes New return clients that send messages to the given Broker rather than to pubsub. Passing nil makes
+// New return pubsub clients again, unless the PUBSUB_TRANSPORT environment variable is set to "memory".
+func UseBroker(b *Broker) {
+	brokerMu.Lock()
+	defer brokerMu.Unlock()
+	broker = b
+}
+
+// DefaultBroker returns the Broker used by New when the PUBSUB_TRANSPORT environment variable is set to "memory". It
+// is created the first time it is needed, configured by BrokerConfigFromEnv, unless one has been set with UseBroker.
+func DefaultBroker() (*Broker, error) {
+	brokerMu.Lock()
+	defer brokerMu.Unlock()
+	if broker == nil {
+		config, err := BrokerConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		broker = NewBroker(config)
+	}
+	return broker, nil
+}
+
+// currentBroker returns the Broker that New should send messages to, or nil if New should return pubsub clients.
+func currentBroker() (*Broker, error) {
+	if os.Getenv("PUBSUB_TRANSPORT") == TransportMemory {
+		return DefaultBroker()
+	}
+	brokerMu.Lock()
+	defer brokerMu.Unlock()
+	return broker, nil
+}
+
+// memoryClient is a Client that reads messages delivered by a Broker and sends messages to the Broker.
+type memoryClient struct {
+	ctx     context.Context
+	event   event.Event
+	broker  *Broker
+	pending pendingResults
+}
+
+var _ Client = &memoryClient{}
+
+// Close does nothing, since the client doesn't hold any connections.
+func (c *memoryClient) Close() {}
+
+// ReadPubSubMessage reads the message in the client's event into the given data interface and returns the attributes of
+// the message.
+func (c *memoryClient) ReadPubSubMessage(data interface{}) (map[string]string, error) {
+	return readMessage(c.ctx, c.event, data)
+}
+
+// SendPubSubMessage sends a message to the given topic of the client's Broker. The message is encoded and sent as the
+// data of the message, along with the attributes. Data is encoded, and offloaded to storage if it is larger than the
+// claim-check threshold, in the same way as for pubsub.
+func (c *memoryClient) SendPubSubMessage(topicName string, data interface{}, attributes map[string]string) error {
+	dataBytes, attributes, err := prepareMessage(c.ctx, topicName, data, attributes)
+	if err != nil {
+		return fmt.Errorf("error publishing message to topic %s: %v", topicName, err)
+	}
+	return c.broker.Publish(topicName, dataBytes, attributes)
+}
+
+// PublishPubSubMessage sends a message to the given topic of the client's Broker in the same way as
+// SendPubSubMessage. Since the Broker queues messages as soon as they are published, the returned result is always
+// ready.
+func (c *memoryClient) PublishPubSubMessage(topicName string, data interface{},
+	attributes map[string]string) PublishResult {
+	result := newPublishResult()
+	result.set(c.SendPubSubMessage(topicName, data, attributes))
+	c.pending.add(result)
+	return result
+}
+
+// Flush returns an error if any of the messages published with PublishPubSubMessage couldn't be sent.
+func (c *memoryClient) Flush() error {
+	return c.pending.flush(c.ctx)
+}
+
+// LastDeliveryAttempt returns true if the message in the client's event is being delivered for the last time, which is
+// when it has been delivered the Broker's maximum number of delivery attempts.
+func (c *memoryClient) LastDeliveryAttempt() bool {
+	return lastDeliveryAttempt(c.event, c.broker.config.MaxDeliveryAttempts)
+}
@@ -0,0 +1,461 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBroker(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	var mu sync.Mutex
+	var received []string
+	var receivedAttributes []map[string]string
+	handler := func(ctx context.Context, e event.Event) error {
+		client, err := New(ctx, e)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		var data []string
+		attributes, err := client.ReadPubSubMessage(&data)
+		if err != nil {
+			return err
+		}
+		// Change the attributes to check that each handler gets its own copy
+		attributes["handled"] = "true"
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, data...)
+		receivedAttributes = append(receivedAttributes, attributes)
+		return nil
+	}
+	broker.Subscribe("some-topic", handler)
+	broker.Subscribe("some-topic", handler)
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+	attributes := map[string]string{"some-key": "some-value"}
+
+	// When
+	err = client.SendPubSubMessage("some-topic", []string{"some", "data"}, attributes)
+	broker.Wait()
+
+	// Then
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"some", "data", "some", "data"}, received)
+	assert.Len(t, receivedAttributes, 2)
+	for _, attr := range receivedAttributes {
+		assert.Equal(t, "some-value", attr["some-key"])
+	}
+	assert.Equal(t, map[string]string{"some-key": "some-value"}, attributes)
+}
+
+func TestBroker_HandlerPublishes(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	done := false
+	broker.Subscribe("first-topic", func(ctx context.Context, e event.Event) error {
+		client, err := New(ctx, e)
+		if err != nil {
+			return err
+		}
+		return client.SendPubSubMessage("second-topic", nil, nil)
+	})
+	broker.Subscribe("second-topic", func(ctx context.Context, e event.Event) error {
+		done = true
+		return nil
+	})
+
+	// When
+	err := broker.Publish("first-topic", []byte("null"), nil)
+	broker.Wait()
+
+	// Then
+	assert.Nil(t, err)
+	assert.True(t, done)
+}
+
+func TestMemoryClient_MarshalError(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+
+	// When
+	err = client.SendPubSubMessage("some-topic", make(chan int), nil)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error marshalling message data")
+}
+
+func TestBroker_Redelivery(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{MaxDeliveryAttempts: 3, RetryDelay: time.Millisecond})
+	var mu sync.Mutex
+	attempts := 0
+	broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			return errors.New("some error")
+		}
+		return nil
+	})
+
+	// When
+	err := broker.Publish("some-topic", []byte("null"), nil)
+	broker.Wait()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 0, broker.Failed())
+}
+
+func TestBroker_RedeliveryGivesUp(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{MaxDeliveryAttempts: 2, RetryDelay: time.Millisecond})
+	var mu sync.Mutex
+	attempts := 0
+	broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return errors.New("some error")
+	})
+
+	// When
+	err := broker.Publish("some-topic", []byte("null"), nil)
+	broker.Wait()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 1, broker.Failed())
+}
+
+func TestReportFailure_Redelivered(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{MaxDeliveryAttempts: 3, RetryDelay: time.Millisecond})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	var mu sync.Mutex
+	attempts := 0
+	failures := 0
+	broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+		client, err := New(ctx, e)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		attempts++
+		attempt := attempts
+		mu.Unlock()
+		// The first attempt fails, and the redelivery succeeds
+		if attempt == 1 {
+			err := errors.New("some error")
+			ReportFailure(client, map[string]string{"jobId": "job-1"}, err)
+			return err
+		}
+		return nil
+	})
+	broker.Subscribe(ControllerTopic, func(ctx context.Context, e event.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		failures++
+		return nil
+	})
+
+	// When
+	err := broker.Publish("some-topic", []byte("null"), nil)
+	broker.Wait()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	// The failure of the first attempt shouldn't be reported, since the message was redelivered
+	assert.Equal(t, 0, failures)
+	assert.Equal(t, 0, broker.Failed())
+}
+
+func TestReportFailure_LastDeliveryAttempt(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{MaxDeliveryAttempts: 2, RetryDelay: time.Millisecond})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	var mu sync.Mutex
+	var failures []ControllerMessage
+	broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+		client, err := New(ctx, e)
+		if err != nil {
+			return err
+		}
+		err = errors.New("some error")
+		ReportFailure(client, map[string]string{"jobId": "job-1"}, err)
+		return err
+	})
+	broker.Subscribe(ControllerTopic, func(ctx context.Context, e event.Event) error {
+		client, err := New(ctx, e)
+		if err != nil {
+			return err
+		}
+		var message ControllerMessage
+		if _, err := client.ReadPubSubMessage(&message); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		failures = append(failures, message)
+		return nil
+	})
+
+	// When
+	err := broker.Publish("some-topic", []byte("null"), nil)
+	broker.Wait()
+
+	// Then
+	assert.Nil(t, err)
+	// The failure should only be reported once, on the last delivery attempt
+	assert.Equal(t, []ControllerMessage{{ID: "job-1", Status: StatusFailed, Error: "some error"}}, failures)
+	assert.Equal(t, 1, broker.Failed())
+}
+
+func TestBroker_Concurrency(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{Concurrency: 2})
+	var mu sync.Mutex
+	active, maxActive, delivered := 0, 0, 0
+	broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		active--
+		delivered++
+		mu.Unlock()
+		return nil
+	})
+
+	// When
+	for i := 0; i < 10; i++ {
+		if err := broker.Publish("some-topic", []byte("null"), nil); err != nil {
+			t.Fatalf("Error publishing message: %v", err)
+		}
+	}
+	broker.Wait()
+
+	// Then
+	assert.Equal(t, 10, delivered)
+	assert.Equal(t, 2, maxActive)
+}
+
+func TestBroker_SubscribeWithConcurrency(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{Concurrency: 1})
+	var mu sync.Mutex
+	active, maxActive, delivered := 0, 0, 0
+	broker.SubscribeWithConcurrency("some-topic", func(ctx context.Context, e event.Event) error {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		active--
+		delivered++
+		mu.Unlock()
+		return nil
+	}, 3)
+
+	// When
+	for i := 0; i < 10; i++ {
+		if err := broker.Publish("some-topic", []byte("null"), nil); err != nil {
+			t.Fatalf("Error publishing message: %v", err)
+		}
+	}
+	broker.Wait()
+
+	// Then
+	assert.Equal(t, 10, delivered)
+	// The subscription's concurrency should be used rather than the broker's
+	assert.Equal(t, 3, maxActive)
+}
+
+func TestBroker_Faults(t *testing.T) {
+	tests := []struct {
+		name              string
+		faults            Faults
+		expectedDelivered int
+	}{
+		{name: "None", faults: Faults{}, expectedDelivered: 10},
+		{name: "Drop", faults: Faults{DropRate: 1}, expectedDelivered: 0},
+		{name: "Duplicate", faults: Faults{DuplicateRate: 1}, expectedDelivered: 20},
+		{name: "Delay", faults: Faults{MaxDelay: 10 * time.Millisecond}, expectedDelivered: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given
+			broker := NewBroker(BrokerConfig{Faults: tt.faults})
+			var mu sync.Mutex
+			delivered := 0
+			broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+				mu.Lock()
+				defer mu.Unlock()
+				delivered++
+				return nil
+			})
+
+			// When
+			for i := 0; i < 10; i++ {
+				if err := broker.Publish("some-topic", []byte("null"), nil); err != nil {
+					t.Fatalf("Error publishing message: %v", err)
+				}
+			}
+			broker.Wait()
+
+			// Then
+			assert.Equal(t, tt.expectedDelivered, delivered)
+		})
+	}
+}
+
+func TestBroker_Reorder(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{Concurrency: 1, Faults: Faults{ReorderRate: 1, Seed: 1}})
+	var mu sync.Mutex
+	var received []int
+	release := make(chan struct{})
+	broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+		var msg MessagePublishedData
+		if err := e.DataAs(&msg); err != nil {
+			return err
+		}
+		var i int
+		if err := json.Unmarshal(msg.Message.Data, &i); err != nil {
+			return err
+		}
+		// Hold up the first message so that the rest are queued behind it
+		if i == 0 {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, i)
+		return nil
+	})
+
+	// When
+	for i := 0; i < 10; i++ {
+		if err := broker.Publish("some-topic", []byte(strconv.Itoa(i)), nil); err != nil {
+			t.Fatalf("Error publishing message: %v", err)
+		}
+	}
+	close(release)
+	broker.Wait()
+
+	// Then
+	assert.ElementsMatch(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, received)
+	assert.False(t, sort.IntsAreSorted(received))
+}
+
+func TestBrokerConfigFromEnv(t *testing.T) {
+	// Given
+	setEnv(t, "PUBSUB_MEMORY_CONCURRENCY", "4")
+	setEnv(t, "PUBSUB_MEMORY_MAX_DELIVERY_ATTEMPTS", "3")
+	setEnv(t, "PUBSUB_MEMORY_RETRY_DELAY", "5ms")
+	setEnv(t, "PUBSUB_FAULT_DROP_RATE", "0.1")
+	setEnv(t, "PUBSUB_FAULT_DUPLICATE_RATE", "0.2")
+	setEnv(t, "PUBSUB_FAULT_REORDER_RATE", "0.3")
+	setEnv(t, "PUBSUB_FAULT_MAX_DELAY", "50ms")
+	setEnv(t, "PUBSUB_FAULT_SEED", "42")
+
+	expectedConfig := BrokerConfig{
+		Concurrency:         4,
+		MaxDeliveryAttempts: 3,
+		RetryDelay:          5 * time.Millisecond,
+		Faults: Faults{
+			DropRate:      0.1,
+			DuplicateRate: 0.2,
+			ReorderRate:   0.3,
+			MaxDelay:      50 * time.Millisecond,
+			Seed:          42,
+		},
+	}
+
+	// When
+	config, err := BrokerConfigFromEnv()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, expectedConfig, config)
+}
+
+func TestBrokerConfigFromEnv_InvalidRateError(t *testing.T) {
+	// Given
+	setEnv(t, "PUBSUB_FAULT_DROP_RATE", "2")
+
+	// When
+	_, err := BrokerConfigFromEnv()
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "PUBSUB_FAULT_DROP_RATE")
+}
+
+func TestNew_MemoryTransport(t *testing.T) {
+	// Given
+	setEnv(t, "PUBSUB_TRANSPORT", TransportMemory)
+	defer UseBroker(nil)
+
+	// When
+	client, err := New(context.Background(), event.New())
+
+	// Then
+	assert.Nil(t, err)
+	assert.IsType(t, &memoryClient{}, client)
+	broker, err := DefaultBroker()
+	assert.Nil(t, err)
+	assert.Equal(t, broker, client.(*memoryClient).broker)
+}
+
+// setEnv sets the given environment variable for the rest of the test.
+func setEnv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("Error setting environment variable: %v", err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// PublishResult is the result of a message published asynchronously with PublishPubSubMessage.
+type PublishResult interface {
+	// Get waits until the message has been published, or has failed to be published, and returns an error if it
+	// couldn't be published. It returns early with the context's error if the given context is done first.
+	Get(ctx context.Context) error
+}
+
+// publishResult is a PublishResult that is ready once set has been called with the result of publishing the message.
+type publishResult struct {
+	done chan struct{}
+	err  error
+}
+
+var _ PublishResult = &publishResult{}
+
+// newPublishResult returns a new publishResult that isn't ready yet.
+func newPublishResult() *publishResult {
+	return &publishResult{done: make(chan struct{})}
+}
+
+// set records the given error, or nil if the message was published, as the result and makes the result ready. It must
+// only be called once.
+func (r *publishResult) set(err error) {
+	r.err = err
+	close(r.done)
+}
+
+// Get waits until the result is ready and returns its error.
+func (r *publishResult) Get(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return r.err
+	}
+}
+
+// pendingResults holds the results of the messages published asynchronously by a client that haven't been waited for
+// by Flush yet.
+type pendingResults struct {
+	mu      sync.Mutex
+	results []*publishResult
+}
+
+// add adds the given result to the pending results.
+func (p *pendingResults) add(result *publishResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.results = append(p.results, result)
+}
+
+// flush waits for every pending result and returns the first error of any of them. Results added while it is waiting
+// are waited for too.
+func (p *pendingResults) flush(ctx context.Context) error {
+	var firstErr error
+	for {
+		p.mu.Lock()
+		results := p.results
+		p.results = nil
+		p.mu.Unlock()
+		if len(results) == 0 {
+			return firstErr
+		}
+		for _, result := range results {
+			if err := result.Get(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPublishResult_Get(t *testing.T) {
+	// Given
+	result := newPublishResult()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		result.set(errors.New("some error"))
+	}()
+
+	// When
+	err := result.Get(context.Background())
+
+	// Then
+	assert.EqualError(t, err, "some error")
+}
+
+func TestPublishResult_Get_ContextDoneError(t *testing.T) {
+	// Given
+	result := newPublishResult()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// When
+	err := result.Get(ctx)
+
+	// Then
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestPendingResults_Flush(t *testing.T) {
+	// Given
+	var pending pendingResults
+	results := []*publishResult{newPublishResult(), newPublishResult(), newPublishResult()}
+	for _, result := range results {
+		pending.add(result)
+	}
+	go func() {
+		results[0].set(nil)
+		results[1].set(errors.New("first error"))
+		results[2].set(errors.New("second error"))
+	}()
+
+	// When
+	err := pending.flush(context.Background())
+
+	// Then
+	assert.EqualError(t, err, "first error")
+	// The results should have been removed once they were waited for
+	assert.Nil(t, pending.flush(context.Background()))
+}
+
+func TestMemoryClient_PublishPubSubMessage(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	received := make(chan string, 3)
+	broker.Subscribe("some-topic", func(ctx context.Context, e event.Event) error {
+		client, err := New(ctx, e)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		var word string
+		_, err = client.ReadPubSubMessage(&word)
+		received <- word
+		return err
+	})
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+
+	// When
+	var results []PublishResult
+	for _, word := range []string{"some", "more", "data"} {
+		results = append(results, client.PublishPubSubMessage("some-topic", word, map[string]string{}))
+	}
+	err = client.Flush()
+	broker.Wait()
+	close(received)
+
+	// Then
+	assert.Nil(t, err)
+	for _, result := range results {
+		assert.Nil(t, result.Get(context.Background()))
+	}
+	var words []string
+	for word := range received {
+		words = append(words, word)
+	}
+	assert.ElementsMatch(t, []string{"some", "more", "data"}, words)
+}
+
+func TestMemoryClient_Flush_Error(t *testing.T) {
+	// Given
+	setEnv(t, "PUBSUB_CODEC", "protobuf")
+	broker := NewBroker(BrokerConfig{})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+
+	// When
+	client.PublishPubSubMessage("some-topic", "text", map[string]string{})
+	err = client.Flush()
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error publishing message to topic some-topic")
+}
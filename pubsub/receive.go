@@ -0,0 +1,91 @@
+package pubsub
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// receiveAckDeadline is the time a handler has to handle a message pulled by Receive before pubsub redelivers it,
+// which is the longest that pubsub allows.
+const receiveAckDeadline = 10 * time.Minute
+
+// Receive pulls the messages published to the given topic from the pubsub subscription with the given name, and
+// delivers each to the given handler wrapped in a CloudEvent in the same format as the events that trigger the
+// functions, so the functions can be run outside of Cloud Functions. The subscription is created if it doesn't exist.
+// At most the given number of messages are handled at the same time, or pubsub's default if it is 0. A message is
+// acknowledged if the handler returns nil, and redelivered by pubsub if it returns an error. The event says how many
+// times the message has been delivered if the subscription has a dead-letter policy.
+//
+// Receive blocks until the given context is done, at which point it stops pulling messages and returns once the
+// messages already being handled have been handled. Handlers are called with their own context, so that they aren't
+// cancelled part of the way through.
+func Receive(ctx context.Context, topicName, subscriptionName string, concurrency int, handler Handler) error {
+	client, err := pubsub.NewClient(ctx, os.Getenv("GCP_PROJECT"))
+	if err != nil {
+		return fmt.Errorf("error creating pubsub client: %v", err)
+	}
+	defer client.Close()
+	subscription, err := ensureSubscription(ctx, client, topicName, subscriptionName)
+	if err != nil {
+		return err
+	}
+	if concurrency > 0 {
+		subscription.ReceiveSettings.MaxOutstandingMessages = concurrency
+	}
+	err = subscription.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+		e, err := NewMessageEvent(topicName, msg.Data, msg.Attributes)
+		if err != nil {
+			log.Printf("Error creating event for message %s from subscription %s: %v", msg.ID, subscriptionName, err)
+			msg.Nack()
+			return
+		}
+		e.SetID(msg.ID)
+		if msg.DeliveryAttempt != nil {
+			if err := setDeliveryAttempt(&e, *msg.DeliveryAttempt); err != nil {
+				log.Printf("Error setting delivery attempt of message %s from subscription %s: %v", msg.ID,
+					subscriptionName, err)
+			}
+		}
+		if err := handler(context.Background(), e); err != nil {
+			log.Printf("Error handling message %s from subscription %s: %v", msg.ID, subscriptionName, err)
+			msg.Nack()
+			return
+		}
+		msg.Ack()
+	})
+	if err != nil {
+		return fmt.Errorf("error receiving messages from subscription %s: %v", subscriptionName, err)
+	}
+	return nil
+}
+
+// ensureSubscription returns the pubsub subscription with the given name, creating it for the given topic if it
+// doesn't exist. A created subscription backs off before redelivering a message in the same way as the subscriptions of
+// the deployed functions.
+func ensureSubscription(ctx context.Context, client *pubsub.Client, topicName,
+	subscriptionName string) (*pubsub.Subscription, error) {
+	subscription := client.Subscription(subscriptionName)
+	exists, err := subscription.Exists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error checking if subscription %s exists: %v", subscriptionName, err)
+	}
+	if exists {
+		return subscription, nil
+	}
+	subscription, err = client.CreateSubscription(ctx, subscriptionName, pubsub.SubscriptionConfig{
+		Topic:       client.Topic(topicName),
+		AckDeadline: receiveAckDeadline,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinimumBackoff: time.Second,
+			MaximumBackoff: 10 * time.Second,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating subscription %s: %v", subscriptionName, err)
+	}
+	return subscription, nil
+}
@@ -0,0 +1,53 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/cameron_w20/serverless-mapreduce/test"
+	"testing"
+	"time"
+)
+
+func TestReceive(t *testing.T) {
+	// Setup test
+	teardown, _ := test.SetupPubSubTest(t, []string{"some-topic"})
+	defer teardown(t)
+
+	// Given
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+	defer client.Close()
+	err = client.SendPubSubMessage("some-topic", []string{"some", "data"}, map[string]string{"some-key": "some-value"})
+	if err != nil {
+		t.Fatalf("Error sending message: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var received []string
+	var receivedAttributes map[string]string
+	deliveries := 0
+	handler := func(handlerCtx context.Context, e event.Event) error {
+		deliveries++
+		client, err := New(handlerCtx, e)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		receivedAttributes, err = client.ReadPubSubMessage(&received)
+		// Stop receiving once the message has been handled
+		cancel()
+		return err
+	}
+
+	// When
+	err = Receive(ctx, "some-topic", "some-topic", 1, handler)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deliveries)
+	assert.Equal(t, []string{"some", "data"}, received)
+	assert.Equal(t, "some-value", receivedAttributes["some-key"])
+}
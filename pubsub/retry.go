@@ -0,0 +1,61 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"time"
+)
+
+// maxPublishAttempts is the maximum number of times a message is published before giving up.
+const maxPublishAttempts = 5
+
+// initialPublishBackoff is the time waited before the first retry of a failed publish. It doubles for each retry after.
+var initialPublishBackoff = 100 * time.Millisecond
+
+// maxPublishBackoff is the maximum time waited between retries of a failed publish.
+var maxPublishBackoff = 2 * time.Second
+
+// retryPublish calls the given publish function until it succeeds, it returns an error that isn't transient, or it has
+// been called maxPublishAttempts times. The time waited between each attempt is doubled, up to maxPublishBackoff. It
+// returns the error from the last attempt.
+func retryPublish(ctx context.Context, publish func() error) error {
+	backoff := initialPublishBackoff
+	var err error
+	for attempt := 1; attempt <= maxPublishAttempts; attempt++ {
+		err = publish()
+		if err == nil || !isTransient(err) || attempt == maxPublishAttempts {
+			return err
+		}
+		log.Printf("Error publishing message on attempt %d, retrying in %v: %v", attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxPublishBackoff {
+			backoff = maxPublishBackoff
+		}
+	}
+	return err
+}
+
+// isTransient returns true if the given publish error is likely to succeed if the message is published again.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal,
+		codes.Unknown:
+		return true
+	default:
+		return false
+	}
+}
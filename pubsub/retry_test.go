@@ -0,0 +1,73 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestRetryPublish(t *testing.T) {
+	// Given
+	initialPublishBackoff = time.Millisecond
+	attempts := 0
+	publish := func() error {
+		attempts++
+		if attempts < 3 {
+			return status.Error(codes.Unavailable, "unavailable")
+		}
+		return nil
+	}
+
+	// When
+	err := retryPublish(context.Background(), publish)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryPublish_NonTransientError(t *testing.T) {
+	// Given
+	initialPublishBackoff = time.Millisecond
+	attempts := 0
+	publish := func() error {
+		attempts++
+		return status.Error(codes.NotFound, "topic not found")
+	}
+
+	// When
+	err := retryPublish(context.Background(), publish)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPublish_MaxAttemptsError(t *testing.T) {
+	// Given
+	initialPublishBackoff = time.Millisecond
+	attempts := 0
+	publish := func() error {
+		attempts++
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+
+	// When
+	err := retryPublish(context.Background(), publish)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Equal(t, maxPublishAttempts, attempts)
+}
+
+func TestIsTransient(t *testing.T) {
+	assert.True(t, isTransient(status.Error(codes.Unavailable, "unavailable")))
+	assert.True(t, isTransient(context.DeadlineExceeded))
+	assert.False(t, isTransient(context.Canceled))
+	assert.False(t, isTransient(status.Error(codes.PermissionDenied, "permission denied")))
+	assert.True(t, isTransient(errors.New("connection reset")))
+}
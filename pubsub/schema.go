@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidMessage is returned when a message read from a topic doesn't match the schema of the topic.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// schemaByName returns the schema with the given name, and false if there isn't one.
+func schemaByName(name string) (Schema, bool) {
+	for _, schema := range Schemas {
+		if schema.Name == name {
+			return schema, true
+		}
+	}
+	return Schema{}, false
+}
+
+// topicFromSource returns the name of the topic that a message was published to from the source of the event that
+// delivered it, which is the topic's full resource name for pubsub, e.g.
+// "//pubsub.googleapis.com/projects/my-project/topics/mapreduce-mapper", and the topic name for a Broker.
+func topicFromSource(source string) string {
+	return source[strings.LastIndex(source, "/")+1:]
+}
+
+// tagAttributes returns a copy of the given attributes with the name and version of the schema of the given topic, so
+// that the functions reading the message know how to read it. Messages sent to topics without a schema aren't tagged.
+func tagAttributes(topicName string, attributes map[string]string) map[string]string {
+	taggedAttributes := make(map[string]string, len(attributes)+2)
+	for k, v := range attributes {
+		taggedAttributes[k] = v
+	}
+	// Remove the schema of the message the attributes were received with, since functions pass on the attributes
+	delete(taggedAttributes, SchemaAttribute)
+	delete(taggedAttributes, SchemaVersionAttribute)
+	schema, ok := Schemas[topicName]
+	if !ok {
+		return taggedAttributes
+	}
+	taggedAttributes[SchemaAttribute] = schema.Name
+	taggedAttributes[SchemaVersionAttribute] = strconv.Itoa(schema.Version)
+	return taggedAttributes
+}
+
+// messageSchema returns the schema and version of a message with the given attributes that was published to the given
+// topic, and false if the message isn't checked against a schema because neither the topic nor the message has one. A
+// message with no schema attributes was sent before messages carried their schema, and is read as the first version of
+// the topic's schema. An error wrapping ErrInvalidMessage is returned if the message's schema isn't the topic's schema,
+// or its version can't be read. The schema attributes are removed from the attributes, so that they aren't passed on to
+// the messages that functions send with them.
+func messageSchema(topicName string, attributes map[string]string) (Schema, int, bool, error) {
+	name, tagged := attributes[SchemaAttribute]
+	versionAttribute := attributes[SchemaVersionAttribute]
+	delete(attributes, SchemaAttribute)
+	delete(attributes, SchemaVersionAttribute)
+	schema, ok := Schemas[topicName]
+	switch {
+	case !tagged && !ok:
+		return Schema{}, 0, false, nil
+	case !tagged:
+		// Read the message with the compatibility rules of the first version
+		if schema.Version-legacySchemaVersion > 1 {
+			return Schema{}, 0, false, fmt.Errorf("%w: message has no schema, which was version %d of schema %s, and "+
+				"only versions %d and %d can be read", ErrInvalidMessage, legacySchemaVersion, schema.Name,
+				schema.Version-1, schema.Version)
+		}
+		return schema, legacySchemaVersion, true, nil
+	case !ok:
+		if schema, ok = schemaByName(name); !ok {
+			return Schema{}, 0, false, fmt.Errorf("%w: unknown schema %s", ErrInvalidMessage, name)
+		}
+	case schema.Name != name:
+		return Schema{}, 0, false, fmt.Errorf("%w: message has schema %s, but topic %s has schema %s", ErrInvalidMessage,
+			name, topicName, schema.Name)
+	}
+	version, err := strconv.Atoi(versionAttribute)
+	if err != nil {
+		return Schema{}, 0, false, fmt.Errorf("%w: invalid version %q of schema %s", ErrInvalidMessage, versionAttribute,
+			name)
+	}
+	if version != schema.Version && version != schema.Version-1 {
+		return Schema{}, 0, false, fmt.Errorf("%w: version %d of schema %s can't be read, only versions %d and %d can",
+			ErrInvalidMessage, version, name, schema.Version-1, schema.Version)
+	}
+	return schema, version, true, nil
+}
+
+// validateAttributes returns an error wrapping ErrInvalidMessage if the given attributes are missing any of the
+// required attributes of the given schema.
+func validateAttributes(schema Schema, attributes map[string]string) error {
+	for _, name := range schema.RequiredAttributes {
+		if attributes[name] == "" {
+			return fmt.Errorf("%w: message is missing required attribute %s of schema %s", ErrInvalidMessage, name,
+				schema.Name)
+		}
+	}
+	return nil
+}
+
+// decodeTarget returns the pointer that the data of a message with the given version of the given schema is decoded
+// into, given the pointer that it is read into, which is returned by dataTarget. This is a new value of the data of the
+// version if it has an upgrader, which upgradeData converts into the data that the message is read into, and the
+// pointer that the message is read into otherwise.
+func decodeTarget(schema Schema, version int, target interface{}) interface{} {
+	if upgrader, ok := schema.Upgraders[version]; ok && target != nil {
+		return upgrader.NewData()
+	}
+	return target
+}
+
+// upgradeData converts the given decoded data of a message with the given version of the given schema, which was
+// decoded into the pointer returned by decodeTarget, into the given pointer that the message is read into. The data is
+// already in the pointer that the message is read into if the version has no upgrader.
+func upgradeData(schema Schema, version int, decoded, target interface{}) {
+	if upgrader, ok := schema.Upgraders[version]; ok && target != nil {
+		upgrader.Upgrade(decoded, target)
+	}
+}
+
+// dataTarget returns the pointer that the data of a message with the given schema is decoded into, given the pointer
+// that the function reading the message passed. The message is always decoded so that it can be validated, so a new
+// value of the schema's data is returned if the function passed nil. An error wrapping ErrInvalidMessage is returned if
+// the function passed a pointer to a different type to the schema's data.
+func dataTarget(schema Schema, data interface{}) (interface{}, error) {
+	if schema.NewData == nil {
+		if data != nil {
+			return nil, fmt.Errorf("%w: messages with schema %s have no data, but the message was read into %T",
+				ErrInvalidMessage, schema.Name, data)
+		}
+		return nil, nil
+	}
+	if data == nil {
+		return schema.NewData(), nil
+	}
+	if expected := reflect.TypeOf(schema.NewData()); reflect.TypeOf(data) != expected {
+		return nil, fmt.Errorf("%w: messages with schema %s hold %v, but the message was read into %T",
+			ErrInvalidMessage, schema.Name, expected, data)
+	}
+	return data, nil
+}
@@ -0,0 +1,274 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemoryClient_Schema(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	var received []string
+	var publishedAttributes, receivedAttributes map[string]string
+	broker.Subscribe(MapperTopic, func(ctx context.Context, e event.Event) error {
+		var msg MessagePublishedData
+		_ = e.DataAs(&msg)
+		publishedAttributes = msg.Message.Attributes
+		client, err := New(ctx, e)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		receivedAttributes, err = client.ReadPubSubMessage(&received)
+		return err
+	})
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+	attributes := map[string]string{"jobId": "job-1", "outputBucket": "output", "fileName": "book.txt",
+		"partitionId": "partition-1", SchemaAttribute: "splitter-data", SchemaVersionAttribute: "2"}
+
+	// When
+	err = client.SendPubSubMessage(MapperTopic, []string{"some", "words"}, attributes)
+	broker.Wait()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, 0, broker.Failed())
+	assert.Equal(t, []string{"some", "words"}, received)
+	// The schema of the message the attributes were received with should have been replaced by the topic's schema
+	assert.Equal(t, "partition", publishedAttributes[SchemaAttribute])
+	assert.Equal(t, "2", publishedAttributes[SchemaVersionAttribute])
+	assert.Equal(t, map[string]string{"jobId": "job-1", "outputBucket": "output", "fileName": "book.txt",
+		"partitionId": "partition-1"}, receivedAttributes)
+}
+
+func TestMemoryClient_Schema_MissingRequiredAttributeError(t *testing.T) {
+	// Given
+	broker := NewBroker(BrokerConfig{MaxDeliveryAttempts: 1})
+	UseBroker(broker)
+	defer UseBroker(nil)
+	var readErr error
+	broker.Subscribe(ReducerTopic, func(ctx context.Context, e event.Event) error {
+		client, err := New(ctx, e)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		_, readErr = client.ReadPubSubMessage(nil)
+		return readErr
+	})
+	client, err := New(context.Background(), event.New())
+	if err != nil {
+		t.Fatalf("Error creating pubsub client: %v", err)
+	}
+
+	// When
+	err = client.SendPubSubMessage(ReducerTopic, nil, map[string]string{"jobId": "job-1", "outputBucket": "output"})
+	broker.Wait()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, 1, broker.Failed())
+	assert.True(t, errors.Is(readErr, ErrInvalidMessage))
+	assert.Contains(t, readErr.Error(), "message is missing required attribute redisNum of schema reducer-start")
+}
+
+func TestReadMessage_Schema(t *testing.T) {
+	reducerAttributes := map[string]string{"jobId": "job-1", "outputBucket": "output", "redisNum": "0"}
+	tests := []struct {
+		name       string
+		topic      string
+		data       string
+		attributes map[string]string
+		read       func() interface{}
+	}{
+		{name: "CurrentVersion", topic: ControllerTopic, data: `{"id":"job-1","status":"job-started","count":1}`,
+			attributes: map[string]string{"jobId": "job-1", SchemaAttribute: "controller-message",
+				SchemaVersionAttribute: "2"},
+			read: func() interface{} { return &ControllerMessage{} }},
+		{name: "PreviousVersion", topic: ControllerTopic, data: `{"id":"job-1","status":"job-started","count":1}`,
+			attributes: map[string]string{"jobId": "job-1", SchemaAttribute: "controller-message",
+				SchemaVersionAttribute: "1"},
+			read: func() interface{} { return &ControllerMessage{} }},
+		{name: "NoSchema", topic: ControllerTopic, data: `{"id":"job-1","status":"job-started","count":1}`,
+			attributes: map[string]string{"jobId": "job-1"},
+			read:       func() interface{} { return &ControllerMessage{} }},
+		{name: "NilData", topic: ReducerTopic, data: "null", attributes: reducerAttributes,
+			read: func() interface{} { return nil }},
+		{name: "TopicWithoutSchema", topic: "some-topic", data: `["some","words"]`,
+			attributes: map[string]string{"jobId": "job-1", "outputBucket": "output", "fileName": "book.txt",
+				"partitionId": "partition-1", SchemaAttribute: "partition", SchemaVersionAttribute: "2"},
+			read: func() interface{} { return &[]string{} }},
+		{name: "PubsubSource", topic: "//pubsub.googleapis.com/projects/some-project/topics/" + ReducerTopic,
+			data: "null", attributes: reducerAttributes, read: func() interface{} { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given
+			e, err := NewMessageEvent(tt.topic, []byte(tt.data), tt.attributes)
+			if err != nil {
+				t.Fatalf("Error creating event: %v", err)
+			}
+
+			// When
+			attributes, err := readMessage(context.Background(), e, tt.read())
+
+			// Then
+			assert.Nil(t, err)
+			assert.NotContains(t, attributes, SchemaAttribute)
+			assert.NotContains(t, attributes, SchemaVersionAttribute)
+		})
+	}
+}
+
+func TestReadMessage_UpgradedVersion(t *testing.T) {
+	// Given
+	// Messages without a schema were sent before messages carried their schema, and are read as version 1
+	attributes := map[string]string{"jobId": "job-1", "outputBucket": "output", "fileName": "book.txt",
+		"partitionId": "partition-1"}
+	mappedWords := []mappedWordV1{
+		{SortedWord: "acer", Anagrams: map[string]struct{}{"race": {}, "care": {}}},
+		{SortedWord: "eilnst", Anagrams: map[string]struct{}{"listen": {}}},
+	}
+	binaryData, err := binaryCodec{}.Marshal(mappedWords)
+	if err != nil {
+		t.Fatalf("Error encoding data: %v", err)
+	}
+	tests := []struct {
+		name       string
+		data       []byte
+		attributes map[string]string
+	}{
+		{name: "JSON", data: []byte(`[{"sortedWord":"acer","anagrams":{"race":{},"care":{}}},` +
+			`{"sortedWord":"eilnst","anagrams":{"listen":{}}}]`), attributes: attributes},
+		{name: "Binary", data: binaryData, attributes: withAttribute(attributes, CodecAttribute, CodecBinary)},
+	}
+	expected := []KeyValues{
+		{Key: "acer", Values: []string{"care", "race"}},
+		{Key: "eilnst", Values: []string{"listen"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewMessageEvent(ShufflerTopic, tt.data, tt.attributes)
+			if err != nil {
+				t.Fatalf("Error creating event: %v", err)
+			}
+
+			// When
+			var keyValues []KeyValues
+			_, err = readMessage(context.Background(), e, &keyValues)
+
+			// Then
+			assert.Nil(t, err)
+			assert.Equal(t, expected, keyValues)
+		})
+	}
+}
+
+// withAttribute returns a copy of the given attributes with the given attribute set to the given value.
+func withAttribute(attributes map[string]string, name, value string) map[string]string {
+	copied := make(map[string]string, len(attributes)+1)
+	for k, v := range attributes {
+		copied[k] = v
+	}
+	copied[name] = value
+	return copied
+}
+
+func TestReadMessage_InvalidMessageError(t *testing.T) {
+	splitterAttributes := map[string]string{"jobId": "job-1", "outputBucket": "output", SchemaAttribute: "splitter-data",
+		SchemaVersionAttribute: "2"}
+	tests := []struct {
+		name       string
+		topic      string
+		data       string
+		attributes map[string]string
+		read       func() interface{}
+		expected   string
+	}{
+		{name: "UnsupportedVersion", topic: SplitterTopic, data: `{"bucketName":"input","fileName":"book.txt"}`,
+			attributes: map[string]string{"jobId": "job-1", "outputBucket": "output", SchemaAttribute: "splitter-data",
+				SchemaVersionAttribute: "4"},
+			read:     func() interface{} { return &SplitterData{} },
+			expected: "version 4 of schema splitter-data can't be read, only versions 2 and 3 can"},
+		{name: "InvalidVersion", topic: SplitterTopic, data: `{"bucketName":"input","fileName":"book.txt"}`,
+			attributes: map[string]string{"jobId": "job-1", "outputBucket": "output", SchemaAttribute: "splitter-data",
+				SchemaVersionAttribute: "two"},
+			read:     func() interface{} { return &SplitterData{} },
+			expected: `invalid version "two" of schema splitter-data`},
+		{name: "WrongSchema", topic: SplitterTopic, data: `{"bucketName":"input","fileName":"book.txt"}`,
+			attributes: map[string]string{"jobId": "job-1", "outputBucket": "output", SchemaAttribute: "partition",
+				SchemaVersionAttribute: "2"},
+			read:     func() interface{} { return &SplitterData{} },
+			expected: "message has schema partition, but topic mapreduce-splitter has schema splitter-data"},
+		{name: "UnknownSchema", topic: "some-topic", data: `["some","words"]`,
+			attributes: map[string]string{SchemaAttribute: "words", SchemaVersionAttribute: "1"},
+			read:       func() interface{} { return &[]string{} },
+			expected:   "unknown schema words"},
+		{name: "MissingAttribute", topic: SplitterTopic, data: `{"bucketName":"input","fileName":"book.txt"}`,
+			attributes: map[string]string{"jobId": "job-1", SchemaAttribute: "splitter-data",
+				SchemaVersionAttribute: "3"},
+			read:     func() interface{} { return &SplitterData{} },
+			expected: "message is missing required attribute outputBucket of schema splitter-data"},
+		{name: "WrongType", topic: SplitterTopic, data: `{"bucketName":"input","fileName":"book.txt"}`,
+			attributes: splitterAttributes,
+			read:       func() interface{} { return &ControllerMessage{} },
+			expected: "messages with schema splitter-data hold *pubsub.SplitterData, but the message was read into " +
+				"*pubsub.ControllerMessage"},
+		{name: "UnknownField", topic: SplitterTopic,
+			data:       `{"bucketName":"input","fileName":"book.txt","bucket":"input"}`,
+			attributes: splitterAttributes,
+			read:       func() interface{} { return &SplitterData{} },
+			expected:   `json: unknown field "bucket"`},
+		{name: "InvalidData", topic: SplitterTopic,
+			data:       `{"bucketName":"input","fileName":"book.txt","start":10,"end":5}`,
+			attributes: splitterAttributes,
+			read:       func() interface{} { return &SplitterData{} },
+			expected:   "splitter data has an empty byte range [10, 5)"},
+		{name: "InvalidDataReadIntoNil", topic: ControllerTopic, data: `{"id":"job-1","status":"done"}`,
+			attributes: map[string]string{"jobId": "job-1"},
+			read:       func() interface{} { return nil },
+			expected:   "controller message has unknown status: done"},
+		{name: "UnexpectedData", topic: ReducerTopic, data: `["some","words"]`,
+			attributes: map[string]string{"jobId": "job-1", "outputBucket": "output", "redisNum": "0"},
+			read:       func() interface{} { return nil },
+			expected:   "message has data, but none was expected"},
+		{name: "DataForSchemaWithoutData", topic: ReducerTopic, data: "null",
+			attributes: map[string]string{"jobId": "job-1", "outputBucket": "output", "redisNum": "0"},
+			read:       func() interface{} { return &[]string{} },
+			expected:   "messages with schema reducer-start have no data, but the message was read into *[]string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given
+			e, err := NewMessageEvent(tt.topic, []byte(tt.data), tt.attributes)
+			if err != nil {
+				t.Fatalf("Error creating event: %v", err)
+			}
+
+			// When
+			attributes, err := readMessage(context.Background(), e, tt.read())
+
+			// Then
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+			assert.Nil(t, attributes)
+			if tt.name != "UnknownField" {
+				assert.True(t, errors.Is(err, ErrInvalidMessage))
+			}
+		})
+	}
+}
+
+func TestTopicFromSource(t *testing.T) {
+	assert.Equal(t, MapperTopic, topicFromSource("//pubsub.googleapis.com/projects/some-project/topics/"+MapperTopic))
+	assert.Equal(t, MapperTopic, topicFromSource(MapperTopic))
+	assert.Equal(t, "", topicFromSource(""))
+}
@@ -1,6 +1,10 @@
 package pubsub
 
-import "time"
+import (
+	"fmt"
+	"sort"
+	"time"
+)
 
 // MaxMessageSizeBytes is the maximum size of a pubsub message in bytes.
 const MaxMessageSizeBytes = 50000
@@ -29,15 +33,30 @@ const ShufflerTopic = "mapreduce-shuffler"
 // ReducerTopic is the name of the topic that the reducer reads from.
 const ReducerTopic = "mapreduce-reducer"
 
+// StatusJobStarted is the status of a job when its files have been pushed to the SplitterTopic.
+const StatusJobStarted = "job-started"
+
+// StatusFileSplit is the status of a file when it has been split into partitions.
+const StatusFileSplit = "file-split"
+
 // StatusStarted is the status of a partition when it has been pushed to the MapperTopic.
 const StatusStarted = "started"
 
 // StatusFinished is the status of a partition when its mapped text has been added to the Redis instances.
 const StatusFinished = "finished"
 
-// MessagePublishedData is a struct that represents the data of a pubsub message published event.
+// StatusReducerFinished is the status of a reducer job when its output files have been written to the output bucket.
+const StatusReducerFinished = "reducer-finished"
+
+// StatusFailed is the status of a job when one of its functions has failed.
+const StatusFailed = "failed"
+
+// MessagePublishedData is a struct that represents the data of a pubsub message published event. DeliveryAttempt is
+// the number of times the message has been delivered, which pubsub only counts for subscriptions with a dead-letter
+// policy, so it is 0 if it isn't known.
 type MessagePublishedData struct {
-	Message Message `json:"message"`
+	Message         Message `json:"message"`
+	DeliveryAttempt int     `json:"deliveryAttempt,omitempty"`
 }
 
 // Message is a JSON field of MessagePublishedData.
@@ -46,20 +65,193 @@ type Message struct {
 	Attributes map[string]string `json:"attributes"`
 }
 
-// ControllerMessage is a message sent to the controller.
+// ControllerMessage is a message sent to the controller. The ID is the ID of the job, partition or reducer job that
+// the message is about, depending on the status. Outputs holds the output files written by a reducer job.
 type ControllerMessage struct {
-	ID     string `json:"id"`
-	Status string `json:"status"`
+	ID       string          `json:"id"`
+	Status   string          `json:"status"`
+	FileName string          `json:"fileName,omitempty"`
+	Count    int             `json:"count,omitempty"`
+	Outputs  []ReducerOutput `json:"outputs,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// ReducerOutput is an output file written by a reducer job and the number of records in it.
+type ReducerOutput struct {
+	ObjectName string `json:"objectName"`
+	Records    int    `json:"records"`
+}
+
+// KeyValues is the output of the mapper. Key holds an encoded key emitted by the job and Values holds the list of
+// encoded values emitted for the key, which can hold the same value more than once.
+type KeyValues struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+}
+
+// SplitterData is the data sent to the splitter. A large file is split into byte ranges that are sent to the splitter
+// separately, with Start and End holding the range [Start, End) of the file. End is 0 when the whole file is sent.
+// Compression is the compression of the file, which is always sent whole, or empty if it isn't compressed. When the
+// file is an archive, each of its members is sent separately, with Archive holding the archive's format, Member the
+// name of the member and Size the size of the archive. BodyStart and BodyEnd hold the byte range [BodyStart, BodyEnd)
+// of the whole file that the book's text is in, without its header and footer, and are only set when a range is sent.
+type SplitterData struct {
+	BucketName  string `json:"bucketName"`
+	FileName    string `json:"fileName"`
+	Start       int64  `json:"start,omitempty"`
+	End         int64  `json:"end,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Archive     string `json:"archive,omitempty"`
+	Member      string `json:"member,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	BodyStart   int64  `json:"bodyStart,omitempty"`
+	BodyEnd     int64  `json:"bodyEnd,omitempty"`
 }
 
-// MappedWord is the output of the mapper.
-type MappedWord struct {
+// SplitName returns the name that the controller tracks the split by. This is the file name if the whole file is sent,
+// the file name followed by the byte range of the split if a range is sent, e.g. "book.txt@0-1048576", or the archive
+// name followed by the member name if a member of an archive is sent, e.g. "books.zip!book.txt".
+func (d SplitterData) SplitName() string {
+	if d.Member != "" {
+		return d.FileName + "!" + d.Member
+	}
+	if d.End == 0 {
+		return d.FileName
+	}
+	return fmt.Sprintf("%s@%d-%d", d.FileName, d.Start, d.End)
+}
+
+// SchemaAttribute is the attribute of a message holding the name of the schema of its data and attributes.
+const SchemaAttribute = "schema"
+
+// SchemaVersionAttribute is the attribute of a message holding the version of the schema of its data and attributes.
+const SchemaVersionAttribute = "schemaVersion"
+
+// legacySchemaVersion is the version of the messages sent before messages carried their schema, which are read as the
+// version of the schema they were sent with.
+const legacySchemaVersion = 1
+
+// Schema describes the data and attributes of the messages sent to a topic. The version is increased whenever either
+// changes, and functions read messages with the current or the previous version of a schema, so that the functions can
+// be upgraded one at a time. The data of a version is decoded as the data of the current version, unless the version
+// has an upgrader because the data's fields have changed.
+type Schema struct {
+	Name    string
+	Version int
+	// RequiredAttributes are the attributes that every message must have.
+	RequiredAttributes []string
+	// NewData returns a pointer to a new value of the data of the messages, or is nil if the messages have no data.
+	NewData func() interface{}
+	// Validate returns an error if the given data, which is a pointer returned by NewData, isn't valid. It is nil if
+	// any data that can be decoded is valid.
+	Validate func(data interface{}) error
+	// Upgraders holds the upgrader of each earlier version of the schema whose data can't be decoded as the data of
+	// the current version.
+	Upgraders map[int]Upgrader
+}
+
+// Upgrader reads the data of an earlier version of a schema as the data of the current version.
+type Upgrader struct {
+	// NewData returns a pointer to a new value of the data of the earlier version.
+	NewData func() interface{}
+	// Upgrade converts the given data of the earlier version, which is a pointer returned by NewData, into the given
+	// data of the current version, which is a pointer returned by the schema's NewData.
+	Upgrade func(old, data interface{})
+}
+
+// Schemas holds the schema of the messages sent to each topic.
+var Schemas = map[string]Schema{
+	SplitterTopic: {
+		Name:               "splitter-data",
+		Version:            3,
+		RequiredAttributes: []string{"jobId", "outputBucket"},
+		NewData:            func() interface{} { return &SplitterData{} },
+		Validate:           validateSplitterData,
+	},
+	MapperTopic: {
+		Name:               "partition",
+		Version:            2,
+		RequiredAttributes: []string{"jobId", "outputBucket", "fileName", "partitionId"},
+		NewData:            func() interface{} { return &[]string{} },
+	},
+	CombineTopic: {
+		Name:               "mapped-words",
+		Version:            2,
+		RequiredAttributes: []string{"jobId", "outputBucket", "fileName", "partitionId"},
+		NewData:            func() interface{} { return &[]KeyValues{} },
+		Upgraders:          map[int]Upgrader{legacySchemaVersion: mappedWordsV1Upgrader},
+	},
+	ShufflerTopic: {
+		Name:               "mapped-words",
+		Version:            2,
+		RequiredAttributes: []string{"jobId", "outputBucket", "fileName", "partitionId"},
+		NewData:            func() interface{} { return &[]KeyValues{} },
+		Upgraders:          map[int]Upgrader{legacySchemaVersion: mappedWordsV1Upgrader},
+	},
+	ControllerTopic: {
+		Name:               "controller-message",
+		Version:            2,
+		RequiredAttributes: []string{"jobId"},
+		NewData:            func() interface{} { return &ControllerMessage{} },
+		Validate:           validateControllerMessage,
+	},
+	ReducerTopic: {
+		Name:               "reducer-start",
+		Version:            2,
+		RequiredAttributes: []string{"jobId", "outputBucket", "redisNum"},
+	},
+}
+
+// mappedWordV1 is the data of version 1 of the mapped-words schema, which was sent before messages carried their
+// schema. It held the set of values emitted for each key as the keys of a map rather than the list of every value
+// emitted.
+type mappedWordV1 struct {
 	SortedWord string              `json:"sortedWord"`
 	Anagrams   map[string]struct{} `json:"anagrams"`
 }
 
-// SplitterData is the data sent to the splitter.
-type SplitterData struct {
-	BucketName string `json:"bucketName"`
-	FileName   string `json:"fileName"`
+// mappedWordsV1Upgrader reads version 1 of the mapped-words schema, whose set of values for each key becomes the list
+// of its values, in sorted order.
+var mappedWordsV1Upgrader = Upgrader{
+	NewData: func() interface{} { return &[]mappedWordV1{} },
+	Upgrade: func(old, data interface{}) {
+		mappedWords := *old.(*[]mappedWordV1)
+		keyValues := make([]KeyValues, 0, len(mappedWords))
+		for _, mappedWord := range mappedWords {
+			values := make([]string, 0, len(mappedWord.Anagrams))
+			for value := range mappedWord.Anagrams {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+			keyValues = append(keyValues, KeyValues{Key: mappedWord.SortedWord, Values: values})
+		}
+		*data.(*[]KeyValues) = keyValues
+	},
+}
+
+// validateSplitterData returns an error if the given SplitterData doesn't name a file, or has an empty byte range.
+func validateSplitterData(data interface{}) error {
+	splitterData := data.(*SplitterData)
+	if splitterData.BucketName == "" || splitterData.FileName == "" {
+		return fmt.Errorf("splitter data must have a bucket name and a file name")
+	}
+	if splitterData.End != 0 && splitterData.Start >= splitterData.End {
+		return fmt.Errorf("splitter data has an empty byte range [%d, %d)", splitterData.Start, splitterData.End)
+	}
+	return nil
+}
+
+// validateControllerMessage returns an error if the given ControllerMessage doesn't have an ID, or has an unknown
+// status.
+func validateControllerMessage(data interface{}) error {
+	message := data.(*ControllerMessage)
+	if message.ID == "" {
+		return fmt.Errorf("controller message must have an ID")
+	}
+	switch message.Status {
+	case StatusJobStarted, StatusFileSplit, StatusStarted, StatusFinished, StatusReducerFinished, StatusFailed:
+		return nil
+	default:
+		return fmt.Errorf("controller message has unknown status: %s", message.Status)
+	}
 }
@@ -0,0 +1,59 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+// Processed returns the value of the dedupe record with the given key, and whether the record exists. Pubsub delivers
+// messages at least once, so each stage checks for its dedupe record before processing a message and writes it with
+// MarkProcessed once it has, so that a redelivered message isn't processed twice.
+func Processed(ctx context.Context, client redis.Cmdable, key string) (string, bool, error) {
+	value, err := client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error reading dedupe record: %v", err)
+	}
+	return value, true, nil
+}
+
+// MarkProcessed writes the dedupe record with the given key and value. The record is given the same TTL as the rest of
+// the job's keys.
+func MarkProcessed(ctx context.Context, client redis.Cmdable, key string, value interface{}) error {
+	if err := client.Set(ctx, key, value, IntermediateKeyTTL).Err(); err != nil {
+		return fmt.Errorf("error writing dedupe record: %v", err)
+	}
+	return nil
+}
+
+// ClaimTTL is how long a claim made with Claim lasts if it isn't released, so that a stage that crashed while holding a
+// claim doesn't stop the message from being processed once it is redelivered.
+const ClaimTTL = 10 * time.Minute
+
+// Claim claims the processing of the message with the given dedupe record key, and returns whether the claim was made.
+// It is used by stages that can't safely process the same message twice at the same time, which can happen when pubsub
+// delivers a message again before the first delivery has finished. The claim is released with ReleaseClaim.
+func Claim(ctx context.Context, client redis.Cmdable, key string) (bool, error) {
+	claimed, err := client.SetNX(ctx, claimKey(key), 1, ClaimTTL).Result()
+	if err != nil {
+		return false, fmt.Errorf("error claiming message: %v", err)
+	}
+	return claimed, nil
+}
+
+// ReleaseClaim releases the claim made with Claim for the message with the given dedupe record key.
+func ReleaseClaim(ctx context.Context, client redis.Cmdable, key string) error {
+	if err := client.Del(ctx, claimKey(key)).Err(); err != nil {
+		return fmt.Errorf("error releasing claim: %v", err)
+	}
+	return nil
+}
+
+// claimKey returns the key of the claim for the message with the given dedupe record key.
+func claimKey(key string) string {
+	return key + ":claim"
+}
@@ -0,0 +1,95 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+)
+
+// keyPrefix is the prefix of every key written to redis by the MapReduce, so that the keys can't clash with keys
+// written by anything else using the same redis instance.
+const keyPrefix = "mapreduce"
+
+// JobKey returns the key for the given name namespaced by the given job ID, so that the state of concurrent jobs
+// sharing the same redis instance is kept separate.
+func JobKey(jobID, name string) string {
+	return fmt.Sprintf("%s:%s:%s", keyPrefix, jobID, name)
+}
+
+// StartedProcessingKey returns the key of the controller's set of partitions that are being processed for the given
+// job.
+func StartedProcessingKey(jobID string) string {
+	return JobKey(jobID, "started-processing")
+}
+
+// JobStatusKey returns the key of the controller's hash holding the progress of the given job.
+func JobStatusKey(jobID string) string {
+	return JobKey(jobID, "status")
+}
+
+// FinishedPartitionsKey returns the key of the controller's set of partitions that have finished being processed for
+// the given job.
+func FinishedPartitionsKey(jobID string) string {
+	return JobKey(jobID, "finished-partitions")
+}
+
+// FilePartitionsKey returns the key of the controller's hash of file name to the number of partitions the file was
+// split into for the given job.
+func FilePartitionsKey(jobID string) string {
+	return JobKey(jobID, "file-partitions")
+}
+
+// InputsKey returns the key of the controller's set of the names of the input files that have been split for the given
+// job.
+func InputsKey(jobID string) string {
+	return JobKey(jobID, "inputs")
+}
+
+// FileFinishedPartitionsKey returns the key of the controller's hash of file name to the number of the file's
+// partitions that have finished being processed for the given job.
+func FileFinishedPartitionsKey(jobID string) string {
+	return JobKey(jobID, "file-finished-partitions")
+}
+
+// OutputsKey returns the key of the controller's hash of output object name to the time the object was written for the
+// given job.
+func OutputsKey(jobID string) string {
+	return JobKey(jobID, "outputs")
+}
+
+// ReducersFinishedKey returns the key of the controller's hash of redis instance number to the time the instance's
+// reducer finished writing its output files for the given job.
+func ReducersFinishedKey(jobID string) string {
+	return JobKey(jobID, "reducers-finished")
+}
+
+// OutputRecordsKey returns the key of the controller's hash of output object name to the number of records the reducer
+// wrote to the object for the given job.
+func OutputRecordsKey(jobID string) string {
+	return JobKey(jobID, "output-records")
+}
+
+// ProcessedKey returns the key of the dedupe record written once the given stage has processed the message with the
+// given ID for the given job.
+func ProcessedKey(jobID, stage, id string) string {
+	return JobKey(jobID, fmt.Sprintf("processed:%s:%s", stage, id))
+}
+
+// ShuffleKey returns the key of the list that the shuffler pushes the values for the given key to for the given job.
+func ShuffleKey(jobID, key string) string {
+	return JobKey(jobID, "shuffle:"+key)
+}
+
+// ShuffleKeyPattern returns a pattern that matches all the shuffle keys for the given job.
+func ShuffleKeyPattern(jobID string) string {
+	return ShuffleKey(escapePattern(jobID), "*")
+}
+
+// KeyFromShuffleKey returns the original key from the given shuffle key for the given job.
+func KeyFromShuffleKey(jobID, shuffleKey string) string {
+	return strings.TrimPrefix(shuffleKey, ShuffleKey(jobID, ""))
+}
+
+// escapePattern escapes the characters that have a special meaning in redis glob-style patterns.
+func escapePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
@@ -0,0 +1,55 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStartedProcessingKey(t *testing.T) {
+	// When
+	key := StartedProcessingKey("12345")
+
+	// Then
+	assert.Equal(t, "mapreduce:12345:started-processing", key)
+}
+
+func TestShuffleKey(t *testing.T) {
+	// When
+	key := ShuffleKey("12345", "acer")
+
+	// Then
+	assert.Equal(t, "mapreduce:12345:shuffle:acer", key)
+	assert.Equal(t, "acer", KeyFromShuffleKey("12345", key))
+}
+
+func TestShuffleKeyPattern(t *testing.T) {
+	// When
+	pattern := ShuffleKeyPattern("job*")
+
+	// Then
+	assert.Equal(t, `mapreduce:job\*:shuffle:*`, pattern)
+}
+
+func TestInputsKey(t *testing.T) {
+	// When
+	key := InputsKey("12345")
+
+	// Then
+	assert.Equal(t, "mapreduce:12345:inputs", key)
+}
+
+func TestReducersFinishedKey(t *testing.T) {
+	// When
+	key := ReducersFinishedKey("12345")
+
+	// Then
+	assert.Equal(t, "mapreduce:12345:reducers-finished", key)
+}
+
+func TestProcessedKey(t *testing.T) {
+	// When
+	key := ProcessedKey("12345", "shuffler", "partition-1")
+
+	// Then
+	assert.Equal(t, "mapreduce:12345:processed:shuffler:partition-1", key)
+}
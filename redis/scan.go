@@ -0,0 +1,61 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+// IntermediateKeyTTL is the time to live of the keys written to redis during a job. The keys are deleted once they've
+// been reduced, but the TTL acts as a safety net so that the keys of a job that fails part way through don't stay in
+// redis forever.
+var IntermediateKeyTTL = 24 * time.Hour
+
+// scanCount is the number of keys that redis is asked to look at in each call to SCAN.
+const scanCount = 1000
+
+// ScanKeys returns all the keys in the redis instance that match the given pattern. It uses SCAN rather than KEYS so
+// that the redis instance isn't blocked while the keys are found. SCAN can return the same key more than once, so the
+// keys are de-duplicated before being returned.
+func ScanKeys(ctx context.Context, client *redis.Client, pattern string) ([]string, error) {
+	seen := make(map[string]struct{})
+	keys := make([]string, 0)
+	iter := client.Scan(ctx, 0, pattern, scanCount).Iterator()
+	for iter.Next(ctx) {
+		if _, ok := seen[iter.Val()]; ok {
+			continue
+		}
+		seen[iter.Val()] = struct{}{}
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("error scanning keys: %v", err)
+	}
+	return keys, nil
+}
+
+// DeleteKeys deletes all the keys in the redis instance that match the given pattern, leaving any other keys in the
+// instance untouched. The keys are deleted in batches as they are found.
+func DeleteKeys(ctx context.Context, client *redis.Client, pattern string) error {
+	batch := make([]string, 0, scanCount)
+	iter := client.Scan(ctx, 0, pattern, scanCount).Iterator()
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == scanCount {
+			if err := client.Del(ctx, batch...).Err(); err != nil {
+				return fmt.Errorf("error deleting keys: %v", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("error scanning keys: %v", err)
+	}
+	if len(batch) > 0 {
+		if err := client.Del(ctx, batch...).Err(); err != nil {
+			return fmt.Errorf("error deleting keys: %v", err)
+		}
+	}
+	return nil
+}
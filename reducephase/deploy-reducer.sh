@@ -32,7 +32,7 @@ done
 echo "Deploying reducer"
 if (gcloud functions deploy reducer \
     --gen2 \
-    --runtime=go116 \
+    --runtime=go119 \
     --trigger-topic mapreduce-reducer \
     --source=. \
     --entry-point Reducer \
@@ -40,7 +40,7 @@ if (gcloud functions deploy reducer \
     --memory=512MB \
     --project="$GCP_PROJECT" \
     --vpc-connector=projects/"$GCP_PROJECT"/locations/"$GCP_REGION"/connectors/mapreduce-connector \
-    --set-env-vars=REDIS_HOSTS="$REDIS_HOSTS",GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS"
+    --set-env-vars=REDIS_HOSTS="$REDIS_HOSTS",GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS",PUBSUB_CODEC="$PUBSUB_CODEC",PUBSUB_COMPRESSION="$PUBSUB_COMPRESSION",PUBSUB_MAX_DELIVERY_ATTEMPTS="$PUBSUB_MAX_DELIVERY_ATTEMPTS"
     ) ; then
   echo "Successfully deployed reducer"
 else
@@ -48,10 +48,36 @@ else
   exit 1
 fi
 
-# Change the backoff delay of the subscription to start at 1 second
+# The dead-letter topic lets the reducer count how many times a message has been delivered, so that it only reports a
+# failure to the controller on the last delivery attempt
+echo "Creating topic mapreduce-dead-letter"
+if (gcloud pubsub topics create mapreduce-dead-letter \
+  --project="$GCP_PROJECT") ; then
+  echo "Successfully created topic mapreduce-dead-letter"
+else
+  echo "Topic mapreduce-dead-letter wasn't created, it may already exist"
+fi
+
+# Change the backoff delay of the subscription to start at 1 second, and add the dead-letter policy
 subscription=$(gcloud pubsub subscriptions list | grep "eventarc-$GCP_REGION-reducer" | cut -c 7-)
 echo "Changing backoff delay of subscription $subscription"
 gcloud pubsub subscriptions update "$subscription" \
   --project="$GCP_PROJECT" \
   --min-retry-delay=1s \
-  --max-retry-delay=10s
\ No newline at end of file
+  --max-retry-delay=10s \
+  --dead-letter-topic=mapreduce-dead-letter \
+  --max-delivery-attempts="$PUBSUB_MAX_DELIVERY_ATTEMPTS"
+
+# Let the Pub/Sub service agent publish the messages that reach the maximum delivery attempts to the dead-letter topic,
+# and acknowledge them on the subscription, which it needs to do for the dead-letter policy to work
+PROJECT_NUMBER=$(gcloud projects describe "$GCP_PROJECT" --format="value(projectNumber)")
+PUBSUB_SERVICE_AGENT="serviceAccount:service-$PROJECT_NUMBER@gcp-sa-pubsub.iam.gserviceaccount.com"
+echo "Granting the Pub/Sub service agent access to the dead-letter topic and subscription $subscription"
+gcloud pubsub topics add-iam-policy-binding mapreduce-dead-letter \
+  --project="$GCP_PROJECT" \
+  --member="$PUBSUB_SERVICE_AGENT" \
+  --role=roles/pubsub.publisher
+gcloud pubsub subscriptions add-iam-policy-binding "$subscription" \
+  --project="$GCP_PROJECT" \
+  --member="$PUBSUB_SERVICE_AGENT" \
+  --role=roles/pubsub.subscriber
\ No newline at end of file
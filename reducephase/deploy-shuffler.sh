@@ -32,7 +32,7 @@ done
 echo "Deploying shuffler"
 if (gcloud functions deploy shuffler \
     --gen2 \
-    --runtime=go116 \
+    --runtime=go119 \
     --trigger-topic mapreduce-shuffler \
     --source=. \
     --entry-point Shuffler \
@@ -40,7 +40,7 @@ if (gcloud functions deploy shuffler \
     --memory=512MB \
     --project="$GCP_PROJECT" \
     --vpc-connector=projects/"$GCP_PROJECT"/locations/"$GCP_REGION"/connectors/mapreduce-connector \
-    --set-env-vars=REDIS_HOSTS="$REDIS_HOSTS",GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS"
+    --set-env-vars=REDIS_HOSTS="$REDIS_HOSTS",GCP_PROJECT="$GCP_PROJECT",NO_OF_REDUCERS="$NO_OF_REDUCERS",PUBSUB_CODEC="$PUBSUB_CODEC",PUBSUB_COMPRESSION="$PUBSUB_COMPRESSION"
     ) ; then
   echo "Successfully deployed shuffler"
 else
@@ -2,8 +2,10 @@ package reducephase
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"gitlab.com/cameron_w20/serverless-mapreduce/job"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
 	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
 	"gitlab.com/cameron_w20/serverless-mapreduce/storage"
@@ -15,8 +17,14 @@ import (
 // Reducer is a function that is triggered by a message being published to the Reducer topic. It receives a message from
 // the controller with the number of the redis instance to read from and the name of the output bucket in the message
 // attributes. It then accesses the Redis instance and reads the sorted key-value pairs that were written by the
-// shuffler. At this point, any duplicate anagrams are removed and the remaining anagrams are sorted alphabetically, and
-// each key-value pair is written to a file in the output bucket if there is more than one anagram in the set.
+// shuffler. At this point, the values for each key are reduced by the job named in the message attributes, and each
+// key-value pair that the job keeps is written to the job's temporary directory in the output bucket, sorted by key,
+// with the output options in the message attributes, which choose the format and compression of the output files and
+// whether they are split into parts. Once the files have been written, it sends a message to the controller topic to
+// let it know that the reducer job has finished.
+//
+// A dedupe record holding the output files written is written to the Redis instance before the job's keys are deleted
+// from it, so that a redelivered message doesn't overwrite the output files with empty ones.
 func Reducer(ctx context.Context, e event.Event) error {
 	r.InitMultiRedisClient()
 	// Create a new pubsub client
@@ -34,42 +42,123 @@ func Reducer(ctx context.Context, e event.Event) error {
 	// Get the redis number and the output bucket from the message attributes
 	redisNum := attributes["redisNum"]
 	outputBucket := attributes["outputBucket"]
-	fileName := fmt.Sprintf("anagrams-part-%s.txt", redisNum)
-
+	// Get the job that will reduce the key-value pairs
+	jobName := job.NameFromAttributes(attributes)
+	j, err := job.Get(jobName)
+	if err != nil {
+		return err
+	}
+	// Get the options that the key-value pairs will be written with
+	outputOptions, err := storage.OutputOptionsFromAttributes(attributes)
+	if err != nil {
+		return err
+	}
+	jobID := attributes["jobId"]
+	baseName := outputBaseName(jobID, jobName, redisNum)
+	// If a previous delivery of the message has already written the output files, then the job's keys have been
+	// deleted from the redis instance, so the files mustn't be written again. The controller is sent the output files
+	// again in case the previous delivery failed before letting it know.
+	processedKey := r.ProcessedKey(jobID, "reducer", redisNum)
+	// Only one delivery of the message can reduce the instance at a time, otherwise a second delivery could read the
+	// job's keys after the first has deleted them and overwrite the output files with empty ones. The message is
+	// redelivered later if another delivery is still running.
+	claimed, err := r.Claim(ctx, r.MultiRedisClient[redisNum], processedKey)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return fmt.Errorf("output files %s are already being written by another delivery of the message", baseName)
+	}
 	defer func() {
-		// Remove all the data from the redis instance after returning
-		res := r.MultiRedisClient[redisNum].FlushAll(ctx)
-		if res.Err() != nil {
-			log.Printf("error flushing redis: %v", err)
+		if err := r.ReleaseClaim(ctx, r.MultiRedisClient[redisNum], processedKey); err != nil {
+			log.Println(err)
 		}
 	}()
-
-	// Read, reduce and write the key-value pairs from redis to a file in the output bucket
-	err = reduceAnagramsFromRedis(ctx, outputBucket, fileName, redisNum)
+	processedOutputs, processed, err := r.Processed(ctx, r.MultiRedisClient[redisNum], processedKey)
 	if err != nil {
 		return err
 	}
+	if processed {
+		log.Printf("Output files %s have already been written, skipping", baseName)
+		var outputs []pubsub.ReducerOutput
+		if err := json.Unmarshal([]byte(processedOutputs), &outputs); err != nil {
+			return fmt.Errorf("error reading dedupe record: %v", err)
+		}
+		return sendReducerFinished(pubsubClient, jobID, redisNum, outputs)
+	}
+	// Read, reduce and write the key-value pairs from redis to files in the output bucket
+	outputs, err := reduceFromRedis(ctx, j, outputOptions, jobID, outputBucket, baseName, redisNum)
+	if err != nil {
+		pubsub.ReportFailure(pubsubClient, attributes, err)
+		return err
+	}
+	// Record that the output files have been written before the job's keys are deleted
+	outputsBytes, err := json.Marshal(outputs)
+	if err != nil {
+		return fmt.Errorf("error marshalling output files: %v", err)
+	}
+	err = r.MarkProcessed(ctx, r.MultiRedisClient[redisNum], processedKey, outputsBytes)
+	if err != nil {
+		return err
+	}
+	// Remove the job's data from the redis instance, leaving any other data in the instance
+	if err := r.DeleteKeys(ctx, r.MultiRedisClient[redisNum], r.ShuffleKeyPattern(jobID)); err != nil {
+		log.Printf("error deleting job %s keys from redis: %v", jobID, err)
+	}
+	return sendReducerFinished(pubsubClient, jobID, redisNum, outputs)
+}
+
+// sendReducerFinished sends a message to the controller topic to let it know that the output files have been written
+// and how many records each contains
+func sendReducerFinished(pubsubClient pubsub.Client, jobID, redisNum string, outputs []pubsub.ReducerOutput) error {
+	statusMessage := pubsub.ControllerMessage{
+		ID:      redisNum,
+		Status:  pubsub.StatusReducerFinished,
+		Outputs: outputs,
+	}
+	for _, output := range outputs {
+		statusMessage.Count += output.Records
+	}
+	err := pubsubClient.SendPubSubMessage(pubsub.ControllerTopic, statusMessage, map[string]string{"jobId": jobID})
+	if err != nil {
+		return fmt.Errorf("error sending status message to controller: %v", err)
+	}
 	return nil
 }
 
-// reduceAnagramsFromRedis reads the key-value pairs from redis, removes duplicate anagrams and sorts them concurrently,
-// and then writes them to a file in the output bucket if there is more than one anagram in the set. It uses a mutex to
-// prevent race conditions when writing to the file.
-func reduceAnagramsFromRedis(ctx context.Context, outputBucket, fileName, redisNum string) error {
-	// Create a new storage client to write the output file
-	storageClient, err := storage.NewWithWriter(ctx, outputBucket, fileName)
+// outputBaseName returns the name of the output files for the given redis number, without the part number and
+// extension added by the storage.OutputWriter. The files are written to the job's temporary directory, and are only
+// promoted to the job's output directory by the controller once every reducer has finished, so a reducer that fails
+// part of the way through never leaves output files that look finished.
+func outputBaseName(jobID, jobName, redisNum string) string {
+	return storage.TemporaryPrefix(storage.OutputPrefix(jobID)) + fmt.Sprintf("%s-part-%s", jobName, redisNum)
+}
+
+// reduceFromRedis reads the key-value pairs for the given job ID from redis, reduces the values for each key
+// concurrently using the given job, and then writes the records of the keys that the job keeps to the output files in
+// the output bucket with the given options. The records are sorted by key before they are written, so the output files
+// are the same for the same input however the keys are reduced. It returns the output files that were written and the
+// number of records in each.
+func reduceFromRedis(ctx context.Context, j job.Job, outputOptions storage.OutputOptions, jobID, outputBucket,
+	baseName, redisNum string) ([]pubsub.ReducerOutput, error) {
+	// Create a new output writer to write the output files
+	outputWriter, err := storage.NewOutputWriter(ctx, outputBucket, baseName, outputOptions)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer storageClient.Close()
+	// Don't leave the part being written open if a record can't be written, which does nothing once it's closed
+	defer outputWriter.Abort()
 
-	// Get all the keys from the redis instance
-	keys := r.MultiRedisClient[redisNum].Keys(ctx, "*").Val()
+	// Get all the job's keys from the redis instance
+	keys, err := r.ScanKeys(ctx, r.MultiRedisClient[redisNum], r.ShuffleKeyPattern(jobID))
+	if err != nil {
+		return nil, err
+	}
 
 	var wg sync.WaitGroup
 	var mu sync.Mutex
-	// Loop through each key and reduce the list of anagrams for that key and write it to the file in the output bucket
-	// concurrently
+	records := make([]record, 0, len(keys))
+	// Loop through each key and reduce the list of values for that key concurrently
 	for _, key := range keys {
 		wg.Add(1)
 		go func(key string) {
@@ -77,39 +166,70 @@ func reduceAnagramsFromRedis(ctx context.Context, outputBucket, fileName, redisN
 			// Use LRange to get all the values in the list for the key
 			res := r.MultiRedisClient[redisNum].LRange(ctx, key, 0, -1)
 			if res.Err() != nil {
+				mu.Lock()
 				err = fmt.Errorf("error getting value from redis: %v", res.Err())
+				mu.Unlock()
 				return
 			}
-			// Remove any duplicate anagrams in the slice
-			reducedAnagrams := reduceAnagrams(res.Val())
-			// Only write to the file if the key has more than one anagram
-			if len(reducedAnagrams) > 1 {
-				// Sort the anagrams alphabetically
-				sort.Strings(reducedAnagrams)
-				// Write the key-value pairs to the output file and use a mutex to prevent race conditions
-				mu.Lock()
-				storageClient.WriteData(key, reducedAnagrams)
-				mu.Unlock()
+			// Reduce the values for the key, without the job's namespace, using the job
+			outputKey := r.KeyFromShuffleKey(jobID, key)
+			reducedValues, ok, reduceErr := reduceValues(j, outputKey, res.Val())
+			// Only keep the record if the job keeps the key, using a mutex to prevent race conditions
+			mu.Lock()
+			defer mu.Unlock()
+			if reduceErr != nil {
+				err = reduceErr
+			} else if ok {
+				records = append(records, record{key: outputKey, values: reducedValues})
 			}
 		}(key)
 	}
-	// Wait until all the key, list of anagrams pairs have been processed
+	// Wait until all the key, list of values pairs have been processed
 	wg.Wait()
-	return err
+	if err != nil {
+		return nil, err
+	}
+	// Write the records in order of their keys
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].key < records[j].key
+	})
+	for _, rec := range records {
+		if err := outputWriter.WriteRecord(rec.key, rec.values); err != nil {
+			return nil, err
+		}
+	}
+	// Create the last output file, which holds any records the output writer has buffered
+	if err := outputWriter.Close(); err != nil {
+		return nil, err
+	}
+	outputs := make([]pubsub.ReducerOutput, 0)
+	for _, file := range outputWriter.Files() {
+		outputs = append(outputs, pubsub.ReducerOutput{ObjectName: file.ObjectName, Records: file.Records})
+	}
+	return outputs, nil
 }
 
-// reduceAnagrams removes any duplicate anagrams from the slice by converting it to a map and then back to a slice
-func reduceAnagrams(values []string) []string {
-	var reducedAnagrams []string
-	// Create a map to ignore duplicate anagrams
-	var anagramMap = make(map[string]struct{})
-	// Loop through each anagram and add it to the map
-	for _, value := range values {
-		anagramMap[value] = struct{}{}
-	}
-	// Convert the map back to a slice
-	for key := range anagramMap {
-		reducedAnagrams = append(reducedAnagrams, key)
-	}
-	return reducedAnagrams
+// record is a key that has been reduced and the values it was reduced to.
+type record struct {
+	key    string
+	values []string
+}
+
+// reduceValues decodes the given key and values and reduces them using the given job. It returns the reduced values,
+// whether the key should be written to the output, and an error if the key or any of the values can't be decoded.
+func reduceValues(j job.Job, encodedKey string, encodedValues []string) ([]string, bool, error) {
+	key, err := j.KeyCodec().Decode(encodedKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("error decoding key %s: %v", encodedKey, err)
+	}
+	values := make([]string, 0, len(encodedValues))
+	for _, encodedValue := range encodedValues {
+		value, err := j.ValueCodec().Decode(encodedValue)
+		if err != nil {
+			return nil, false, fmt.Errorf("error decoding value %s: %v", encodedValue, err)
+		}
+		values = append(values, value)
+	}
+	reducedValues, ok := j.Reduce(key, values)
+	return reducedValues, ok, nil
 }
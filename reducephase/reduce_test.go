@@ -1,8 +1,10 @@
 package reducephase
 
 import (
+	ps "cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
 	"context"
+	"encoding/json"
 	"github.com/cloudevents/sdk-go/v2/event"
 	"github.com/stretchr/testify/assert"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
@@ -24,7 +26,7 @@ func TestReducer(t *testing.T) {
 
 	message := pubsub.MessagePublishedData{
 		Message: pubsub.Message{
-			Attributes: map[string]string{"outputBucket": test.OutputBucketName, "redisNum": "1"},
+			Attributes: map[string]string{"outputBucket": test.OutputBucketName, "redisNum": "1", "jobId": "12345"},
 		},
 	}
 	// Create a CloudEvent to be sent to the mapper
@@ -35,11 +37,13 @@ func TestReducer(t *testing.T) {
 		t.Fatalf("Error setting event data: %v", err)
 	}
 
-	redis.MultiRedisClient["1"].LPush(context.Background(), "acer", "race", "race", "care", "race")
-	redis.MultiRedisClient["1"].LPush(context.Background(), "aprt", "part", "trap", "trap", "part")
+	redis.MultiRedisClient["1"].LPush(context.Background(), redis.ShuffleKey("12345", "acer"), "race", "race", "care", "race")
+	redis.MultiRedisClient["1"].LPush(context.Background(), redis.ShuffleKey("12345", "aprt"), "part", "trap", "trap", "part")
+	// Add a key for another job which shouldn't be written to the output
+	redis.MultiRedisClient["1"].LPush(context.Background(), redis.ShuffleKey("67890", "eilv"), "evil", "live", "vile")
 
-	expectedResult1 := "acer: care race\n"
-	expectedResult2 := "aprt: part trap\n"
+	// The records should be sorted by key
+	expectedResult := "acer: care race\naprt: part trap\n"
 
 	// When
 	err = Reducer(context.Background(), e)
@@ -55,7 +59,7 @@ func TestReducer(t *testing.T) {
 		t.Fatalf("Error creating storage client: %v", err)
 	}
 	// Create a reader to read the file
-	reader, err := client.Bucket(test.OutputBucketName).Object("anagrams-part-1.txt").NewReader(storageCtx)
+	reader, err := client.Bucket(test.OutputBucketName).Object("12345/_temporary/anagrams-part-1.txt").NewReader(storageCtx)
 	if err != nil {
 		t.Fatalf("Error creating reader: %v", err)
 	}
@@ -65,8 +69,99 @@ func TestReducer(t *testing.T) {
 		t.Fatalf("Error reading file: %v", err)
 	}
 	// Check that the data is correct
-	assert.Contains(t, string(actualResult), expectedResult1)
-	assert.Contains(t, string(actualResult), expectedResult2)
+	assert.Equal(t, expectedResult, string(actualResult))
+	// Check that only the job's keys were removed from redis
+	keys, err := redis.MultiRedisClient["1"].Keys(context.Background(), "*").Result()
+	if err != nil {
+		t.Fatalf("Error getting keys from redis: %v", err)
+	}
+	assert.ElementsMatch(t, []string{redis.ShuffleKey("67890", "eilv"), redis.ProcessedKey("12345", "reducer", "1")}, keys)
+	// Check that the output files written were recorded in case the message is redelivered
+	outputs, err := redis.MultiRedisClient["1"].Get(context.Background(), redis.ProcessedKey("12345", "reducer", "1")).Result()
+	if err != nil {
+		t.Fatalf("Error getting data from redis: %v", err)
+	}
+	assert.Equal(t, `[{"objectName":"12345/_temporary/anagrams-part-1.txt","records":2}]`, outputs)
+}
+
+func TestReducer_Redelivered(t *testing.T) {
+	// Given
+	teardown, subscriptions := test.SetupPubSubTest(t, []string{pubsub.ControllerTopic})
+	defer teardown(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+
+	message := pubsub.MessagePublishedData{
+		Message: pubsub.Message{
+			Attributes: map[string]string{"outputBucket": test.OutputBucketName, "redisNum": "1", "jobId": "12345"},
+		},
+	}
+	// Create a CloudEvent to be sent to the reducer
+	e := event.New()
+	e.SetDataContentType("application/json")
+	err := e.SetData(e.DataContentType(), message)
+	if err != nil {
+		t.Fatalf("Error setting event data: %v", err)
+	}
+	// Record that a previous delivery of the message has written the output file
+	redis.MultiRedisClient["1"].Set(context.Background(), redis.ProcessedKey("12345", "reducer", "1"),
+		`[{"objectName":"12345/_temporary/anagrams-part-1.txt","records":2}]`, 0)
+
+	// When
+	err = Reducer(context.Background(), e)
+
+	// Then
+	assert.Nil(t, err)
+	// Check that the controller is still told how many records were written
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	var actualMessage pubsub.ControllerMessage
+	err = subscriptions[0].Receive(ctx, func(ctx context.Context, msg *ps.Message) {
+		msg.Ack()
+		if err := json.Unmarshal(msg.Data, &actualMessage); err != nil {
+			t.Fatalf("Error unmarshalling controller message: %v", err)
+		}
+		cancel()
+	})
+	if err != nil {
+		t.Fatalf("Error receiving message: %v", err)
+	}
+	assert.Equal(t, pubsub.StatusReducerFinished, actualMessage.Status)
+	assert.Equal(t, []pubsub.ReducerOutput{{ObjectName: "12345/_temporary/anagrams-part-1.txt", Records: 2}},
+		actualMessage.Outputs)
+	assert.Equal(t, 2, actualMessage.Count)
+}
+
+func TestReducer_AlreadyClaimedError(t *testing.T) {
+	// Given
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+
+	message := pubsub.MessagePublishedData{
+		Message: pubsub.Message{
+			Attributes: map[string]string{"outputBucket": test.OutputBucketName, "redisNum": "1", "jobId": "12345"},
+		},
+	}
+	// Create a CloudEvent to be sent to the reducer
+	e := event.New()
+	e.SetDataContentType("application/json")
+	err := e.SetData(e.DataContentType(), message)
+	if err != nil {
+		t.Fatalf("Error setting event data: %v", err)
+	}
+	// Claim the message as if another delivery of it were still running
+	processedKey := redis.ProcessedKey("12345", "reducer", "1")
+	claimed, err := redis.Claim(context.Background(), redis.MultiRedisClient["1"], processedKey)
+	if err != nil || !claimed {
+		t.Fatalf("Error claiming message: %v", err)
+	}
+
+	// When
+	err = Reducer(context.Background(), e)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already being written by another delivery")
 }
 
 func TestReducer_CreateStorageClientWithWriterError(t *testing.T) {
@@ -78,7 +173,7 @@ func TestReducer_CreateStorageClientWithWriterError(t *testing.T) {
 
 	message := pubsub.MessagePublishedData{
 		Message: pubsub.Message{
-			Attributes: map[string]string{"outputBucket": test.OutputBucketName, "redisNum": "1"},
+			Attributes: map[string]string{"outputBucket": test.OutputBucketName, "redisNum": "1", "jobId": "12345"},
 		},
 	}
 	// Create a CloudEvent to be sent to the mapper
@@ -106,7 +201,7 @@ func TestReducer_CreatePubSubClientError(t *testing.T) {
 
 	message := pubsub.MessagePublishedData{
 		Message: pubsub.Message{
-			Attributes: map[string]string{"outputBucket": test.OutputBucketName, "redisNum": "1"},
+			Attributes: map[string]string{"outputBucket": test.OutputBucketName, "redisNum": "1", "jobId": "12345"},
 		},
 	}
 	// Create a CloudEvent to be sent to the mapper
@@ -124,3 +219,11 @@ func TestReducer_CreatePubSubClientError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "error creating pubsub client")
 }
+
+func TestOutputBaseName(t *testing.T) {
+	// When
+	baseName := outputBaseName("12345", "anagrams", "1")
+
+	// Then
+	assert.Equal(t, "12345/_temporary/anagrams-part-1", baseName)
+}
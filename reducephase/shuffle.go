@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/go-redis/redis/v8"
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
 	r "gitlab.com/cameron_w20/serverless-mapreduce/redis"
 	"hash/fnv"
@@ -12,13 +13,17 @@ import (
 )
 
 // Shuffler is a function that is triggered by a message being published to the Shuffler topic. It receives a list of
-// MappedWord objects and shuffles them into a map of reducer number to a list of MappedWord objects. This is done through
-// the use of a hashing function. The reducer number is calculated by taking the modulus of the hashed key and the total
-// number of reducer jobs that will run. It then writes each list of MappedWord objects to the appropriate redis instance.
+// KeyValues objects and shuffles them into a map of reducer number to a list of KeyValues objects. This is done
+// through the use of a hashing function. The reducer number is calculated by taking the modulus of the hashed key and
+// the total number of reducer jobs that will run. It then writes each list of KeyValues objects to the appropriate
+// redis instance.
 //
 // The sorting phase of MapReduce happens through how the data is stored in Redis - it is stored in lists meaning all
-// the anagrams for a given word are stored together. It then sends a message to the controller topic to let it know
+// the values for a given key are stored together. It then sends a message to the controller topic to let it know
 // that the shuffling is complete for the partition.
+//
+// A dedupe record for the partition is written to each Redis instance in the same transaction as the values, so that a
+// redelivered message doesn't push the partition's values twice.
 func Shuffler(ctx context.Context, e event.Event) error {
 	r.InitMultiRedisClient()
 	// Create a new pubsub client
@@ -29,47 +34,51 @@ func Shuffler(ctx context.Context, e event.Event) error {
 	defer pubsubClient.Close()
 
 	// Read the data from the event i.e. message pushed from Combiner
-	var wordData []pubsub.MappedWord
+	var wordData []pubsub.KeyValues
 	attributes, err := pubsubClient.ReadPubSubMessage(&wordData)
 	if err != nil {
 		return err
 	}
 
-	// Shuffle the words into a map of reducer number to a list of MappedWord objects
+	// Shuffle the words into a map of reducer number to a list of KeyValues objects
 	shuffledText := shuffle(wordData)
-	// Add each list of MappedWord objects to the correct redis instance
-	err = addToRedis(ctx, shuffledText)
+	// Add each list of KeyValues objects to the correct redis instance
+	err = addToRedis(ctx, attributes["jobId"], attributes["partitionId"], shuffledText)
 	if err != nil {
 		return fmt.Errorf("error adding to redis: %v", err)
 	}
 	// Send a message to the controller topic to let it know that the shuffling is complete for the partition
 	statusMessage := pubsub.ControllerMessage{
-		ID:     attributes["partitionId"],
-		Status: pubsub.StatusFinished,
+		ID:       attributes["partitionId"],
+		Status:   pubsub.StatusFinished,
+		FileName: attributes["fileName"],
+	}
+	err = pubsubClient.SendPubSubMessage(pubsub.ControllerTopic, statusMessage, attributes)
+	if err != nil {
+		return fmt.Errorf("error sending status message to controller: %v", err)
 	}
-	pubsubClient.SendPubSubMessage(pubsub.ControllerTopic, statusMessage, attributes)
 	return nil
 }
 
-// shuffle takes a list of MappedWord objects and shuffles them into a map of reducer number to a list of MappedWord
+// shuffle takes a list of KeyValues objects and shuffles them into a map of reducer number to a list of KeyValues
 // objects. This happens concurrently for each word through the use of goroutines which makes the process happen faster.
-func shuffle(wordData []pubsub.MappedWord) map[int][]pubsub.MappedWord {
-	shuffledText := make(map[int][]pubsub.MappedWord)
+func shuffle(wordData []pubsub.KeyValues) map[int][]pubsub.KeyValues {
+	shuffledText := make(map[int][]pubsub.KeyValues)
 	var mu sync.Mutex
 	var wg sync.WaitGroup
-	// Loop through each MappedWord object and add it to the appropriate reducer number concurrently
+	// Loop through each KeyValues object and add it to the appropriate reducer number concurrently
 	for _, value := range wordData {
 		wg.Add(1)
-		go func(value pubsub.MappedWord) {
+		go func(value pubsub.KeyValues) {
 			defer wg.Done()
 			// Get the reducer number for a given sorted word
-			reducerNum := partitioner(value.SortedWord)
+			reducerNum := partitioner(value.Key)
 			// Lock the mutex to prevent concurrent writes to the map
 			mu.Lock()
 			defer mu.Unlock()
-			// Add the MappedWord object to the appropriate reducer number
+			// Add the KeyValues object to the appropriate reducer number
 			if shuffledText[reducerNum] == nil {
-				shuffledText[reducerNum] = make([]pubsub.MappedWord, 0)
+				shuffledText[reducerNum] = make([]pubsub.KeyValues, 0)
 			}
 			shuffledText[reducerNum] = append(shuffledText[reducerNum], value)
 		}(value)
@@ -90,29 +99,59 @@ func partitioner(s string) int {
 	return int(hashedString % uint32(r.NoOfReducerJobs))
 }
 
-// addToRedis takes a map of reducer number to a list of MappedWord objects and adds each list of MappedWord objects
-// to its respective Redis instance. This happens concurrently for each reducer number through the use of goroutines.
-func addToRedis(ctx context.Context, shuffledText map[int][]pubsub.MappedWord) error {
+// addToRedis takes a map of reducer number to a list of KeyValues objects and adds each list of KeyValues objects
+// to its respective Redis instance under keys namespaced by the given job ID. Each key is given a TTL so that it is
+// removed even if the job never reaches the reduce phase. This happens concurrently for each reducer number through the
+// use of goroutines, and the commands for each Redis instance are run in a single transaction to reduce the number of
+// round trips.
+//
+// The transaction also writes a dedupe record for the given partition ID, and watches it so that if two deliveries of
+// the same partition are shuffled at the same time, only one of them can push its values. If the record already exists,
+// the partition's values have already been pushed to the instance and nothing is done.
+func addToRedis(ctx context.Context, jobID, partitionID string, shuffledText map[int][]pubsub.KeyValues) error {
 	var err error
 	var wg sync.WaitGroup
-	// Loop through each reducer number and add the list of MappedWord objects to the appropriate redis instance concurrently
+	var mu sync.Mutex
+	// Loop through each reducer number and add the list of KeyValues objects to the appropriate redis instance
+	// concurrently
 	for reducerNum := range shuffledText {
 		wg.Add(1)
 		go func(reducerNum int) {
 			defer wg.Done()
-			// Loop through each MappedWord object and add it to the redis instance
-			for _, value := range shuffledText[reducerNum] {
-				// Convert the map to a slice of interfaces
-				var anagrams []interface{}
-				for word := range value.Anagrams {
-					anagrams = append(anagrams, word)
-				}
-				// Push the anagrams into the list for the sorted word in the redis instance, this emulates the job of
-				// the sort phase of MapReduce
-				res := r.MultiRedisClient[strconv.Itoa(reducerNum)].LPush(ctx, value.SortedWord, anagrams...)
-				if res.Err() != nil {
-					err = res.Err()
+			// Include the reducer number in the dedupe record in case the redis instances are shared
+			processedKey := r.ProcessedKey(jobID, "shuffler", fmt.Sprintf("%s:%d", partitionID, reducerNum))
+			txErr := r.MultiRedisClient[strconv.Itoa(reducerNum)].Watch(ctx, func(tx *redis.Tx) error {
+				_, processed, err := r.Processed(ctx, tx, processedKey)
+				if err != nil || processed {
+					return err
 				}
+				_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+					// Loop through each KeyValues object and add it to the redis instance
+					for _, value := range shuffledText[reducerNum] {
+						// A job's combiner can leave a key with no values
+						if len(value.Values) == 0 {
+							continue
+						}
+						// Convert the values to a slice of interfaces
+						values := make([]interface{}, 0, len(value.Values))
+						for _, v := range value.Values {
+							values = append(values, v)
+						}
+						// Push the values into the list for the key in the redis instance, this emulates the job of the
+						// sort phase of MapReduce
+						key := r.ShuffleKey(jobID, value.Key)
+						pipe.LPush(ctx, key, values...)
+						pipe.Expire(ctx, key, r.IntermediateKeyTTL)
+					}
+					return r.MarkProcessed(ctx, pipe, processedKey, 1)
+				})
+				return err
+			}, processedKey)
+			// Use a mutex to prevent race conditions when more than one redis instance fails
+			if txErr != nil {
+				mu.Lock()
+				err = txErr
+				mu.Unlock()
 			}
 		}(reducerNum)
 	}
@@ -8,6 +8,7 @@ import (
 	"gitlab.com/cameron_w20/serverless-mapreduce/pubsub"
 	"gitlab.com/cameron_w20/serverless-mapreduce/redis"
 	"gitlab.com/cameron_w20/serverless-mapreduce/test"
+	"strconv"
 	"testing"
 )
 
@@ -19,9 +20,9 @@ func TestShuffler(t *testing.T) {
 	defer teardownRedis(t)
 	// Given
 	// Create a message
-	inputData := []pubsub.MappedWord{
-		{SortedWord: "acer", Anagrams: map[string]struct{}{"care": {}, "race": {}}},
-		{SortedWord: "aprt", Anagrams: map[string]struct{}{"trap": {}, "part": {}}},
+	inputData := []pubsub.KeyValues{
+		{Key: "acer", Values: []string{"care", "race"}},
+		{Key: "aprt", Values: []string{"trap", "part"}},
 	}
 	inputDataBytes, err := json.Marshal(inputData)
 	if err != nil {
@@ -30,7 +31,7 @@ func TestShuffler(t *testing.T) {
 	message := pubsub.MessagePublishedData{
 		Message: pubsub.Message{
 			Data:       inputDataBytes,
-			Attributes: make(map[string]string),
+			Attributes: map[string]string{"jobId": "12345"},
 		},
 	}
 	// Create a CloudEvent to be sent to the Shuffler
@@ -48,11 +49,11 @@ func TestShuffler(t *testing.T) {
 	// Ensure there are no errors returned
 	assert.Nil(t, err)
 	// Check that the data was stored in Redis
-	result1, err := redis.MultiRedisClient["1"].LRange(context.Background(), "acer", 0, -1).Result()
+	result1, err := redis.MultiRedisClient["1"].LRange(context.Background(), redis.ShuffleKey("12345", "acer"), 0, -1).Result()
 	if err != nil {
 		t.Fatalf("Error getting data from Redis: %v", err)
 	}
-	result2, err := redis.MultiRedisClient["1"].LRange(context.Background(), "aprt", 0, -1).Result()
+	result2, err := redis.MultiRedisClient["1"].LRange(context.Background(), redis.ShuffleKey("12345", "aprt"), 0, -1).Result()
 	if err != nil {
 		t.Fatalf("Error getting data from Redis: %v", err)
 	}
@@ -62,6 +63,58 @@ func TestShuffler(t *testing.T) {
 	assert.Contains(t, result2, "part")
 	assert.Contains(t, result2, "trap")
 	assert.Len(t, result2, 2)
+	// Check that the keys will expire
+	ttl, err := redis.MultiRedisClient["1"].TTL(context.Background(), redis.ShuffleKey("12345", "acer")).Result()
+	if err != nil {
+		t.Fatalf("Error getting TTL from Redis: %v", err)
+	}
+	assert.True(t, ttl > 0)
+}
+
+func TestShuffler_Redelivered(t *testing.T) {
+	// Setup test
+	teardown, _ := test.SetupPubSubTest(t, []string{pubsub.ControllerTopic})
+	defer teardown(t)
+	teardownRedis := test.SetupRedisTest(t)
+	defer teardownRedis(t)
+	// Given
+	// Create a message
+	inputData := []pubsub.KeyValues{
+		{Key: "acer", Values: []string{"care", "race"}},
+	}
+	inputDataBytes, err := json.Marshal(inputData)
+	if err != nil {
+		t.Fatalf("Error marshalling Shuffler data: %v", err)
+	}
+	message := pubsub.MessagePublishedData{
+		Message: pubsub.Message{
+			Data:       inputDataBytes,
+			Attributes: map[string]string{"jobId": "12345", "partitionId": "partition-1"},
+		},
+	}
+	// Create a CloudEvent to be sent to the Shuffler
+	e := event.New()
+	e.SetDataContentType("application/json")
+	err = e.SetData(e.DataContentType(), message)
+	if err != nil {
+		t.Fatalf("Error setting event data: %v", err)
+	}
+
+	// When
+	err = Shuffler(context.Background(), e)
+	// Deliver the same message again
+	errRedelivered := Shuffler(context.Background(), e)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Nil(t, errRedelivered)
+	// Check that the values were only pushed once
+	reducerNum := strconv.Itoa(partitioner("acer"))
+	result, err := redis.MultiRedisClient[reducerNum].LRange(context.Background(), redis.ShuffleKey("12345", "acer"), 0, -1).Result()
+	if err != nil {
+		t.Fatalf("Error getting data from Redis: %v", err)
+	}
+	assert.Len(t, result, 2)
 }
 
 func TestShuffler_ReadPubSubMessageError(t *testing.T) {
@@ -105,9 +158,9 @@ func TestShuffler_CreatePubSubClientError(t *testing.T) {
 	defer teardownRedis(t)
 	// Given
 	// Create a message
-	inputData := []pubsub.MappedWord{
-		{SortedWord: "acer", Anagrams: map[string]struct{}{"care": {}, "race": {}}},
-		{SortedWord: "aprt", Anagrams: map[string]struct{}{"trap": {}, "part": {}}},
+	inputData := []pubsub.KeyValues{
+		{Key: "acer", Values: []string{"care", "race"}},
+		{Key: "aprt", Values: []string{"trap", "part"}},
 	}
 	inputDataBytes, err := json.Marshal(inputData)
 	if err != nil {
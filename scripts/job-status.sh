@@ -0,0 +1,17 @@
+#!/usr/bin/env bash
+
+# Read env file
+source .env
+
+# Check if gcloud is installed
+if ! [ -x "$(command -v gcloud)" ]; then
+  echo 'Error: gcloud is not installed.' >&2
+  exit 1
+fi
+
+uri=$(gcloud functions describe status --region="$GCP_REGION" --project="$GCP_PROJECT" --format="value(serviceConfig.uri)")
+
+echo "Enter job ID:"
+read -r job_id
+
+curl -X GET "$uri?job-id=$job_id"
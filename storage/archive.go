@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ArchiveZip is the archive format of zip archives.
+const ArchiveZip = "zip"
+
+// ArchiveTar is the archive format of tar archives, which can also be compressed, e.g. "books.tar.gz".
+const ArchiveTar = "tar"
+
+// ErrInvalidArchive is returned when an archive can't be read because it is malformed or can't be read in its format.
+var ErrInvalidArchive = errors.New("invalid archive")
+
+// archiveReadAhead is the minimum number of bytes of an archive read by each ranged read, so that reading the small
+// headers in an archive doesn't take a request each.
+var archiveReadAhead = 1 << 20
+
+// archiveExtensions maps the extensions of archives to their format.
+var archiveExtensions = map[string]string{
+	".zip":  ArchiveZip,
+	".tar":  ArchiveTar,
+	".tgz":  ArchiveTar,
+	".tbz2": ArchiveTar,
+}
+
+// archiveContentTypes maps the content types of archives to their format.
+var archiveContentTypes = map[string]string{
+	"application/zip":              ArchiveZip,
+	"application/x-zip-compressed": ArchiveZip,
+	"application/x-tar":            ArchiveTar,
+}
+
+// DetectArchive returns the format of an archive with the given name and content type, or an empty string if the
+// object isn't an archive. The content type is used if it is an archive type, and the extension of the name, without
+// its compression extension, otherwise.
+func DetectArchive(objectName, contentType string) string {
+	if archive, ok := archiveContentTypes[mediaType(contentType)]; ok {
+		return archive
+	}
+	if archive, ok := archiveExtensions[strings.ToLower(path.Ext(objectName))]; ok {
+		return archive
+	}
+	return archiveExtensions[strings.ToLower(path.Ext(TrimCompressionExtension(objectName)))]
+}
+
+// ListArchiveMembers returns the names and sizes of the files in the given archive object in the given bucket, in the
+// order they are stored in the archive. The directory of a zip archive and the headers of an uncompressed tar archive
+// are read with ranged reads, and a compressed tar archive is read whole. It returns an error wrapping
+// ErrInvalidArchive if the archive is malformed.
+func ListArchiveMembers(ctx context.Context, client Client, bucketName string, archive ObjectAttrs) ([]ObjectAttrs,
+	error) {
+	members := make([]ObjectAttrs, 0)
+	switch archive.Archive {
+	case ArchiveZip:
+		zipReader, err := newZipReader(ctx, client, bucketName, archive)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range zipReader.File {
+			if file.Mode().IsRegular() {
+				members = append(members, ObjectAttrs{Name: file.Name, Size: int64(file.UncompressedSize64)})
+			}
+		}
+		return members, nil
+	case ArchiveTar:
+		tarReader, closer, err := newTarReader(ctx, client, bucketName, archive)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return members, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: error reading archive %s: %v", ErrInvalidArchive, archive.Name, err)
+			}
+			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+				members = append(members, ObjectAttrs{Name: header.Name, Size: header.Size})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported archive format: %s", ErrInvalidArchive, archive.Archive)
+	}
+}
+
+// OpenArchiveMember returns a reader of the contents of the given member of the given archive object in the given
+// bucket. The reader must be closed. It returns an error wrapping ErrInvalidArchive if the archive is malformed or
+// doesn't have the member.
+func OpenArchiveMember(ctx context.Context, client Client, bucketName string, archive ObjectAttrs,
+	member string) (io.ReadCloser, error) {
+	switch archive.Archive {
+	case ArchiveZip:
+		zipReader, err := newZipReader(ctx, client, bucketName, archive)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range zipReader.File {
+			if file.Name == member && file.Mode().IsRegular() {
+				rc, err := file.Open()
+				if err != nil {
+					return nil, fmt.Errorf("%w: error reading member %s of archive %s: %v", ErrInvalidArchive, member,
+						archive.Name, err)
+				}
+				return rc, nil
+			}
+		}
+	case ArchiveTar:
+		tarReader, closer, err := newTarReader(ctx, client, bucketName, archive)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				closer.Close()
+				return nil, fmt.Errorf("%w: error reading archive %s: %v", ErrInvalidArchive, archive.Name, err)
+			}
+			if header.Name == member && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA) {
+				return struct {
+					io.Reader
+					io.Closer
+				}{tarReader, closer}, nil
+			}
+		}
+		closer.Close()
+	default:
+		return nil, fmt.Errorf("%w: unsupported archive format: %s", ErrInvalidArchive, archive.Archive)
+	}
+	return nil, fmt.Errorf("%w: archive %s doesn't have member %s", ErrInvalidArchive, archive.Name, member)
+}
+
+// newZipReader returns a reader of the given zip archive object, which reads the parts of the archive it needs with
+// ranged reads.
+func newZipReader(ctx context.Context, client Client, bucketName string, archive ObjectAttrs) (*zip.Reader, error) {
+	if archive.Compression != "" {
+		return nil, fmt.Errorf("%w: zip archive %s can't be read when it is compressed with %s", ErrInvalidArchive,
+			archive.Name, archive.Compression)
+	}
+	readerAt := newObjectReaderAt(ctx, client, bucketName, archive)
+	zipReader, err := zip.NewReader(readerAt, archive.Size)
+	if err != nil {
+		if readerAt.err != nil {
+			return nil, readerAt.err
+		}
+		return nil, fmt.Errorf("%w: error reading archive %s: %v", ErrInvalidArchive, archive.Name, err)
+	}
+	return zipReader, nil
+}
+
+// newTarReader returns a reader of the given tar archive object and the closer of the reader it reads from. An
+// uncompressed archive is read with ranged reads, so that the members that aren't read are skipped, and a compressed
+// archive is decompressed as it is read.
+func newTarReader(ctx context.Context, client Client, bucketName string, archive ObjectAttrs) (*tar.Reader, io.Closer,
+	error) {
+	if archive.Compression == "" {
+		readerAt := newObjectReaderAt(ctx, client, bucketName, archive)
+		return tar.NewReader(io.NewSectionReader(readerAt, 0, archive.Size)), io.NopCloser(nil), nil
+	}
+	rc, err := client.ReadObjectRange(ctx, bucketName, archive.Name, 0, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := NewDecompressor(rc, archive.Compression)
+	if err != nil {
+		rc.Close()
+		return nil, nil, fmt.Errorf("%w: error reading archive %s: %v", ErrInvalidArchive, archive.Name, err)
+	}
+	return tar.NewReader(reader), reader, nil
+}
+
+// objectReaderAt is an io.ReaderAt of an object that reads it with ranged reads. Each read reads at least
+// archiveReadAhead bytes, which are kept for the reads that follow it.
+type objectReaderAt struct {
+	ctx        context.Context
+	client     Client
+	bucketName string
+	object     ObjectAttrs
+	mu         sync.Mutex
+	buf        []byte
+	bufOffset  int64
+	err        error
+}
+
+// newObjectReaderAt returns an io.ReaderAt of the given object in the given bucket.
+func newObjectReaderAt(ctx context.Context, client Client, bucketName string, object ObjectAttrs) *objectReaderAt {
+	return &objectReaderAt{ctx: ctx, client: client, bucketName: bucketName, object: object}
+}
+
+// ReadAt reads len(p) bytes of the object from the given offset into p. The last error from the client is kept so that
+// it can be returned instead of the error of the archive reader that called ReadAt.
+func (r *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off >= r.object.Size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > r.object.Size {
+		end = r.object.Size
+	}
+	if off < r.bufOffset || end > r.bufOffset+int64(len(r.buf)) {
+		length := end - off
+		if length < int64(archiveReadAhead) {
+			length = int64(archiveReadAhead)
+		}
+		rc, err := r.client.ReadObjectRange(r.ctx, r.bucketName, r.object.Name, off, length)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		defer rc.Close()
+		if r.buf, err = io.ReadAll(rc); err != nil {
+			r.err = fmt.Errorf("error reading object %s: %v", r.object.Name, err)
+			return 0, r.err
+		}
+		r.bufOffset = off
+	}
+	n := copy(p, r.buf[off-r.bufOffset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// mediaType returns the media type of the given content type, without its parameters, in lower case.
+func mediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
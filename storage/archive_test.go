@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+// testArchiveMembers are the files written to the archives used by the tests.
+var testArchiveMembers = []struct {
+	name     string
+	contents string
+}{
+	{name: "book-1.txt", contents: "the first book"},
+	{name: "books/book-2.txt", contents: "the second book"},
+}
+
+func TestDetectArchive(t *testing.T) {
+	tests := []struct {
+		name        string
+		objectName  string
+		contentType string
+		expected    string
+	}{
+		{name: "Text", objectName: "book.txt", expected: ""},
+		{name: "Zip", objectName: "books.zip", expected: ArchiveZip},
+		{name: "Tar", objectName: "books.TAR", expected: ArchiveTar},
+		{name: "CompressedTar", objectName: "books.tar.gz", expected: ArchiveTar},
+		{name: "Tgz", objectName: "books.tgz", expected: ArchiveTar},
+		{name: "CompressedText", objectName: "book.txt.gz", expected: ""},
+		{name: "ZipContentType", objectName: "books", contentType: "application/zip", expected: ArchiveZip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, DetectArchive(tt.objectName, tt.contentType))
+		})
+	}
+}
+
+func TestListArchiveMembers(t *testing.T) {
+	// Read the archives with small ranged reads so that the headers are read with more than one
+	previousReadAhead := archiveReadAhead
+	archiveReadAhead = 64
+	defer func() { archiveReadAhead = previousReadAhead }()
+
+	for _, archive := range testArchives(t) {
+		t.Run(archive.Name, func(t *testing.T) {
+			// When
+			members, err := ListArchiveMembers(context.Background(), archive.client, "input", archive.ObjectAttrs)
+
+			// Then
+			assert.Nil(t, err)
+			assert.Equal(t, []ObjectAttrs{{Name: "book-1.txt", Size: 14}, {Name: "books/book-2.txt", Size: 15}}, members)
+		})
+	}
+}
+
+func TestOpenArchiveMember(t *testing.T) {
+	previousReadAhead := archiveReadAhead
+	archiveReadAhead = 64
+	defer func() { archiveReadAhead = previousReadAhead }()
+
+	for _, archive := range testArchives(t) {
+		t.Run(archive.Name, func(t *testing.T) {
+			// When
+			reader, err := OpenArchiveMember(context.Background(), archive.client, "input", archive.ObjectAttrs,
+				"books/book-2.txt")
+
+			// Then
+			assert.Nil(t, err)
+			data, err := io.ReadAll(reader)
+			assert.Nil(t, err)
+			assert.Equal(t, "the second book", string(data))
+			assert.Nil(t, reader.Close())
+		})
+	}
+}
+
+func TestOpenArchiveMember_MemberDoesntExistError(t *testing.T) {
+	for _, archive := range testArchives(t) {
+		t.Run(archive.Name, func(t *testing.T) {
+			// When
+			_, err := OpenArchiveMember(context.Background(), archive.client, "input", archive.ObjectAttrs, "missing.txt")
+
+			// Then
+			assert.True(t, errors.Is(err, ErrInvalidArchive))
+			assert.Contains(t, err.Error(), "doesn't have member missing.txt")
+		})
+	}
+}
+
+func TestListArchiveMembers_InvalidArchiveError(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("input", "books.zip", []byte("not a zip archive"))
+	memory.PutObject("input", "books.zip.gz", []byte("not a zip archive"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		archive  ObjectAttrs
+		expected string
+	}{
+		{name: "Malformed", archive: ObjectAttrs{Name: "books.zip", Size: 17, Archive: ArchiveZip},
+			expected: "error reading archive books.zip"},
+		{name: "CompressedZip", archive: ObjectAttrs{Name: "books.zip.gz", Size: 17, Compression: CompressionGzip,
+			Archive: ArchiveZip}, expected: "can't be read when it is compressed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			_, err := ListArchiveMembers(context.Background(), client, "input", tt.archive)
+
+			// Then
+			assert.True(t, errors.Is(err, ErrInvalidArchive))
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+// testArchive is an archive of testArchiveMembers in an in-memory bucket named "input".
+type testArchive struct {
+	ObjectAttrs
+	client Client
+}
+
+// testArchives returns a zip archive, a tar archive and a compressed tar archive of testArchiveMembers, each with a
+// directory entry that shouldn't be listed as a member.
+func testArchives(t *testing.T) []testArchive {
+	var zipData, tarData, tarGzData bytes.Buffer
+	zipWriter := zip.NewWriter(&zipData)
+	zipWriter.Create("books/")
+	tarWriter := tar.NewWriter(&tarData)
+	tarWriter.WriteHeader(&tar.Header{Name: "books/", Typeflag: tar.TypeDir, Mode: 0o755})
+	for _, member := range testArchiveMembers {
+		writer, err := zipWriter.Create(member.name)
+		if err != nil {
+			t.Fatalf("Error writing zip archive: %v", err)
+		}
+		writer.Write([]byte(member.contents))
+		err = tarWriter.WriteHeader(&tar.Header{Name: member.name, Typeflag: tar.TypeReg, Mode: 0o644,
+			Size: int64(len(member.contents))})
+		if err != nil {
+			t.Fatalf("Error writing tar archive: %v", err)
+		}
+		tarWriter.Write([]byte(member.contents))
+	}
+	zipWriter.Close()
+	tarWriter.Close()
+	gzipWriter := gzip.NewWriter(&tarGzData)
+	gzipWriter.Write(tarData.Bytes())
+	gzipWriter.Close()
+
+	memory := NewMemory()
+	memory.PutObject("input", "books.zip", zipData.Bytes())
+	memory.PutObject("input", "books.tar", tarData.Bytes())
+	memory.PutObject("input", "books.tar.gz", tarGzData.Bytes())
+	client, _ := memory.New(context.Background())
+	t.Cleanup(func() { _ = client.Close() })
+	objects, err := client.ListObjects(context.Background(), "input", "")
+	if err != nil {
+		t.Fatalf("Error listing archives: %v", err)
+	}
+	archives := make([]testArchive, 0, len(objects))
+	for _, object := range objects {
+		archives = append(archives, testArchive{ObjectAttrs: object, client: client})
+	}
+	return archives
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend is an interface for creating clients for a type of storage. Backends are registered by URL scheme, and the
+// scheme of a bucket name, e.g. "mem://input", decides which backend is used for the bucket. The bucket names passed to
+// a backend's clients have the scheme removed.
+type Backend interface {
+	// New returns a new client for the backend.
+	New(ctx context.Context) (Client, error)
+	// NewWithWriter returns a new client for the backend with a writer for the given bucket and object.
+	NewWithWriter(ctx context.Context, bucketName, objectName string) (Client, error)
+}
+
+// errNoWriter is returned when data is written to a client that wasn't created with a writer.
+var errNoWriter = errors.New("error writing data to file: storage client has no writer")
+
+// errAborted is the error that the writes of a client fail with once it has been aborted.
+var errAborted = errors.New("storage writer aborted")
+
+// DefaultScheme is the scheme of the backend used for bucket names without a scheme.
+const DefaultScheme = "gs"
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Backend{
+		DefaultScheme: gcsBackend{},
+		FileScheme:    fileBackend{},
+		S3Scheme:      s3Backend{},
+	}
+)
+
+// RegisterBackend makes a Backend available for bucket names with the given scheme, replacing any Backend already
+// registered for the scheme.
+func RegisterBackend(scheme string, backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[scheme] = backend
+}
+
+// Schemes returns the schemes that backends have been registered for in alphabetical order.
+func Schemes() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	schemes := make([]string, 0, len(backends))
+	for scheme := range backends {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// IsSupported returns true if a backend has been registered for the scheme of the given bucket name.
+func IsSupported(bucketName string) bool {
+	_, _, err := backendFor(bucketName)
+	return err == nil
+}
+
+// SplitBucketName returns the scheme and the name without the scheme of the given bucket name. Bucket names without a
+// scheme have the DefaultScheme.
+func SplitBucketName(bucketName string) (string, string) {
+	i := strings.Index(bucketName, "://")
+	if i < 0 {
+		return DefaultScheme, bucketName
+	}
+	return bucketName[:i], bucketName[i+len("://"):]
+}
+
+// rangeLength returns the number of bytes in the range of an object of the given size starting at the given offset with
+// the given length, where a negative length means the rest of the object.
+func rangeLength(offset, length, size int64) int64 {
+	if offset >= size {
+		return 0
+	}
+	if length < 0 || offset+length > size {
+		return size - offset
+	}
+	return length
+}
+
+// backendFor returns the Backend and the name without the scheme of the given bucket name, or an error if no Backend
+// has been registered for the bucket name's scheme.
+func backendFor(bucketName string) (Backend, string, error) {
+	scheme, name := SplitBucketName(bucketName)
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	backend, ok := backends[scheme]
+	if !ok {
+		return nil, "", fmt.Errorf("error creating storage client: no storage backend registered for scheme: %s", scheme)
+	}
+	return backend, name, nil
+}
+
+// New returns a new storage client. The client can be used with buckets of any registered scheme, and a client for each
+// scheme is only created when a bucket with the scheme is first used.
+func New(ctx context.Context) (Client, error) {
+	return &router{clients: make(map[Backend]Client)}, nil
+}
+
+// NewWithWriter returns a new storage client with a writer for the given bucket and object, using the Backend for the
+// bucket's scheme.
+func NewWithWriter(ctx context.Context, bucketName, objectName string) (Client, error) {
+	backend, name, err := backendFor(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return backend.NewWithWriter(ctx, name, objectName)
+}
+
+// router is a Client that passes each call on to a client of the Backend for the bucket's scheme.
+type router struct {
+	mu      sync.Mutex
+	clients map[Backend]Client
+}
+
+var _ Client = &router{}
+
+// client returns the client for the given bucket, creating it if it doesn't exist yet, and the name of the bucket
+// without its scheme.
+func (r *router) client(ctx context.Context, bucketName string) (Client, string, error) {
+	backend, name, err := backendFor(bucketName)
+	if err != nil {
+		return nil, "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[backend]; ok {
+		return client, name, nil
+	}
+	client, err := backend.New(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	r.clients[backend] = client
+	return client, name, nil
+}
+
+// Abort aborts the clients that have been created.
+func (r *router) Abort() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, client := range r.clients {
+		client.Abort()
+	}
+}
+
+// Close closes the clients that have been created, and returns the first error returned by any of them.
+func (r *router) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var firstErr error
+	for _, client := range r.clients {
+		if err := client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ListObjects returns the names and sizes of all objects in the given bucket whose names start with the given prefix.
+func (r *router) ListObjects(ctx context.Context, bucketName, prefix string) ([]ObjectAttrs, error) {
+	client, name, err := r.client(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return client.ListObjects(ctx, name, prefix)
+}
+
+// ReadObject returns the contents of the given object in the given bucket.
+func (r *router) ReadObject(ctx context.Context, bucketName, objectName string) ([]byte, error) {
+	client, name, err := r.client(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadObject(ctx, name, objectName)
+}
+
+// ReadObjectRange returns a reader that streams length bytes of the given object in the given bucket from the given
+// offset, or the rest of the object if length is negative.
+func (r *router) ReadObjectRange(ctx context.Context, bucketName, objectName string, offset,
+	length int64) (io.ReadCloser, error) {
+	client, name, err := r.client(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadObjectRange(ctx, name, objectName, offset, length)
+}
+
+// WriteObject writes the given data to the given object in the given bucket.
+func (r *router) WriteObject(ctx context.Context, bucketName, objectName string, data []byte) error {
+	client, name, err := r.client(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+	return client.WriteObject(ctx, name, objectName, data)
+}
+
+// CopyObject copies the given source object to the given destination object in the given bucket.
+func (r *router) CopyObject(ctx context.Context, bucketName, srcObjectName, dstObjectName string) error {
+	client, name, err := r.client(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+	return client.CopyObject(ctx, name, srcObjectName, dstObjectName)
+}
+
+// DeleteObject deletes the given object in the given bucket.
+func (r *router) DeleteObject(ctx context.Context, bucketName, objectName string) error {
+	client, name, err := r.client(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+	return client.DeleteObject(ctx, name, objectName)
+}
+
+// Write isn't supported by clients created with New, since they don't have a writer. Use NewWithWriter instead.
+func (r *router) Write(data []byte) (int, error) {
+	return 0, errNoWriter
+}
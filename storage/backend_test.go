@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSplitBucketName(t *testing.T) {
+	tests := []struct {
+		bucketName     string
+		expectedScheme string
+		expectedName   string
+	}{
+		{"some-bucket", DefaultScheme, "some-bucket"},
+		{"gs://some-bucket", "gs", "some-bucket"},
+		{"mem://some-bucket", "mem", "some-bucket"},
+		{"file:///tmp/some-bucket", "file", "/tmp/some-bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bucketName, func(t *testing.T) {
+			// When
+			scheme, name := SplitBucketName(tt.bucketName)
+
+			// Then
+			assert.Equal(t, tt.expectedScheme, scheme)
+			assert.Equal(t, tt.expectedName, name)
+		})
+	}
+}
+
+func TestNew_RoutesByScheme(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("input", "book.txt", []byte("some text"))
+	RegisterBackend("test-mem", memory)
+	client, err := New(context.Background())
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	defer client.Close()
+
+	// When
+	data, err := client.ReadObject(context.Background(), "test-mem://input", "book.txt")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, "some text", string(data))
+}
+
+func TestNew_UnknownSchemeError(t *testing.T) {
+	// Given
+	client, err := New(context.Background())
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	defer client.Close()
+
+	// When
+	_, err = client.ListObjects(context.Background(), "unknown://input", "")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no storage backend registered for scheme: unknown")
+}
+
+func TestNewWithWriter_UnknownSchemeError(t *testing.T) {
+	// When
+	_, err := NewWithWriter(context.Background(), "unknown://output", "part-0.txt")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error creating storage client")
+}
+
+func TestNew_WriteWithoutWriterError(t *testing.T) {
+	// Given
+	client, err := New(context.Background())
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	defer client.Close()
+
+	// When
+	_, err = client.Write([]byte("acer: care race\n"))
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "storage client has no writer")
+}
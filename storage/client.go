@@ -3,6 +3,7 @@ package storage
 import (
 	"cloud.google.com/go/storage"
 	"context"
+	"errors"
 	"fmt"
 	"google.golang.org/api/iterator"
 	"io"
@@ -12,21 +13,31 @@ import (
 
 // Client is an interface for interacting with storage.
 type Client interface {
-	Close()
-	ReadObjectNames(ctx context.Context, bucketName string) ([]string, error)
+	Abort()
+	Close() error
+	ListObjects(ctx context.Context, bucketName, prefix string) ([]ObjectAttrs, error)
 	ReadObject(ctx context.Context, bucketName, objectName string) ([]byte, error)
-	WriteData(key string, value []string)
+	ReadObjectRange(ctx context.Context, bucketName, objectName string, offset, length int64) (io.ReadCloser, error)
+	WriteObject(ctx context.Context, bucketName, objectName string, data []byte) error
+	CopyObject(ctx context.Context, bucketName, srcObjectName, dstObjectName string) error
+	DeleteObject(ctx context.Context, bucketName, objectName string) error
+	Write(data []byte) (int, error)
 }
 
 type clientImpl struct {
 	client *storage.Client
 	writer *storage.Writer
+	cancel context.CancelFunc
 }
 
 var _ Client = &clientImpl{}
 
-// New returns a new storage client.
-func New(ctx context.Context) (Client, error) {
+// gcsBackend is the Backend for Google Cloud Storage buckets, which is used for bucket names without a scheme or with the
+// gs scheme.
+type gcsBackend struct{}
+
+// New returns a new Cloud Storage client.
+func (gcsBackend) New(ctx context.Context) (Client, error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error creating storage client: %v", err)
@@ -36,52 +47,77 @@ func New(ctx context.Context) (Client, error) {
 	}, nil
 }
 
-// NewWithWriter returns a new storage client with a writer for the given bucket and object.
-func NewWithWriter(ctx context.Context, bucketName, objectName string) (Client, error) {
+// NewWithWriter returns a new Cloud Storage client with a writer for the given bucket and object.
+func (gcsBackend) NewWithWriter(ctx context.Context, bucketName, objectName string) (Client, error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error creating storage client: %v", err)
 	}
+	// The writer's context is cancelled to abort the upload
+	ctx, cancel := context.WithCancel(ctx)
 	return &clientImpl{
 		client: client,
 		writer: client.Bucket(bucketName).Object(objectName).NewWriter(ctx),
+		cancel: cancel,
 	}, nil
 }
 
-// Close closes the storage client.
-func (c *clientImpl) Close() {
-	err := c.client.Close()
-	if err != nil {
+// Abort closes the storage client without creating the object written with Write, if the client has a writer.
+func (c *clientImpl) Abort() {
+	if c.writer != nil {
+		c.cancel()
+		_ = c.writer.Close()
+		c.writer = nil
+	}
+	if err := c.client.Close(); err != nil {
 		log.Println("Error closing storage client: ", err)
 	}
-	// Close the writer if it exists
+}
+
+// Close closes the storage client. If the client has a writer, the writer is closed first, which is when the object is
+// uploaded, so an error is returned if the object couldn't be created.
+func (c *clientImpl) Close() error {
+	var writerErr error
 	if c.writer != nil {
-		err = c.writer.Close()
-		if err != nil {
-			log.Println("Error closing storage writer: ", err)
-		}
+		writerErr = c.writer.Close()
+		c.writer = nil
+		c.cancel()
+	}
+	if err := c.client.Close(); err != nil {
+		log.Println("Error closing storage client: ", err)
+	}
+	if writerErr != nil {
+		return fmt.Errorf("error closing storage writer: %v", writerErr)
 	}
+	return nil
 }
 
-// ReadObjectNames returns the names of all objects in the given bucket.
-func (c *clientImpl) ReadObjectNames(ctx context.Context, bucketName string) ([]string, error) {
-	// Iterate over all objects in the bucket and add each file name to the files slice
-	objects := c.client.Bucket(bucketName).Objects(ctx, nil)
-	files := make([]string, 0)
+// ListObjects returns the names and sizes of all objects in the given bucket whose names start with the given prefix,
+// in alphabetical order.
+func (c *clientImpl) ListObjects(ctx context.Context, bucketName, prefix string) ([]ObjectAttrs, error) {
+	// Iterate over all objects in the bucket with the prefix and add each one to the objects slice
+	it := c.client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	objects := make([]ObjectAttrs, 0)
 	for {
-		attributes, err := objects.Next()
+		attributes, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		// Add the file name to the list of files if it is a text file
-		if strings.HasSuffix(attributes.Name, ".txt") {
-			files = append(files, attributes.Name)
+		// Skip the placeholder objects that some tools create for folders
+		if strings.HasSuffix(attributes.Name, "/") {
+			continue
 		}
+		object := newObjectAttrs(attributes.Name, attributes.Size, attributes.ContentType)
+		// GCS decompresses objects stored with gzip content encoding when they are read
+		if attributes.ContentEncoding == "gzip" {
+			object.Compression = ""
+		}
+		objects = append(objects, object)
 	}
-	return files, nil
+	return objects, nil
 }
 
 // ReadObject returns the contents of the given object in the given bucket.
@@ -100,13 +136,59 @@ func (c *clientImpl) ReadObject(ctx context.Context, bucketName, objectName stri
 	return data, nil
 }
 
-// WriteData writes the given data to the storage client's writer.
-func (c *clientImpl) WriteData(key string, value []string) {
-	// Create a string from the key and the value slice
-	data := fmt.Sprintf("%s: %s\n", key, strings.Join(value, " "))
-	// Write the data to the writer
-	_, err := c.writer.Write([]byte(data))
+// ReadObjectRange returns a reader that streams length bytes of the given object in the given bucket from the given
+// offset, or the rest of the object if length is negative. The reader must be closed.
+func (c *clientImpl) ReadObjectRange(ctx context.Context, bucketName, objectName string, offset,
+	length int64) (io.ReadCloser, error) {
+	rc, err := c.client.Bucket(bucketName).Object(objectName).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, err)
+	}
+	return rc, nil
+}
+
+// WriteObject writes the given data to the given object in the given bucket, replacing the object if it exists.
+func (c *clientImpl) WriteObject(ctx context.Context, bucketName, objectName string, data []byte) error {
+	// Create a writer for the object
+	wc := c.client.Bucket(bucketName).Object(objectName).NewWriter(ctx)
+	if _, err := wc.Write(data); err != nil {
+		_ = wc.Close()
+		return fmt.Errorf("error writing object %s: %v", objectName, err)
+	}
+	// The object is only created once the writer has been closed
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("error closing writer for object %s: %v", objectName, err)
+	}
+	return nil
+}
+
+// CopyObject copies the given source object to the given destination object in the given bucket, replacing the
+// destination object if it exists.
+func (c *clientImpl) CopyObject(ctx context.Context, bucketName, srcObjectName, dstObjectName string) error {
+	bucket := c.client.Bucket(bucketName)
+	if _, err := bucket.Object(dstObjectName).CopierFrom(bucket.Object(srcObjectName)).Run(ctx); err != nil {
+		return fmt.Errorf("error copying object %s to %s: %v", srcObjectName, dstObjectName, err)
+	}
+	return nil
+}
+
+// DeleteObject deletes the given object in the given bucket. It isn't an error if the object doesn't exist.
+func (c *clientImpl) DeleteObject(ctx context.Context, bucketName, objectName string) error {
+	err := c.client.Bucket(bucketName).Object(objectName).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("error deleting object %s: %v", objectName, err)
+	}
+	return nil
+}
+
+// Write writes the given data to the storage client's writer, so that a RecordWriter can write to the client.
+func (c *clientImpl) Write(data []byte) (int, error) {
+	if c.writer == nil {
+		return 0, errNoWriter
+	}
+	n, err := c.writer.Write(data)
 	if err != nil {
-		log.Println("Error writing data to file: ", err)
+		return n, fmt.Errorf("error writing data to file: %v", err)
 	}
+	return n, nil
 }
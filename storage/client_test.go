@@ -8,7 +8,7 @@ import (
 	"testing"
 )
 
-func TestReadObjectNames(t *testing.T) {
+func TestListObjects(t *testing.T) {
 	// Setup test
 	teardownStorage := test.SetupStorageTest(t)
 	defer teardownStorage(t)
@@ -21,17 +21,17 @@ func TestReadObjectNames(t *testing.T) {
 	defer client.Close()
 
 	// When
-	objectNames, err := client.ReadObjectNames(context.Background(), test.InputBucketName)
+	objects, err := client.ListObjects(context.Background(), test.InputBucketName, "")
 	if err != nil {
 		return
 	}
 
 	// Then
 	assert.Nil(t, err)
-	assert.Equal(t, []string{"test.txt"}, objectNames)
+	assert.Equal(t, []ObjectAttrs{{Name: "test.txt", Size: 118}}, objects)
 }
 
-func TestReeadObjectNames_TxtFilesOnly(t *testing.T) {
+func TestListObjects_Prefix(t *testing.T) {
 	// Setup test
 	teardownStorage := test.SetupStorageTest(t)
 	defer teardownStorage(t)
@@ -48,26 +48,22 @@ func TestReeadObjectNames_TxtFilesOnly(t *testing.T) {
 		t.Fatalf("Error creating storage client: %v", err)
 	}
 	bucket := c.Bucket(test.InputBucketName)
-	err = bucket.Object("test.txt").Delete(context.Background())
-	if err != nil {
-		t.Fatalf("Error deleting object: %v", err)
-	}
-	err = bucket.Object("test.csv").NewWriter(context.Background()).Close()
+	err = bucket.Object("books/test.csv").NewWriter(context.Background()).Close()
 	if err != nil {
 		t.Fatalf("Error creating object: %v", err)
 	}
 
 	// When
-	objectNames, err := client.ReadObjectNames(context.Background(), test.InputBucketName)
+	objects, err := client.ListObjects(context.Background(), test.InputBucketName, "books/")
 	if err != nil {
 		return
 	}
 
 	// Then
 	assert.Nil(t, err)
-	assert.Empty(t, objectNames)
+	assert.Equal(t, []ObjectAttrs{{Name: "books/test.csv", Size: 0}}, objects)
 
-	err = bucket.Object("test.csv").Delete(context.Background())
+	err = bucket.Object("books/test.csv").Delete(context.Background())
 	if err != nil {
 		t.Fatalf("Error deleting object: %v", err)
 	}
@@ -115,3 +111,25 @@ func TestReadObject_CreateReaderError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, data)
 }
+
+func TestWriteObject(t *testing.T) {
+	// Setup test
+	teardownStorage := test.SetupStorageTest(t)
+	defer teardownStorage(t)
+
+	// Given
+	client, err := New(context.Background())
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	defer client.Close()
+
+	// When
+	err = client.WriteObject(context.Background(), test.OutputBucketName, "job-1/_SUCCESS", []byte("{}"))
+
+	// Then
+	assert.Nil(t, err)
+	data, err := client.ReadObject(context.Background(), test.OutputBucketName, "job-1/_SUCCESS")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("{}"), data)
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// TemporaryDir is the directory, in a job's output directory, that the reducers write the job's output files to until
+// the job is committed.
+const TemporaryDir = "_temporary"
+
+// OutputPrefix returns the prefix of the output files of the job with the given ID, which are written to a directory
+// named after the job ID so that the output of concurrent jobs is kept separate.
+func OutputPrefix(jobID string) string {
+	if jobID == "" {
+		return ""
+	}
+	return jobID + "/"
+}
+
+// TemporaryPrefix returns the prefix of the temporary output files of the job whose output files have the given prefix,
+// e.g. "job-1/_temporary/" for "job-1/".
+func TemporaryPrefix(prefix string) string {
+	return prefix + TemporaryDir + "/"
+}
+
+// CommitOutputs promotes the given temporary output files of the job whose output files have the given prefix to their
+// final names, which are their names without the temporary directory, and returns the final names in the same order.
+// Each file is copied rather than moved, so a commit that fails part of the way through can be run again. The
+// temporary files should be deleted with DeleteTemporaryOutputs once the job has been committed.
+func CommitOutputs(ctx context.Context, bucketName, prefix string, objectNames []string) ([]string, error) {
+	temporaryPrefix := TemporaryPrefix(prefix)
+	storageClient, err := New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer storageClient.Close()
+	committed := make([]string, 0, len(objectNames))
+	for _, objectName := range objectNames {
+		if !strings.HasPrefix(objectName, temporaryPrefix) {
+			return nil, fmt.Errorf("error committing output file %s: it isn't in %s", objectName, temporaryPrefix)
+		}
+		finalName := prefix + strings.TrimPrefix(objectName, temporaryPrefix)
+		if err := storageClient.CopyObject(ctx, bucketName, objectName, finalName); err != nil {
+			return nil, fmt.Errorf("error committing output file %s: %v", objectName, err)
+		}
+		committed = append(committed, finalName)
+	}
+	return committed, nil
+}
+
+// DeleteTemporaryOutputs deletes every temporary output file of the job whose output files have the given prefix, along
+// with any message data offloaded to the temporary directory. It is used to clean up once the job has been committed,
+// or to abort the job so that none of its output files are kept.
+func DeleteTemporaryOutputs(ctx context.Context, bucketName, prefix string) error {
+	storageClient, err := New(ctx)
+	if err != nil {
+		return err
+	}
+	defer storageClient.Close()
+	objects, err := storageClient.ListObjects(ctx, bucketName, TemporaryPrefix(prefix))
+	if err != nil {
+		return fmt.Errorf("error listing temporary output files: %v", err)
+	}
+	for _, object := range objects {
+		if err := storageClient.DeleteObject(ctx, bucketName, object.Name); err != nil {
+			return fmt.Errorf("error deleting temporary output file: %v", err)
+		}
+	}
+	return nil
+}
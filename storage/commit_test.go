@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOutputPrefix(t *testing.T) {
+	assert.Equal(t, "job-1/", OutputPrefix("job-1"))
+	assert.Equal(t, "", OutputPrefix(""))
+}
+
+func TestTemporaryPrefix(t *testing.T) {
+	assert.Equal(t, "job-1/_temporary/", TemporaryPrefix("job-1/"))
+	assert.Equal(t, "_temporary/", TemporaryPrefix(""))
+}
+
+func TestCommitOutputs(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	RegisterBackend("test-mem", memory)
+	memory.PutObject("output", "job-1/_temporary/anagrams-part-0.txt", []byte("acer: care race\n"))
+	memory.PutObject("output", "job-1/_temporary/anagrams-part-1.txt", []byte("aet: eat tea\n"))
+
+	// When
+	committed, err := CommitOutputs(context.Background(), "test-mem://output", "job-1/",
+		[]string{"job-1/_temporary/anagrams-part-1.txt", "job-1/_temporary/anagrams-part-0.txt"})
+	errDelete := DeleteTemporaryOutputs(context.Background(), "test-mem://output", "job-1/")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Nil(t, errDelete)
+	assert.Equal(t, []string{"job-1/anagrams-part-1.txt", "job-1/anagrams-part-0.txt"}, committed)
+	assert.Equal(t, map[string][]byte{
+		"job-1/anagrams-part-0.txt": []byte("acer: care race\n"),
+		"job-1/anagrams-part-1.txt": []byte("aet: eat tea\n"),
+	}, memory.Objects("output"))
+}
+
+func TestCommitOutputs_NotTemporaryError(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	RegisterBackend("test-mem", memory)
+	memory.PutObject("output", "job-1/anagrams-part-0.txt", []byte("acer: care race\n"))
+
+	// When
+	_, err := CommitOutputs(context.Background(), "test-mem://output", "job-1/",
+		[]string{"job-1/anagrams-part-0.txt"})
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error committing output file job-1/anagrams-part-0.txt: it isn't in "+
+		"job-1/_temporary/")
+}
+
+func TestCommitOutputs_MissingFileError(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("output")
+	RegisterBackend("test-mem", memory)
+
+	// When
+	_, err := CommitOutputs(context.Background(), "test-mem://output", "job-1/",
+		[]string{"job-1/_temporary/anagrams-part-0.txt"})
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error committing output file job-1/_temporary/anagrams-part-0.txt")
+	assert.Empty(t, memory.Objects("output"))
+}
+
+func TestDeleteTemporaryOutputs(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	RegisterBackend("test-mem", memory)
+	memory.PutObject("output", "job-1/_temporary/anagrams-part-0.txt", []byte("acer: care race\n"))
+	memory.PutObject("output", "job-2/_temporary/anagrams-part-0.txt", []byte("aet: eat tea\n"))
+	memory.PutObject("output", "job-1/anagrams-part-0.txt", []byte("acer: care race\n"))
+
+	// When
+	err := DeleteTemporaryOutputs(context.Background(), "test-mem://output", "job-1/")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{
+		"job-2/_temporary/anagrams-part-0.txt": []byte("aet: eat tea\n"),
+		"job-1/anagrams-part-0.txt":            []byte("acer: care race\n"),
+	}, memory.Objects("output"))
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// CompressionGzip is the compression of objects compressed with gzip.
+const CompressionGzip = "gzip"
+
+// CompressionBzip2 is the compression of objects compressed with bzip2.
+const CompressionBzip2 = "bzip2"
+
+// CompressionZlib is the compression of objects compressed with zlib.
+const CompressionZlib = "zlib"
+
+// compressionExtensions maps the extensions of compressed objects to their compression.
+var compressionExtensions = map[string]string{
+	".gz":   CompressionGzip,
+	".gzip": CompressionGzip,
+	".tgz":  CompressionGzip,
+	".bz2":  CompressionBzip2,
+	".tbz2": CompressionBzip2,
+	".zz":   CompressionZlib,
+	".zlib": CompressionZlib,
+}
+
+// compressionContentTypes maps the content types of compressed objects to their compression.
+var compressionContentTypes = map[string]string{
+	"application/gzip":    CompressionGzip,
+	"application/x-gzip":  CompressionGzip,
+	"application/x-bzip2": CompressionBzip2,
+	"application/x-bzip":  CompressionBzip2,
+	"application/zlib":    CompressionZlib,
+}
+
+// DetectCompression returns the compression of an object with the given name and content type, or an empty string if
+// the object isn't compressed. The content type is used if it is a compressed type, and the extension of the name
+// otherwise.
+func DetectCompression(objectName, contentType string) string {
+	if compression, ok := compressionContentTypes[mediaType(contentType)]; ok {
+		return compression
+	}
+	return compressionExtensions[strings.ToLower(path.Ext(objectName))]
+}
+
+// TrimCompressionExtension returns the given object name without the extension of its compression, e.g. "book.txt"
+// for "book.txt.gz". The name is returned unchanged if it doesn't have a compression extension.
+func TrimCompressionExtension(objectName string) string {
+	ext := path.Ext(objectName)
+	if _, ok := compressionExtensions[strings.ToLower(ext)]; ok {
+		return strings.TrimSuffix(objectName, ext)
+	}
+	return objectName
+}
+
+// NewDecompressor returns a reader of the decompressed contents of the given reader, which holds data with the given
+// compression. The given reader is returned if the compression is empty. Closing the returned reader closes the given
+// reader.
+func NewDecompressor(reader io.ReadCloser, compression string) (io.ReadCloser, error) {
+	var decompressor io.Reader
+	var err error
+	switch compression {
+	case "":
+		return reader, nil
+	case CompressionGzip:
+		decompressor, err = gzip.NewReader(reader)
+	case CompressionBzip2:
+		decompressor = bzip2.NewReader(reader)
+	case CompressionZlib:
+		decompressor, err = zlib.NewReader(reader)
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s data: %v", compression, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{decompressor, reader}, nil
+}
+
+// NewCompressor returns a writer that compresses the data written to it with the given compression and writes it to
+// the given writer. The returned writer must be closed to flush the compressed data, which doesn't close the given
+// writer. Data can't be compressed with bzip2, since the standard library can only read it.
+func NewCompressor(writer io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(writer), nil
+	case CompressionZlib:
+		return zlib.NewWriter(writer), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression for writing: %s", compression)
+	}
+}
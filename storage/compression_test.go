@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestDetectCompression(t *testing.T) {
+	tests := []struct {
+		name        string
+		objectName  string
+		contentType string
+		expected    string
+	}{
+		{name: "Text", objectName: "book.txt", contentType: "text/plain", expected: ""},
+		{name: "GzipExtension", objectName: "book.txt.gz", expected: CompressionGzip},
+		{name: "Bzip2Extension", objectName: "books/book.txt.BZ2", expected: CompressionBzip2},
+		{name: "ZlibExtension", objectName: "book.txt.zz", expected: CompressionZlib},
+		{name: "GzipContentType", objectName: "book", contentType: "application/gzip", expected: CompressionGzip},
+		{name: "ContentTypeWithParameters", objectName: "book", contentType: "application/x-bzip2; charset=binary",
+			expected: CompressionBzip2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, DetectCompression(tt.objectName, tt.contentType))
+		})
+	}
+}
+
+func TestTrimCompressionExtension(t *testing.T) {
+	assert.Equal(t, "books/book.txt", TrimCompressionExtension("books/book.txt.gz"))
+	assert.Equal(t, "book.txt", TrimCompressionExtension("book.txt.bz2"))
+	assert.Equal(t, "book.txt", TrimCompressionExtension("book.txt"))
+}
+
+func TestNewDecompressor(t *testing.T) {
+	var gzipData, zlibData bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipData)
+	gzipWriter.Write([]byte("some text"))
+	gzipWriter.Close()
+	zlibWriter := zlib.NewWriter(&zlibData)
+	zlibWriter.Write([]byte("some text"))
+	zlibWriter.Close()
+	// "some text" compressed with bzip2, since the standard library can't write bzip2 data
+	bzip2Data, _ := hex.DecodeString("425a6839314159265359fb2ce7c20000029180400002028c402000310c01064f4723c44945dc914e1424" +
+		"3ecb39f080")
+
+	tests := []struct {
+		name        string
+		compression string
+		data        []byte
+	}{
+		{name: "None", compression: "", data: []byte("some text")},
+		{name: "Gzip", compression: CompressionGzip, data: gzipData.Bytes()},
+		{name: "Bzip2", compression: CompressionBzip2, data: bzip2Data},
+		{name: "Zlib", compression: CompressionZlib, data: zlibData.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			reader, err := NewDecompressor(io.NopCloser(bytes.NewReader(tt.data)), tt.compression)
+
+			// Then
+			assert.Nil(t, err)
+			data, err := io.ReadAll(reader)
+			assert.Nil(t, err)
+			assert.Equal(t, "some text", string(data))
+			assert.Nil(t, reader.Close())
+		})
+	}
+}
+
+func TestNewDecompressor_InvalidDataError(t *testing.T) {
+	// When
+	_, err := NewDecompressor(io.NopCloser(bytes.NewReader([]byte("some text"))), CompressionGzip)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error reading gzip data")
+}
+
+func TestNewDecompressor_UnsupportedCompressionError(t *testing.T) {
+	// When
+	_, err := NewDecompressor(io.NopCloser(bytes.NewReader(nil)), "zstd")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unsupported compression: zstd")
+}
+
+func TestNewCompressor(t *testing.T) {
+	for _, compression := range []string{CompressionGzip, CompressionZlib} {
+		t.Run(compression, func(t *testing.T) {
+			// Given
+			var compressed bytes.Buffer
+
+			// When
+			compressor, err := NewCompressor(&compressed, compression)
+			if err != nil {
+				t.Fatalf("Error creating compressor: %v", err)
+			}
+			_, _ = compressor.Write([]byte("some text"))
+			err = compressor.Close()
+
+			// Then
+			assert.Nil(t, err)
+			reader, err := NewDecompressor(io.NopCloser(&compressed), compression)
+			if err != nil {
+				t.Fatalf("Error creating decompressor: %v", err)
+			}
+			data, err := io.ReadAll(reader)
+			assert.Nil(t, err)
+			assert.Equal(t, "some text", string(data))
+		})
+	}
+}
+
+func TestNewCompressor_UnsupportedCompressionError(t *testing.T) {
+	// When
+	_, err := NewCompressor(&bytes.Buffer{}, CompressionBzip2)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unsupported compression for writing: bzip2")
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileScheme is the scheme of bucket names that are directories on the local filesystem, e.g. "file:///data/input" or
+// "file://./input".
+const FileScheme = "file"
+
+// fileBackend is the Backend for buckets that are directories on the local filesystem. Objects are the files in the
+// directory and its subdirectories, named by their path relative to the directory with "/" separators. Objects are
+// written to a temporary file that is renamed over the object once it has been written, so readers never see a
+// partially written object.
+type fileBackend struct{}
+
+// New returns a new filesystem client.
+func (fileBackend) New(ctx context.Context) (Client, error) {
+	return &fileClient{}, nil
+}
+
+// NewWithWriter returns a new filesystem client with a writer for the given bucket and object. The object is only
+// created once the client is closed.
+func (fileBackend) NewWithWriter(ctx context.Context, bucketName, objectName string) (Client, error) {
+	path, err := objectPath(bucketName, objectName)
+	if err != nil {
+		return nil, fmt.Errorf("error creating storage client: %v", err)
+	}
+	file, err := createTempFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating storage client: %v", err)
+	}
+	return &fileClient{
+		path:   path,
+		writer: file,
+	}, nil
+}
+
+// fileClient is a Client for the filesystem backend.
+type fileClient struct {
+	path   string
+	mu     sync.Mutex
+	writer *os.File
+	err    error
+}
+
+var _ Client = &fileClient{}
+
+// Abort removes the file written with Write without creating the client's object, if the client has a writer.
+func (c *fileClient) Abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer == nil {
+		return
+	}
+	_ = commitTempFile(c.writer, c.path, errAborted)
+	c.writer = nil
+}
+
+// Close renames the file written with Write over the client's object, if the client has a writer. If any of the
+// writes failed, or the file couldn't be renamed, the file is removed, the object is left as it was and an error is
+// returned.
+func (c *fileClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer == nil {
+		return nil
+	}
+	err := commitTempFile(c.writer, c.path, c.err)
+	c.writer = nil
+	if err != nil {
+		return fmt.Errorf("error closing storage writer: %v", err)
+	}
+	return nil
+}
+
+// ListObjects returns the names and sizes of all objects in the given bucket whose names start with the given prefix,
+// in alphabetical order.
+func (c *fileClient) ListObjects(ctx context.Context, bucketName, prefix string) ([]ObjectAttrs, error) {
+	if err := checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+	// Only walk the directory that the prefix is in, rather than the whole bucket
+	root := bucketName
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = filepath.Join(bucketName, filepath.FromSlash(prefix[:i]))
+	}
+	objects := make([]ObjectAttrs, 0)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		// Skip directories and the temporary files of objects that are being written
+		if info.IsDir() || isTempFile(info.Name()) {
+			return nil
+		}
+		name, err := filepath.Rel(bucketName, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, newObjectAttrs(name, info.Size(), ""))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading objects in bucket %s: %v", bucketName, err)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+// ReadObject returns the contents of the given object in the given bucket.
+func (c *fileClient) ReadObject(ctx context.Context, bucketName, objectName string) ([]byte, error) {
+	path, err := objectPath(bucketName, objectName)
+	if err != nil {
+		return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, err)
+	}
+	return data, nil
+}
+
+// ReadObjectRange returns a reader that streams length bytes of the given object in the given bucket from the given
+// offset, or the rest of the object if length is negative. The reader must be closed.
+func (c *fileClient) ReadObjectRange(ctx context.Context, bucketName, objectName string, offset,
+	length int64) (io.ReadCloser, error) {
+	path, err := objectPath(bucketName, objectName)
+	if err != nil {
+		return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, offset, rangeLength(offset, length, info.Size())), file}, nil
+}
+
+// WriteObject writes the given data to the given object in the given bucket, replacing the object if it exists.
+func (c *fileClient) WriteObject(ctx context.Context, bucketName, objectName string, data []byte) error {
+	path, err := objectPath(bucketName, objectName)
+	if err != nil {
+		return fmt.Errorf("error writing object %s: %v", objectName, err)
+	}
+	file, err := createTempFile(path)
+	if err != nil {
+		return fmt.Errorf("error writing object %s: %v", objectName, err)
+	}
+	_, err = file.Write(data)
+	if err := commitTempFile(file, path, err); err != nil {
+		return fmt.Errorf("error writing object %s: %v", objectName, err)
+	}
+	return nil
+}
+
+// CopyObject copies the given source object to the given destination object in the given bucket, replacing the
+// destination object if it exists. The destination is written to a temporary file that is renamed over it, so readers
+// never see a partially copied object.
+func (c *fileClient) CopyObject(ctx context.Context, bucketName, srcObjectName, dstObjectName string) error {
+	src, err := c.ReadObjectRange(ctx, bucketName, srcObjectName, 0, -1)
+	if err != nil {
+		return fmt.Errorf("error copying object %s to %s: %v", srcObjectName, dstObjectName, err)
+	}
+	defer src.Close()
+	path, err := objectPath(bucketName, dstObjectName)
+	if err != nil {
+		return fmt.Errorf("error copying object %s to %s: %v", srcObjectName, dstObjectName, err)
+	}
+	file, err := createTempFile(path)
+	if err != nil {
+		return fmt.Errorf("error copying object %s to %s: %v", srcObjectName, dstObjectName, err)
+	}
+	_, err = io.Copy(file, src)
+	if err := commitTempFile(file, path, err); err != nil {
+		return fmt.Errorf("error copying object %s to %s: %v", srcObjectName, dstObjectName, err)
+	}
+	return nil
+}
+
+// DeleteObject deletes the given object in the given bucket. It isn't an error if the object doesn't exist.
+func (c *fileClient) DeleteObject(ctx context.Context, bucketName, objectName string) error {
+	path, err := objectPath(bucketName, objectName)
+	if err != nil {
+		return fmt.Errorf("error deleting object %s: %v", objectName, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting object %s: %v", objectName, err)
+	}
+	return nil
+}
+
+// Write writes the given data to the client's writer. If the write fails, the object isn't created when the client is
+// closed.
+func (c *fileClient) Write(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer == nil {
+		return 0, errNoWriter
+	}
+	n, err := c.writer.Write(data)
+	if err != nil {
+		c.err = err
+		return n, fmt.Errorf("error writing data to file: %v", err)
+	}
+	return n, nil
+}
+
+// tempFilePrefix is the prefix of the temporary files that objects are written to before they are renamed.
+const tempFilePrefix = ".tmp-"
+
+// isTempFile returns true if the file with the given name is the temporary file of an object that is being written.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix)
+}
+
+// checkBucket returns an error if the given bucket isn't a directory.
+func checkBucket(bucketName string) error {
+	info, err := os.Stat(bucketName)
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("storage: bucket doesn't exist: %s", bucketName)
+	}
+	return nil
+}
+
+// objectPath returns the path of the given object in the given bucket. It returns an error if the bucket doesn't exist
+// or the object name would refer to a file outside the bucket.
+func objectPath(bucketName, objectName string) (string, error) {
+	if err := checkBucket(bucketName); err != nil {
+		return "", err
+	}
+	name := filepath.FromSlash(objectName)
+	if objectName == "" || filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+		return "", fmt.Errorf("storage: invalid object name: %s", objectName)
+	}
+	return filepath.Join(bucketName, name), nil
+}
+
+// createTempFile creates the temporary file that the object with the given path is written to, creating the object's
+// directory if needed. The file is in the same directory as the object so that it can be renamed over it.
+func createTempFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(filepath.Dir(path), tempFilePrefix+filepath.Base(path)+"-")
+}
+
+// commitTempFile closes the given temporary file and renames it to the given path, unless writing to it failed with
+// the given error, in which case the file is removed and the error returned.
+func commitTempFile(file *os.File, path string, writeErr error) error {
+	closeErr := file.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		// Temporary files are only readable by their owner
+		writeErr = os.Chmod(file.Name(), 0o644)
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(file.Name(), path)
+	}
+	if writeErr != nil {
+		_ = os.Remove(file.Name())
+		return writeErr
+	}
+	return nil
+}
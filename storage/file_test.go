@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile_ListObjects(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	writeTestFile(t, filepath.Join(bucket, "b.txt"), "b")
+	writeTestFile(t, filepath.Join(bucket, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(bucket, "c.csv"), "c")
+	writeTestFile(t, filepath.Join(bucket, "books", "d.txt"), "d")
+	writeTestFile(t, filepath.Join(bucket, ".tmp-e.txt-123"), "e")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	objects, err := client.ListObjects(context.Background(), "file://"+bucket, "")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []ObjectAttrs{
+		{Name: "a.txt", Size: 1},
+		{Name: "b.txt", Size: 1},
+		{Name: "books/d.txt", Size: 1},
+		{Name: "c.csv", Size: 1},
+	}, objects)
+}
+
+func TestFile_ListObjects_Prefix(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	writeTestFile(t, filepath.Join(bucket, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(bucket, "books", "b.txt"), "bb")
+	writeTestFile(t, filepath.Join(bucket, "books", "old", "c.txt"), "ccc")
+	writeTestFile(t, filepath.Join(bucket, "booklet.txt"), "d")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	objects, err := client.ListObjects(context.Background(), "file://"+bucket, "books/")
+	missingObjects, errMissing := client.ListObjects(context.Background(), "file://"+bucket, "missing/")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []ObjectAttrs{{Name: "books/b.txt", Size: 2}, {Name: "books/old/c.txt", Size: 3}}, objects)
+	assert.Nil(t, errMissing)
+	assert.Empty(t, missingObjects)
+}
+
+func TestFile_ListObjects_BucketDoesntExistError(t *testing.T) {
+	// Given
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := client.ListObjects(context.Background(), "file://"+filepath.Join(t.TempDir(), "missing"), "")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bucket doesn't exist")
+}
+
+func TestFile_ReadObject(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	writeTestFile(t, filepath.Join(bucket, "books", "book.txt"), "some text")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	data, err := client.ReadObject(context.Background(), "file://"+bucket, "books/book.txt")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, "some text", string(data))
+}
+
+func TestFile_ReadObject_InvalidObjectNameError(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := client.ReadObject(context.Background(), "file://"+bucket, "../secret.txt")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid object name")
+}
+
+func TestFile_ReadObjectRange(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	writeTestFile(t, filepath.Join(bucket, "book.txt"), "some text to read in ranges")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	for _, tt := range readObjectRangeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			data, err := readRange(client, "file://"+bucket, "book.txt", tt.offset, tt.length)
+
+			// Then
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, data)
+		})
+	}
+}
+
+func TestFile_ReadObjectRange_ObjectDoesntExistError(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := client.ReadObjectRange(context.Background(), "file://"+bucket, "book.txt", 0, -1)
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error creating reader for object book.txt")
+}
+
+func TestFile_WriteObject(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.WriteObject(context.Background(), "file://"+bucket, "job-1/_SUCCESS", []byte("{}"))
+
+	// Then
+	assert.Nil(t, err)
+	data, err := os.ReadFile(filepath.Join(bucket, "job-1", "_SUCCESS"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(data))
+	assert.Equal(t, []string{"_SUCCESS"}, dirNames(t, filepath.Join(bucket, "job-1")))
+}
+
+func TestFile_CopyObject(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	client, _ := New(context.Background())
+	defer client.Close()
+	_ = client.WriteObject(context.Background(), "file://"+bucket, "job-1/_temporary/part-0.txt", []byte("acer"))
+
+	// When
+	err := client.CopyObject(context.Background(), "file://"+bucket, "job-1/_temporary/part-0.txt", "job-1/part-0.txt")
+
+	// Then
+	assert.Nil(t, err)
+	data, err := os.ReadFile(filepath.Join(bucket, "job-1", "part-0.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "acer", string(data))
+	assert.Equal(t, []string{"_temporary", "part-0.txt"}, dirNames(t, filepath.Join(bucket, "job-1")))
+}
+
+func TestFile_CopyObject_ObjectDoesntExistError(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.CopyObject(context.Background(), "file://"+bucket, "part-0.txt", "part-1.txt")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error copying object part-0.txt to part-1.txt")
+	assert.Empty(t, dirNames(t, bucket))
+}
+
+func TestFile_DeleteObject(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	client, _ := New(context.Background())
+	defer client.Close()
+	_ = client.WriteObject(context.Background(), "file://"+bucket, "part-0.txt", []byte("acer"))
+
+	// When
+	err := client.DeleteObject(context.Background(), "file://"+bucket, "part-0.txt")
+	// Deleting an object that doesn't exist shouldn't be an error
+	errMissing := client.DeleteObject(context.Background(), "file://"+bucket, "part-0.txt")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Nil(t, errMissing)
+	assert.Empty(t, dirNames(t, bucket))
+}
+
+func TestFile_Write(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	client, err := NewWithWriter(context.Background(), "file://"+bucket, "job-1/anagrams-part-0.txt")
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	path := filepath.Join(bucket, "job-1", "anagrams-part-0.txt")
+
+	// When
+	_, errWrite := client.Write([]byte("acer: care race\n"))
+	// The object shouldn't exist until the client is closed
+	_, errBeforeClose := os.Stat(path)
+	errClose := client.Close()
+
+	// Then
+	assert.Nil(t, errWrite)
+	assert.Nil(t, errClose)
+	assert.True(t, os.IsNotExist(errBeforeClose))
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "acer: care race\n", string(data))
+	assert.Equal(t, []string{"anagrams-part-0.txt"}, dirNames(t, filepath.Join(bucket, "job-1")))
+}
+
+func TestFile_Write_RenameError(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	client, err := NewWithWriter(context.Background(), "file://"+bucket, "job-1/anagrams-part-0.txt")
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	// A file can't be renamed over a directory that isn't empty
+	path := filepath.Join(bucket, "job-1", "anagrams-part-0.txt")
+	if err := os.MkdirAll(filepath.Join(path, "dir"), 0o755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if _, err := client.Write([]byte("acer: care race\n")); err != nil {
+		t.Fatalf("Error writing data: %v", err)
+	}
+
+	// When
+	err = client.Close()
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error closing storage writer")
+	// The temporary file should have been removed
+	assert.Equal(t, []string{"anagrams-part-0.txt"}, dirNames(t, filepath.Join(bucket, "job-1")))
+}
+
+func TestFile_Abort(t *testing.T) {
+	// Given
+	bucket := t.TempDir()
+	client, err := NewWithWriter(context.Background(), "file://"+bucket, "job-1/anagrams-part-0.txt")
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	if _, err := client.Write([]byte("acer: care race\n")); err != nil {
+		t.Fatalf("Error writing data: %v", err)
+	}
+
+	// When
+	client.Abort()
+
+	// Then
+	// Neither the object nor the temporary file should exist
+	assert.Empty(t, dirNames(t, filepath.Join(bucket, "job-1")))
+}
+
+func TestFile_NewWithWriter_BucketDoesntExistError(t *testing.T) {
+	// When
+	_, err := NewWithWriter(context.Background(), "file://"+filepath.Join(t.TempDir(), "missing"), "book.txt")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bucket doesn't exist")
+}
+
+// readObjectRangeTests are the ranges that each backend's ReadObjectRange is tested with, of an object holding the text
+// "some text to read in ranges".
+var readObjectRangeTests = []struct {
+	name     string
+	offset   int64
+	length   int64
+	expected string
+}{
+	{name: "Start", offset: 0, length: 4, expected: "some"},
+	{name: "Middle", offset: 5, length: 4, expected: "text"},
+	{name: "RestOfObject", offset: 18, length: -1, expected: "in ranges"},
+	{name: "PastEnd", offset: 21, length: 100, expected: "ranges"},
+	{name: "OffsetAtEnd", offset: 27, length: -1, expected: ""},
+	{name: "Empty", offset: 5, length: 0, expected: ""},
+}
+
+// readRange reads the given range of the given object with the given client.
+func readRange(client Client, bucketName, objectName string, offset, length int64) (string, error) {
+	reader, err := client.ReadObjectRange(context.Background(), bucketName, objectName, offset, length)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	return string(data), err
+}
+
+// writeTestFile writes the given contents to the file at the given path, creating its directory if needed.
+func writeTestFile(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+}
+
+// dirNames returns the names of the files in the given directory.
+func dirNames(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
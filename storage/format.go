@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FormatText is the output format that writes each record as a "key: value1 value2" line. Backslashes, spaces and
+// newlines in the key and values are escaped with a backslash, so the records can be read back as they were written.
+const FormatText = "text"
+
+// FormatJSONLines is the output format that writes each record as a {"key":"...","values":[...]} JSON object on its
+// own line.
+const FormatJSONLines = "jsonl"
+
+// FormatCSV is the output format that writes each record as a comma-separated row of the key followed by a column for
+// each value.
+const FormatCSV = "csv"
+
+// FormatTSV is the output format that writes each record as a tab-separated row of the key followed by a column for
+// each value.
+const FormatTSV = "tsv"
+
+// DefaultFormat is the output format used when a job doesn't select one.
+const DefaultFormat = FormatText
+
+// RecordWriter writes the key-value records of a job's output in an output format.
+type RecordWriter interface {
+	// WriteRecord writes a record of the given key and values.
+	WriteRecord(key string, values []string) error
+	// Flush writes any records that have been buffered to the underlying writer.
+	Flush() error
+}
+
+// RecordReader reads the key-value records of a job's output written in an output format.
+type RecordReader interface {
+	// ReadRecord returns the key and values of the next record, or io.EOF once every record has been read.
+	ReadRecord() (string, []string, error)
+}
+
+// Format is an output format that the records of a job's output can be written in. Formats are registered by name,
+// and the name is carried in the "outputFormat" message attribute from the start of a job to its reducers.
+type Format interface {
+	// Extension returns the extension of the output files written in the format, e.g. ".txt".
+	Extension() string
+	// NewRecordWriter returns a RecordWriter that writes records in the format to the given writer.
+	NewRecordWriter(w io.Writer) RecordWriter
+	// NewRecordReader returns a RecordReader that reads the records written in the format from the given reader.
+	NewRecordReader(r io.Reader) RecordReader
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]Format{
+		FormatText:      textFormat{},
+		FormatJSONLines: jsonLinesFormat{},
+		FormatCSV:       csvFormat{comma: ',', extension: ".csv"},
+		FormatTSV:       csvFormat{comma: '\t', extension: ".tsv"},
+	}
+)
+
+// RegisterFormat makes a Format available with the given name, replacing any Format already registered with the name.
+func RegisterFormat(name string, format Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats[name] = format
+}
+
+// GetFormat returns the Format registered with the given name or an error if no Format has been registered with the
+// name.
+func GetFormat(name string) (Format, error) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	format, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("no output format registered with name: %s", name)
+	}
+	return format, nil
+}
+
+// Formats returns the sorted names of all the registered output formats.
+func Formats() []string {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FormatNameFromAttributes returns the name of the output format in the given message attributes, or the
+// DefaultFormat if the attributes don't contain one.
+func FormatNameFromAttributes(attributes map[string]string) string {
+	if name := attributes["outputFormat"]; name != "" {
+		return name
+	}
+	return DefaultFormat
+}
+
+// textFormat is the Format of FormatText.
+type textFormat struct{}
+
+// Extension returns the extension of text output files.
+func (textFormat) Extension() string {
+	return ".txt"
+}
+
+// NewRecordWriter returns a RecordWriter that writes "key: value1 value2" lines to the given writer.
+func (textFormat) NewRecordWriter(w io.Writer) RecordWriter {
+	return &textRecordWriter{writer: bufio.NewWriter(w)}
+}
+
+// textRecordWriter is the RecordWriter of FormatText.
+type textRecordWriter struct {
+	writer *bufio.Writer
+}
+
+// WriteRecord writes a "key: value1 value2" line, or a "key:" line if there are no values, so that a record with no
+// values can be told apart from a record with a single empty value.
+func (w *textRecordWriter) WriteRecord(key string, values []string) error {
+	if len(values) == 0 {
+		_, err := fmt.Fprintf(w.writer, "%s:\n", textEscaper.Replace(key))
+		return err
+	}
+	escapedValues := make([]string, 0, len(values))
+	for _, value := range values {
+		escapedValues = append(escapedValues, textEscaper.Replace(value))
+	}
+	_, err := fmt.Fprintf(w.writer, "%s: %s\n", textEscaper.Replace(key), strings.Join(escapedValues, " "))
+	return err
+}
+
+// textEscaper escapes the characters of a key or value written by FormatText that would otherwise be read as the end
+// of the key, value or record.
+var textEscaper = strings.NewReplacer(`\`, `\\`, " ", `\ `, "\n", `\n`, "\r", `\r`)
+
+// Flush writes the buffered lines to the underlying writer.
+func (w *textRecordWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+// NewRecordReader returns a RecordReader that reads "key: value1 value2" lines from the given reader.
+func (textFormat) NewRecordReader(r io.Reader) RecordReader {
+	return &textRecordReader{reader: bufio.NewReader(r)}
+}
+
+// textRecordReader is the RecordReader of FormatText.
+type textRecordReader struct {
+	reader *bufio.Reader
+}
+
+// ReadRecord reads the next "key: value1 value2" line, skipping empty lines.
+func (r *textRecordReader) ReadRecord() (string, []string, error) {
+	for {
+		line, err := r.reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			continue
+		}
+		// The key is the first field, which ends with the separator since spaces in the key are escaped
+		fields := splitTextFields(line)
+		if !strings.HasSuffix(fields[0], ":") {
+			return "", nil, fmt.Errorf("invalid text record: %s", line)
+		}
+		return strings.TrimSuffix(fields[0], ":"), fields[1:], nil
+	}
+}
+
+// splitTextFields splits the given line written by FormatText at the spaces that aren't escaped, and unescapes each
+// field.
+func splitTextFields(line string) []string {
+	fields := make([]string, 0)
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			switch line[i] {
+			case 'n':
+				field.WriteByte('\n')
+			case 'r':
+				field.WriteByte('\r')
+			default:
+				field.WriteByte(line[i])
+			}
+		case line[i] == ' ':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+// jsonLinesFormat is the Format of FormatJSONLines.
+type jsonLinesFormat struct{}
+
+// Extension returns the extension of JSON Lines output files.
+func (jsonLinesFormat) Extension() string {
+	return ".jsonl"
+}
+
+// NewRecordWriter returns a RecordWriter that writes a JSON object on its own line for each record to the given
+// writer.
+func (jsonLinesFormat) NewRecordWriter(w io.Writer) RecordWriter {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	// Keep the values as they are rather than escaping characters such as < and &
+	encoder.SetEscapeHTML(false)
+	return &jsonLinesRecordWriter{writer: writer, encoder: encoder}
+}
+
+// jsonRecord is a record written by FormatJSONLines.
+type jsonRecord struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+}
+
+// jsonLinesRecordWriter is the RecordWriter of FormatJSONLines.
+type jsonLinesRecordWriter struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+// WriteRecord writes the record as a JSON object followed by a newline.
+func (w *jsonLinesRecordWriter) WriteRecord(key string, values []string) error {
+	if values == nil {
+		values = []string{}
+	}
+	return w.encoder.Encode(jsonRecord{Key: key, Values: values})
+}
+
+// Flush writes the buffered lines to the underlying writer.
+func (w *jsonLinesRecordWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+// NewRecordReader returns a RecordReader that reads a JSON object for each record from the given reader.
+func (jsonLinesFormat) NewRecordReader(r io.Reader) RecordReader {
+	return &jsonLinesRecordReader{decoder: json.NewDecoder(r)}
+}
+
+// jsonLinesRecordReader is the RecordReader of FormatJSONLines.
+type jsonLinesRecordReader struct {
+	decoder *json.Decoder
+}
+
+// ReadRecord reads the next JSON object.
+func (r *jsonLinesRecordReader) ReadRecord() (string, []string, error) {
+	var record jsonRecord
+	if err := r.decoder.Decode(&record); err != nil {
+		return "", nil, err
+	}
+	return record.Key, record.Values, nil
+}
+
+// csvFormat is the Format of FormatCSV and FormatTSV, which only differ in the separator between fields.
+type csvFormat struct {
+	comma     rune
+	extension string
+}
+
+// Extension returns the extension of the format's output files.
+func (f csvFormat) Extension() string {
+	return f.extension
+}
+
+// NewRecordWriter returns a RecordWriter that writes a row of the key followed by a column for each value for each
+// record to the given writer. Fields are quoted if they contain the separator, a quote or a newline.
+func (f csvFormat) NewRecordWriter(w io.Writer) RecordWriter {
+	writer := csv.NewWriter(w)
+	writer.Comma = f.comma
+	return &csvRecordWriter{writer: writer}
+}
+
+// csvRecordWriter is the RecordWriter of FormatCSV and FormatTSV.
+type csvRecordWriter struct {
+	writer *csv.Writer
+}
+
+// WriteRecord writes a row of the key followed by a column for each value.
+func (w *csvRecordWriter) WriteRecord(key string, values []string) error {
+	return w.writer.Write(append([]string{key}, values...))
+}
+
+// Flush writes the buffered rows to the underlying writer.
+func (w *csvRecordWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// NewRecordReader returns a RecordReader that reads a row of the key followed by a column for each value for each
+// record from the given reader. The rows can have different numbers of columns, since records can have different
+// numbers of values.
+func (f csvFormat) NewRecordReader(r io.Reader) RecordReader {
+	reader := csv.NewReader(r)
+	reader.Comma = f.comma
+	reader.FieldsPerRecord = -1
+	return &csvRecordReader{reader: reader}
+}
+
+// csvRecordReader is the RecordReader of FormatCSV and FormatTSV.
+type csvRecordReader struct {
+	reader *csv.Reader
+}
+
+// ReadRecord reads the next row.
+func (r *csvRecordReader) ReadRecord() (string, []string, error) {
+	row, err := r.reader.Read()
+	if err != nil {
+		return "", nil, err
+	}
+	return row[0], row[1:], nil
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	assert.Equal(t, []string{"csv", "jsonl", "text", "tsv"}, Formats())
+}
+
+func TestFormat_WriteRecord(t *testing.T) {
+	tests := []struct {
+		name              string
+		format            string
+		expectedExtension string
+		expected          string
+	}{
+		{name: "Text", format: FormatText, expectedExtension: ".txt",
+			expected: "acer: care race\neilnst: enlist listen silent\n\"a,b\": <b&a> \"b,a\"\n"},
+		{name: "JSONLines", format: FormatJSONLines, expectedExtension: ".jsonl",
+			expected: `{"key":"acer","values":["care","race"]}` + "\n" +
+				`{"key":"eilnst","values":["enlist","listen","silent"]}` + "\n" +
+				`{"key":"\"a,b\"","values":["<b&a>","\"b,a\""]}` + "\n"},
+		{name: "CSV", format: FormatCSV, expectedExtension: ".csv",
+			expected: "acer,care,race\neilnst,enlist,listen,silent\n\"\"\"a,b\"\"\",<b&a>,\"\"\"b,a\"\"\"\n"},
+		{name: "TSV", format: FormatTSV, expectedExtension: ".tsv",
+			expected: "acer\tcare\trace\neilnst\tenlist\tlisten\tsilent\n\"\"\"a,b\"\"\"\t<b&a>\t\"\"\"b,a\"\"\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given
+			format, err := GetFormat(tt.format)
+			if err != nil {
+				t.Fatalf("Error getting format: %v", err)
+			}
+			var buf bytes.Buffer
+			recordWriter := format.NewRecordWriter(&buf)
+
+			// When
+			errAcer := recordWriter.WriteRecord("acer", []string{"care", "race"})
+			errEilnst := recordWriter.WriteRecord("eilnst", []string{"enlist", "listen", "silent"})
+			errQuoted := recordWriter.WriteRecord(`"a,b"`, []string{"<b&a>", `"b,a"`})
+			// Nothing should be written to the underlying writer until the record writer is flushed
+			writtenBeforeFlush := buf.Len()
+			errFlush := recordWriter.Flush()
+
+			// Then
+			assert.Nil(t, errAcer)
+			assert.Nil(t, errEilnst)
+			assert.Nil(t, errQuoted)
+			assert.Nil(t, errFlush)
+			assert.Equal(t, 0, writtenBeforeFlush)
+			assert.Equal(t, tt.expected, buf.String())
+			assert.Equal(t, tt.expectedExtension, format.Extension())
+		})
+	}
+}
+
+func TestFormat_ReadRecord(t *testing.T) {
+	for _, name := range Formats() {
+		t.Run(name, func(t *testing.T) {
+			// Given
+			format, err := GetFormat(name)
+			if err != nil {
+				t.Fatalf("Error getting format: %v", err)
+			}
+			var buf bytes.Buffer
+			recordWriter := format.NewRecordWriter(&buf)
+			_ = recordWriter.WriteRecord("acer", []string{"care", "race"})
+			_ = recordWriter.WriteRecord(`"a,b"`, []string{"<b&a>", `"b,a"`})
+			_ = recordWriter.WriteRecord("empty", nil)
+			// Every format should keep separators, escapes and empty values in keys and values as they were written
+			_ = recordWriter.WriteRecord("a: b", []string{"c d", "", `e\f`, "g\nh", "i\\nj"})
+			_ = recordWriter.WriteRecord("single", []string{""})
+			_ = recordWriter.Flush()
+			recordReader := format.NewRecordReader(&buf)
+
+			// When
+			keyAcer, valuesAcer, errAcer := recordReader.ReadRecord()
+			keyQuoted, valuesQuoted, errQuoted := recordReader.ReadRecord()
+			keyEmpty, valuesEmpty, errEmpty := recordReader.ReadRecord()
+			keyEscaped, valuesEscaped, errEscaped := recordReader.ReadRecord()
+			keySingle, valuesSingle, errSingle := recordReader.ReadRecord()
+			_, _, errEOF := recordReader.ReadRecord()
+
+			// Then
+			assert.Nil(t, errAcer)
+			assert.Equal(t, "acer", keyAcer)
+			assert.Equal(t, []string{"care", "race"}, valuesAcer)
+			assert.Nil(t, errQuoted)
+			assert.Equal(t, `"a,b"`, keyQuoted)
+			assert.Equal(t, []string{"<b&a>", `"b,a"`}, valuesQuoted)
+			assert.Nil(t, errEmpty)
+			assert.Equal(t, "empty", keyEmpty)
+			assert.Empty(t, valuesEmpty)
+			assert.Nil(t, errEscaped)
+			assert.Equal(t, "a: b", keyEscaped)
+			assert.Equal(t, []string{"c d", "", `e\f`, "g\nh", "i\\nj"}, valuesEscaped)
+			assert.Nil(t, errSingle)
+			assert.Equal(t, "single", keySingle)
+			assert.Equal(t, []string{""}, valuesSingle)
+			assert.Equal(t, io.EOF, errEOF)
+		})
+	}
+}
+
+func TestTextRecordReader_InvalidRecordError(t *testing.T) {
+	// Given
+	recordReader := textFormat{}.NewRecordReader(strings.NewReader("acer care race\n"))
+
+	// When
+	_, _, err := recordReader.ReadRecord()
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid text record: acer care race")
+}
+
+func TestGetFormat_UnknownFormatError(t *testing.T) {
+	// When
+	_, err := GetFormat("xml")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no output format registered with name: xml")
+}
+
+func TestFormatNameFromAttributes(t *testing.T) {
+	assert.Equal(t, FormatJSONLines, FormatNameFromAttributes(map[string]string{"outputFormat": "jsonl"}))
+	assert.Equal(t, DefaultFormat, FormatNameFromAttributes(map[string]string{"job": "anagrams"}))
+}
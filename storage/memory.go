@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory is a Backend that keeps buckets and their objects in memory. It is used to run the MapReduce in a single
+// process without Cloud Storage. Objects written with a writer are only added to the bucket once the client is closed,
+// in the same way as Cloud Storage.
+type Memory struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+var _ Backend = &Memory{}
+
+// NewMemory returns a new Memory backend with no buckets.
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]map[string][]byte)}
+}
+
+// CreateBucket creates an empty bucket with the given name if it doesn't already exist.
+func (m *Memory) CreateBucket(bucketName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets[bucketName] == nil {
+		m.buckets[bucketName] = make(map[string][]byte)
+	}
+}
+
+// PutObject writes the given data to the given object, creating the bucket if it doesn't exist.
+func (m *Memory) PutObject(bucketName, objectName string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets[bucketName] == nil {
+		m.buckets[bucketName] = make(map[string][]byte)
+	}
+	m.buckets[bucketName][objectName] = append([]byte(nil), data...)
+}
+
+// Objects returns a copy of all the objects in the given bucket, keyed by object name.
+func (m *Memory) Objects(bucketName string) map[string][]byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	objects := make(map[string][]byte, len(m.buckets[bucketName]))
+	for name, data := range m.buckets[bucketName] {
+		objects[name] = append([]byte(nil), data...)
+	}
+	return objects
+}
+
+// New returns a new client for the Memory backend.
+func (m *Memory) New(ctx context.Context) (Client, error) {
+	return &memoryClient{memory: m}, nil
+}
+
+// NewWithWriter returns a new client for the Memory backend with a writer for the given bucket and object.
+func (m *Memory) NewWithWriter(ctx context.Context, bucketName, objectName string) (Client, error) {
+	return &memoryClient{
+		memory:     m,
+		bucketName: bucketName,
+		objectName: objectName,
+		writer:     &bytes.Buffer{},
+	}, nil
+}
+
+// memoryClient is a Client for the Memory backend.
+type memoryClient struct {
+	memory     *Memory
+	bucketName string
+	objectName string
+	mu         sync.Mutex
+	writer     *bytes.Buffer
+}
+
+var _ Client = &memoryClient{}
+
+// Abort discards the data written with Write without creating the client's object.
+func (c *memoryClient) Abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writer = nil
+}
+
+// Close writes the data written with Write to the client's object, if the client has a writer.
+func (c *memoryClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer != nil {
+		c.memory.PutObject(c.bucketName, c.objectName, c.writer.Bytes())
+		c.writer = nil
+	}
+	return nil
+}
+
+// ListObjects returns the names and sizes of all objects in the given bucket whose names start with the given prefix,
+// in alphabetical order.
+func (c *memoryClient) ListObjects(ctx context.Context, bucketName, prefix string) ([]ObjectAttrs, error) {
+	c.memory.mu.RLock()
+	defer c.memory.mu.RUnlock()
+	bucket, ok := c.memory.buckets[bucketName]
+	if !ok {
+		return nil, fmt.Errorf("storage: bucket doesn't exist: %s", bucketName)
+	}
+	objects := make([]ObjectAttrs, 0)
+	for name, data := range bucket {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, newObjectAttrs(name, int64(len(data)), ""))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+// ReadObject returns the contents of the given object in the given bucket.
+func (c *memoryClient) ReadObject(ctx context.Context, bucketName, objectName string) ([]byte, error) {
+	c.memory.mu.RLock()
+	defer c.memory.mu.RUnlock()
+	data, ok := c.memory.buckets[bucketName][objectName]
+	if !ok {
+		return nil, fmt.Errorf("error creating reader for object %s: storage: object doesn't exist", objectName)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// ReadObjectRange returns a reader of length bytes of the given object in the given bucket from the given offset, or
+// the rest of the object if length is negative.
+func (c *memoryClient) ReadObjectRange(ctx context.Context, bucketName, objectName string, offset,
+	length int64) (io.ReadCloser, error) {
+	data, err := c.ReadObject(ctx, bucketName, objectName)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(io.NewSectionReader(bytes.NewReader(data), offset, rangeLength(offset, length,
+		int64(len(data))))), nil
+}
+
+// WriteObject writes the given data to the given object in the given bucket, replacing the object if it exists.
+func (c *memoryClient) WriteObject(ctx context.Context, bucketName, objectName string, data []byte) error {
+	c.memory.PutObject(bucketName, objectName, data)
+	return nil
+}
+
+// CopyObject copies the given source object to the given destination object in the given bucket, replacing the
+// destination object if it exists.
+func (c *memoryClient) CopyObject(ctx context.Context, bucketName, srcObjectName, dstObjectName string) error {
+	data, err := c.ReadObject(ctx, bucketName, srcObjectName)
+	if err != nil {
+		return fmt.Errorf("error copying object %s to %s: %v", srcObjectName, dstObjectName, err)
+	}
+	c.memory.PutObject(bucketName, dstObjectName, data)
+	return nil
+}
+
+// DeleteObject deletes the given object in the given bucket. It isn't an error if the object doesn't exist.
+func (c *memoryClient) DeleteObject(ctx context.Context, bucketName, objectName string) error {
+	c.memory.mu.Lock()
+	defer c.memory.mu.Unlock()
+	delete(c.memory.buckets[bucketName], objectName)
+	return nil
+}
+
+// Write writes the given data to the client's writer.
+func (c *memoryClient) Write(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer == nil {
+		return 0, errNoWriter
+	}
+	return c.writer.Write(data)
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemory_ListObjects(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("input", "books/b.txt", []byte("bb"))
+	memory.PutObject("input", "books/a.txt", []byte("a"))
+	memory.PutObject("input", "c.csv", []byte("c"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	// When
+	objects, err := client.ListObjects(context.Background(), "input", "books/")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []ObjectAttrs{{Name: "books/a.txt", Size: 1}, {Name: "books/b.txt", Size: 2}}, objects)
+}
+
+func TestMemory_ListObjects_Compressed(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("input", "a.txt.gz", []byte("a"))
+	memory.PutObject("input", "b.txt", []byte("b"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	// When
+	objects, err := client.ListObjects(context.Background(), "input", "")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []ObjectAttrs{{Name: "a.txt.gz", Size: 1, Compression: CompressionGzip}, {Name: "b.txt", Size: 1}},
+		objects)
+}
+
+func TestMemory_ListObjects_BucketDoesntExistError(t *testing.T) {
+	// Given
+	client, _ := NewMemory().New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := client.ListObjects(context.Background(), "input", "")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bucket doesn't exist")
+}
+
+func TestMemory_ReadObject_ObjectDoesntExistError(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("input")
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := client.ReadObject(context.Background(), "input", "book.txt")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error creating reader for object book.txt")
+}
+
+func TestMemory_ReadObjectRange(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("input", "book.txt", []byte("some text to read in ranges"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	for _, tt := range readObjectRangeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			data, err := readRange(client, "input", "book.txt", tt.offset, tt.length)
+
+			// Then
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, data)
+		})
+	}
+}
+
+func TestMemory_WriteObject(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.WriteObject(context.Background(), "output", "job-1/_SUCCESS", []byte("{}"))
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"job-1/_SUCCESS": []byte("{}")}, memory.Objects("output"))
+}
+
+func TestMemory_CopyObject(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("output", "job-1/_temporary/part-0.txt", []byte("acer: care race\n"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.CopyObject(context.Background(), "output", "job-1/_temporary/part-0.txt", "job-1/part-0.txt")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{
+		"job-1/_temporary/part-0.txt": []byte("acer: care race\n"),
+		"job-1/part-0.txt":            []byte("acer: care race\n"),
+	}, memory.Objects("output"))
+}
+
+func TestMemory_DeleteObject(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("output", "part-0.txt", []byte("acer: care race\n"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.DeleteObject(context.Background(), "output", "part-0.txt")
+	// Deleting an object that doesn't exist shouldn't be an error
+	errMissing := client.DeleteObject(context.Background(), "output", "part-0.txt")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Nil(t, errMissing)
+	assert.Empty(t, memory.Objects("output"))
+}
+
+func TestMemory_Write(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	client, _ := memory.NewWithWriter(context.Background(), "output", "part-0.txt")
+
+	// When
+	_, err := client.Write([]byte("acer: care race\n"))
+	// The object shouldn't exist until the client is closed
+	objectsBeforeClose := memory.Objects("output")
+	client.Close()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Empty(t, objectsBeforeClose)
+	assert.Equal(t, "acer: care race\n", string(memory.Objects("output")["part-0.txt"]))
+}
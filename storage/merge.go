@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+)
+
+// MergeOutputs merges the records of the given output files, each of which must be sorted by key, into a single file
+// in the same bucket that is sorted by key. The file is named after the given base name and the extension of the
+// options, and is written in the format and with the compression of the options, which must be the options the output
+// files were written with. Records with the same key are written in the order of the given files. Only one record of
+// each file is held in memory at a time, so the files can be larger than the memory available.
+func MergeOutputs(ctx context.Context, bucketName string, objectNames []string, baseName string,
+	options OutputOptions) (OutputFile, error) {
+	if err := options.Validate(); err != nil {
+		return OutputFile{}, err
+	}
+	format, _ := GetFormat(options.formatName())
+	storageClient, err := New(ctx)
+	if err != nil {
+		return OutputFile{}, err
+	}
+	defer storageClient.Close()
+
+	// Open a reader of each output file, starting with its first record
+	sources := make(mergeHeap, 0, len(objectNames))
+	defer func() {
+		for _, source := range sources {
+			_ = source.reader.Close()
+		}
+	}()
+	for i, objectName := range objectNames {
+		reader, err := storageClient.ReadObjectRange(ctx, bucketName, objectName, 0, -1)
+		if err != nil {
+			return OutputFile{}, fmt.Errorf("error reading output file %s: %v", objectName, err)
+		}
+		decompressor, err := NewDecompressor(reader, options.Compression)
+		if err != nil {
+			_ = reader.Close()
+			return OutputFile{}, fmt.Errorf("error reading output file %s: %v", objectName, err)
+		}
+		source := &mergeSource{objectName: objectName, index: i, reader: decompressor,
+			recordReader: format.NewRecordReader(decompressor)}
+		sources = append(sources, source)
+	}
+	// Only the sources that have records are kept in the heap, but every source is closed
+	merging := make(mergeHeap, 0, len(sources))
+	for _, source := range sources {
+		ok, err := source.next()
+		if err != nil {
+			return OutputFile{}, err
+		}
+		if ok {
+			merging = append(merging, source)
+		}
+	}
+	heap.Init(&merging)
+
+	// Write the smallest record of all the files until every record has been written
+	options.MaxPartBytes = 0
+	options.MaxPartRecords = 0
+	outputWriter, err := NewOutputWriter(ctx, bucketName, baseName, options)
+	if err != nil {
+		return OutputFile{}, err
+	}
+	for merging.Len() > 0 {
+		source := merging[0]
+		if err := outputWriter.WriteRecord(source.key, source.values); err != nil {
+			return OutputFile{}, err
+		}
+		ok, err := source.next()
+		if err != nil {
+			return OutputFile{}, err
+		}
+		if ok {
+			heap.Fix(&merging, 0)
+		} else {
+			heap.Pop(&merging)
+		}
+	}
+	if err := outputWriter.Close(); err != nil {
+		return OutputFile{}, err
+	}
+	return outputWriter.Files()[0], nil
+}
+
+// mergeSource is an output file being merged and the record that was last read from it.
+type mergeSource struct {
+	objectName   string
+	index        int
+	reader       io.ReadCloser
+	recordReader RecordReader
+	key          string
+	values       []string
+}
+
+// next reads the next record of the file, returning false once every record has been read.
+func (s *mergeSource) next() (bool, error) {
+	key, values, err := s.recordReader.ReadRecord()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading record from output file %s: %v", s.objectName, err)
+	}
+	s.key = key
+	s.values = values
+	return true, nil
+}
+
+// mergeHeap is a heap of the output files being merged, ordered by the key of their current record and then by the
+// order the files were given in.
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int {
+	return len(h)
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].index < h[j].index
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(*mergeSource))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	source := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return source
+}
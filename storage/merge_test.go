@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMergeOutputs(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("output")
+	RegisterBackend("test-mem", memory)
+	memory.PutObject("output", "job-1/anagrams-part-0.txt", []byte("acer: care race\neilnst: listen silent\n"))
+	memory.PutObject("output", "job-1/anagrams-part-1.txt", []byte("aet: eat tea\nbst: bts\n"))
+	memory.PutObject("output", "job-1/anagrams-part-2.txt", []byte(""))
+
+	// When
+	file, err := MergeOutputs(context.Background(), "test-mem://output", []string{"job-1/anagrams-part-0.txt",
+		"job-1/anagrams-part-1.txt", "job-1/anagrams-part-2.txt"}, "job-1/anagrams", OutputOptions{MaxPartRecords: 1})
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, OutputFile{ObjectName: "job-1/anagrams.txt", Records: 4}, file)
+	assert.Equal(t, "acer: care race\naet: eat tea\nbst: bts\neilnst: listen silent\n",
+		string(memory.Objects("output")["job-1/anagrams.txt"]))
+}
+
+func TestMergeOutputs_Gzip(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("output")
+	RegisterBackend("test-mem", memory)
+	options := OutputOptions{Format: FormatJSONLines, Compression: CompressionGzip, MaxPartRecords: 1}
+	for _, records := range [][]string{{"eilnst", "acer"}, {"aet"}} {
+		outputWriter, err := NewOutputWriter(context.Background(), "test-mem://output", "anagrams-part-"+records[0],
+			options)
+		if err != nil {
+			t.Fatalf("Error creating output writer: %v", err)
+		}
+		for _, key := range records {
+			_ = outputWriter.WriteRecord(key, []string{key})
+		}
+		_ = outputWriter.Close()
+	}
+
+	// When
+	file, err := MergeOutputs(context.Background(), "test-mem://output", []string{"anagrams-part-eilnst-00002.jsonl.gz",
+		"anagrams-part-eilnst-00001.jsonl.gz", "anagrams-part-aet-00001.jsonl.gz"}, "anagrams", options)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, OutputFile{ObjectName: "anagrams.jsonl.gz", Records: 3}, file)
+	assert.Equal(t, `{"key":"acer","values":["acer"]}`+"\n"+`{"key":"aet","values":["aet"]}`+"\n"+
+		`{"key":"eilnst","values":["eilnst"]}`+"\n", gunzip(t, memory.Objects("output")["anagrams.jsonl.gz"]))
+}
+
+func TestMergeOutputs_MissingFileError(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("output")
+	RegisterBackend("test-mem", memory)
+
+	// When
+	_, err := MergeOutputs(context.Background(), "test-mem://output", []string{"anagrams-part-0.txt"}, "anagrams",
+		OutputOptions{})
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error reading output file anagrams-part-0.txt")
+}
+
+func TestMergeOutputs_InvalidOptionsError(t *testing.T) {
+	// When
+	_, err := MergeOutputs(context.Background(), "output", nil, "anagrams", OutputOptions{Format: "xml"})
+
+	// Then
+	assert.True(t, errors.Is(err, ErrInvalidOutputOptions))
+}
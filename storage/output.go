@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidOutputOptions is returned when the OutputOptions of a job are invalid.
+var ErrInvalidOutputOptions = errors.New("invalid output options")
+
+// OutputOptions are the options that the output files of a job are written with. They are chosen when the job is
+// started and carried to the reducers in the message attributes returned by Attributes.
+type OutputOptions struct {
+	// Format is the name of the registered Format the records are written in, by default this is DefaultFormat.
+	Format string
+	// Compression is the compression of the output files, either CompressionGzip or empty for uncompressed files.
+	Compression string
+	// MaxPartBytes is the number of bytes of records, before they are compressed, after which a reducer starts writing
+	// to a new part file, or 0 for no limit.
+	MaxPartBytes int64
+	// MaxPartRecords is the number of records after which a reducer starts writing to a new part file, or 0 for no
+	// limit.
+	MaxPartRecords int
+	// Merge is true if the output files of every reducer are merged into a single file sorted by key once the job has
+	// finished.
+	Merge bool
+}
+
+// Validate returns an error if the OutputOptions' format isn't registered, its compression isn't supported or either
+// of its part limits is negative.
+func (o OutputOptions) Validate() error {
+	if _, err := GetFormat(o.formatName()); err != nil {
+		return fmt.Errorf("%w: unknown output format %s, the available formats are: %s", ErrInvalidOutputOptions,
+			o.Format, strings.Join(Formats(), ", "))
+	}
+	if o.Compression != "" && o.Compression != CompressionGzip {
+		return fmt.Errorf("%w: unsupported output compression %s, the supported compressions are: %s",
+			ErrInvalidOutputOptions, o.Compression, CompressionGzip)
+	}
+	if o.MaxPartBytes < 0 || o.MaxPartRecords < 0 {
+		return fmt.Errorf("%w: the part size and number of records can't be negative", ErrInvalidOutputOptions)
+	}
+	return nil
+}
+
+// Rolls returns true if the output files are split into numbered part files once a limit is reached.
+func (o OutputOptions) Rolls() bool {
+	return o.MaxPartBytes > 0 || o.MaxPartRecords > 0
+}
+
+// Extension returns the extension of the output files, which is the extension of the format followed by the extension
+// of the compression, e.g. ".jsonl.gz".
+func (o OutputOptions) Extension() string {
+	format, err := GetFormat(o.formatName())
+	if err != nil {
+		return ""
+	}
+	if o.Compression == CompressionGzip {
+		return format.Extension() + ".gz"
+	}
+	return format.Extension()
+}
+
+// Attributes returns the message attributes that carry the OutputOptions. Options that are unset are left out.
+func (o OutputOptions) Attributes() map[string]string {
+	attributes := map[string]string{"outputFormat": o.formatName()}
+	if o.Compression != "" {
+		attributes["outputCompression"] = o.Compression
+	}
+	if o.MaxPartBytes > 0 {
+		attributes["maxPartBytes"] = strconv.FormatInt(o.MaxPartBytes, 10)
+	}
+	if o.MaxPartRecords > 0 {
+		attributes["maxPartRecords"] = strconv.Itoa(o.MaxPartRecords)
+	}
+	if o.Merge {
+		attributes["mergeOutput"] = strconv.FormatBool(o.Merge)
+	}
+	return attributes
+}
+
+// formatName returns the name of the OutputOptions' format, or DefaultFormat if it isn't set.
+func (o OutputOptions) formatName() string {
+	if o.Format == "" {
+		return DefaultFormat
+	}
+	return o.Format
+}
+
+// OutputOptionsFromAttributes returns the OutputOptions carried in the given message attributes, or an error if they
+// are invalid. Messages without the attributes have the default options.
+func OutputOptionsFromAttributes(attributes map[string]string) (OutputOptions, error) {
+	options := OutputOptions{
+		Format:      FormatNameFromAttributes(attributes),
+		Compression: attributes["outputCompression"],
+	}
+	var err error
+	if value := attributes["maxPartBytes"]; value != "" {
+		if options.MaxPartBytes, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return options, fmt.Errorf("%w: invalid maxPartBytes attribute: %s", ErrInvalidOutputOptions, value)
+		}
+	}
+	if value := attributes["maxPartRecords"]; value != "" {
+		if options.MaxPartRecords, err = strconv.Atoi(value); err != nil {
+			return options, fmt.Errorf("%w: invalid maxPartRecords attribute: %s", ErrInvalidOutputOptions, value)
+		}
+	}
+	if value := attributes["mergeOutput"]; value != "" {
+		if options.Merge, err = strconv.ParseBool(value); err != nil {
+			return options, fmt.Errorf("%w: invalid mergeOutput attribute: %s", ErrInvalidOutputOptions, value)
+		}
+	}
+	return options, options.Validate()
+}
+
+// OutputFile is an output file written by an OutputWriter and the number of records in it.
+type OutputFile struct {
+	ObjectName string
+	Records    int
+}
+
+// OutputWriter writes the records of a reducer's output to one or more part files in a bucket, in the format and with
+// the compression of its OutputOptions. When the options have a part limit, the files are named after the base name
+// with a 5 digit part number and the extension of the options, e.g. "anagrams-part-0-00001.txt.gz", and a new part is
+// started once a limit is reached. Otherwise, a single file is written that is named after the base name and the
+// extension. Each part is only created in the bucket once it has been fully written.
+type OutputWriter struct {
+	ctx        context.Context
+	bucketName string
+	baseName   string
+	options    OutputOptions
+	format     Format
+	files      []OutputFile
+	part       *outputPart
+}
+
+// outputPart is the part file that an OutputWriter is writing to. The records are written by the record writer to the
+// counter, which counts them before they are compressed, and the compressed data is buffered before it is written to
+// the client.
+type outputPart struct {
+	client       Client
+	buffer       *bufio.Writer
+	compressor   *gzip.Writer
+	counter      *countingWriter
+	recordWriter RecordWriter
+}
+
+// NewOutputWriter returns an OutputWriter that writes part files named after the given base name to the given bucket,
+// or an error if the options are invalid. The OutputWriter must be closed to create the last part.
+func NewOutputWriter(ctx context.Context, bucketName, baseName string, options OutputOptions) (*OutputWriter,
+	error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	format, _ := GetFormat(options.formatName())
+	return &OutputWriter{ctx: ctx, bucketName: bucketName, baseName: baseName, options: options, format: format}, nil
+}
+
+// WriteRecord writes a record of the given key and values to the current part, first starting a new part if the
+// current one has reached a limit. A part is only rolled between records, so it can be larger than MaxPartBytes by up
+// to the size of its last record.
+func (w *OutputWriter) WriteRecord(key string, values []string) error {
+	if w.part != nil && w.partFull() {
+		if err := w.closePart(); err != nil {
+			return err
+		}
+	}
+	if w.part == nil {
+		if err := w.openPart(); err != nil {
+			return err
+		}
+	}
+	if err := w.part.recordWriter.WriteRecord(key, values); err != nil {
+		return fmt.Errorf("error writing record to output file %s: %v", w.currentObjectName(), err)
+	}
+	w.files[len(w.files)-1].Records++
+	// The record writer buffers the records, so it is flushed to count the record's bytes when the size is limited
+	if w.options.MaxPartBytes > 0 {
+		if err := w.part.recordWriter.Flush(); err != nil {
+			return fmt.Errorf("error writing record to output file %s: %v", w.currentObjectName(), err)
+		}
+	}
+	return nil
+}
+
+// Close creates the current part in the bucket. A single empty part is created if no records were written, so that
+// every reducer has at least one output file.
+func (w *OutputWriter) Close() error {
+	if w.part == nil && len(w.files) == 0 {
+		if err := w.openPart(); err != nil {
+			return err
+		}
+	}
+	if w.part == nil {
+		return nil
+	}
+	return w.closePart()
+}
+
+// Abort stops writing the current part without creating it in the bucket, e.g. because a record couldn't be written.
+// The parts that have already been created are left in the bucket. Aborting a closed OutputWriter does nothing.
+func (w *OutputWriter) Abort() {
+	if w.part == nil {
+		return
+	}
+	w.part.client.Abort()
+	w.part = nil
+	w.files = w.files[:len(w.files)-1]
+}
+
+// Files returns the part files that have been written, in the order they were written.
+func (w *OutputWriter) Files() []OutputFile {
+	return append(make([]OutputFile, 0, len(w.files)), w.files...)
+}
+
+// partFull returns true if the current part has reached one of the limits of the options.
+func (w *OutputWriter) partFull() bool {
+	if w.options.MaxPartRecords > 0 && w.files[len(w.files)-1].Records >= w.options.MaxPartRecords {
+		return true
+	}
+	return w.options.MaxPartBytes > 0 && w.part.counter.n >= w.options.MaxPartBytes
+}
+
+// openPart starts writing the next part.
+func (w *OutputWriter) openPart() error {
+	objectName := w.baseName + w.options.Extension()
+	if w.options.Rolls() {
+		objectName = fmt.Sprintf("%s-%05d%s", w.baseName, len(w.files)+1, w.options.Extension())
+	}
+	client, err := NewWithWriter(w.ctx, w.bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	part := &outputPart{client: client, buffer: bufio.NewWriter(client)}
+	var writer io.Writer = part.buffer
+	if w.options.Compression == CompressionGzip {
+		part.compressor = gzip.NewWriter(part.buffer)
+		writer = part.compressor
+	}
+	part.counter = &countingWriter{writer: writer}
+	part.recordWriter = w.format.NewRecordWriter(part.counter)
+	w.part = part
+	w.files = append(w.files, OutputFile{ObjectName: objectName})
+	return nil
+}
+
+// closePart flushes the records of the current part and closes its client, which creates the part in the bucket. An
+// error is returned if the part couldn't be created, e.g. because its upload failed.
+func (w *OutputWriter) closePart() error {
+	part := w.part
+	w.part = nil
+	if err := w.flushPart(part); err != nil {
+		_ = part.client.Close()
+		return err
+	}
+	if err := part.client.Close(); err != nil {
+		return fmt.Errorf("error creating output file %s: %v", w.currentObjectName(), err)
+	}
+	return nil
+}
+
+// flushPart writes the records that the given part has buffered to its client.
+func (w *OutputWriter) flushPart(part *outputPart) error {
+	if err := part.recordWriter.Flush(); err != nil {
+		return fmt.Errorf("error writing output file %s: %v", w.currentObjectName(), err)
+	}
+	if part.compressor != nil {
+		if err := part.compressor.Close(); err != nil {
+			return fmt.Errorf("error compressing output file %s: %v", w.currentObjectName(), err)
+		}
+	}
+	if err := part.buffer.Flush(); err != nil {
+		return fmt.Errorf("error writing output file %s: %v", w.currentObjectName(), err)
+	}
+	return nil
+}
+
+// currentObjectName returns the name of the part being written.
+func (w *OutputWriter) currentObjectName() string {
+	return w.files[len(w.files)-1].ObjectName
+}
+
+// countingWriter is an io.Writer that counts the bytes written to the writer it wraps.
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+// Write writes the given data to the wrapped writer and adds the number of bytes written to the count.
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.writer.Write(data)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestOutputOptions_Attributes(t *testing.T) {
+	// Given
+	options := OutputOptions{Format: FormatCSV, Compression: CompressionGzip, MaxPartBytes: 1024, MaxPartRecords: 10,
+		Merge: true}
+
+	// When
+	attributes := options.Attributes()
+	parsedOptions, err := OutputOptionsFromAttributes(attributes)
+
+	// Then
+	assert.Equal(t, map[string]string{"outputFormat": "csv", "outputCompression": "gzip", "maxPartBytes": "1024",
+		"maxPartRecords": "10", "mergeOutput": "true"}, attributes)
+	assert.Nil(t, err)
+	assert.Equal(t, options, parsedOptions)
+}
+
+func TestOutputOptionsFromAttributes_Default(t *testing.T) {
+	// When
+	options, err := OutputOptionsFromAttributes(map[string]string{"jobId": "job-1"})
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, OutputOptions{Format: DefaultFormat}, options)
+	assert.Equal(t, ".txt", options.Extension())
+	assert.False(t, options.Rolls())
+}
+
+func TestOutputOptionsFromAttributes_InvalidAttributeError(t *testing.T) {
+	// When
+	_, err := OutputOptionsFromAttributes(map[string]string{"maxPartRecords": "ten"})
+
+	// Then
+	assert.True(t, errors.Is(err, ErrInvalidOutputOptions))
+	assert.Contains(t, err.Error(), "invalid maxPartRecords attribute: ten")
+}
+
+func TestOutputWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  OutputOptions
+		expected map[string]string
+		files    []OutputFile
+	}{
+		{name: "SingleFile", options: OutputOptions{},
+			expected: map[string]string{"job-1/anagrams-part-0.txt": "a: 1\nb: 2\nc: 3\n"},
+			files:    []OutputFile{{ObjectName: "job-1/anagrams-part-0.txt", Records: 3}}},
+		{name: "MaxPartRecords", options: OutputOptions{Format: FormatCSV, MaxPartRecords: 2},
+			expected: map[string]string{
+				"job-1/anagrams-part-0-00001.csv": "a,1\nb,2\n",
+				"job-1/anagrams-part-0-00002.csv": "c,3\n",
+			},
+			files: []OutputFile{
+				{ObjectName: "job-1/anagrams-part-0-00001.csv", Records: 2},
+				{ObjectName: "job-1/anagrams-part-0-00002.csv", Records: 1},
+			}},
+		// Each record is 5 bytes, so a part is rolled once it holds 2 records
+		{name: "MaxPartBytes", options: OutputOptions{MaxPartBytes: 6},
+			expected: map[string]string{
+				"job-1/anagrams-part-0-00001.txt": "a: 1\nb: 2\n",
+				"job-1/anagrams-part-0-00002.txt": "c: 3\n",
+			},
+			files: []OutputFile{
+				{ObjectName: "job-1/anagrams-part-0-00001.txt", Records: 2},
+				{ObjectName: "job-1/anagrams-part-0-00002.txt", Records: 1},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given
+			memory := NewMemory()
+			memory.CreateBucket("output")
+			RegisterBackend("test-mem", memory)
+			outputWriter, err := NewOutputWriter(context.Background(), "test-mem://output", "job-1/anagrams-part-0",
+				tt.options)
+			if err != nil {
+				t.Fatalf("Error creating output writer: %v", err)
+			}
+
+			// When
+			errA := outputWriter.WriteRecord("a", []string{"1"})
+			errB := outputWriter.WriteRecord("b", []string{"2"})
+			errC := outputWriter.WriteRecord("c", []string{"3"})
+			errClose := outputWriter.Close()
+
+			// Then
+			assert.Nil(t, errA)
+			assert.Nil(t, errB)
+			assert.Nil(t, errC)
+			assert.Nil(t, errClose)
+			objects := make(map[string]string)
+			for objectName, data := range memory.Objects("output") {
+				objects[objectName] = string(data)
+			}
+			assert.Equal(t, tt.expected, objects)
+			assert.Equal(t, tt.files, outputWriter.Files())
+		})
+	}
+}
+
+func TestOutputWriter_Gzip(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("output")
+	RegisterBackend("test-mem", memory)
+	options := OutputOptions{Format: FormatJSONLines, Compression: CompressionGzip, MaxPartRecords: 1}
+	outputWriter, err := NewOutputWriter(context.Background(), "test-mem://output", "anagrams-part-0", options)
+	if err != nil {
+		t.Fatalf("Error creating output writer: %v", err)
+	}
+
+	// When
+	errAcer := outputWriter.WriteRecord("acer", []string{"care", "race"})
+	errEilnst := outputWriter.WriteRecord("eilnst", []string{"enlist", "listen"})
+	errClose := outputWriter.Close()
+
+	// Then
+	assert.Nil(t, errAcer)
+	assert.Nil(t, errEilnst)
+	assert.Nil(t, errClose)
+	objects := memory.Objects("output")
+	assert.Len(t, objects, 2)
+	assert.Equal(t, `{"key":"acer","values":["care","race"]}`+"\n",
+		gunzip(t, objects["anagrams-part-0-00001.jsonl.gz"]))
+	assert.Equal(t, `{"key":"eilnst","values":["enlist","listen"]}`+"\n",
+		gunzip(t, objects["anagrams-part-0-00002.jsonl.gz"]))
+}
+
+func TestOutputWriter_NoRecords(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("output")
+	RegisterBackend("test-mem", memory)
+	options := OutputOptions{Compression: CompressionGzip, MaxPartRecords: 10}
+	outputWriter, err := NewOutputWriter(context.Background(), "test-mem://output", "anagrams-part-0", options)
+	if err != nil {
+		t.Fatalf("Error creating output writer: %v", err)
+	}
+
+	// When
+	err = outputWriter.Close()
+
+	// Then
+	assert.Nil(t, err)
+	// An empty part should still be written, so that every reducer has an output file
+	assert.Equal(t, []OutputFile{{ObjectName: "anagrams-part-0-00001.txt.gz", Records: 0}}, outputWriter.Files())
+	assert.Equal(t, "", gunzip(t, memory.Objects("output")["anagrams-part-0-00001.txt.gz"]))
+}
+
+func TestOutputWriter_Close_UploadError(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("output")
+	RegisterBackend("test-failing-upload", failingUploadBackend{Memory: memory})
+	outputWriter, err := NewOutputWriter(context.Background(), "test-failing-upload://output", "anagrams-part-0",
+		OutputOptions{})
+	if err != nil {
+		t.Fatalf("Error creating output writer: %v", err)
+	}
+	if err := outputWriter.WriteRecord("acer", []string{"care", "race"}); err != nil {
+		t.Fatalf("Error writing record: %v", err)
+	}
+
+	// When
+	err = outputWriter.Close()
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error creating output file anagrams-part-0.txt: upload failed")
+}
+
+func TestOutputWriter_Abort(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("output")
+	RegisterBackend("test-mem", memory)
+	outputWriter, err := NewOutputWriter(context.Background(), "test-mem://output", "anagrams-part-0",
+		OutputOptions{MaxPartRecords: 1})
+	if err != nil {
+		t.Fatalf("Error creating output writer: %v", err)
+	}
+	for _, key := range []string{"acer", "alert"} {
+		if err := outputWriter.WriteRecord(key, []string{key}); err != nil {
+			t.Fatalf("Error writing record: %v", err)
+		}
+	}
+
+	// When
+	outputWriter.Abort()
+	// Closing an aborted writer shouldn't create the part that was aborted
+	err = outputWriter.Close()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []OutputFile{{ObjectName: "anagrams-part-0-00001.txt", Records: 1}}, outputWriter.Files())
+	assert.Equal(t, map[string][]byte{"anagrams-part-0-00001.txt": []byte("acer: acer\n")}, memory.Objects("output"))
+}
+
+func TestNewOutputWriter_InvalidOptionsError(t *testing.T) {
+	// When
+	_, err := NewOutputWriter(context.Background(), "output", "anagrams-part-0", OutputOptions{Format: "xml"})
+
+	// Then
+	assert.True(t, errors.Is(err, ErrInvalidOutputOptions))
+	assert.Contains(t, err.Error(), "unknown output format xml")
+}
+
+// gunzip returns the decompressed contents of the given gzip data.
+func gunzip(t *testing.T, data []byte) string {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error creating gzip reader: %v", err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Error reading gzip data: %v", err)
+	}
+	return string(decompressed)
+}
+
+// failingUploadBackend is a Backend whose writers fail to create their object when they are closed, like a Cloud
+// Storage writer whose upload fails.
+type failingUploadBackend struct {
+	*Memory
+}
+
+// NewWithWriter returns a client with a writer whose Close returns an error.
+func (b failingUploadBackend) NewWithWriter(ctx context.Context, bucketName, objectName string) (Client, error) {
+	client, err := b.Memory.NewWithWriter(ctx, bucketName, objectName)
+	if err != nil {
+		return nil, err
+	}
+	return failingUploadClient{Client: client}, nil
+}
+
+// failingUploadClient is a Client whose Close returns an error.
+type failingUploadClient struct {
+	Client
+}
+
+// Close returns an error without creating the object.
+func (c failingUploadClient) Close() error {
+	return errors.New("upload failed")
+}
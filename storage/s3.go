@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// S3Scheme is the scheme of bucket names that are buckets in S3 or an S3-compatible object store, e.g.
+// "s3://serverless-mapreduce-input".
+const S3Scheme = "s3"
+
+// s3PartSize is the size of each part of a multipart upload. Objects written with Write that are smaller than this are
+// written with a single request. S3 requires every part but the last to be at least 5MiB.
+var s3PartSize = 8 << 20
+
+// s3Backend is the Backend for S3 buckets, which uses the MinIO client to talk to S3 or any S3-compatible object
+// store. It is configured with the following environment variables:
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY: the credentials used to sign requests
+// AWS_SESSION_TOKEN: the session token of temporary credentials, if they are used
+// AWS_REGION: the region of the buckets, by default this is us-east-1
+// S3_ENDPOINT: the URL of an S3-compatible object store, e.g. "http://localhost:9000". Buckets are addressed by path
+// when an endpoint is set, and by virtual host on AWS otherwise.
+type s3Backend struct{}
+
+// New returns a new S3 client.
+func (s3Backend) New(ctx context.Context) (Client, error) {
+	client, err := newS3ClientFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error creating storage client: %v", err)
+	}
+	return &s3Client{client: client}, nil
+}
+
+// NewWithWriter returns a new S3 client with a writer for the given bucket and object. The object is only created
+// once the client is closed.
+func (s3Backend) NewWithWriter(ctx context.Context, bucketName, objectName string) (Client, error) {
+	client, err := newS3ClientFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error creating storage client: %v", err)
+	}
+	return &s3Client{
+		client: client,
+		writer: &s3Writer{ctx: ctx, client: client, bucketName: bucketName, objectName: objectName},
+	}, nil
+}
+
+// newS3ClientFromEnv returns a MinIO client configured by the environment variables described on s3Backend.
+func newS3ClientFromEnv() (*minio.Client, error) {
+	accessKeyID := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKeyID == "" || secretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use S3 buckets")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	options := &minio.Options{
+		Creds:        credentials.NewStaticV4(accessKeyID, secretAccessKey, os.Getenv("AWS_SESSION_TOKEN")),
+		Secure:       true,
+		Region:       region,
+		BucketLookup: minio.BucketLookupDNS,
+	}
+	host := fmt.Sprintf("s3.%s.amazonaws.com", region)
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		endpointURL, err := url.Parse(endpoint)
+		if err != nil || endpointURL.Scheme == "" || endpointURL.Host == "" {
+			return nil, fmt.Errorf("invalid S3_ENDPOINT: %s", endpoint)
+		}
+		host = endpointURL.Host
+		options.Secure = endpointURL.Scheme == "https"
+		options.BucketLookup = minio.BucketLookupPath
+	}
+	return minio.New(host, options)
+}
+
+// s3Client is a Client for S3 buckets.
+type s3Client struct {
+	client *minio.Client
+	mu     sync.Mutex
+	writer *s3Writer
+}
+
+var _ Client = &s3Client{}
+
+// Abort discards the data written with Write without creating the client's object, if the client has a writer.
+func (c *s3Client) Abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer == nil {
+		return
+	}
+	c.writer.abort()
+	c.writer = nil
+}
+
+// Close writes the data written with Write to the client's object, if the client has a writer, and returns an error if
+// the object couldn't be created.
+func (c *s3Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer == nil {
+		return nil
+	}
+	writer := c.writer
+	c.writer = nil
+	if err := writer.commit(); err != nil {
+		return fmt.Errorf("error closing storage writer: %v", s3Error(err, writer.bucketName))
+	}
+	return nil
+}
+
+// ListObjects returns the names and sizes of all objects in the given bucket whose names start with the given prefix,
+// in alphabetical order.
+func (c *s3Client) ListObjects(ctx context.Context, bucketName, prefix string) ([]ObjectAttrs, error) {
+	objects := make([]ObjectAttrs, 0)
+	for object := range c.client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: prefix,
+		Recursive: true}) {
+		if object.Err != nil {
+			return nil, s3Error(object.Err, bucketName)
+		}
+		// Skip the placeholder objects that some tools create for folders
+		if !strings.HasSuffix(object.Key, "/") {
+			objects = append(objects, newObjectAttrs(object.Key, object.Size, ""))
+		}
+	}
+	return objects, nil
+}
+
+// ReadObject returns the contents of the given object in the given bucket.
+func (c *s3Client) ReadObject(ctx context.Context, bucketName, objectName string) ([]byte, error) {
+	object, err := c.client.GetObject(ctx, bucketName, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, s3Error(err, bucketName))
+	}
+	defer object.Close()
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, s3Error(err, bucketName))
+	}
+	return data, nil
+}
+
+// ReadObjectRange returns a reader that streams length bytes of the given object in the given bucket from the given
+// offset, or the rest of the object if length is negative. The reader must be closed.
+func (c *s3Client) ReadObjectRange(ctx context.Context, bucketName, objectName string, offset,
+	length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	options := minio.GetObjectOptions{}
+	if offset > 0 || length > 0 {
+		end := int64(0)
+		if length > 0 {
+			end = offset + length - 1
+		}
+		if err := options.SetRange(offset, end); err != nil {
+			return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, err)
+		}
+	}
+	// The core client requests the object straight away, rather than when it is first read, so errors are returned here
+	object, _, _, err := minio.Core{Client: c.client}.GetObject(ctx, bucketName, objectName, options)
+	if minio.ToErrorResponse(err).Code == "InvalidRange" {
+		// The object is empty, or the offset is at its end
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating reader for object %s: %v", objectName, s3Error(err, bucketName))
+	}
+	return object, nil
+}
+
+// WriteObject writes the given data to the given object in the given bucket, replacing the object if it exists.
+func (c *s3Client) WriteObject(ctx context.Context, bucketName, objectName string, data []byte) error {
+	_, err := c.client.PutObject(ctx, bucketName, objectName, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{PartSize: uint64(s3PartSize)})
+	if err != nil {
+		return fmt.Errorf("error writing object %s: %v", objectName, s3Error(err, bucketName))
+	}
+	return nil
+}
+
+// CopyObject copies the given source object to the given destination object in the given bucket, replacing the
+// destination object if it exists.
+func (c *s3Client) CopyObject(ctx context.Context, bucketName, srcObjectName, dstObjectName string) error {
+	_, err := c.client.CopyObject(ctx, minio.CopyDestOptions{Bucket: bucketName, Object: dstObjectName},
+		minio.CopySrcOptions{Bucket: bucketName, Object: srcObjectName})
+	if err != nil {
+		return fmt.Errorf("error copying object %s to %s: %v", srcObjectName, dstObjectName, s3Error(err, bucketName))
+	}
+	return nil
+}
+
+// DeleteObject deletes the given object in the given bucket. S3 doesn't return an error if the object doesn't exist.
+func (c *s3Client) DeleteObject(ctx context.Context, bucketName, objectName string) error {
+	if err := c.client.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("error deleting object %s: %v", objectName, s3Error(err, bucketName))
+	}
+	return nil
+}
+
+// Write writes the given data to the client's writer.
+func (c *s3Client) Write(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer == nil {
+		return 0, errNoWriter
+	}
+	if err := c.writer.write(data); err != nil {
+		return 0, fmt.Errorf("error writing data to file: %v", s3Error(err, c.writer.bucketName))
+	}
+	return len(data), nil
+}
+
+// s3Writer writes an object to S3. The data written is buffered until there is more than s3PartSize bytes, at which
+// point a multipart upload of the object is started that the rest of the data is streamed to. An object smaller than a
+// part is written with a single request when the writer is committed.
+type s3Writer struct {
+	ctx        context.Context
+	client     *minio.Client
+	bucketName string
+	objectName string
+	buffer     bytes.Buffer
+	pipe       *io.PipeWriter
+	done       chan error
+	err        error
+}
+
+// write adds the given data to the object. Once a write has failed, every write after it fails with the same error.
+func (w *s3Writer) write(data []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.pipe != nil {
+		// The write fails with the upload's error if the upload has failed
+		_, w.err = w.pipe.Write(data)
+		return w.err
+	}
+	w.buffer.Write(data)
+	if w.buffer.Len() > s3PartSize {
+		w.startUpload()
+	}
+	return nil
+}
+
+// startUpload starts a multipart upload of the object in the background, which uploads the data that has been
+// buffered followed by the data written to the writer's pipe.
+func (w *s3Writer) startUpload() {
+	reader, writer := io.Pipe()
+	w.pipe = writer
+	w.done = make(chan error, 1)
+	go func() {
+		_, err := w.client.PutObject(w.ctx, w.bucketName, w.objectName, io.MultiReader(&w.buffer, reader), -1,
+			minio.PutObjectOptions{PartSize: uint64(s3PartSize)})
+		// Make any writes waiting on the pipe fail with the upload's error
+		if err != nil {
+			reader.CloseWithError(err)
+		} else {
+			reader.Close()
+		}
+		w.done <- err
+	}()
+}
+
+// commit creates the object from the data written. If a multipart upload was started, the rest of the data is
+// uploaded and the upload is completed, or aborted if any write failed.
+func (w *s3Writer) commit() error {
+	if w.pipe == nil {
+		if w.err != nil {
+			return w.err
+		}
+		_, err := w.client.PutObject(w.ctx, w.bucketName, w.objectName, bytes.NewReader(w.buffer.Bytes()),
+			int64(w.buffer.Len()), minio.PutObjectOptions{PartSize: uint64(s3PartSize)})
+		return err
+	}
+	if w.err != nil {
+		// Failing the upload's reader aborts the upload
+		w.pipe.CloseWithError(w.err)
+		<-w.done
+		return w.err
+	}
+	w.pipe.Close()
+	return <-w.done
+}
+
+// abort discards the data written, aborting the multipart upload if one was started.
+func (w *s3Writer) abort() {
+	if w.pipe == nil {
+		return
+	}
+	// Failing the upload's reader aborts the upload
+	w.pipe.CloseWithError(errAborted)
+	<-w.done
+}
+
+// s3Error returns the error for an error returned by the MinIO client for the given bucket, which includes the S3 error
+// code of an error response.
+func s3Error(err error, bucketName string) error {
+	var response minio.ErrorResponse
+	if !errors.As(err, &response) {
+		return err
+	}
+	if response.Code == "NoSuchBucket" {
+		return fmt.Errorf("storage: bucket doesn't exist: %s", bucketName)
+	}
+	return fmt.Errorf("S3 request failed with status code %d: %s %s", response.StatusCode, response.Code,
+		response.Message)
+}
@@ -0,0 +1,549 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a fake S3-compatible object store which supports the requests made by the S3 backend, with buckets
+// addressed by path.
+type fakeS3 struct {
+	mu       sync.Mutex
+	buckets  map[string]map[string][]byte
+	uploads  map[string]map[int][]byte
+	pageSize int
+	requests []string
+}
+
+// newFakeS3 starts a fake S3 server with the given buckets and points the S3 backend at it.
+func newFakeS3(t *testing.T, bucketNames ...string) *fakeS3 {
+	fake := &fakeS3{
+		buckets:  make(map[string]map[string][]byte),
+		uploads:  make(map[string]map[int][]byte),
+		pageSize: 2,
+	}
+	for _, bucketName := range bucketNames {
+		fake.buckets[bucketName] = make(map[string][]byte)
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	setEnv(t, "S3_ENDPOINT", server.URL)
+	setEnv(t, "AWS_ACCESS_KEY_ID", "some-key-id")
+	setEnv(t, "AWS_SECRET_ACCESS_KEY", "some-secret")
+	return fake
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(req.Body)
+	if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body = decodeAWSChunked(body)
+	}
+	query := req.URL.Query()
+	f.requests = append(f.requests, req.Method+" "+req.URL.RawQuery)
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=some-key-id/") {
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	bucket, ok := f.buckets[parts[0]]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		f.list(w, bucket, query.Get("prefix"), query.Get("continuation-token"))
+		return
+	}
+	key := parts[1]
+	switch {
+	case req.Method == http.MethodGet:
+		f.get(w, req, bucket, key)
+	case req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") != "":
+		copySource, _ := url.PathUnescape(req.Header.Get("X-Amz-Copy-Source"))
+		source := strings.SplitN(strings.TrimPrefix(copySource, "/"), "/", 2)
+		data, ok := f.buckets[source[0]][source[1]]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		bucket[key] = data
+		fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+	case req.Method == http.MethodPut && query.Get("uploadId") == "":
+		bucket[key] = body
+		w.Header().Set("ETag", `"etag"`)
+	case req.Method == http.MethodPost && query["uploads"] != nil:
+		uploadID := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case req.Method == http.MethodPut:
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, partNumber))
+	case req.Method == http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		_ = xml.Unmarshal(body, &complete)
+		var data []byte
+		for _, part := range complete.Parts {
+			if strings.Trim(part.ETag, `"`) != fmt.Sprintf("etag-%d", part.PartNumber) {
+				writeS3Error(w, http.StatusOK, "InvalidPart")
+				return
+			}
+			data = append(data, f.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		bucket[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>\"etag\"</ETag>"+
+			"</CompleteMultipartUploadResult>", parts[0], key)
+	case req.Method == http.MethodDelete && query.Get("uploadId") == "":
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodDelete:
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decodeAWSChunked returns the data in the given body of a request signed with a streaming signature, which is sent in
+// chunks that each start with their size in hex and their signature.
+func decodeAWSChunked(body []byte) []byte {
+	var data []byte
+	for len(body) > 0 {
+		header := body[:bytes.Index(body, []byte("\r\n"))]
+		size, _ := strconv.ParseInt(string(bytes.SplitN(header, []byte(";"), 2)[0]), 16, 64)
+		if size == 0 {
+			break
+		}
+		start := len(header) + len("\r\n")
+		data = append(data, body[start:start+int(size)]...)
+		body = body[start+int(size)+len("\r\n"):]
+	}
+	return data
+}
+
+// list writes a page of the objects in the given bucket with the given prefix, starting from the given continuation
+// token.
+func (f *fakeS3) list(w http.ResponseWriter, bucket map[string][]byte, prefix, continuationToken string) {
+	keys := make([]string, 0, len(bucket))
+	for key := range bucket {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(continuationToken)
+	end := start + f.pageSize
+	if end > len(keys) {
+		end = len(keys)
+	}
+	fmt.Fprint(w, "<ListBucketResult>")
+	for _, key := range keys[start:end] {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(bucket[key]))
+	}
+	if end < len(keys) {
+		fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// get writes the given object, or the range of it given in the request's Range header.
+func (f *fakeS3) get(w http.ResponseWriter, req *http.Request, bucket map[string][]byte, key string) {
+	data, ok := bucket[key]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", `"etag"`)
+	w.Header().Set("Last-Modified", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+	start, end := 0, len(data)-1
+	if n, _ := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); n == 0 {
+		_, _ = w.Write(data)
+		return
+	}
+	if start >= len(data) {
+		writeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		return
+	}
+	if end >= len(data) {
+		end = len(data) - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(data[start : end+1])
+}
+
+// wrongETags points the S3 backend at a server in front of the fake that makes the ETag of every uploaded part wrong,
+// so that completing a multipart upload fails with an error in a 200 response.
+func (f *fakeS3) wrongETags(t *testing.T) {
+	wrapped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		if req.Method == http.MethodPut && req.URL.Query().Get("uploadId") != "" {
+			w.Header().Set("ETag", `"wrong"`)
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	}))
+	t.Cleanup(wrapped.Close)
+	setEnv(t, "S3_ENDPOINT", wrapped.URL)
+}
+
+// writeS3Error writes an S3 error response with the given status code and error code.
+func writeS3Error(w http.ResponseWriter, statusCode int, code string) {
+	w.WriteHeader(statusCode)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>some message</Message></Error>", code)
+}
+
+func TestS3_ListObjects(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "input")
+	for _, key := range []string{"b.txt", "a.txt", "c.csv", "books/", "books/d.txt", "e.txt"} {
+		fake.buckets["input"][key] = []byte(key)
+	}
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	objects, err := client.ListObjects(context.Background(), "s3://input", "")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []ObjectAttrs{
+		{Name: "a.txt", Size: 5},
+		{Name: "b.txt", Size: 5},
+		{Name: "books/d.txt", Size: 11},
+		{Name: "c.csv", Size: 5},
+		{Name: "e.txt", Size: 5},
+	}, objects)
+	// Each page holds 2 objects, so the 6 objects are listed with 3 requests
+	assert.Len(t, fake.requests, 3)
+}
+
+func TestS3_ListObjects_Prefix(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "input")
+	for _, key := range []string{"a.txt", "books/b.txt", "books/c.txt"} {
+		fake.buckets["input"][key] = []byte(key)
+	}
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	objects, err := client.ListObjects(context.Background(), "s3://input", "books/")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []ObjectAttrs{{Name: "books/b.txt", Size: 11}, {Name: "books/c.txt", Size: 11}}, objects)
+}
+
+func TestS3_ListObjects_BucketDoesntExistError(t *testing.T) {
+	// Given
+	newFakeS3(t)
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := client.ListObjects(context.Background(), "s3://input", "")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bucket doesn't exist")
+}
+
+func TestS3_ReadObject(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "input")
+	fake.buckets["input"]["books/book 1.txt"] = []byte("some text to read in ranges")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	data, err := client.ReadObject(context.Background(), "s3://input", "books/book 1.txt")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, "some text to read in ranges", string(data))
+}
+
+func TestS3_ReadObject_EmptyObject(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "input")
+	fake.buckets["input"]["empty.txt"] = []byte{}
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	data, err := client.ReadObject(context.Background(), "s3://input", "empty.txt")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Empty(t, data)
+}
+
+func TestS3_ReadObjectRange(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "input")
+	fake.buckets["input"]["book.txt"] = []byte("some text to read in ranges")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	for _, tt := range readObjectRangeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// When
+			data, err := readRange(client, "s3://input", "book.txt", tt.offset, tt.length)
+
+			// Then
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, data)
+		})
+	}
+}
+
+func TestS3_ReadObject_ObjectDoesntExistError(t *testing.T) {
+	// Given
+	newFakeS3(t, "input")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := client.ReadObject(context.Background(), "s3://input", "book.txt")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error creating reader for object book.txt")
+	assert.Contains(t, err.Error(), "NoSuchKey")
+}
+
+func TestS3_WriteObject(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "output")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.WriteObject(context.Background(), "s3://output", "job-1/_SUCCESS", []byte("{}"))
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(fake.buckets["output"]["job-1/_SUCCESS"]))
+	assert.Len(t, fake.requests, 1)
+}
+
+func TestS3_CopyObject(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "output")
+	fake.buckets["output"]["job-1/_temporary/part 0.txt"] = []byte("acer: care race\n")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.CopyObject(context.Background(), "s3://output", "job-1/_temporary/part 0.txt", "job-1/part 0.txt")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, "acer: care race\n", string(fake.buckets["output"]["job-1/part 0.txt"]))
+	assert.Equal(t, "acer: care race\n", string(fake.buckets["output"]["job-1/_temporary/part 0.txt"]))
+}
+
+func TestS3_CopyObject_ObjectDoesntExistError(t *testing.T) {
+	// Given
+	newFakeS3(t, "output")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.CopyObject(context.Background(), "s3://output", "part-0.txt", "part-1.txt")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error copying object part-0.txt to part-1.txt")
+	assert.Contains(t, err.Error(), "NoSuchKey")
+}
+
+func TestS3_DeleteObject(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "output")
+	fake.buckets["output"]["part-0.txt"] = []byte("acer: care race\n")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.DeleteObject(context.Background(), "s3://output", "part-0.txt")
+
+	// Then
+	assert.Nil(t, err)
+	assert.Empty(t, fake.buckets["output"])
+}
+
+func TestS3_Write(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "output")
+	client, err := NewWithWriter(context.Background(), "s3://output", "job-1/anagrams-part-0.txt")
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+
+	// When
+	client.Write([]byte("acer: care race\n"))
+	client.Write([]byte("eilnst: enlist listen silent\n"))
+	err = client.Close()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, "acer: care race\neilnst: enlist listen silent\n",
+		string(fake.buckets["output"]["job-1/anagrams-part-0.txt"]))
+	// An object smaller than a part is written with a single request
+	assert.Len(t, fake.requests, 1)
+}
+
+func TestS3_Write_Multipart(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "output")
+	setMinimumPartSize(t)
+	client, err := NewWithWriter(context.Background(), "s3://output", "job-1/anagrams-part-0.txt")
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	line := "acer: care race\n"
+	expected := strings.Repeat(line, s3PartSize/len(line)+10)
+
+	// When
+	for i := 0; i < len(expected); i += len(line) {
+		client.Write([]byte(line))
+	}
+	err = client.Close()
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, expected, string(fake.buckets["output"]["job-1/anagrams-part-0.txt"]))
+	assert.Empty(t, fake.uploads)
+	// The upload is started, 2 parts are uploaded and then the upload is completed
+	assert.Len(t, fake.requests, 4)
+}
+
+func TestS3_Abort_Multipart(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "output")
+	setMinimumPartSize(t)
+	client, err := NewWithWriter(context.Background(), "s3://output", "job-1/anagrams-part-0.txt")
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	if _, err := client.Write(make([]byte, s3PartSize+1)); err != nil {
+		t.Fatalf("Error writing data: %v", err)
+	}
+
+	// When
+	client.Abort()
+
+	// Then
+	_, ok := fake.buckets["output"]["job-1/anagrams-part-0.txt"]
+	assert.False(t, ok)
+	// The upload should have been aborted
+	assert.Empty(t, fake.uploads)
+}
+
+func TestS3_WriteObject_CompleteMultipartUploadError(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "output")
+	setMinimumPartSize(t)
+	fake.wrongETags(t)
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	err := client.WriteObject(context.Background(), "s3://output", "job-1/_SUCCESS", make([]byte, s3PartSize+1))
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "InvalidPart")
+	_, ok := fake.buckets["output"]["job-1/_SUCCESS"]
+	assert.False(t, ok)
+	// The upload should have been aborted
+	assert.Empty(t, fake.uploads)
+}
+
+func TestS3_Write_CompleteMultipartUploadError(t *testing.T) {
+	// Given
+	fake := newFakeS3(t, "output")
+	setMinimumPartSize(t)
+	fake.wrongETags(t)
+	client, err := NewWithWriter(context.Background(), "s3://output", "job-1/anagrams-part-0.txt")
+	if err != nil {
+		t.Fatalf("Error creating storage client: %v", err)
+	}
+	if _, err := client.Write(make([]byte, s3PartSize+1)); err != nil {
+		t.Fatalf("Error writing data: %v", err)
+	}
+
+	// When
+	err = client.Close()
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "InvalidPart")
+	_, ok := fake.buckets["output"]["job-1/anagrams-part-0.txt"]
+	assert.False(t, ok)
+	assert.Empty(t, fake.uploads)
+}
+
+func TestS3_New_MissingCredentialsError(t *testing.T) {
+	// Given
+	setEnv(t, "AWS_ACCESS_KEY_ID", "")
+	setEnv(t, "AWS_SECRET_ACCESS_KEY", "")
+	client, _ := New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := client.ListObjects(context.Background(), "s3://input", "")
+
+	// Then
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+}
+
+// setMinimumPartSize sets the size of each part of a multipart upload to the smallest that S3 allows for the rest of
+// the test.
+func setMinimumPartSize(t *testing.T) {
+	previousPartSize := s3PartSize
+	s3PartSize = 5 << 20
+	t.Cleanup(func() { s3PartSize = previousPartSize })
+}
+
+// setEnv sets the given environment variable for the rest of the test.
+func setEnv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("Error setting environment variable: %v", err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ObjectAttrs holds the attributes of an object returned by ListObjects. Compression is the compression of the object
+// that must be decoded to read its contents, or empty if the object isn't compressed. Archive is the format of the
+// object if it is an archive of other files, or empty otherwise.
+type ObjectAttrs struct {
+	Name        string
+	Size        int64
+	Compression string
+	Archive     string
+}
+
+// newObjectAttrs returns the attributes of an object with the given name, size and content type, detecting its
+// compression and archive format.
+func newObjectAttrs(name string, size int64, contentType string) ObjectAttrs {
+	return ObjectAttrs{
+		Name:        name,
+		Size:        size,
+		Compression: DetectCompression(name, contentType),
+		Archive:     DetectArchive(name, contentType),
+	}
+}
+
+// DefaultInclude is the pattern that objects are selected with when a Selection has no include patterns, which selects
+// every text file.
+const DefaultInclude = "*.txt"
+
+// ErrInvalidSelection is returned by SelectObjects when the objects can't be selected because the Selection is invalid
+// or its manifest can't be used.
+var ErrInvalidSelection = errors.New("invalid input selection")
+
+// Selection selects the objects in a bucket that are used as the input files of a job. Objects can either be selected
+// by their name and size, or listed by name in a manifest object.
+//
+// Patterns are matched with path.Match. A pattern without a "/" is matched against the last element of an object's
+// name, so "*.txt" matches "books/book.txt", and a pattern with a "/" is matched against the whole name. The name of a
+// compressed object is matched both with and without its compression extension, so "*.txt" also matches
+// "books/book.txt.gz". An archive is selected like any other object, so it is only used if an include pattern matches
+// its name, e.g. "*.zip", and the include and exclude patterns are then matched against the names of its members to
+// select the files in it that are used.
+type Selection struct {
+	// Prefix is the prefix of the names of the objects that are selected.
+	Prefix string
+	// Include are the patterns that an object's name must match at least one of, by default this is DefaultInclude.
+	Include []string
+	// Exclude are the patterns that an object's name mustn't match any of.
+	Exclude []string
+	// MinSize is the minimum size of an object in bytes.
+	MinSize int64
+	// MaxSize is the maximum size of an object in bytes, or 0 for no maximum.
+	MaxSize int64
+	// Manifest is the name of an object in the bucket that lists the names of the objects to select, one per line. Blank
+	// lines and lines starting with "#" are ignored. It can't be used with any of the other fields.
+	Manifest string
+}
+
+// Validate returns an error if any of the Selection's patterns are malformed, its size range is invalid or a manifest
+// is used with any of the other fields.
+func (s Selection) Validate() error {
+	if s.Manifest != "" && (s.Prefix != "" || len(s.Include) > 0 || len(s.Exclude) > 0 || s.MinSize != 0 ||
+		s.MaxSize != 0) {
+		return fmt.Errorf("%w: a manifest can't be used with a prefix, patterns or a size range", ErrInvalidSelection)
+	}
+	for _, pattern := range append(append([]string{}, s.Include...), s.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: malformed pattern %s", ErrInvalidSelection, pattern)
+		}
+	}
+	if s.MinSize < 0 || s.MaxSize < 0 || (s.MaxSize != 0 && s.MinSize > s.MaxSize) {
+		return fmt.Errorf("%w: invalid size range", ErrInvalidSelection)
+	}
+	return nil
+}
+
+// Matches returns true if the given object is selected by the Selection's prefix, patterns and size range.
+func (s Selection) Matches(object ObjectAttrs) bool {
+	if !strings.HasPrefix(object.Name, s.Prefix) || object.Size < s.MinSize ||
+		(s.MaxSize != 0 && object.Size > s.MaxSize) {
+		return false
+	}
+	name := TrimCompressionExtension(object.Name)
+	if matchesAny(s.Exclude, object.Name) || matchesAny(s.Exclude, name) {
+		return false
+	}
+	return matchesAny(s.include(), object.Name) || matchesAny(s.include(), name)
+}
+
+// MatchesMember returns true if the member of an archive with the given name is selected by the Selection's patterns.
+func (s Selection) MatchesMember(memberName string) bool {
+	return matchesAny(s.include(), memberName) && !matchesAny(s.Exclude, memberName)
+}
+
+// include returns the Selection's include patterns, or DefaultInclude if it has none.
+func (s Selection) include() []string {
+	if len(s.Include) == 0 {
+		return []string{DefaultInclude}
+	}
+	return s.Include
+}
+
+// matchesAny returns true if the given object name matches any of the given patterns.
+func matchesAny(patterns []string, objectName string) bool {
+	for _, pattern := range patterns {
+		name := objectName
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(objectName)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectObjects returns the attributes of the objects in the given bucket that are selected by the given Selection.
+// Objects selected by name and size are returned in alphabetical order, and objects listed in a manifest are returned
+// in the order they are listed. It returns an error wrapping ErrInvalidSelection if the Selection is invalid, or the
+// manifest doesn't exist or lists objects that don't exist.
+func SelectObjects(ctx context.Context, client Client, bucketName string, selection Selection) ([]ObjectAttrs, error) {
+	if err := selection.Validate(); err != nil {
+		return nil, err
+	}
+	if selection.Manifest != "" {
+		return selectManifestObjects(ctx, client, bucketName, selection.Manifest)
+	}
+	objects, err := client.ListObjects(ctx, bucketName, selection.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	selected := make([]ObjectAttrs, 0)
+	for _, object := range objects {
+		if selection.Matches(object) {
+			selected = append(selected, object)
+		}
+	}
+	return selected, nil
+}
+
+// selectManifestObjects returns the names and sizes of the objects listed in the given manifest object, checking that
+// each of them exists in the given bucket.
+func selectManifestObjects(ctx context.Context, client Client, bucketName, manifest string) ([]ObjectAttrs, error) {
+	data, err := client.ReadObject(ctx, bucketName, manifest)
+	if err != nil {
+		if strings.Contains(err.Error(), "bucket doesn't exist") {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: error reading manifest %s: %v", ErrInvalidSelection, manifest, err)
+	}
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" || strings.HasPrefix(name, "#") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return []ObjectAttrs{}, nil
+	}
+	// Check that every object exists with a single listing of the objects under the names' common prefix
+	objects, err := client.ListObjects(ctx, bucketName, commonPrefix(names))
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]ObjectAttrs, len(objects))
+	for _, object := range objects {
+		attrs[object.Name] = object
+	}
+	selected := make([]ObjectAttrs, 0, len(names))
+	missing := make([]string, 0)
+	for _, name := range names {
+		object, ok := attrs[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		selected = append(selected, object)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%w: objects listed in manifest %s don't exist: %s", ErrInvalidSelection, manifest,
+			strings.Join(missing, ", "))
+	}
+	return selected, nil
+}
+
+// commonPrefix returns the longest prefix shared by all the given names.
+func commonPrefix(names []string) string {
+	prefix := names[0]
+	for _, name := range names[1:] {
+		for !strings.HasPrefix(name, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
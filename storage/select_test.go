@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSelection_Matches(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection Selection
+		object    ObjectAttrs
+		expected  bool
+	}{
+		{name: "DefaultInclude", selection: Selection{}, object: ObjectAttrs{Name: "books/a.txt"}, expected: true},
+		{name: "DefaultIncludeNotText", selection: Selection{}, object: ObjectAttrs{Name: "a.csv"}, expected: false},
+		{name: "Prefix", selection: Selection{Prefix: "books/"}, object: ObjectAttrs{Name: "a.txt"}, expected: false},
+		{name: "Include", selection: Selection{Include: []string{"*.md", "*.csv"}}, object: ObjectAttrs{Name: "a.csv"},
+			expected: true},
+		{name: "IncludeWithSlash", selection: Selection{Include: []string{"books/*.txt"}},
+			object: ObjectAttrs{Name: "books/old/a.txt"}, expected: false},
+		{name: "Compressed", selection: Selection{}, object: ObjectAttrs{Name: "a.txt.gz", Compression: CompressionGzip},
+			expected: true},
+		{name: "CompressedIncludeExtension", selection: Selection{Include: []string{"*.bz2"}},
+			object: ObjectAttrs{Name: "a.txt.bz2", Compression: CompressionBzip2}, expected: true},
+		{name: "CompressedExclude", selection: Selection{Exclude: []string{"draft-*.txt"}},
+			object: ObjectAttrs{Name: "draft-1.txt.gz", Compression: CompressionGzip}, expected: false},
+		{name: "Archive", selection: Selection{Include: []string{"*.zip", "*.txt"}},
+			object: ObjectAttrs{Name: "books.zip", Archive: ArchiveZip}, expected: true},
+		{name: "ArchiveDefaultInclude", selection: Selection{},
+			object: ObjectAttrs{Name: "books.zip", Archive: ArchiveZip}, expected: false},
+		{name: "CompressedArchive", selection: Selection{Include: []string{"*.tar"}},
+			object: ObjectAttrs{Name: "books.tar.gz", Compression: CompressionGzip, Archive: ArchiveTar}, expected: true},
+		{name: "ArchiveExclude", selection: Selection{Include: []string{"*.zip"}, Exclude: []string{"*.zip"}},
+			object: ObjectAttrs{Name: "books.zip", Archive: ArchiveZip}, expected: false},
+		{name: "Exclude", selection: Selection{Exclude: []string{"draft-*"}}, object: ObjectAttrs{Name: "draft-1.txt"},
+			expected: false},
+		{name: "TooSmall", selection: Selection{MinSize: 10}, object: ObjectAttrs{Name: "a.txt", Size: 9},
+			expected: false},
+		{name: "TooLarge", selection: Selection{MaxSize: 10}, object: ObjectAttrs{Name: "a.txt", Size: 11},
+			expected: false},
+		{name: "InSizeRange", selection: Selection{MinSize: 10, MaxSize: 10}, object: ObjectAttrs{Name: "a.txt", Size: 10},
+			expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.selection.Matches(tt.object))
+		})
+	}
+}
+
+func TestSelection_MatchesMember(t *testing.T) {
+	selection := Selection{Include: []string{"*.txt"}, Exclude: []string{"draft-*"}}
+
+	assert.True(t, selection.MatchesMember("books/book.txt"))
+	assert.False(t, selection.MatchesMember("README.md"))
+	assert.False(t, selection.MatchesMember("draft-1.txt"))
+	assert.True(t, Selection{}.MatchesMember("book.txt"))
+}
+
+func TestSelection_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection Selection
+		expected  string
+	}{
+		{name: "Valid", selection: Selection{Prefix: "books/", Include: []string{"*.txt"}, MinSize: 1, MaxSize: 2}},
+		{name: "MalformedPattern", selection: Selection{Exclude: []string{"[a-"}}, expected: "malformed pattern [a-"},
+		{name: "InvalidSizeRange", selection: Selection{MinSize: 2, MaxSize: 1}, expected: "invalid size range"},
+		{name: "ManifestWithPrefix", selection: Selection{Manifest: "inputs.txt", Prefix: "books/"},
+			expected: "a manifest can't be used with"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.selection.Validate()
+			if tt.expected == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrInvalidSelection))
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+func TestSelectObjects(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("input", "books/a.txt", []byte("some text"))
+	memory.PutObject("input", "books/b.txt", []byte("text"))
+	memory.PutObject("input", "books/draft-c.txt", []byte("some more text"))
+	memory.PutObject("input", "books/d.md", []byte("some more text"))
+	memory.PutObject("input", "e.txt", []byte("some text"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+	selection := Selection{Prefix: "books/", Include: []string{"*.txt", "*.md"}, Exclude: []string{"draft-*"},
+		MinSize: 5}
+
+	// When
+	objects, err := SelectObjects(context.Background(), client, "input", selection)
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []ObjectAttrs{{Name: "books/a.txt", Size: 9}, {Name: "books/d.md", Size: 14}}, objects)
+}
+
+func TestSelectObjects_Manifest(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("input", "books/a.txt", []byte("a"))
+	memory.PutObject("input", "books/b.csv", []byte("bb"))
+	memory.PutObject("input", "books/c.txt", []byte("c"))
+	memory.PutObject("input", "inputs", []byte("# The books to use\nbooks/b.csv\n\nbooks/a.txt\nbooks/b.csv\n"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	// When
+	objects, err := SelectObjects(context.Background(), client, "input", Selection{Manifest: "inputs"})
+
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []ObjectAttrs{{Name: "books/b.csv", Size: 2}, {Name: "books/a.txt", Size: 1}}, objects)
+}
+
+func TestSelectObjects_ManifestObjectDoesntExistError(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.PutObject("input", "books/a.txt", []byte("a"))
+	memory.PutObject("input", "inputs", []byte("books/a.txt\nbooks/missing.txt\n"))
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := SelectObjects(context.Background(), client, "input", Selection{Manifest: "inputs"})
+
+	// Then
+	assert.True(t, errors.Is(err, ErrInvalidSelection))
+	assert.Contains(t, err.Error(), "objects listed in manifest inputs don't exist: books/missing.txt")
+}
+
+func TestSelectObjects_ManifestDoesntExistError(t *testing.T) {
+	// Given
+	memory := NewMemory()
+	memory.CreateBucket("input")
+	client, _ := memory.New(context.Background())
+	defer client.Close()
+
+	// When
+	_, err := SelectObjects(context.Background(), client, "input", Selection{Manifest: "inputs"})
+
+	// Then
+	assert.True(t, errors.Is(err, ErrInvalidSelection))
+	assert.Contains(t, err.Error(), "error reading manifest inputs")
+}
+
+func TestCommonPrefix(t *testing.T) {
+	assert.Equal(t, "books/", commonPrefix([]string{"books/a.txt", "books/b.txt"}))
+	assert.Equal(t, "", commonPrefix([]string{"a.txt", "books/b.txt"}))
+	assert.Equal(t, "a.txt", commonPrefix([]string{"a.txt"}))
+}